@@ -0,0 +1,89 @@
+package stick
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// An accessKind describes how an attribute of a struct is accessed.
+type accessKind int
+
+const (
+	accessNone      accessKind = iota // The struct has no such attribute.
+	accessField                       // A field, by its index path.
+	accessMethod                      // A method of the value's own type.
+	accessPtrMethod                   // A method with a pointer receiver, called on a copy of the value.
+)
+
+// An attrKey identifies an attribute of a type.
+type attrKey struct {
+	t    reflect.Type
+	name string
+}
+
+// A resolvedAttr is the location of an attribute of a type.
+type resolvedAttr struct {
+	kind   accessKind
+	index  []int // The index path of a field.
+	method int   // The index of a method in the method set of its receiver.
+}
+
+// attrCache holds the resolvedAttr for each attrKey that has been looked up,
+// so that attribute access in loops does not search for fields and methods
+// by name each time. Attributes that do not exist are not cached.
+var attrCache sync.Map
+
+// resolveAttr returns the location of the named attribute of values of
+// type t, which is a struct or a pointer to one. Fields take precedence
+// over methods.
+func resolveAttr(t reflect.Type, name string) resolvedAttr {
+	key := attrKey{t, name}
+	if a, ok := attrCache.Load(key); ok {
+		return a.(resolvedAttr)
+	}
+	a := lookupAttr(t, name)
+	if a.kind != accessNone {
+		attrCache.Store(key, a)
+	}
+	return a
+}
+
+// lookupAttr finds the named attribute of values of type t.
+func lookupAttr(t reflect.Type, name string) resolvedAttr {
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if f, ok := st.FieldByName(name); ok {
+		return resolvedAttr{kind: accessField, index: f.Index}
+	}
+	// Match either "value, value receiver" or "ptr, ptr receiver" or
+	// "ptr, value receiver".
+	if m, ok := t.MethodByName(name); ok {
+		return resolvedAttr{kind: accessMethod, method: m.Index}
+	}
+	// Match "value, ptr receiver".
+	if t.Kind() != reflect.Ptr {
+		if m, ok := reflect.PtrTo(t).MethodByName(name); ok {
+			return resolvedAttr{kind: accessPtrMethod, method: m.Index}
+		}
+	}
+	return resolvedAttr{}
+}
+
+// structAttr returns the named field or method of v, a struct or a pointer
+// to one, whose struct value is r.
+func structAttr(v Value, r reflect.Value, name string) (reflect.Value, error) {
+	switch a := resolveAttr(reflect.TypeOf(v), name); a.kind {
+	case accessField:
+		return r.FieldByIndex(a.index), nil
+	case accessMethod:
+		return reflect.ValueOf(v).Method(a.method), nil
+	case accessPtrMethod:
+		ptr := reflect.New(r.Type())
+		ptr.Elem().Set(r)
+		return ptr.Method(a.method), nil
+	}
+	return reflect.Value{}, fmt.Errorf("stick: unable to locate method \"%s\" on \"%v\"", name, v)
+}
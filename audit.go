@@ -0,0 +1,289 @@
+package stick
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An AuditReport describes the constructs used by a set of templates that
+// an Env does not support.
+type AuditReport struct {
+	Templates  int             `json:"templates"`  // The number of templates scanned.
+	Unparsable []string        `json:"unparsable"` // Templates that could not be parsed fully, even ignoring unknown tags.
+	Findings   []*AuditFinding `json:"findings"`   // Unsupported constructs, most frequently used first.
+}
+
+// An AuditFinding describes an unsupported construct and where it is used.
+type AuditFinding struct {
+	// Kind is one of "tag", "operator", "filter", "function", "test",
+	// "syntax", or "load". Syntax and load findings describe templates that
+	// could not be parsed or loaded, and are named by the error message.
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Locations []AuditLocation `json:"locations"`
+}
+
+// An AuditLocation is a position in a template.
+type AuditLocation struct {
+	Template string `json:"template"`
+	Line     int    `json:"line"` // The line, or 0 if the finding applies to the whole template.
+	Column   int    `json:"column"`
+}
+
+// builtinTags are the names of the tags supported by the parser.
+var builtinTags = map[string]bool{
+	"extends": true, "block": true, "endblock": true, "if": true, "elseif": true,
+	"else": true, "endif": true, "for": true, "endfor": true, "include": true,
+	"embed": true, "endembed": true, "use": true, "set": true, "endset": true,
+	"do": true, "filter": true, "endfilter": true, "apply": true, "endapply": true,
+	"macro": true, "endmacro": true, "import": true, "from": true,
+	"verbatim": true, "endverbatim": true,
+}
+
+// twigOperators matches Twig operators that the parser does not support.
+var twigOperators = regexp.MustCompile(`\?\?|\?:|\?\.|===|!==|=>|\.\.\.|\bxor\b|\bb-not\b|\bhas (?:some|every)\b`)
+
+// Audit scans the named templates for constructs that the Env cannot parse
+// or execute, such as tags, operators, filters, functions, and tests that
+// are supported by Twig but not defined in the Env. It is intended for
+// assessing the feasibility of migrating existing Twig templates.
+//
+// Unknown tags are ignored while parsing each template, so that the rest of
+// it can be checked. Print statements that fail to parse are likewise
+// ignored, but any other syntax error ends the audit of the template.
+func (env *Env) Audit(names ...string) *AuditReport {
+	a := &auditor{env: env, findings: make(map[[2]string]*AuditFinding)}
+	for _, name := range names {
+		a.audit(name)
+	}
+	r := &AuditReport{Templates: len(names), Unparsable: a.unparsable}
+	for _, f := range a.findings {
+		r.Findings = append(r.Findings, f)
+	}
+	sort.Slice(r.Findings, func(i, j int) bool {
+		a, b := r.Findings[i], r.Findings[j]
+		if len(a.Locations) != len(b.Locations) {
+			return len(a.Locations) > len(b.Locations)
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return r
+}
+
+type auditor struct {
+	env        *Env
+	findings   map[[2]string]*AuditFinding
+	unparsable []string
+}
+
+func (a *auditor) add(kind, name string, loc AuditLocation) {
+	k := [2]string{kind, name}
+	f, ok := a.findings[k]
+	if !ok {
+		f = &AuditFinding{Kind: kind, Name: name}
+		a.findings[k] = f
+	}
+	f.Locations = append(f.Locations, loc)
+}
+
+// auditSpan is the location of a tag or print statement in a template's
+// source.
+type auditSpan struct {
+	start, end int
+	tag        string // The tag's name, or empty for a print statement.
+	name       int    // The offset of the tag's name.
+}
+
+func (a *auditor) audit(name string) {
+	tpl, err := a.env.Loader.Load(name)
+	if errors.Is(err, os.ErrNotExist) {
+		err = &TemplateNotFoundError{Name: name, Err: err}
+	}
+	var src []byte
+	if err == nil {
+		src, err = ioutil.ReadAll(tpl.Contents())
+	}
+	if err != nil {
+		a.add("load", err.Error(), AuditLocation{Template: name})
+		return
+	}
+	lines := lineOffsets(src)
+	loc := func(off int) AuditLocation {
+		l := sort.Search(len(lines), func(i int) bool { return lines[i] > off })
+		return AuditLocation{name, l, off - lines[l-1]}
+	}
+	spans := scanSpans(src)
+	flagged := make(map[int]bool) // Spans already reported as unsupported.
+	for i, s := range spans {
+		if s.tag == "" || builtinTags[s.tag] || a.env.Tags[s.tag] != nil {
+			if m := twigOperators.FindIndex(stripStrings(src[s.start:s.end])); m != nil {
+				op := string(src[s.start+m[0] : s.start+m[1]])
+				if _, ok := a.env.Operators[op]; !ok {
+					a.add("operator", op, loc(s.start+m[0]))
+					flagged[i] = true
+				}
+			}
+			continue
+		}
+		blank(src, s)
+		if base := strings.TrimPrefix(s.tag, "end"); base != s.tag && !builtinTags[base] && a.env.Tags[base] == nil {
+			// The end of an unknown tag is not reported separately.
+			continue
+		}
+		a.add("tag", s.tag, loc(s.name))
+	}
+	var tree *parse.Tree
+	for {
+		tree = parse.NewNamedTree(name, bytes.NewReader(src))
+		tree.Tags = a.env.Tags
+		for k, op := range a.env.Operators {
+			tree.DefineOperator(k, op.Precedence, op.RightAssoc)
+		}
+		err = tree.Parse()
+		if err == nil {
+			break
+		}
+		var perr ParseError
+		if !errors.As(err, &perr) {
+			a.add("syntax", err.Error(), AuditLocation{Template: name})
+			a.unparsable = append(a.unparsable, name)
+			return
+		}
+		pos := perr.Pos()
+		if pos.Line < 1 || pos.Line > len(lines) {
+			a.add("syntax", err.Error(), AuditLocation{Template: name})
+			a.unparsable = append(a.unparsable, name)
+			return
+		}
+		off := lines[pos.Line-1] + pos.Offset
+		i := sort.Search(len(spans), func(i int) bool { return spans[i].end > off })
+		if i == len(spans) || spans[i].start > off || !flagged[i] {
+			a.add("syntax", err.Error(), loc(off))
+		}
+		if i == len(spans) || spans[i].start > off || spans[i].tag != "" {
+			a.unparsable = append(a.unparsable, name)
+			return
+		}
+		// Ignore the print statement and try again.
+		blank(src, spans[i])
+		flagged[i] = true
+	}
+	v := &validator{env: a.env, name: name, macros: make(map[string]bool)}
+	for k := range tree.Macros() {
+		v.macros[k] = true
+	}
+	visitAll(tree.Root(), v.collect)
+	visitAll(tree.Root(), v.check)
+	for _, err := range v.errs {
+		if uerr, ok := err.(*UndeclaredError); ok {
+			a.add(uerr.Kind, uerr.Name, AuditLocation{name, uerr.Pos.Line, uerr.Pos.Offset})
+		}
+	}
+}
+
+// lineOffsets returns the offset of the start of each line in src, indexed
+// from zero.
+func lineOffsets(src []byte) []int {
+	res := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			res = append(res, i+1)
+		}
+	}
+	return res
+}
+
+var (
+	auditTagName     = regexp.MustCompile(`^\{%-?\s*(\w+)`)
+	auditEndVerbatim = regexp.MustCompile(`\{%-?\s*endverbatim`)
+)
+
+// scanSpans returns the tags and print statements in src, in order. The
+// contents of comments and verbatim tags are skipped.
+func scanSpans(src []byte) []auditSpan {
+	var res []auditSpan
+	for i := 0; i < len(src); {
+		j := bytes.IndexByte(src[i:], '{')
+		if j < 0 || i+j+1 >= len(src) {
+			break
+		}
+		i += j
+		var end []byte
+		switch src[i+1] {
+		case '#':
+			end = []byte("#}")
+		case '{':
+			end = []byte("}}")
+		case '%':
+			end = []byte("%}")
+		default:
+			i++
+			continue
+		}
+		n := bytes.Index(src[i+2:], end)
+		if n < 0 {
+			break
+		}
+		s := auditSpan{start: i, end: i + 2 + n + 2}
+		i = s.end
+		if src[s.start+1] == '#' {
+			continue
+		}
+		if src[s.start+1] == '%' {
+			m := auditTagName.FindSubmatchIndex(src[s.start:s.end])
+			if m == nil {
+				continue
+			}
+			s.tag, s.name = string(src[s.start+m[2]:s.start+m[3]]), s.start+m[2]
+		}
+		res = append(res, s)
+		if s.tag == "verbatim" {
+			k := auditEndVerbatim.FindIndex(src[i:])
+			if k == nil {
+				break
+			}
+			i += k[0]
+		}
+	}
+	return res
+}
+
+// blank replaces the span s in src with a comment of the same length,
+// preserving line breaks.
+func blank(src []byte, s auditSpan) {
+	for i := s.start + 2; i < s.end-2; i++ {
+		if src[i] != '\n' {
+			src[i] = ' '
+		}
+	}
+	src[s.start+1], src[s.end-2] = '#', '#'
+}
+
+// stripStrings returns a copy of the expression source b in which the
+// contents of string literals are replaced with spaces.
+func stripStrings(b []byte) []byte {
+	res := make([]byte, len(b))
+	var quote byte
+	for i, c := range b {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			c = ' '
+		case c == '\'' || c == '"':
+			quote = c
+		}
+		res[i] = c
+	}
+	return res
+}
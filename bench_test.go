@@ -0,0 +1,150 @@
+package stick
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// The benchmark suite measures parsing and rendering of templates typical of
+// real applications, to provide baselines for performance work. TestSuite
+// checks that each template renders as expected with a small context, so
+// that optimizations cannot silently change the output. Run the suite with:
+//
+//	go test -run Suite -bench Suite -benchmem
+var suite = []struct {
+	name      string
+	templates map[string]string
+	ctx       func(n int) map[string]Value // Returns a context with n items.
+	expected  string                       // The output for a context with 3 items.
+}{
+	{
+		"inheritance",
+		map[string]string{
+			"base.twig": `<html><head>{% block head %}<title>{% block title %}Site{% endblock %}</title>{% endblock %}</head>` +
+				`<body>{% block nav %}[nav]{% endblock %}{% block content %}{% endblock %}{% block footer %}[footer]{% endblock %}</body></html>`,
+			"section.twig": `{% extends "base.twig" %}{% block title %}{{ section }}{% endblock %}` +
+				`{% block nav %}{{ parent() }}[{{ section }}]{% endblock %}{% block content %}<main>{% block main %}{% endblock %}</main>{% endblock %}`,
+			"page.twig": `{% extends "section.twig" %}{% block title %}Page - {{ parent() }}{% endblock %}` +
+				`{% block main %}{% for item in items %}{% block item %}<p>{{ item.Name }}</p>{% endblock %}{% endfor %}{% endblock %}` +
+				`{% block footer %}{{ section }} {{ parent() }}{% endblock %}`,
+		},
+		func(n int) map[string]Value {
+			return map[string]Value{"section": "Docs", "items": suiteItems(n)}
+		},
+		`<html><head><title>Page - Docs</title></head><body>[nav][Docs]<main><p>item 0</p><p>item 1</p><p>item 2</p></main>Docs [footer]</body></html>`,
+	},
+	{
+		"loops",
+		map[string]string{
+			"page.twig": `{% for row in items %}{% for col in 1..4 %}` +
+				`{% if (loop.index % 2) == 1 and row.Visible %}{{ row.Name }}:{{ col * row.ID }}{% elseif loop.last %}.{% else %}-{% endif %}` +
+				`{% endfor %}{% if not loop.last %},{% endif %}{% endfor %}`,
+		},
+		func(n int) map[string]Value {
+			return map[string]Value{"items": suiteItems(n)}
+		},
+		`item 0:0-item 0:0.,---.,item 2:2-item 2:6.`,
+	},
+	{
+		"includes",
+		map[string]string{
+			"page.twig": `<ul>{% for item in items %}{% include "item.twig" with {"item": item, "index": loop.index} only %}{% endfor %}</ul>`,
+			"item.twig": `<li id="{{ index }}">{% include "name.twig" %}</li>`,
+			"name.twig": `{{ item.Name }}`,
+		},
+		func(n int) map[string]Value {
+			return map[string]Value{"items": suiteItems(n)}
+		},
+		`<ul><li id="1">item 0</li><li id="2">item 1</li><li id="3">item 2</li></ul>`,
+	},
+	{
+		"macros",
+		map[string]string{
+			"page.twig": `{% import "forms.twig" as forms %}{% for item in items %}{{ forms.field(item.Name, item.ID) }}{% endfor %}`,
+			"forms.twig": `{% macro field(label, value, type = "text") %}<label>{{ label }}{{ _self.input(value, type) }}</label>{% endmacro %}` +
+				`{% macro input(value, type) %}<input type="{{ type }}" value="{{ value }}">{% endmacro %}`,
+		},
+		func(n int) map[string]Value {
+			return map[string]Value{"items": suiteItems(n)}
+		},
+		`<label>item 0<input type="text" value="0"></label><label>item 1<input type="text" value="1"></label><label>item 2<input type="text" value="2"></label>`,
+	},
+}
+
+type suiteItem struct {
+	ID      int
+	Name    string
+	Visible bool
+}
+
+// suiteItems returns n items for the suite's templates.
+func suiteItems(n int) []*suiteItem {
+	items := make([]*suiteItem, n)
+	for i := range items {
+		items[i] = &suiteItem{i, fmt.Sprintf("item %d", i), i%2 == 0}
+	}
+	return items
+}
+
+// newSuiteEnv returns an Env that executes the given templates with engine.
+func newSuiteEnv(templates map[string]string, engine Engine) *Env {
+	env := New(NewMemoryLoader(templates))
+	env.CacheMode = CacheForever
+	env.Engine = engine
+	return env
+}
+
+func TestSuite(t *testing.T) {
+	for _, test := range suite {
+		for _, engine := range []Engine{EngineTree, EngineVM} {
+			env := newSuiteEnv(test.templates, engine)
+			actual, err := env.ExecuteToString("page.twig", test.ctx(3))
+			if err != nil {
+				t.Errorf("%s (engine %d): unexpected error: %s", test.name, engine, err)
+			} else if actual != test.expected {
+				t.Errorf("%s (engine %d):\n\texpected: %s\n\tgot: %s", test.name, engine, test.expected, actual)
+			}
+		}
+	}
+}
+
+func BenchmarkSuite(b *testing.B) {
+	for _, test := range suite {
+		test := test
+		b.Run("parse/"+test.name, func(b *testing.B) {
+			var size int64
+			for _, src := range test.templates {
+				size += int64(len(src))
+			}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, src := range test.templates {
+					if _, err := parse.Parse(src); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		for _, engine := range []struct {
+			name   string
+			engine Engine
+		}{{"tree", EngineTree}, {"vm", EngineVM}} {
+			b.Run(strings.Join([]string{"render", test.name, engine.name}, "/"), func(b *testing.B) {
+				env := newSuiteEnv(test.templates, engine.engine)
+				ctx := test.ctx(100)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := env.Execute("page.twig", ioutil.Discard, ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
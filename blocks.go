@@ -0,0 +1,115 @@
+package stick
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A blockTable merges a chain of block maps, such as those of a template
+// and its parents, so that blocks can be found without searching each map
+// in turn.
+//
+// The tables of chains made up of the block maps of cached templates are
+// cached themselves: each table holds the tables of its chain extended by
+// one more map, so that a template rendered with the same parents reuses
+// the same table.
+type blockTable struct {
+	blocks  map[string]*parse.BlockNode // The first block with each name.
+	parents map[string]*parse.BlockNode // The second block with each name.
+
+	last map[string]*parse.BlockNode // The last map in the chain, which must stay reachable while its address is used as a key.
+	next sync.Map                    // The extended tables, keyed by the address of the added map.
+}
+
+// mapKey returns the address of the block map m, which identifies it.
+func mapKey(m map[string]*parse.BlockNode) uintptr {
+	return reflect.ValueOf(m).Pointer()
+}
+
+// with returns a new table of the chain of t extended by m.
+func (t *blockTable) with(m map[string]*parse.BlockNode) *blockTable {
+	res := &blockTable{
+		blocks:  make(map[string]*parse.BlockNode, len(t.blocks)+len(m)),
+		parents: make(map[string]*parse.BlockNode, len(t.parents)),
+		last:    m,
+	}
+	for k, v := range t.blocks {
+		res.blocks[k] = v
+	}
+	for k, v := range t.parents {
+		res.parents[k] = v
+	}
+	for k, v := range m {
+		if _, ok := res.blocks[k]; !ok {
+			res.blocks[k] = v
+		} else if _, ok := res.parents[k]; !ok {
+			res.parents[k] = v
+		}
+	}
+	return res
+}
+
+// extend returns the table of the chain of t extended by m, reusing the
+// table from an earlier call if there is one.
+func (t *blockTable) extend(m map[string]*parse.BlockNode) *blockTable {
+	k := mapKey(m)
+	if v, ok := t.next.Load(k); ok {
+		return v.(*blockTable)
+	}
+	v, _ := t.next.LoadOrStore(k, t.with(m))
+	return v.(*blockTable)
+}
+
+// blockTable returns the table of the given chain of block maps. The table
+// is cached if each map in the chain belongs to a cached template.
+func (c *templateCache) blockTable(chain []map[string]*parse.BlockNode) *blockTable {
+	var t *blockTable
+	for i, m := range chain {
+		v, ok := c.blockTables.Load(mapKey(m))
+		if !ok {
+			t = nil
+			break
+		}
+		if i == 0 {
+			t = v.(*blockTable)
+		} else {
+			t = t.extend(m)
+		}
+	}
+	if t != nil {
+		return t
+	}
+	t = &blockTable{}
+	for _, m := range chain {
+		t = t.with(m)
+	}
+	return t
+}
+
+// pushBlocks adds the given block maps to the end of the state's chain.
+func (s *state) pushBlocks(blocks ...map[string]*parse.BlockNode) {
+	s.blocks = append(s.blocks, blocks...)
+	s.table = nil
+}
+
+// blockTable returns the table of the state's chain of block maps.
+func (s *state) blockTable() *blockTable {
+	if s.table == nil {
+		s.table = s.env.cache.blockTable(s.blocks)
+	}
+	return s.table
+}
+
+// getBlock returns the first block with the given name in the state's
+// chain of block maps, or nil if there is none.
+func (s *state) getBlock(name string) *parse.BlockNode {
+	return s.blockTable().blocks[name]
+}
+
+// getParentBlock returns the block that the first block with the given name
+// overrides, or nil if there is none.
+func (s *state) getParentBlock(name string) *parse.BlockNode {
+	return s.blockTable().parents[name]
+}
@@ -0,0 +1,211 @@
+package stick
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A CacheMode determines how an Env's template cache handles templates that
+// are modified after they are cached.
+type CacheMode int
+
+const (
+	// CacheAutoReload checks whether each cached template has been modified
+	// before it is used, reloading it if so. Templates are only cached if
+	// the Env's Loader is a FreshnessChecker. This is similar to Twig's
+	// auto_reload option, and is intended for development.
+	CacheAutoReload CacheMode = iota
+	// CacheForever uses cached templates without checking whether they have
+	// been modified. Templates are cached regardless of the Env's Loader.
+	// Use ClearTemplateCache, for example from a deploy hook, to reload them.
+	CacheForever
+)
+
+// ClearTemplateCache removes all templates from the Env's template cache,
+// causing them to be reloaded when next used. Cache statistics are kept.
+func (env *Env) ClearTemplateCache() {
+	c := &env.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		c.removeLocked(name)
+	}
+}
+
+// CacheStats describes the use of an Env's template cache.
+type CacheStats struct {
+	Hits      uint64 // Number of times a cached template was used.
+	Misses    uint64 // Number of times a template was not cached, or was stale.
+	Evictions uint64 // Number of templates evicted to stay within limits.
+	Templates int    // Number of templates currently cached.
+	Bytes     int64  // Total size of the source of the cached templates.
+}
+
+// CacheStats returns statistics about the Env's template cache.
+func (env *Env) CacheStats() CacheStats {
+	c := &env.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Templates = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// templateCache holds parsed templates, keyed by name.
+//
+// With CacheAutoReload, cached templates are reused as long as the Env's
+// Loader reports that they, and any templates inlined into them by
+// OptimizeInclude, are fresh. See CacheMode.
+//
+// When the Env's MaxCachedTemplates or MaxCachedBytes is exceeded, the least
+// recently used templates are evicted.
+type templateCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Most recently used first.
+	bytes   int64     // Total size of the cached templates.
+	stats   CacheStats
+
+	// programs contains the programs compiled for EngineVM from the bodies
+	// of cached templates, keyed by *parse.BodyNode.
+	programs sync.Map
+
+	// blockTables contains the *blockTable of the blocks of each cached
+	// template, keyed by the address of its block map.
+	blockTables sync.Map
+}
+
+// cacheEntry is a parsed template in a templateCache.
+type cacheEntry struct {
+	name   string
+	tree   *parse.Tree
+	loaded time.Time // When the template was loaded.
+	deps   []string  // Names of other templates inlined into tree.
+	size   int64     // Size of the source of the template and its deps.
+
+	programs map[*parse.BodyNode]*program // Programs compiled for EngineVM.
+}
+
+// get returns the cached entry for name, marking it as recently used.
+func (c *templateCache) get(name string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put adds e to the cache, then evicts the least recently used entries
+// until the cache is within the given limits. A limit of zero is unlimited.
+func (c *templateCache) put(e *cacheEntry, maxTemplates int, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.removeLocked(e.name)
+	c.entries[e.name] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for body, p := range e.programs {
+		c.programs.Store(body, p)
+	}
+	blocks := e.tree.Blocks()
+	c.blockTables.Store(mapKey(blocks), (&blockTable{}).with(blocks))
+	for c.lru.Len() > 0 {
+		if (maxTemplates <= 0 || c.lru.Len() <= maxTemplates) && (maxBytes <= 0 || c.bytes <= maxBytes) {
+			break
+		}
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).name)
+		c.stats.Evictions++
+	}
+}
+
+func (c *templateCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(name)
+}
+
+// removeLocked removes the entry for name. The caller must hold the lock.
+func (c *templateCache) removeLocked(name string) {
+	el, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, name)
+	e := el.Value.(*cacheEntry)
+	c.bytes -= e.size
+	for body := range e.programs {
+		c.programs.Delete(body)
+	}
+	c.blockTables.Delete(mapKey(e.tree.Blocks()))
+}
+
+// record updates the hit or miss count.
+func (c *templateCache) record(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+// fresh returns true if the entry, and each template it depends on, has
+// not been modified since it was loaded.
+func (env *Env) fresh(e *cacheEntry) bool {
+	if !env.IsFresh(e.name, e.loaded) {
+		return false
+	}
+	for _, dep := range e.deps {
+		if !env.IsFresh(dep, e.loaded) {
+			return false
+		}
+	}
+	return true
+}
+
+// cached returns the parsed template with the given name, loading and
+// parsing it if it is not cached or has been modified.
+//
+// The returned Tree is shared and must not be modified.
+func (env *Env) cached(name string) (*parse.Tree, error) {
+	if e := env.cache.get(name); e != nil {
+		if env.CacheMode == CacheForever || env.fresh(e) {
+			env.cache.record(true)
+			if env.Metrics != nil {
+				env.Metrics.CacheLookup(name, true)
+			}
+			return e.tree, nil
+		}
+		env.cache.remove(name)
+	}
+	env.cache.record(false)
+	loaded := time.Now()
+	e, err := env.compile(name)
+	if env.Metrics != nil {
+		env.Metrics.CacheLookup(name, false)
+		env.Metrics.Parse(name, time.Since(loaded), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := env.Loader.(FreshnessChecker); ok || env.CacheMode == CacheForever {
+		e.name = name
+		e.loaded = loaded
+		if env.Engine == EngineVM {
+			e.programs = compileTree(e.tree)
+		}
+		env.cache.put(e, env.MaxCachedTemplates, env.MaxCachedBytes)
+	}
+	return e.tree, nil
+}
@@ -0,0 +1,99 @@
+package stick
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultCharset is the charset used when an Env's Charset is empty.
+const DefaultCharset = "UTF-8"
+
+// normalizeCharset returns the canonical form of the named charset, or an
+// empty string if the charset is not supported.
+func normalizeCharset(charset string) string {
+	switch strings.Replace(strings.Replace(strings.ToUpper(charset), "-", "", -1), "_", "", -1) {
+	case "", "UTF8":
+		return "UTF-8"
+	case "ISO88591", "LATIN1":
+		return "ISO-8859-1"
+	case "ASCII", "USASCII":
+		return "US-ASCII"
+	}
+	return ""
+}
+
+// IsUTF8 returns true if charset names UTF-8. An empty charset is
+// considered UTF-8.
+func IsUTF8(charset string) bool {
+	return normalizeCharset(charset) == "UTF-8"
+}
+
+// Decode converts s from the given charset to UTF-8.
+//
+// Supported charsets are UTF-8, ISO-8859-1, and US-ASCII.
+func Decode(s, charset string) (string, error) {
+	switch normalizeCharset(charset) {
+	case "UTF-8":
+		return s, nil
+	case "ISO-8859-1":
+		r := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			r[i] = rune(s[i])
+		}
+		return string(r), nil
+	case "US-ASCII":
+		return encodeSingleByte(s, 0x7f), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// Encode converts the UTF-8 string s to the given charset. Characters that
+// cannot be represented in the charset are replaced with "?".
+//
+// Supported charsets are UTF-8, ISO-8859-1, and US-ASCII.
+func Encode(s, charset string) (string, error) {
+	switch normalizeCharset(charset) {
+	case "UTF-8":
+		return s, nil
+	case "ISO-8859-1":
+		return encodeSingleByte(s, 0xff), nil
+	case "US-ASCII":
+		return encodeSingleByte(s, 0x7f), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// encodeSingleByte encodes s using one byte per character, replacing
+// characters above max with "?".
+func encodeSingleByte(s string, max rune) string {
+	b := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		r, n := utf8.DecodeRuneInString(s)
+		s = s[n:]
+		if r == utf8.RuneError && n <= 1 || r > max {
+			b = append(b, '?')
+			continue
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+// applyEscaper escapes str, which is encoded in the Env's charset, using
+// esc. Escapers operate on UTF-8, so str is converted before and after
+// escaping if necessary.
+func (env *Env) applyEscaper(esc Escaper, str string) string {
+	if IsUTF8(env.Charset) {
+		return esc(str)
+	}
+	dec, err := Decode(str, env.Charset)
+	if err != nil {
+		return esc(str)
+	}
+	res, err := Encode(esc(dec), env.Charset)
+	if err != nil {
+		return esc(str)
+	}
+	return res
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+var astCommand = &command{
+	name:  "ast",
+	args:  "template",
+	short: "print the syntax tree of a template",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		return func(args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			env := newEnv(*path)
+			tpl, err := env.Loader.Load(args[0])
+			if errors.Is(err, os.ErrNotExist) {
+				return &stick.TemplateNotFoundError{Name: args[0], Err: err}
+			} else if err != nil {
+				return err
+			}
+			tree, err := parseTemplate(env, args[0], tpl.Contents())
+			if err != nil {
+				return err
+			}
+			return parse.Dump(stdout, tree)
+		}
+	},
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/tyler-sommer/stick"
+)
+
+var auditCommand = &command{
+	name:  "audit",
+	args:  "[template ...]",
+	short: "report Twig features used by templates that are not supported",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		asJSON := fs.Bool("json", false, "print the report as JSON")
+		return func(args []string) error {
+			env := newEnv(*path)
+			if len(args) == 0 {
+				var err error
+				if args, err = env.Loader.(stick.Lister).List(); err != nil {
+					return err
+				}
+			}
+			r := env.Audit(args...)
+			if *asJSON {
+				enc := json.NewEncoder(stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(r)
+			}
+			fmt.Fprintf(stdout, "%d templates scanned, %d could not be parsed fully, %d unsupported constructs found.\n",
+				r.Templates, len(r.Unparsable), len(r.Findings))
+			for _, f := range r.Findings {
+				fmt.Fprintf(stdout, "\n%s %s (%d)\n", f.Kind, f.Name, len(f.Locations))
+				for _, l := range f.Locations {
+					if l.Line == 0 {
+						fmt.Fprintf(stdout, "\t%s\n", l.Template)
+						continue
+					}
+					fmt.Fprintf(stdout, "\t%s:%d:%d\n", l.Template, l.Line, l.Column)
+				}
+			}
+			return nil
+		}
+	},
+}
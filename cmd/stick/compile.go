@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/compile"
+)
+
+var compileCommand = &command{
+	name:  "compile",
+	args:  "[template ...]",
+	short: "generate Go source for templates",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		pkg := fs.String("pkg", "templates", "name of the generated package")
+		out := fs.String("o", "", "file to write to, instead of standard output")
+		return func(args []string) error {
+			env := newEnv(*path)
+			if len(args) == 0 {
+				var err error
+				if args, err = env.Loader.(stick.Lister).List(); err != nil {
+					return err
+				}
+			}
+			var buf bytes.Buffer
+			failed := false
+			for _, err := range compile.Generate(&buf, env, *pkg, args...) {
+				var uerr *compile.UnsupportedError
+				if errors.As(err, &uerr) {
+					// Unsupported templates are executed by the interpreter.
+					fmt.Fprintf(stderr, "warning: %s\n", err)
+					continue
+				}
+				fmt.Fprintln(stderr, err)
+				failed = true
+			}
+			if failed {
+				return errors.New("some templates could not be compiled")
+			}
+			if *out == "" {
+				_, err := stdout.Write(buf.Bytes())
+				return err
+			}
+			return ioutil.WriteFile(*out, buf.Bytes(), 0644)
+		}
+	},
+}
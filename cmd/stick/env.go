@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+	"github.com/tyler-sommer/stick/twig"
+)
+
+// newEnv returns a Twig-compatible Env that loads templates from dir.
+func newEnv(dir string) *stick.Env {
+	return twig.New(stick.NewFilesystemLoader(dir))
+}
+
+// parseTemplate parses the source of the named template using the custom
+// tags and operators of env. Unlike env.Parse, the Env's Visitors and
+// Optimizations are not applied.
+func parseTemplate(env *stick.Env, name string, src io.Reader) (*parse.Tree, error) {
+	tree := parse.NewNamedTree(name, src)
+	tree.Tags = env.Tags
+	for k, op := range env.Operators {
+		tree.DefineOperator(k, op.Precedence, op.RightAssoc)
+	}
+	if err := tree.Parse(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+var fmtCommand = &command{
+	name:  "fmt",
+	args:  "[template ...]",
+	short: "rewrite templates in canonical form",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		check := fs.Bool("check", false, "list templates that are not formatted, instead of rewriting them")
+		return func(args []string) error {
+			env := newEnv(*path)
+			loader := env.Loader.(*stick.FilesystemLoader)
+			if len(args) == 0 {
+				var err error
+				if args, err = loader.List(); err != nil {
+					return err
+				}
+			}
+			failed, unformatted := false, 0
+			for _, name := range args {
+				changed, err := formatTemplate(env, loader, name, *check)
+				if err != nil {
+					fmt.Fprintln(stderr, err)
+					failed = true
+				} else if changed && *check {
+					fmt.Fprintln(stdout, name)
+					unformatted++
+				}
+			}
+			if failed {
+				return errors.New("some templates could not be formatted")
+			}
+			if unformatted > 0 {
+				return fmt.Errorf("%d template(s) not formatted", unformatted)
+			}
+			return nil
+		}
+	},
+}
+
+// formatTemplate formats the named template, returning true if its source
+// changed. The template's file is rewritten unless check is true.
+func formatTemplate(env *stick.Env, loader *stick.FilesystemLoader, name string, check bool) (bool, error) {
+	path, err := loader.Path(name)
+	if err != nil {
+		return false, &stick.TemplateNotFoundError{Name: name, Err: err}
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	tree, err := parseTemplate(env, name, bytes.NewReader(src))
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	if err := parse.Format(&buf, tree); err != nil {
+		return false, fmt.Errorf("%s: %s", name, err)
+	}
+	if bytes.Equal(buf.Bytes(), src) {
+		return false, nil
+	}
+	if check {
+		return true, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path, buf.Bytes(), info.Mode())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/tyler-sommer/stick"
+)
+
+var lintCommand = &command{
+	name:  "lint",
+	args:  "[template ...]",
+	short: "check templates for problems",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		asJSON := fs.Bool("json", false, "print each problem as a JSON object on its own line")
+		return func(args []string) error {
+			env := newEnv(*path)
+			if len(args) == 0 {
+				var err error
+				if args, err = env.Loader.(stick.Lister).List(); err != nil {
+					return err
+				}
+			}
+			errs := 0
+			enc := json.NewEncoder(stdout)
+			for _, d := range env.Lint(args...) {
+				if d.Severity == stick.SeverityError {
+					errs++
+				}
+				if *asJSON {
+					if err := enc.Encode(d); err != nil {
+						return err
+					}
+					continue
+				}
+				fmt.Fprintln(stdout, d)
+			}
+			if errs > 0 {
+				return fmt.Errorf("%d error(s) found", errs)
+			}
+			return nil
+		}
+	},
+}
@@ -0,0 +1,128 @@
+// Command stick works with Stick templates from the command line.
+//
+// Usage:
+//
+//	stick <command> [arguments]
+//
+// The commands are:
+//
+//	ast        print the syntax tree of a template
+//	audit      report Twig features used by templates that are not supported
+//	compile    generate Go source for templates
+//	fmt        rewrite templates in canonical form
+//	lint       check templates for problems
+//	render     render a template
+//	types      generate Go types for template variables
+//
+// Templates are loaded from the directory given by the -path flag, and are
+// parsed and executed using a Twig-compatible Env, as created by twig.New.
+//
+// The lint command exits with status 1 if any errors are found, and the fmt
+// command with -check exits with status 1 if any template is not formatted,
+// making them suitable for use in CI. Lint warnings are printed but do not
+// affect the status.
+//
+// Run "stick <command> -h" for more information about a command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A command is a stick subcommand.
+type command struct {
+	name  string
+	args  string // Description of the positional arguments.
+	short string // Short description, shown in the command list.
+
+	// setup defines the command's flags, returning a function that runs the
+	// command with the remaining arguments.
+	setup func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error
+}
+
+var commands = []*command{
+	astCommand,
+	auditCommand,
+	compileCommand,
+	fmtCommand,
+	lintCommand,
+	renderCommand,
+	typesCommand,
+}
+
+// errUsage is returned by a command when its arguments are invalid.
+var errUsage = errors.New("invalid usage")
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: stick <command> [arguments]\n\nThe commands are:\n\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t%-10s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(w, "\nRun \"stick <command> -h\" for more information about a command.\n")
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command given by args, returning the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		fs.Usage = func() {
+			fmt.Fprintf(stderr, "Usage: stick %s [flags] %s\n\n", c.name, c.args)
+			fs.PrintDefaults()
+		}
+		fn := c.setup(fs, stdout, stderr)
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return 2
+		}
+		err = fn(rest)
+		if err == errUsage {
+			fs.Usage()
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "stick %s: %s\n", c.name, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stderr, "stick: unknown command %q\n\n", args[0])
+	usage(stderr)
+	return 2
+}
+
+// parseFlags parses args using fs, allowing flags to follow positional
+// arguments, as in "stick render index.twig -data data.json". The positional
+// arguments are returned. Arguments after "--" are never parsed as flags.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if n := len(args) - fs.NArg(); n > 0 && args[n-1] == "--" {
+			return append(rest, fs.Args()...), nil
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string // Expected to be contained in the output.
+		stderr string // Expected to be contained in the error output.
+	}{
+		{"no command", nil, 2, "", "Usage: stick <command>"},
+		{"unknown command", []string{"nope"}, 2, "", `unknown command "nope"`},
+		{"ast", []string{"ast", "-path", "testdata", "hello.html.twig"}, 0, "  Nodes[1]: PrintNode 1:11\n    X: NameExpr 1:14 Name=\"name\"\n", ""},
+		{"ast no template", []string{"ast"}, 2, "", "Usage: stick ast"},
+		{"ast missing", []string{"ast", "-path", "testdata", "missing.twig"}, 1, "", `template "missing.twig" not found`},
+		{"audit", []string{"audit", "-path", "testdata/audit"}, 0, "tag trans (1)\n\tpage.html.twig:1:3\n", ""},
+		{"audit json", []string{"audit", "-path", "testdata/audit", "-json"}, 0, `"kind": "operator",`, ""},
+		{"compile", []string{"compile", "-path", "../../compile/testdata", "-pkg", "views", "plain.txt.twig"}, 0, `"plain.txt.twig": template0`, ""},
+		{"compile unsupported", []string{"compile", "-path", "../../compile/testdata", "child.html.twig"}, 0, "package templates", "warning: compile: extends is not supported"},
+		{"compile missing", []string{"compile", "-path", "../../compile/testdata", "missing.twig"}, 1, "", `template "missing.twig" not found`},
+		{"fmt check", []string{"fmt", "-check", "-path", "testdata/fmt"}, 1, "unformatted.html.twig", "1 template(s) not formatted"},
+		{"fmt check formatted", []string{"fmt", "-check", "-path", "testdata/fmt", "formatted.html.twig"}, 0, "", ""},
+		{"fmt missing", []string{"fmt", "-path", "testdata/fmt", "missing.twig"}, 1, "", `template "missing.twig" not found`},
+		{"lint", []string{"lint", "-path", "testdata/lint", "page.html.twig"}, 0, `page.html.twig:3:3: warning: block "sidebar" is not defined in any parent template (undefined-block)`, ""},
+		{"lint errors", []string{"lint", "-path", "testdata/lint"}, 1, `broken.html.twig:1:`, "1 error(s) found"},
+		{"lint json", []string{"lint", "-path", "testdata/lint", "-json", "broken.html.twig"}, 1, `{"template":"broken.html.twig","line":1,`, ""},
+		{"lint missing", []string{"lint", "-path", "testdata/lint", "missing.twig"}, 1, `missing.twig: error: template "missing.twig" not found (not-found)`, ""},
+		{"render json", []string{"render", "-path", "testdata", "-data", "testdata/data.json", "hello.html.twig"}, 0, "<h1>Hello, &lt;World&gt;!</h1>\n<li>FIRST (1)</li>\n<li>SECOND (2.5)</li>\n", ""},
+		{"render yaml", []string{"render", "hello.html.twig", "--path", "testdata", "--data", "testdata/data.yaml"}, 0, "<li>SECOND (2.5)</li>", ""},
+		{"render no data", []string{"render", "-path", "testdata", "hello.html.twig"}, 0, "Hello, !", ""},
+		{"render no template", []string{"render", "-path", "testdata"}, 2, "", "Usage: stick render"},
+		{"render invalid data", []string{"render", "-path", "testdata", "-data", "testdata/list.json", "hello.html.twig"}, 1, "", "data must be an object"},
+		{"render missing", []string{"render", "-path", "testdata", "missing.twig"}, 1, "", `template "missing.twig" not found`},
+		{"types", []string{"types", "-path", "../../compile/testdata", "-pkg", "views", "plain.txt.twig"}, 0, "type PlainTxt struct {\n\tHTML    string\n", ""},
+		{"types missing", []string{"types", "-path", "../../compile/testdata", "missing.twig"}, 1, "", `template "missing.twig" not found`},
+		{"render flag terminator", []string{"render", "-path", "testdata", "--", "-data"}, 1, "", `template "-data" not found`},
+	}
+	for _, test := range tests {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(test.args, stdout, stderr)
+		if code != test.code {
+			t.Errorf("%s: expected exit code %d, got %d: %s", test.name, test.code, code, stderr)
+		}
+		if !strings.Contains(stdout.String(), test.stdout) {
+			t.Errorf("%s: expected output to contain %q, got %q", test.name, test.stdout, stdout)
+		}
+		if !strings.Contains(stderr.String(), test.stderr) {
+			t.Errorf("%s: expected error output to contain %q, got %q", test.name, test.stderr, stderr)
+		}
+	}
+}
+
+func TestFmt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stick-fmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := ioutil.ReadFile("testdata/fmt/unformatted.html.twig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "page.html.twig")
+	if err := ioutil.WriteFile(name, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := run([]string{"fmt", "-path", dir}, stdout, stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr)
+	}
+	expected, err := ioutil.ReadFile("testdata/fmt/formatted.html.twig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := ioutil.ReadFile(name); string(actual) != string(expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if code := run([]string{"fmt", "-check", "-path", dir}, stdout, stderr); code != 0 {
+		t.Errorf("expected formatted template to pass -check, got exit code %d", code)
+	}
+}
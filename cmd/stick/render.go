@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/internal/yaml"
+)
+
+var renderCommand = &command{
+	name:  "render",
+	args:  "template",
+	short: "render a template",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		data := fs.String("data", "", "JSON or YAML `file` containing the template's variables")
+		return func(args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			ctx := map[string]stick.Value{}
+			if *data != "" {
+				var err error
+				if ctx, err = readData(*data); err != nil {
+					return err
+				}
+			}
+			return newEnv(*path).Execute(args[0], stdout, ctx)
+		}
+	},
+}
+
+// readData reads template variables from the named file. Files with a
+// ".yaml" or ".yml" extension are decoded as YAML, others as JSON.
+func readData(name string) (map[string]stick.Value, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		v, err = yaml.Unmarshal(b)
+	default:
+		err = json.Unmarshal(b, &v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if v == nil {
+		return map[string]stick.Value{}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(name + ": data must be an object")
+	}
+	ctx := make(map[string]stick.Value, len(m))
+	for k, v := range m {
+		ctx[k] = v
+	}
+	return ctx, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/compile"
+)
+
+var typesCommand = &command{
+	name:  "types",
+	args:  "[template ...]",
+	short: "generate Go types for template variables",
+	setup: func(fs *flag.FlagSet, stdout, stderr io.Writer) func(args []string) error {
+		path := fs.String("path", ".", "directory containing templates")
+		pkg := fs.String("pkg", "templates", "name of the generated package")
+		out := fs.String("o", "", "file to write to, instead of standard output")
+		return func(args []string) error {
+			env := newEnv(*path)
+			if len(args) == 0 {
+				var err error
+				if args, err = env.Loader.(stick.Lister).List(); err != nil {
+					return err
+				}
+			}
+			var buf bytes.Buffer
+			if errs := compile.GenerateTypes(&buf, env, *pkg, args...); len(errs) > 0 {
+				for _, err := range errs {
+					fmt.Fprintln(stderr, err)
+				}
+				return errors.New("some templates could not be analyzed")
+			}
+			if *out == "" {
+				_, err := stdout.Write(buf.Bytes())
+				return err
+			}
+			return ioutil.WriteFile(*out, buf.Bytes(), 0644)
+		}
+	},
+}
@@ -0,0 +1,478 @@
+// Package compile translates Stick templates into Go source code.
+//
+// Compiled templates are Go functions that write directly to an io.Writer,
+// so executing them does not require loading or parsing the template.
+// Generate source for a set of templates with the Generate function or
+// the "stick compile" command, then execute them using the generated Set:
+//
+//	err := views.Templates.Execute(env, "index.html.twig", w, ctx)
+//
+// Only a subset of templates can be compiled. Templates that use
+// inheritance, blocks, includes, macros, or custom tags and operators are
+// not compiled, and are instead executed by the Env as usual. Filters,
+// functions, and tests are called through the Env, so a compiled template
+// must be executed using an Env with the same definitions as the one it
+// was generated with.
+package compile // import "github.com/tyler-sommer/stick/compile"
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A Func is a compiled template.
+type Func func(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error
+
+// A Set contains compiled templates, keyed by name.
+type Set map[string]Func
+
+// Execute executes the named template, writing to out. If the template was
+// compiled, and env has no options that compiled templates do not support,
+// the compiled template is used. Otherwise, the template is executed by env.
+// The output of compiled templates is written using env.ExecuteFunc, so the
+// Env's OutputFilter, AtomicOutput, and output middleware apply as usual.
+//
+// Compiled templates do not support the Env's SecurityPolicy,
+// StrictVariables, UndefinedMode, StrictTypes, AttrResolver,
+// MaxOutputBytes, MaxLoopIterations, Instrumentation, or ContextDecorator
+// options.
+func (s Set) Execute(env *stick.Env, name string, out io.Writer, ctx map[string]stick.Value) error {
+	if fn, ok := s[name]; ok && supported(env) {
+		return env.ExecuteFunc(name, out, func(out io.Writer) error {
+			return fn(env, out, ctx)
+		})
+	}
+	return env.Execute(name, out, ctx)
+}
+
+// supported returns true if compiled templates can be executed using env.
+func supported(env *stick.Env) bool {
+	return env.SecurityPolicy == nil &&
+		!env.StrictVariables &&
+		env.UndefinedMode == stick.NilUndefined &&
+		!env.StrictTypes &&
+		env.AttrResolver == nil &&
+		env.MaxOutputBytes <= 0 &&
+		env.MaxLoopIterations <= 0 &&
+		env.Instrumentation == nil &&
+		env.ContextDecorator == nil
+}
+
+// An UnsupportedError is returned by Generate when a template uses a
+// feature that cannot be compiled.
+type UnsupportedError struct {
+	Template string    // The name of the template.
+	Pos      parse.Pos // The position of the unsupported feature.
+	Feature  string    // A description of the feature.
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("compile: %s is not supported on line %d, column %d in %s", e.Feature, e.Pos.Line, e.Pos.Offset, e.Template)
+}
+
+// Generate writes Go source for a package named pkg to w. The source
+// declares a Set named Templates containing each of the named templates.
+//
+// Templates are loaded and parsed using env. A template that cannot be
+// loaded, parsed, or compiled is omitted from the Set, and an error is
+// returned for it; templates using unsupported features are reported with
+// an *UnsupportedError. Generate returns nil if every template was compiled.
+func Generate(w io.Writer, env *stick.Env, pkg string, names ...string) []error {
+	var errs []error
+	var funcs bytes.Buffer
+	var compiled []string
+	imports := make(map[string]bool)
+	for _, name := range names {
+		tree, err := env.Parse(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		g := &generator{env: env, name: name, ret: "return err", imports: make(map[string]bool)}
+		g.node(tree.Root())
+		if g.err != nil {
+			errs = append(errs, g.err)
+			continue
+		}
+		fmt.Fprintf(&funcs, "\n// template%d is compiled from %s.\n", len(compiled), strconv.Quote(name))
+		fmt.Fprintf(&funcs, "func template%d(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {\n", len(compiled))
+		fmt.Fprintf(&funcs, "s := compile.NewState(env, %s, out, ctx)\n", strconv.Quote(name))
+		funcs.Write(g.buf.Bytes())
+		funcs.WriteString("return nil\n}\n")
+		compiled = append(compiled, name)
+		for k := range g.imports {
+			imports[k] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by stick compile. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n", pkg)
+	if len(compiled) > 0 {
+		imports["io"] = true
+		imports["github.com/tyler-sommer/stick"] = true
+	}
+	imports["github.com/tyler-sommer/stick/compile"] = true
+	paths := make([]string, 0, len(imports))
+	for k := range imports {
+		paths = append(paths, k)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		si, sj := strings.Contains(paths[i], "."), strings.Contains(paths[j], ".")
+		if si != sj {
+			return sj
+		}
+		return paths[i] < paths[j]
+	})
+	for i, p := range paths {
+		// Standard library packages are grouped first.
+		if i > 0 && !strings.Contains(paths[i-1], ".") && strings.Contains(p, ".") {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%s\n", strconv.Quote(p))
+	}
+	buf.WriteString(")\n\n// Templates contains the compiled templates, keyed by name.\nvar Templates = compile.Set{\n")
+	for i, name := range compiled {
+		fmt.Fprintf(&buf, "%s: template%d,\n", strconv.Quote(name), i)
+	}
+	buf.WriteString("}\n")
+	buf.Write(funcs.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return append(errs, err)
+	}
+	if _, err := w.Write(src); err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
+
+// escapeFilters are filters that, when applied last in a print statement,
+// disable auto-escaping of the printed value.
+var escapeFilters = map[string]bool{
+	"raw":    true,
+	"escape": true,
+	"e":      true,
+}
+
+// generator generates the body of a compiled template.
+type generator struct {
+	env     *stick.Env
+	name    string
+	buf     bytes.Buffer
+	ret     string // The statement used to return an error.
+	vars    int    // Number of temporary variables declared.
+	imports map[string]bool
+	err     error // The first unsupported feature encountered.
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// unsupported records an UnsupportedError for node.
+func (g *generator) unsupported(node parse.Node, feature string) {
+	if g.err == nil {
+		g.err = &UnsupportedError{g.name, node.Start(), feature}
+	}
+}
+
+// temp declares a new temporary variable with the given value, returning
+// its name.
+func (g *generator) temp(format string, args ...interface{}) string {
+	g.vars++
+	v := "v" + strconv.Itoa(g.vars)
+	g.printf("var %s stick.Value = %s\n", v, fmt.Sprintf(format, args...))
+	return v
+}
+
+// call declares a new temporary variable holding the result of a call that
+// may fail, returning its name.
+func (g *generator) call(format string, args ...interface{}) string {
+	g.vars++
+	v := "v" + strconv.Itoa(g.vars)
+	g.printf("%s, err := %s\nif err != nil {\n%s\n}\n", v, fmt.Sprintf(format, args...), g.ret)
+	return v
+}
+
+// check generates a statement that fails if the given expression, of type
+// error, is not nil.
+func (g *generator) check(format string, args ...interface{}) {
+	g.printf("if err := %s; err != nil {\n%s\n}\n", fmt.Sprintf(format, args...), g.ret)
+}
+
+func (g *generator) node(node parse.Node) {
+	if g.err != nil {
+		return
+	}
+	switch node := node.(type) {
+	case nil:
+	case *parse.ModuleNode:
+		if node.Parent != nil {
+			g.unsupported(node.Parent, "extends")
+			return
+		}
+		g.node(node.BodyNode)
+	case *parse.BodyNode:
+		for _, c := range node.All() {
+			g.node(c)
+		}
+	case *parse.CommentNode:
+	case *parse.TextNode:
+		g.check("s.Write(%s)", strconv.Quote(node.Data))
+	case *parse.PrintNode:
+		v := g.expr(node.X)
+		if f, ok := node.X.(*parse.FilterExpr); ok && escapeFilters[f.Name] {
+			g.check("s.Write(stick.CoerceString(%s))", v)
+		} else if node.Strategy != "" {
+			g.check("s.PrintWith(%s, %s)", v, strconv.Quote(node.Strategy))
+		} else {
+			g.check("s.Print(%s)", v)
+		}
+	case *parse.IfNode:
+		v := g.expr(node.Cond)
+		g.printf("if stick.CoerceBool(%s) {\n", v)
+		g.node(node.Body)
+		g.printf("} else {\n")
+		g.node(node.Else)
+		g.printf("}\n")
+	case *parse.ForNode:
+		g.forNode(node)
+	case *parse.SetNode:
+		x, ok := node.X.(parse.Expr)
+		if !ok {
+			g.unsupported(node, "set with a body")
+			return
+		}
+		v := g.expr(x)
+		g.printf("s.Set(%s, %s)\n", strconv.Quote(node.Name), v)
+	case *parse.DoNode:
+		g.printf("_ = %s\n", g.expr(node.X))
+	default:
+		g.unsupported(node, nodeName(node))
+	}
+}
+
+func (g *generator) forNode(node *parse.ForNode) {
+	x := g.expr(node.X)
+	key, loop := "_", "_"
+	if node.Key != "" {
+		key = "k"
+	}
+	if !node.NoLoop {
+		loop = "l"
+	}
+	g.vars++
+	n := "n" + strconv.Itoa(g.vars)
+	g.printf("%s, err := stick.Iterate(%s, func(%s, v stick.Value, %s stick.Loop) (bool, error) {\n", n, x, key, loop)
+	g.printf("s.Push()\ndefer s.Pop()\n")
+	if node.Key != "" {
+		g.printf("s.SetLocal(%s, k)\n", strconv.Quote(node.Key))
+	}
+	g.printf("s.SetLocal(%s, v)\n", strconv.Quote(node.Val))
+	if !node.NoLoop {
+		g.printf("s.SetLoop(l)\n")
+	}
+	ret := g.ret
+	g.ret = "return true, err"
+	g.node(node.Body)
+	g.ret = ret
+	g.printf("return false, nil\n})\nif err != nil {\n%s\n}\n", g.ret)
+	g.printf("if %s == 0 {\n", n)
+	g.node(node.Else)
+	g.printf("}\n")
+}
+
+// binaryOps are binary operators that can be expressed as Go expressions
+// of the evaluated operands. They are format strings; the left operand is
+// argument 1, and the right is argument 2.
+var binaryOps = map[string]string{
+	parse.OpBinaryAdd:          "stick.Add(%[1]s, %[2]s)",
+	parse.OpBinarySubtract:     "stick.Sub(%[1]s, %[2]s)",
+	parse.OpBinaryMultiply:     "stick.Mul(%[1]s, %[2]s)",
+	parse.OpBinaryDivide:       "stick.Div(%[1]s, %[2]s)",
+	parse.OpBinaryFloorDiv:     "compile.FloorDiv(%[1]s, %[2]s)",
+	parse.OpBinaryPower:        "compile.Pow(%[1]s, %[2]s)",
+	parse.OpBinaryConcat:       "stick.CoerceString(%[1]s) + stick.CoerceString(%[2]s)",
+	parse.OpBinaryEndsWith:     "strings.HasSuffix(stick.CoerceString(%[1]s), stick.CoerceString(%[2]s))",
+	parse.OpBinaryStartsWith:   "strings.HasPrefix(stick.CoerceString(%[1]s), stick.CoerceString(%[2]s))",
+	parse.OpBinaryEqual:        "stick.Equal(%[1]s, %[2]s)",
+	parse.OpBinaryNotEqual:     "!stick.Equal(%[1]s, %[2]s)",
+	parse.OpBinaryGreaterEqual: "compile.Compare(%[1]s, %[2]s) == 0 || compile.Compare(%[1]s, %[2]s) == 1",
+	parse.OpBinaryGreaterThan:  "compile.Compare(%[1]s, %[2]s) == 1",
+	parse.OpBinaryLessEqual:    "compile.Compare(%[1]s, %[2]s) == 0 || compile.Compare(%[1]s, %[2]s) == -1",
+	parse.OpBinaryLessThan:     "compile.Compare(%[1]s, %[2]s) == -1",
+	parse.OpBinaryRange:        "compile.Range(%[1]s, %[2]s)",
+	parse.OpBinaryBitwiseAnd:   "int(stick.CoerceNumber(%[1]s)) & int(stick.CoerceNumber(%[2]s))",
+	parse.OpBinaryBitwiseOr:    "int(stick.CoerceNumber(%[1]s)) | int(stick.CoerceNumber(%[2]s))",
+	parse.OpBinaryBitwiseXor:   "int(stick.CoerceNumber(%[1]s)) ^ int(stick.CoerceNumber(%[2]s))",
+	parse.OpBinaryAnd:          "stick.CoerceBool(%[1]s) && stick.CoerceBool(%[2]s)",
+	parse.OpBinaryOr:           "stick.CoerceBool(%[1]s) || stick.CoerceBool(%[2]s)",
+}
+
+// expr generates statements that evaluate exp, returning a Go expression
+// holding the result. Operands are evaluated in order, as by the Env.
+func (g *generator) expr(exp parse.Expr) string {
+	if g.err != nil {
+		return "nil"
+	}
+	switch exp := exp.(type) {
+	case *parse.NullExpr:
+		return "nil"
+	case *parse.BoolExpr:
+		return strconv.FormatBool(exp.Value)
+	case *parse.NumberExpr:
+		num, err := strconv.ParseFloat(exp.Value, 64)
+		if err != nil {
+			g.unsupported(exp, "number "+exp.Value)
+			return "nil"
+		}
+		return "float64(" + strconv.FormatFloat(num, 'g', -1, 64) + ")"
+	case *parse.StringExpr:
+		return strconv.Quote(exp.Text)
+	case *parse.NameExpr:
+		if exp.Name == "_self" {
+			g.unsupported(exp, "_self")
+			return "nil"
+		}
+		return g.temp("s.Get(%s)", strconv.Quote(exp.Name))
+	case *parse.GroupExpr:
+		return g.expr(exp.X)
+	case *parse.UnaryExpr:
+		v := g.expr(exp.X)
+		switch exp.Op {
+		case parse.OpUnaryNot:
+			return g.temp("!stick.CoerceBool(%s)", v)
+		case parse.OpUnaryPositive:
+			return g.temp("stick.CoerceNumber(%s)", v)
+		case parse.OpUnaryNegative:
+			return g.temp("-stick.CoerceNumber(%s)", v)
+		}
+		g.unsupported(exp, "operator "+exp.Op)
+	case *parse.BinaryExpr:
+		return g.binaryExpr(exp)
+	case *parse.FuncExpr:
+		if exp.Name == "parent" || exp.Name == "block" {
+			g.unsupported(exp, exp.Name+" function")
+			return "nil"
+		}
+		args := g.args(exp.Args)
+		return g.call("s.Call(%s)", strings.Join(append([]string{strconv.Quote(exp.Name)}, args...), ", "))
+	case *parse.FilterExpr:
+		args := g.args(exp.Args)
+		if len(args) == 0 {
+			g.unsupported(exp, "filter without arguments")
+			return "nil"
+		}
+		return g.call("s.Filter(%s)", strings.Join(append([]string{strconv.Quote(exp.Name)}, args...), ", "))
+	case *parse.GetAttrExpr:
+		c := g.expr(exp.Cont)
+		k := g.expr(exp.Attr)
+		args := g.args(exp.Args)
+		return g.call("s.Attr(%s)", strings.Join(append([]string{c, k}, args...), ", "))
+	case *parse.TernaryIfExpr:
+		cond := g.expr(exp.Cond)
+		g.vars++
+		v := "v" + strconv.Itoa(g.vars)
+		g.printf("var %s stick.Value\nif stick.CoerceBool(%s) {\n", v, cond)
+		g.printf("%s = %s\n} else {\n", v, g.expr(exp.TrueX))
+		g.printf("%s = %s\n}\n", v, g.expr(exp.FalseX))
+		return v
+	case *parse.HashExpr:
+		g.vars++
+		m := "m" + strconv.Itoa(g.vars)
+		g.printf("%s := stick.NewOrderedMap()\n", m)
+		for _, el := range exp.Elements {
+			var key string
+			if k, ok := el.Key.(*parse.NameExpr); ok {
+				key = strconv.Quote(k.Name)
+			} else {
+				key = "stick.CoerceString(" + g.expr(el.Key) + ")"
+			}
+			g.printf("%s.Set(%s, %s)\n", m, key, g.expr(el.Value))
+		}
+		return g.temp("%s", m)
+	case *parse.ArrayExpr:
+		vals := make([]string, len(exp.Elements))
+		for i, el := range exp.Elements {
+			vals[i] = g.expr(el)
+		}
+		return g.temp("[]stick.Value{%s}", strings.Join(vals, ", "))
+	default:
+		g.unsupported(exp, nodeName(exp))
+	}
+	return "nil"
+}
+
+func (g *generator) binaryExpr(exp *parse.BinaryExpr) string {
+	if _, ok := g.env.Operators[exp.Op]; ok {
+		g.unsupported(exp, "operator "+exp.Op)
+		return "nil"
+	}
+	l := g.expr(exp.Left)
+	if exp.Op == parse.OpBinaryIs || exp.Op == parse.OpBinaryIsNot {
+		t, ok := exp.Right.(*parse.TestExpr)
+		if !ok {
+			g.unsupported(exp, "operator "+exp.Op)
+			return "nil"
+		}
+		if _, user := g.env.Tests[t.Name]; !user && t.Name == "defined" {
+			g.unsupported(exp, "test defined")
+			return "nil"
+		}
+		args := g.args(t.Args)
+		v := g.call("s.Test(%s)", strings.Join(append([]string{strconv.Quote(t.Name), l}, args...), ", "))
+		if exp.Op == parse.OpBinaryIsNot {
+			return g.temp("!%s.(bool)", v)
+		}
+		return v
+	}
+	r := g.expr(exp.Right)
+	switch exp.Op {
+	case parse.OpBinaryIn:
+		return g.call("compile.In(%s, %s)", l, r)
+	case parse.OpBinaryNotIn:
+		v := g.call("compile.In(%s, %s)", l, r)
+		return g.temp("!%s.(bool)", v)
+	case parse.OpBinaryMatches:
+		return g.call("compile.Matches(%s, %s)", l, r)
+	case parse.OpBinaryModulo:
+		return g.call("compile.Mod(%s, %s)", l, r)
+	}
+	op, ok := binaryOps[exp.Op]
+	if !ok {
+		g.unsupported(exp, "operator "+exp.Op)
+		return "nil"
+	}
+	if strings.Contains(op, "strings.") {
+		g.imports["strings"] = true
+	}
+	return g.temp(op, l, r)
+}
+
+// args generates statements that evaluate the arguments of a call.
+func (g *generator) args(exprs []parse.Expr) []string {
+	res := make([]string, len(exprs))
+	for i, e := range exprs {
+		if _, ok := e.(*parse.NamedArgExpr); ok {
+			g.unsupported(e, "named arguments")
+			return nil
+		}
+		res[i] = g.expr(e)
+	}
+	return res
+}
+
+// nodeName returns a description of node's type, such as "BlockNode".
+func nodeName(node parse.Node) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*parse.")
+}
@@ -0,0 +1,271 @@
+package compile_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/compile"
+	"github.com/tyler-sommer/stick/compile/internal/compiled"
+	"github.com/tyler-sommer/stick/twig"
+)
+
+var update = flag.Bool("update", false, "update the generated test templates")
+
+// generated is the file containing the templates in testdata, compiled.
+var generated = filepath.Join("internal", "compiled", "templates_gen.go")
+
+// generatedTypes is the file containing the types for the templates in
+// testdata.
+var generatedTypes = filepath.Join("internal", "compiled", "types_gen.go")
+
+var templates = []string{"basic.html.twig", "plain.txt.twig", "child.html.twig"}
+
+func newEnv() *stick.Env {
+	env := twig.New(stick.NewFilesystemLoader("testdata"))
+	env.Tests["even"] = func(ctx stick.Context, val stick.Value, args ...stick.Value) bool {
+		return int(stick.CoerceNumber(val))%2 == 0
+	}
+	env.Functions["greeting"] = func(ctx stick.Context, args ...stick.Value) stick.Value {
+		return "Hi from " + ctx.Name()
+	}
+	return env
+}
+
+func TestGenerate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	errs := compile.Generate(buf, newEnv(), "compiled", templates...)
+	var uerr *compile.UnsupportedError
+	if len(errs) != 1 || !errors.As(errs[0], &uerr) || uerr.Template != "child.html.twig" || uerr.Feature != "extends" {
+		t.Errorf("expected child.html.twig to be unsupported, got %v", errs)
+	}
+	if *update {
+		if err := ioutil.WriteFile(generated, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("generated source differs from %s; run go test with -update", generated)
+	}
+}
+
+func TestGenerateContextualEscaping(t *testing.T) {
+	env := newEnv()
+	env.ContextualEscaping = true
+	buf := &bytes.Buffer{}
+	if errs := compile.Generate(buf, env, "compiled", "basic.html.twig"); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !strings.Contains(buf.String(), `s.PrintWith(`) || !strings.Contains(buf.String(), `"html_attr")`) {
+		t.Errorf("expected the class attribute to be escaped with html_attr, got:\n%s", buf.String())
+	}
+}
+
+func TestSetExecute(t *testing.T) {
+	ctx := map[string]stick.Value{
+		"title": "Cart",
+		"name":  "World",
+		"html":  "<b>",
+		"user":  map[string]stick.Value{"name": "<Tyler>", "email": "tyler@example.com"},
+		"items": []map[string]stick.Value{
+			{"name": "Apple", "price": 2},
+			{"name": "Pear", "price": 4},
+			{"name": "Fig", "price": 6},
+		},
+	}
+	env := newEnv()
+	for _, name := range templates {
+		expected, err := env.ExecuteToString(name, ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := compiled.Templates.Execute(env, name, buf, ctx); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if actual := buf.String(); actual != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, actual)
+		}
+	}
+	if _, ok := compiled.Templates["child.html.twig"]; ok {
+		t.Errorf("expected child.html.twig not to be compiled")
+	}
+}
+
+func TestSetExecuteOutput(t *testing.T) {
+	set := compile.Set{
+		"hi.twig": func(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {
+			_, err := io.WriteString(out, "  hi  ")
+			return err
+		},
+		"fail.twig": func(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {
+			io.WriteString(out, "partial")
+			return errors.New("failed")
+		},
+	}
+	env := newEnv()
+	env.OutputFilter = func(name string, out []byte) ([]byte, error) {
+		return append(bytes.ToUpper(bytes.TrimSpace(out)), '!'), nil
+	}
+	buf := &bytes.Buffer{}
+	if err := set.Execute(env, "hi.twig", buf, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if expected := "HI!"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	env.UseOutputMiddleware(func(next io.Writer) io.Writer {
+		io.WriteString(next, "<")
+		return next
+	})
+	buf.Reset()
+	if err := set.Execute(env, "hi.twig", buf, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if expected := "<HI!"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	env = newEnv()
+	env.AtomicOutput = true
+	buf.Reset()
+	if err := set.Execute(env, "fail.twig", buf, nil); err == nil {
+		t.Errorf("expected an error")
+	} else if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
+
+func TestSetExecuteUnsupported(t *testing.T) {
+	// With no Loader, the Env executes the name of the template as its
+	// source, so the output shows whether the compiled template was used.
+	set := compile.Set{
+		"source": func(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {
+			_, err := io.WriteString(out, "compiled")
+			return err
+		},
+	}
+	tests := map[string]func(env *stick.Env){
+		"default":        func(env *stick.Env) {},
+		"UndefinedMode":  func(env *stick.Env) { env.UndefinedMode = stick.LenientUndefined },
+		"SecurityPolicy": func(env *stick.Env) { env.SecurityPolicy = &stick.AllowListPolicy{} },
+		"StrictTypes":    func(env *stick.Env) { env.StrictTypes = true },
+		"AttrResolver": func(env *stick.Env) {
+			env.AttrResolver = func(val stick.Value, name string) (stick.Value, bool, error) { return nil, false, nil }
+		},
+	}
+	for name, configure := range tests {
+		env := stick.New(nil)
+		configure(env)
+		expected := "source"
+		if name == "default" {
+			expected = "compiled"
+		}
+		buf := &bytes.Buffer{}
+		if err := set.Execute(env, "source", buf, nil); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if buf.String() != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, buf.String())
+		}
+	}
+}
+
+func TestStateCall(t *testing.T) {
+	s := compile.NewState(newEnv(), "page.html.twig", ioutil.Discard, map[string]stick.Value{
+		"shout": stick.CallableFunc(func(ctx stick.Context, args ...stick.Value) (stick.Value, error) {
+			return strings.ToUpper(stick.CoerceString(args[0])) + " in " + ctx.Name(), nil
+		}),
+		"greeting": stick.CallableFunc(func(ctx stick.Context, args ...stick.Value) (stick.Value, error) {
+			return "shadowed", nil
+		}),
+	})
+	tests := map[string]string{
+		"shout":    "HI in page.html.twig",
+		"greeting": "Hi from page.html.twig",
+	}
+	for name, expected := range tests {
+		actual, err := s.Call(name, "hi")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestGenerateTypes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if errs := compile.GenerateTypes(buf, newEnv(), "compiled", templates...); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if *update {
+		if err := ioutil.WriteFile(generatedTypes, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(generatedTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("generated source differs from %s; run go test with -update", generatedTypes)
+	}
+	if errs := compile.GenerateTypes(ioutil.Discard, newEnv(), "compiled", "missing.twig"); len(errs) != 1 {
+		t.Errorf("expected an error for a missing template, got %v", errs)
+	}
+}
+
+func TestExecuteTyped(t *testing.T) {
+	env := newEnv()
+	ctx := compiled.BasicHTML{
+		Title: "Cart",
+		HTML:  "<b>",
+		User:  compiled.BasicHTMLUser{Name: "<Tyler>", Email: "tyler@example.com"},
+		Items: []stick.Value{
+			map[string]stick.Value{"name": "Apple", "price": 2},
+			map[string]stick.Value{"name": "Pear", "price": 4},
+		},
+	}
+	expected, err := env.ExecuteToString("basic.html.twig", ctx.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := env.ExecuteTyped(buf, ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if !strings.Contains(expected, "<p>&lt;b&gt; <b> &lt;Tyler&gt; tyler@example.com!</p>") {
+		t.Errorf("unexpected output %q", expected)
+	}
+}
+
+func TestGenerateTypesInference(t *testing.T) {
+	env := stick.New(stick.NewMemoryLoader(map[string]string{
+		"page.twig": "{% if show %}{{ count + 1 }}{% endif %}{% for p in posts %}{{ p }}{% endfor %}{{ a.b.c }}{{ a.b.d * 2 }}{{ mixed }}{% for x in mixed %}{% endfor %}{{ a_b_id ~ '' }}",
+	}))
+	buf := &bytes.Buffer{}
+	if errs := compile.GenerateTypes(buf, env, "views", "page.twig"); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, expected := range []string{
+		"type Page struct {\n\tA     PageA\n\tABID  string\n\tCount float64\n\tMixed stick.Value\n\tPosts []stick.Value\n\tShow  bool\n}",
+		"type PageAB struct {\n\tC string\n\tD float64\n}",
+		`"b": v.B.Context(),`,
+		`func (Page) TemplateName() string`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Code generated by stick compile. DO NOT EDIT.
+
+package compiled
+
+import (
+	"io"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/compile"
+)
+
+// Templates contains the compiled templates, keyed by name.
+var Templates = compile.Set{
+	"basic.html.twig": template0,
+	"plain.txt.twig":  template1,
+}
+
+// template0 is compiled from "basic.html.twig".
+func template0(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {
+	s := compile.NewState(env, "basic.html.twig", out, ctx)
+	if err := s.Write("<h1>"); err != nil {
+		return err
+	}
+	var v1 stick.Value = s.Get("title")
+	v2, err := s.Filter("upper", v1)
+	if err != nil {
+		return err
+	}
+	if err := s.Print(v2); err != nil {
+		return err
+	}
+	if err := s.Write("</h1>\n"); err != nil {
+		return err
+	}
+	if err := s.Write("\n<p>"); err != nil {
+		return err
+	}
+	var v3 stick.Value = s.Get("html")
+	if err := s.Print(v3); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v4 stick.Value = s.Get("html")
+	v5, err := s.Filter("raw", v4)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(stick.CoerceString(v5)); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v6 stick.Value = s.Get("user")
+	v7, err := s.Attr(v6, "name")
+	if err != nil {
+		return err
+	}
+	if err := s.Print(v7); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v8 stick.Value = s.Get("user")
+	v9, err := s.Attr(v8, "email")
+	if err != nil {
+		return err
+	}
+	var v10 stick.Value = stick.CoerceString(v9) + stick.CoerceString("!")
+	if err := s.Print(v10); err != nil {
+		return err
+	}
+	if err := s.Write("</p>\n"); err != nil {
+		return err
+	}
+	s.Set("total", float64(0))
+	if err := s.Write("\n<ul>\n"); err != nil {
+		return err
+	}
+	var v11 stick.Value = s.Get("items")
+	n12, err := stick.Iterate(v11, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		s.Push()
+		defer s.Pop()
+		s.SetLocal("i", k)
+		s.SetLocal("item", v)
+		s.SetLoop(l)
+		if err := s.Write("\n  "); err != nil {
+			return true, err
+		}
+		var v13 stick.Value = s.Get("total")
+		var v14 stick.Value = s.Get("item")
+		v15, err := s.Attr(v14, "price")
+		if err != nil {
+			return true, err
+		}
+		var v16 stick.Value = stick.Add(v13, v15)
+		s.Set("total", v16)
+		if err := s.Write("\n  <li class=\""); err != nil {
+			return true, err
+		}
+		var v17 stick.Value = s.Get("loop")
+		v18, err := s.Attr(v17, "first")
+		if err != nil {
+			return true, err
+		}
+		var v19 stick.Value
+		if stick.CoerceBool(v18) {
+			v19 = "first"
+		} else {
+			var v20 stick.Value = s.Get("loop")
+			v21, err := s.Attr(v20, "last")
+			if err != nil {
+				return true, err
+			}
+			var v22 stick.Value
+			if stick.CoerceBool(v21) {
+				v22 = "last"
+			} else {
+				v22 = "middle"
+			}
+			v19 = v22
+		}
+		if err := s.Print(v19); err != nil {
+			return true, err
+		}
+		if err := s.Write("\">"); err != nil {
+			return true, err
+		}
+		var v23 stick.Value = s.Get("loop")
+		v24, err := s.Attr(v23, "index")
+		if err != nil {
+			return true, err
+		}
+		if err := s.Print(v24); err != nil {
+			return true, err
+		}
+		if err := s.Write("/"); err != nil {
+			return true, err
+		}
+		var v25 stick.Value = s.Get("loop")
+		v26, err := s.Attr(v25, "length")
+		if err != nil {
+			return true, err
+		}
+		if err := s.Print(v26); err != nil {
+			return true, err
+		}
+		if err := s.Write(": "); err != nil {
+			return true, err
+		}
+		var v27 stick.Value = s.Get("item")
+		v28, err := s.Attr(v27, "name")
+		if err != nil {
+			return true, err
+		}
+		if err := s.Print(v28); err != nil {
+			return true, err
+		}
+		if err := s.Write(" ("); err != nil {
+			return true, err
+		}
+		var v29 stick.Value = s.Get("item")
+		v30, err := s.Attr(v29, "price")
+		if err != nil {
+			return true, err
+		}
+		var v31 stick.Value = stick.Mul(v30, float64(2))
+		if err := s.Print(v31); err != nil {
+			return true, err
+		}
+		if err := s.Write(")</li>\n"); err != nil {
+			return true, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if n12 == 0 {
+		if err := s.Write("\n  <li>No items</li>\n"); err != nil {
+			return err
+		}
+	}
+	if err := s.Write("\n</ul>\n<p>Total: "); err != nil {
+		return err
+	}
+	var v32 stick.Value = s.Get("total")
+	if err := s.Print(v32); err != nil {
+		return err
+	}
+	if err := s.Write("</p>\n"); err != nil {
+		return err
+	}
+	var v33 stick.Value = s.Get("total")
+	var v34 stick.Value = compile.Compare(v33, float64(10)) == 1
+	var v35 stick.Value = []stick.Value{"a", "b"}
+	v36, err := compile.In("b", v35)
+	if err != nil {
+		return err
+	}
+	var v37 stick.Value = stick.CoerceBool(v34) && stick.CoerceBool(v36)
+	if stick.CoerceBool(v37) {
+		if err := s.Write("\n  <p>Expensive"); err != nil {
+			return err
+		}
+		var v38 stick.Value = s.Get("total")
+		v39, err := s.Test("even", v38)
+		if err != nil {
+			return err
+		}
+		var v40 stick.Value
+		if stick.CoerceBool(v39) {
+			v40 = ", even"
+		} else {
+			v40 = ""
+		}
+		if err := s.Print(v40); err != nil {
+			return err
+		}
+		if err := s.Write("</p>\n"); err != nil {
+			return err
+		}
+	} else {
+		var v41 stick.Value = s.Get("total")
+		var v42 stick.Value = stick.Equal(v41, float64(0))
+		if stick.CoerceBool(v42) {
+			if err := s.Write("\n  <p>Free</p>\n"); err != nil {
+				return err
+			}
+		} else {
+			if err := s.Write("\n  <p>Cheap</p>\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.Write("\n"); err != nil {
+		return err
+	}
+	var v43 stick.Value = compile.Range(float64(1), float64(3))
+	n44, err := stick.Iterate(v43, func(_, v stick.Value, l stick.Loop) (bool, error) {
+		s.Push()
+		defer s.Pop()
+		s.SetLocal("n", v)
+		s.SetLoop(l)
+		var v45 stick.Value = s.Get("n")
+		if err := s.Print(v45); err != nil {
+			return true, err
+		}
+		var v46 stick.Value = s.Get("loop")
+		v47, err := s.Attr(v46, "last")
+		if err != nil {
+			return true, err
+		}
+		var v48 stick.Value = !stick.CoerceBool(v47)
+		if stick.CoerceBool(v48) {
+			if err := s.Write(","); err != nil {
+				return true, err
+			}
+		} else {
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if n44 == 0 {
+	}
+	if err := s.Write("\n"); err != nil {
+		return err
+	}
+	m49 := stick.NewOrderedMap()
+	m49.Set(stick.CoerceString("a"), float64(1))
+	m49.Set(stick.CoerceString("b"), float64(2))
+	var v50 stick.Value = m49
+	v51, err := s.Filter("json_encode", v50)
+	if err != nil {
+		return err
+	}
+	v52, err := s.Filter("raw", v51)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(stick.CoerceString(v52)); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v53 stick.Value = compile.FloorDiv(float64(7), float64(2))
+	if err := s.Print(v53); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v54 stick.Value = s.Get("total")
+	var v55 stick.Value = -stick.CoerceNumber(v54)
+	if err := s.Print(v55); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v56 stick.Value = compile.Pow(float64(2), float64(3))
+	if err := s.Print(v56); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v57 stick.Value = strings.HasPrefix(stick.CoerceString("abc"), stick.CoerceString("a"))
+	if err := s.Print(v57); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	v58, err := s.Call("greeting")
+	if err != nil {
+		return err
+	}
+	if err := s.Print(v58); err != nil {
+		return err
+	}
+	if err := s.Write("\n"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// template1 is compiled from "plain.txt.twig".
+func template1(env *stick.Env, out io.Writer, ctx map[string]stick.Value) error {
+	s := compile.NewState(env, "plain.txt.twig", out, ctx)
+	if err := s.Write("Hello, "); err != nil {
+		return err
+	}
+	var v1 stick.Value = s.Get("name")
+	if err := s.Print(v1); err != nil {
+		return err
+	}
+	if err := s.Write("! "); err != nil {
+		return err
+	}
+	var v2 stick.Value = s.Get("html")
+	if err := s.Print(v2); err != nil {
+		return err
+	}
+	if err := s.Write(" "); err != nil {
+		return err
+	}
+	var v3 stick.Value = s.Get("missing")
+	n4, err := stick.Iterate(v3, func(_, v stick.Value, l stick.Loop) (bool, error) {
+		s.Push()
+		defer s.Pop()
+		s.SetLocal("c", v)
+		s.SetLoop(l)
+		if err := s.Write("never"); err != nil {
+			return true, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if n4 == 0 {
+		if err := s.Write("empty"); err != nil {
+			return err
+		}
+	}
+	if err := s.Write("\n"); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Code generated by stick types. DO NOT EDIT.
+
+package compiled
+
+import "github.com/tyler-sommer/stick"
+
+// BasicHTML contains the variables required by the template "basic.html.twig".
+type BasicHTML struct {
+	HTML  string
+	Items []stick.Value
+	Title stick.Value
+	User  BasicHTMLUser
+}
+
+// Context returns the fields of v, keyed by the names used in the template.
+func (v BasicHTML) Context() map[string]stick.Value {
+	return map[string]stick.Value{
+		"html":  v.HTML,
+		"items": v.Items,
+		"title": v.Title,
+		"user":  v.User.Context(),
+	}
+}
+
+// TemplateName returns "basic.html.twig".
+func (BasicHTML) TemplateName() string {
+	return "basic.html.twig"
+}
+
+// BasicHTMLUser contains the attributes of "user" read by the template "basic.html.twig".
+type BasicHTMLUser struct {
+	Email string
+	Name  string
+}
+
+// Context returns the fields of v, keyed by the names used in the template.
+func (v BasicHTMLUser) Context() map[string]stick.Value {
+	return map[string]stick.Value{
+		"email": v.Email,
+		"name":  v.Name,
+	}
+}
+
+// PlainTxt contains the variables required by the template "plain.txt.twig".
+type PlainTxt struct {
+	HTML    string
+	Missing []stick.Value
+	Name    string
+}
+
+// Context returns the fields of v, keyed by the names used in the template.
+func (v PlainTxt) Context() map[string]stick.Value {
+	return map[string]stick.Value{
+		"html":    v.HTML,
+		"missing": v.Missing,
+		"name":    v.Name,
+	}
+}
+
+// TemplateName returns "plain.txt.twig".
+func (PlainTxt) TemplateName() string {
+	return "plain.txt.twig"
+}
+
+// ChildHTML contains the variables required by the template "child.html.twig".
+type ChildHTML struct {
+	HTML    string
+	Missing []stick.Value
+	Name    string
+}
+
+// Context returns the fields of v, keyed by the names used in the template.
+func (v ChildHTML) Context() map[string]stick.Value {
+	return map[string]stick.Value{
+		"html":    v.HTML,
+		"missing": v.Missing,
+		"name":    v.Name,
+	}
+}
+
+// TemplateName returns "child.html.twig".
+func (ChildHTML) TemplateName() string {
+	return "child.html.twig"
+}
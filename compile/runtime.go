@@ -0,0 +1,210 @@
+package compile
+
+import (
+	"errors"
+	"io"
+	"math"
+	"regexp"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// A State holds the variables and output of a compiled template while it
+// is executed. It is used by generated code.
+type State struct {
+	env    *stick.Env
+	name   string
+	out    io.Writer
+	scopes []map[string]stick.Value
+}
+
+// NewState returns a State for executing the named template. The values in
+// ctx are copied into the root scope.
+func NewState(env *stick.Env, name string, out io.Writer, ctx map[string]stick.Value) *State {
+	root := make(map[string]stick.Value, len(ctx))
+	for k, v := range ctx {
+		root[k] = v
+	}
+	return &State{env, name, out, []map[string]stick.Value{root}}
+}
+
+// Push adds a scope on top of the stack.
+func (s *State) Push() {
+	s.scopes = append(s.scopes, make(map[string]stick.Value))
+}
+
+// Pop removes the top-most scope.
+func (s *State) Pop() {
+	s.scopes = s.scopes[:len(s.scopes)-1]
+}
+
+// Get returns the value of the named variable, or the Env's global with the
+// same name. Undefined variables are nil.
+func (s *State) Get(name string) stick.Value {
+	for i := len(s.scopes) - 1; i >= 0; i-- {
+		if v, ok := s.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return s.env.Globals[name]
+}
+
+// Set sets the named variable in the scope it was defined in, otherwise in
+// the top-most scope.
+func (s *State) Set(name string, val stick.Value) {
+	for _, scope := range s.scopes {
+		if _, ok := scope[name]; ok {
+			scope[name] = val
+			return
+		}
+	}
+	s.SetLocal(name, val)
+}
+
+// SetLocal sets the named variable in the top-most scope.
+func (s *State) SetLocal(name string, val stick.Value) {
+	s.scopes[len(s.scopes)-1][name] = val
+}
+
+// SetLoop sets the "loop" variable in the top-most scope, describing the
+// current iteration of a for loop.
+func (s *State) SetLoop(l stick.Loop) {
+	loop := map[string]stick.Value{
+		"Last":      l.Last,
+		"Index":     l.Index,
+		"Index0":    l.Index0,
+		"last":      l.Last,
+		"index":     l.Index,
+		"index0":    l.Index0,
+		"revindex":  l.Revindex,
+		"revindex0": l.Revindex0,
+		"first":     l.First,
+		"length":    l.Length,
+	}
+	for i := len(s.scopes) - 2; i >= 0; i-- {
+		if parent, ok := s.scopes[i]["loop"]; ok {
+			loop["parent"] = parent
+			break
+		}
+	}
+	s.SetLocal("loop", loop)
+}
+
+// Write writes str to the output, unescaped.
+func (s *State) Write(str string) error {
+	_, err := io.WriteString(s.out, str)
+	return err
+}
+
+// Print writes val to the output, escaped according to the template's
+// escaping strategy.
+func (s *State) Print(val stick.Value) error {
+	return s.Write(s.env.Escape(s.name, val))
+}
+
+// PrintWith writes val to the output, escaped using the given strategy.
+func (s *State) PrintWith(val stick.Value, strategy string) error {
+	return s.Write(s.env.EscapeWith(strategy, val))
+}
+
+// Filter applies the named filter to val.
+func (s *State) Filter(name string, val stick.Value, args ...stick.Value) (stick.Value, error) {
+	return s.env.ApplyFilter(s.name, name, val, args...)
+}
+
+// Call calls the named function, or the variable with that name if it
+// holds a stick.Callable.
+func (s *State) Call(name string, args ...stick.Value) (stick.Value, error) {
+	if _, ok := s.env.Functions[name]; !ok {
+		if fn, ok := s.Get(name).(stick.Callable); ok {
+			return s.env.CallValue(s.name, fn, args...)
+		}
+	}
+	return s.env.CallFunction(s.name, name, args...)
+}
+
+// Test applies the named test to val.
+func (s *State) Test(name string, val stick.Value, args ...stick.Value) (stick.Value, error) {
+	res, err := s.env.ApplyTest(s.name, name, val, args...)
+	return res, err
+}
+
+// Attr returns the named attribute of c, as read by the Env with
+// stick.Env.GetAttr. Attributes that cannot be read are nil.
+func (s *State) Attr(c, attr stick.Value, args ...stick.Value) (stick.Value, error) {
+	return s.env.GetAttr(c, attr, args...)
+}
+
+// Attr returns the named attribute of c. Attributes that cannot be read
+// are nil.
+func Attr(c, attr stick.Value, args ...stick.Value) stick.Value {
+	v, _ := stick.GetAttr(c, attr, args...)
+	return v
+}
+
+// uncomparable is returned by Compare when two values cannot be compared.
+const uncomparable = 2
+
+// Compare compares two values loosely, as with stick.Compare, except that
+// 2 is returned if the values cannot be compared.
+func Compare(left, right stick.Value) int {
+	c := stick.Compare(left, right)
+	if c == 1 && stick.Compare(right, left) == 1 {
+		return uncomparable
+	}
+	return c
+}
+
+// FloorDiv divides left by right, rounding down.
+func FloorDiv(left, right stick.Value) stick.Value {
+	return math.Floor(stick.CoerceNumber(left) / stick.CoerceNumber(right))
+}
+
+// Mod returns the remainder of dividing left by right, as integers. An
+// error is returned if right is zero.
+func Mod(left, right stick.Value) (stick.Value, error) {
+	r := int(stick.CoerceNumber(right))
+	if r == 0 {
+		return nil, errors.New("modulo by zero")
+	}
+	return float64(int(stick.CoerceNumber(left)) % r), nil
+}
+
+// Pow raises left to the power of right.
+func Pow(left, right stick.Value) stick.Value {
+	return math.Pow(stick.CoerceNumber(left), stick.CoerceNumber(right))
+}
+
+// Range returns the numbers from left to right, inclusive, counting down
+// if right is less than left.
+func Range(left, right stick.Value) stick.Value {
+	l, r := stick.CoerceNumber(left), stick.CoerceNumber(right)
+	n, step := r-l, 1.0
+	if n < 0 {
+		n, step = -n, -1
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return []float64{}
+	}
+	res := make([]float64, int(n)+1)
+	for i := range res {
+		res[i] = l + float64(i)*step
+	}
+	return res
+}
+
+// In returns true if haystack contains needle.
+func In(needle, haystack stick.Value) (stick.Value, error) {
+	res, err := stick.Contains(haystack, needle)
+	return res, err
+}
+
+// Matches returns true if the string representation of val matches the
+// regular expression pattern.
+func Matches(val, pattern stick.Value) (stick.Value, error) {
+	reg, err := regexp.Compile(stick.CoerceString(pattern))
+	if err != nil {
+		return nil, err
+	}
+	return reg.MatchString(stick.CoerceString(val)), nil
+}
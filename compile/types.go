@@ -0,0 +1,357 @@
+package compile
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// GenerateTypes writes Go source to w, in package pkg, declaring a struct
+// type for each of the named templates. Each struct has a field for every
+// variable that must be provided when executing the template, as reported
+// by Env.Variables, and implements stick.TypedContext, so that it can be
+// passed to Env.ExecuteTyped:
+//
+//	err := env.ExecuteTyped(w, templates.IndexHTML{
+//		Title: "Home",
+//		User:  templates.IndexHTMLUser{Name: name},
+//	})
+//
+// Types are named after their template, as in IndexHTML for
+// "index.html.twig". A variable whose attributes are read is given its own
+// struct type, with a field for each attribute. The type of any other field
+// is inferred from how the variable is used: iterated variables are
+// []stick.Value, operands of arithmetic are float64, printed or
+// concatenated variables are string, and conditions are bool. Variables
+// used in more than one of these ways, or in none, are stick.Value.
+//
+// An error is returned for each template that could not be analyzed, and
+// no type is generated for it. GenerateTypes returns nil if a type was
+// generated for every template.
+func GenerateTypes(w io.Writer, env *stick.Env, pkg string, names ...string) []error {
+	var errs []error
+	var types bytes.Buffer
+	taken := make(map[string]bool)
+	for _, name := range names {
+		vars, err := env.Variables(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		u := &usages{env: env, uses: make(map[string]usage), seen: make(map[string]bool)}
+		if err := u.template(name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		root := &field{children: make(map[string]*field)}
+		for _, v := range vars {
+			if v.Local {
+				continue
+			}
+			f := root.child(v.Name)
+			f.use = u.uses[v.Name]
+			for _, p := range v.Attrs {
+				c, key := f, v.Name
+				for _, attr := range strings.Split(p, ".") {
+					c, key = c.child(attr), key+"."+attr
+					c.use = u.uses[key]
+				}
+			}
+		}
+		typ := unique(taken, goName(strings.TrimSuffix(name, ".twig")))
+		fmt.Fprintf(&types, "\n// %s contains the variables required by the template %s.\n", typ, strconv.Quote(name))
+		nested := root.declare(&types, typ, name)
+		fmt.Fprintf(&types, "\n// TemplateName returns %s.\n", strconv.Quote(name))
+		fmt.Fprintf(&types, "func (%s) TemplateName() string {\nreturn %s\n}\n", typ, strconv.Quote(name))
+		types.Write(nested)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by stick types. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	if types.Len() > 0 {
+		buf.WriteString("import \"github.com/tyler-sommer/stick\"\n")
+	}
+	buf.Write(types.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return append(errs, err)
+	}
+	if _, err := w.Write(src); err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
+
+// A usage records the ways a variable or attribute is used.
+type usage int
+
+const (
+	useIterate usage = 1 << iota // Iterated by a for loop.
+	useNumber                    // An operand of arithmetic or a numeric comparison.
+	useString                    // Printed or concatenated.
+	useBool                      // Used as a condition.
+)
+
+// goType returns the Go type of a variable used as described by u.
+func (u usage) goType() string {
+	// Any value can be used as a condition.
+	switch u &^ useBool {
+	case useIterate:
+		return "[]stick.Value"
+	case useNumber, useNumber | useString:
+		// Numbers can also be printed.
+		return "float64"
+	case useString:
+		return "string"
+	case 0:
+		if u == useBool {
+			return "bool"
+		}
+	}
+	return "stick.Value"
+}
+
+// usages walks a template and the templates sharing its context, recording
+// how each variable and static attribute path, such as "user.name", is used.
+// Scoping is not considered, so the uses of a variable include those of any
+// local variable with the same name.
+type usages struct {
+	env  *stick.Env
+	uses map[string]usage
+	seen map[string]bool
+}
+
+func (u *usages) template(name string) error {
+	if u.seen[name] {
+		return nil
+	}
+	u.seen[name] = true
+	tree, err := u.env.Parse(name)
+	if err != nil {
+		return err
+	}
+	var refs []string
+	u.visit(tree.Root(), &refs)
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		if err := u.template(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark records that e is used as described by use, if e is a variable or
+// a static attribute path.
+func (u *usages) mark(e parse.Expr, use usage) {
+	if key := pathOf(e); key != "" {
+		u.uses[key] |= use
+	}
+}
+
+func (u *usages) visit(node parse.Node, refs *[]string) {
+	if node == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *parse.ModuleNode:
+		if n.Parent != nil {
+			*refs = append(*refs, staticName(n.Parent.Tpl))
+		}
+	case *parse.IncludeNode:
+		*refs = append(*refs, staticName(n.Tpl))
+	case *parse.EmbedNode:
+		*refs = append(*refs, staticName(n.Tpl))
+	case *parse.MacroNode:
+		// Macros have their own scope.
+		return
+	case *parse.PrintNode:
+		u.mark(n.X, useString)
+	case *parse.ForNode:
+		u.mark(n.X, useIterate)
+	case *parse.IfNode:
+		u.mark(n.Cond, useBool)
+	case *parse.TernaryIfExpr:
+		u.mark(n.Cond, useBool)
+	case *parse.UnaryExpr:
+		if n.Op == parse.OpUnaryNot {
+			u.mark(n.X, useBool)
+		} else {
+			u.mark(n.X, useNumber)
+		}
+	case *parse.BinaryExpr:
+		switch n.Op {
+		case parse.OpBinaryAnd, parse.OpBinaryOr:
+			u.mark(n.Left, useBool)
+			u.mark(n.Right, useBool)
+		case parse.OpBinaryConcat:
+			u.mark(n.Left, useString)
+			u.mark(n.Right, useString)
+		case parse.OpBinaryAdd, parse.OpBinarySubtract, parse.OpBinaryMultiply, parse.OpBinaryDivide,
+			parse.OpBinaryFloorDiv, parse.OpBinaryModulo, parse.OpBinaryPower, parse.OpBinaryRange:
+			u.mark(n.Left, useNumber)
+			u.mark(n.Right, useNumber)
+		case parse.OpBinaryLessThan, parse.OpBinaryLessEqual, parse.OpBinaryGreaterThan,
+			parse.OpBinaryGreaterEqual, parse.OpBinaryEqual, parse.OpBinaryNotEqual:
+			if _, ok := n.Right.(*parse.NumberExpr); ok {
+				u.mark(n.Left, useNumber)
+			}
+			if _, ok := n.Left.(*parse.NumberExpr); ok {
+				u.mark(n.Right, useNumber)
+			}
+		}
+	}
+	for _, c := range node.All() {
+		u.visit(c, refs)
+	}
+}
+
+// staticName returns the template name given by tpl, if it is a string
+// literal.
+func staticName(tpl parse.Expr) string {
+	if s, ok := tpl.(*parse.StringExpr); ok {
+		return s.Text
+	}
+	return ""
+}
+
+// pathOf returns the variable or static attribute path read by e, such as
+// "user.name", or an empty string if e is any other expression.
+func pathOf(e parse.Expr) string {
+	switch e := e.(type) {
+	case *parse.NameExpr:
+		return e.Name
+	case *parse.GetAttrExpr:
+		attr, ok := e.Attr.(*parse.StringExpr)
+		if !ok || len(e.Args) > 0 {
+			return ""
+		}
+		if base := pathOf(e.Cont); base != "" {
+			return base + "." + attr.Text
+		}
+	}
+	return ""
+}
+
+// A field is a variable or attribute in a generated type.
+type field struct {
+	use      usage
+	children map[string]*field // Attributes read, by name.
+}
+
+func (f *field) child(name string) *field {
+	c, ok := f.children[name]
+	if !ok {
+		c = &field{children: make(map[string]*field)}
+		f.children[name] = c
+	}
+	return c
+}
+
+// structured returns true if f is given its own struct type.
+func (f *field) structured() bool {
+	if len(f.children) == 0 || f.use&^useBool != 0 {
+		return false
+	}
+	for name := range f.children {
+		if !isIdent(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// declare writes the struct type typ, containing the children of f, with a
+// Context method. The declarations of the types of any structured children
+// are returned.
+func (f *field) declare(w *bytes.Buffer, typ, tpl string) []byte {
+	names := make([]string, 0, len(f.children))
+	for name := range f.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	goNames := make([]string, len(names))
+	taken := make(map[string]bool)
+	var body, ctx, nested bytes.Buffer
+	for i, name := range names {
+		c := f.children[name]
+		goNames[i] = unique(taken, goName(name))
+		if c.structured() {
+			sub := typ + goNames[i]
+			fmt.Fprintf(&body, "%s %s\n", goNames[i], sub)
+			fmt.Fprintf(&ctx, "%s: v.%s.Context(),\n", strconv.Quote(name), goNames[i])
+			fmt.Fprintf(&nested, "\n// %s contains the attributes of %s read by the template %s.\n", sub, strconv.Quote(name), strconv.Quote(tpl))
+			nested.Write(c.declare(&nested, sub, tpl))
+			continue
+		}
+		fmt.Fprintf(&body, "%s %s\n", goNames[i], c.use.goType())
+		fmt.Fprintf(&ctx, "%s: v.%s,\n", strconv.Quote(name), goNames[i])
+	}
+	fmt.Fprintf(w, "type %s struct {\n%s}\n", typ, body.String())
+	fmt.Fprintf(w, "\n// Context returns the fields of v, keyed by the names used in the template.\n")
+	fmt.Fprintf(w, "func (v %s) Context() map[string]stick.Value {\nreturn map[string]stick.Value{\n%s}\n}\n", typ, ctx.String())
+	return nested.Bytes()
+}
+
+// initialisms are written in upper case when part of a Go name.
+var initialisms = map[string]bool{
+	"api": true, "css": true, "csv": true, "html": true, "http": true, "id": true,
+	"ip": true, "js": true, "json": true, "rss": true, "sql": true, "svg": true,
+	"uri": true, "url": true, "uuid": true, "xml": true,
+}
+
+// goName returns an exported Go identifier for s, such as UserName for
+// "user_name" or IndexHTML for "index.html".
+func goName(s string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if initialisms[strings.ToLower(word)] {
+			b.WriteString(strings.ToUpper(word))
+			continue
+		}
+		r := []rune(word)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+	res := b.String()
+	if res == "" || !unicode.IsLetter([]rune(res)[0]) {
+		res = "T" + res
+	}
+	return res
+}
+
+// unique returns name, or name with a number appended if it is already
+// in taken, and adds the result to taken.
+func unique(taken map[string]bool, name string) string {
+	res := name
+	for i := 2; taken[res]; i++ {
+		res = name + strconv.Itoa(i)
+	}
+	taken[res] = true
+	return res
+}
+
+// isIdent returns true if s is a valid identifier, and so can be made into
+// a field name.
+func isIdent(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,470 @@
+package stick
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An htmlState is the part of an HTML document being read.
+type htmlState uint8
+
+const (
+	stateText        htmlState = iota // Element content.
+	stateRCDATA                       // Content of a title or textarea element.
+	stateScript                       // Content of a script element.
+	stateStyle                        // Content of a style element.
+	stateComment                      // An HTML comment.
+	stateTagName                      // The name of a tag.
+	stateTag                          // Inside a tag, between attributes.
+	stateAttrName                     // The name of an attribute.
+	stateAfterName                    // After an attribute name, before any "=".
+	stateBeforeValue                  // After "=", before an attribute value.
+	stateAttr                         // An attribute value.
+)
+
+// An attrKind describes how an attribute value is interpreted.
+type attrKind uint8
+
+const (
+	attrNormal  attrKind = iota // Plain text.
+	attrURL                     // A URL, as in href.
+	attrJS                      // JavaScript, as in onclick.
+	attrCSS                     // CSS, as in style.
+	attrUnknown                 // The attribute's name is printed.
+)
+
+// A urlPart is the part of a URL being read.
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota // Nothing has been read.
+	urlPath                 // The scheme, host or path.
+	urlQuery                // The query or fragment.
+)
+
+// htmlURLAttrs are the attributes whose values are URLs.
+var htmlURLAttrs = map[string]bool{
+	"action": true, "background": true, "cite": true, "codebase": true,
+	"data": true, "formaction": true, "href": true, "icon": true,
+	"longdesc": true, "manifest": true, "ping": true, "poster": true,
+	"src": true, "srcset": true, "usemap": true, "xlink:href": true,
+}
+
+// An htmlContext describes the position in an HTML document reached after
+// reading some text. It is comparable, so that the contexts reached by
+// different branches of a template can be checked to be the same.
+type htmlContext struct {
+	state   htmlState
+	name    string   // The tag or attribute name being read, in lower case.
+	elem    string   // The name of the element whose tag or content is being read.
+	closing bool     // Whether the tag being read is an end tag.
+	attr    attrKind // The kind of attribute whose value is being read.
+	delim   byte     // The quote delimiting the attribute value, or 0 if unquoted.
+	url     urlPart  // The part of a URL attribute value being read.
+	jsQuote byte     // The quote delimiting the JavaScript string being read, or 0.
+	jsLine  bool     // Whether a JavaScript line comment is being read.
+	jsBlock bool     // Whether a JavaScript block comment is being read.
+}
+
+// strategy returns the escaping strategy for a value printed in c, and the
+// context following it. If no strategy is safe, the reason is returned.
+func (c htmlContext) strategy() (string, htmlContext, string) {
+	switch c.state {
+	case stateText, stateRCDATA, stateComment:
+		return "html", c, ""
+	case stateStyle:
+		return "css", c, ""
+	case stateScript:
+		return c.js()
+	case stateTagName, stateAfterName:
+		return "html_attr", c, ""
+	case stateTag, stateAttrName:
+		c.state, c.name, c.attr = stateAttrName, "", attrUnknown
+		return "html_attr", c, ""
+	case stateBeforeValue:
+		c.state, c.delim = stateAttr, 0
+	}
+	switch c.attr {
+	case attrURL:
+		if c.url == urlStart {
+			c.url = urlPath
+			return "html_url", c, ""
+		}
+		return "url", c, ""
+	case attrJS:
+		return c.js()
+	case attrCSS:
+		return "css", c, ""
+	case attrUnknown:
+		return "", c, "cannot print the value of an attribute whose name is printed"
+	}
+	return "html_attr", c, ""
+}
+
+// js returns the escaping strategy for a value printed in JavaScript.
+func (c htmlContext) js() (string, htmlContext, string) {
+	if c.jsQuote == 0 && !c.jsLine && !c.jsBlock {
+		return "", c, "cannot print a value in JavaScript outside of a string literal"
+	}
+	return "js", c, ""
+}
+
+// text returns the context reached by reading s in c.
+func (c htmlContext) text(s string) htmlContext {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch c.state {
+		case stateText:
+			switch {
+			case strings.HasPrefix(s[i:], "<!--"):
+				c.state = stateComment
+				i += 3
+			case strings.HasPrefix(s[i:], "<!"), strings.HasPrefix(s[i:], "<?"):
+				c.state, c.elem, c.closing = stateTag, "", true
+			case ch == '<' && i+1 < len(s) && isASCIILetter(s[i+1]):
+				c.state, c.name, c.closing = stateTagName, "", false
+			case strings.HasPrefix(s[i:], "</") && i+2 < len(s) && isASCIILetter(s[i+2]):
+				c.state, c.name, c.closing = stateTagName, "", true
+				i++
+			}
+		case stateRCDATA, stateScript, stateStyle:
+			if end := "</" + c.elem; len(s)-i >= len(end) && strings.EqualFold(s[i:i+len(end)], end) {
+				c = htmlContext{state: stateTagName, name: c.elem, closing: true}
+				i += len(end) - 1
+			} else if c.state == stateScript {
+				c, i = c.jsChar(s, i)
+			}
+		case stateComment:
+			if strings.HasPrefix(s[i:], "-->") {
+				c.state = stateText
+				i += 2
+			}
+		case stateTagName:
+			switch {
+			case ch == '>':
+				c = c.endTag(c.name)
+			case isSpace(ch) || ch == '/':
+				c.state, c.elem = stateTag, c.name
+			default:
+				c.name += strings.ToLower(string(ch))
+			}
+		case stateTag:
+			switch {
+			case ch == '>':
+				c = c.endTag(c.elem)
+			case !isSpace(ch) && ch != '/':
+				c.state, c.name, c.attr = stateAttrName, strings.ToLower(string(ch)), attrNormal
+			}
+		case stateAttrName:
+			switch {
+			case ch == '>':
+				c = c.endTag(c.elem)
+			case ch == '=':
+				c = c.beforeValue()
+			case isSpace(ch):
+				c.state = stateAfterName
+			case ch == '/':
+				c.state = stateTag
+			default:
+				if c.attr != attrUnknown {
+					c.name += strings.ToLower(string(ch))
+				}
+			}
+		case stateAfterName:
+			switch {
+			case ch == '>':
+				c = c.endTag(c.elem)
+			case ch == '=':
+				c = c.beforeValue()
+			case ch == '/':
+				c.state = stateTag
+			case !isSpace(ch):
+				c.state, c.name, c.attr = stateAttrName, strings.ToLower(string(ch)), attrNormal
+			}
+		case stateBeforeValue:
+			switch {
+			case ch == '>':
+				c = c.endTag(c.elem)
+			case ch == '"' || ch == '\'':
+				c.state, c.delim = stateAttr, ch
+			case !isSpace(ch):
+				c.state, c.delim = stateAttr, 0
+				i--
+			}
+		case stateAttr:
+			switch {
+			case c.delim != 0 && ch == c.delim, c.delim == 0 && isSpace(ch):
+				c = htmlContext{state: stateTag, elem: c.elem, closing: c.closing}
+			case c.delim == 0 && ch == '>':
+				c = c.endTag(c.elem)
+			case c.attr == attrURL:
+				if ch == '?' || ch == '#' {
+					c.url = urlQuery
+				} else if c.url == urlStart {
+					c.url = urlPath
+				}
+			case c.attr == attrJS:
+				c, i = c.jsChar(s, i)
+			}
+		}
+	}
+	return c
+}
+
+// beforeValue returns the context following the "=" after the name of the
+// attribute being read.
+func (c htmlContext) beforeValue() htmlContext {
+	c.state = stateBeforeValue
+	switch {
+	case c.attr == attrUnknown:
+	case strings.HasPrefix(c.name, "on"):
+		c.attr = attrJS
+	case c.name == "style":
+		c.attr = attrCSS
+	case htmlURLAttrs[c.name], strings.Contains(c.name, "url"), strings.Contains(c.name, "uri"):
+		c.attr = attrURL
+	default:
+		c.attr = attrNormal
+	}
+	c.url, c.jsQuote, c.jsLine, c.jsBlock = urlStart, 0, false, false
+	return c
+}
+
+// join returns a context in which values printed after either a or b
+// are escaped safely, if there is one. Contexts within a URL attribute
+// value that differ only in the part of the URL being read are joined by
+// treating the URL as though nothing had been read, which escapes values
+// most strictly.
+func join(a, b htmlContext) (htmlContext, bool) {
+	if a.url != b.url {
+		u := urlPath
+		if a.url == urlStart || b.url == urlStart {
+			u = urlStart
+		}
+		a.url, b.url = u, u
+	}
+	return a, a == b
+}
+
+// endTag returns the context following the end of a tag for elem.
+func (c htmlContext) endTag(elem string) htmlContext {
+	if c.closing {
+		return htmlContext{}
+	}
+	switch elem {
+	case "script":
+		return htmlContext{state: stateScript, elem: elem}
+	case "style":
+		return htmlContext{state: stateStyle, elem: elem}
+	case "textarea", "title":
+		return htmlContext{state: stateRCDATA, elem: elem}
+	}
+	return htmlContext{}
+}
+
+// jsChar returns the context reached by reading the JavaScript character
+// at s[i], and the index of the last character read.
+func (c htmlContext) jsChar(s string, i int) (htmlContext, int) {
+	ch := s[i]
+	switch {
+	case c.jsLine:
+		c.jsLine = ch != '\n'
+	case c.jsBlock:
+		if strings.HasPrefix(s[i:], "*/") {
+			c.jsBlock = false
+			i++
+		}
+	case c.jsQuote != 0:
+		if ch == '\\' {
+			i++
+		} else if ch == c.jsQuote || ch == '\n' && c.jsQuote != '`' {
+			c.jsQuote = 0
+		}
+	case ch == '"' || ch == '\'' || ch == '`':
+		c.jsQuote = ch
+	case strings.HasPrefix(s[i:], "//"):
+		c.jsLine = true
+		i++
+	case strings.HasPrefix(s[i:], "/*"):
+		c.jsBlock = true
+		i++
+	}
+	return c, i
+}
+
+func isASCIILetter(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+// contextualizer chooses the escaping strategy of each value printed by a
+// template, according to the HTML surrounding it.
+type contextualizer struct {
+	env     *Env
+	name    string                 // The name of the template.
+	blocks  map[string]htmlContext // The contexts in which blocks are rendered.
+	loading []string               // Names of the templates being analyzed.
+}
+
+// contextualize sets the Strategy of each PrintNode in tree, for contextual
+// escaping.
+//
+// Blocks are rendered in the context in which they appear in the
+// outermost parent template that defines them, and must end in the
+// context they start in. Macros and the bodies of set tags are assumed to
+// be rendered in element content, as are included templates.
+func (env *Env) contextualize(tree *parse.Tree) error {
+	c := &contextualizer{env: env}
+	_, err := c.tree(tree, nil)
+	return err
+}
+
+// tree analyzes tree, whose blocks are rendered in the given contexts, if
+// known. The contexts of all the blocks rendered by tree are returned.
+func (c *contextualizer) tree(tree *parse.Tree, blocks map[string]htmlContext) (map[string]htmlContext, error) {
+	c.name, c.blocks = tree.Name, make(map[string]htmlContext)
+	for k, v := range blocks {
+		c.blocks[k] = v
+	}
+	_, err := c.node(tree.Root(), htmlContext{})
+	return c.blocks, err
+}
+
+// blocksOf returns the contexts in which the blocks of the named template
+// are rendered. Nil is returned if the template cannot be analyzed, in
+// which case its blocks are assumed to be rendered in element content.
+func (c *contextualizer) blocksOf(name string) map[string]htmlContext {
+	if name == "" || name == c.name {
+		return nil
+	}
+	for _, n := range c.loading {
+		if n == name {
+			return nil
+		}
+	}
+	tree, _, err := c.env.parse(name)
+	if err != nil {
+		return nil
+	}
+	sub := &contextualizer{env: c.env, loading: append(c.loading, c.name)}
+	blocks, err := sub.tree(tree, nil)
+	if err != nil {
+		return nil
+	}
+	return blocks
+}
+
+// node returns the context reached by rendering node in ctx.
+func (c *contextualizer) node(node parse.Node, ctx htmlContext) (htmlContext, error) {
+	var err error
+	switch node := node.(type) {
+	case nil:
+	case *parse.ModuleNode:
+		if node.Parent != nil {
+			for k, v := range c.blocksOf(staticName(node.Parent.Tpl)) {
+				c.blocks[k] = v
+			}
+		}
+		return c.node(node.BodyNode, ctx)
+	case *parse.TextNode:
+		return ctx.text(node.Data), nil
+	case *parse.PrintNode:
+		if f, ok := node.X.(*parse.FilterExpr); ok && escapeFilters[f.Name] {
+			return ctx, nil
+		}
+		strategy, next, reason := ctx.strategy()
+		if reason == "" {
+			if _, ok := c.env.Escapers[strategy]; !ok {
+				reason = "no escaper for strategy \"" + strategy + "\""
+			}
+		}
+		if reason != "" {
+			return ctx, c.error(node, reason)
+		}
+		node.Strategy = strategy
+		return next, nil
+	case *parse.IfNode:
+		body, err := c.node(node.Body, ctx)
+		if err != nil {
+			return ctx, err
+		}
+		els, err := c.node(node.Else, ctx)
+		if err != nil {
+			return ctx, err
+		}
+		res, ok := join(body, els)
+		if !ok {
+			return ctx, c.error(node, "branches of if statement end in different contexts")
+		}
+		return res, nil
+	case *parse.ForNode:
+		body, err := c.node(node.Body, ctx)
+		if err != nil {
+			return ctx, err
+		}
+		res, ok := join(ctx, body)
+		if !ok {
+			return ctx, c.error(node, "body of for loop ends in a different context than it starts")
+		}
+		els, err := c.node(node.Else, ctx)
+		if err != nil {
+			return ctx, err
+		}
+		if res, ok = join(res, els); !ok {
+			return ctx, c.error(node, "branches of for loop end in different contexts")
+		}
+		return res, nil
+	case *parse.BlockNode:
+		start, ok := c.blocks[node.Name]
+		if !ok {
+			start = ctx
+			c.blocks[node.Name] = ctx
+		}
+		end, err := c.node(node.Body, start)
+		if err != nil {
+			return ctx, err
+		}
+		if _, ok := join(start, end); !ok {
+			return ctx, c.error(node, "block \""+node.Name+"\" ends in a different context than it starts")
+		}
+	case *parse.MacroNode:
+		_, err = c.node(node.Body, htmlContext{})
+	case *parse.SetNode:
+		if body, ok := node.X.(*parse.BodyNode); ok {
+			_, err = c.node(body, htmlContext{})
+		}
+	case *parse.EmbedNode:
+		outer := c.blocks
+		c.blocks = c.blocksOf(staticName(node.Tpl))
+		if c.blocks == nil {
+			c.blocks = make(map[string]htmlContext)
+		}
+		names := make([]string, 0, len(node.Blocks))
+		for name := range node.Blocks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err = c.node(node.Blocks[name], htmlContext{}); err != nil {
+				break
+			}
+		}
+		c.blocks = outer
+	default:
+		for _, n := range node.All() {
+			if ctx, err = c.node(n, ctx); err != nil {
+				return ctx, err
+			}
+		}
+	}
+	return ctx, err
+}
+
+func (c *contextualizer) error(node parse.Node, reason string) error {
+	return &EscapeContextError{Template: c.name, Pos: node.Start(), Reason: reason}
+}
@@ -0,0 +1,64 @@
+package stick
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/tyler-sommer/stick/internal/yaml"
+)
+
+// ExecuteJSON executes the given template, as with Execute, with the
+// variables in the JSON object jsonData. Numbers are decoded as
+// json.Number, so that they are printed exactly as given, and integers too
+// large for a float64 are not rounded.
+func (env *Env) ExecuteJSON(tpl string, out io.Writer, jsonData []byte) error {
+	d := json.NewDecoder(bytes.NewReader(jsonData))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("stick: unexpected data after JSON value")
+	}
+	ctx, err := objectContext(v, "JSON")
+	if err != nil {
+		return err
+	}
+	return env.Execute(tpl, out, ctx)
+}
+
+// ExecuteYAML executes the given template, as with Execute, with the
+// variables in the YAML mapping yamlData. The commonly used subset of YAML
+// is supported: block and flow collections, scalars, and comments, but not
+// anchors, aliases, tags, or multiple documents.
+func (env *Env) ExecuteYAML(tpl string, out io.Writer, yamlData []byte) error {
+	v, err := yaml.Unmarshal(yamlData)
+	if err != nil {
+		return err
+	}
+	ctx, err := objectContext(v, "YAML")
+	if err != nil {
+		return err
+	}
+	return env.Execute(tpl, out, ctx)
+}
+
+// objectContext returns the variables in the decoded object v. An empty
+// document has no variables.
+func objectContext(v interface{}, format string) (map[string]Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("stick: " + format + " data must be an object")
+	}
+	ctx := make(map[string]Value, len(m))
+	for k, v := range m {
+		ctx[k] = v
+	}
+	return ctx, nil
+}
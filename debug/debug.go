@@ -0,0 +1,98 @@
+// Package debug provides a Stick extension that annotates rendered HTML with
+// the templates and blocks that produced it.
+//
+// Each rendered template and block is wrapped in HTML comments:
+//
+//	<!-- BEGIN partials/card.twig -->
+//	...
+//	<!-- END partials/card.twig -->
+//
+// Register an Extension with an Env used during development:
+//
+//	env.Register(debug.New())
+package debug // import "github.com/tyler-sommer/stick/debug"
+
+import (
+	"path"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An Extension annotates templates with HTML comments as they are parsed.
+type Extension struct {
+	// Enabled controls whether templates are annotated. Templates parsed
+	// while Enabled is false are not annotated. Changing Enabled does not
+	// affect templates already parsed and cached by the Env; call the Env's
+	// ClearTemplateCache method to reparse them.
+	Enabled bool
+
+	// Annotate reports whether the named template should be annotated. If
+	// nil, templates named with an ".html" or ".htm" extension, optionally
+	// followed by ".twig", or with no extension at all, are annotated.
+	Annotate func(name string) bool
+}
+
+// New returns an enabled Extension.
+func New() *Extension {
+	return &Extension{Enabled: true}
+}
+
+// Init adds the Extension's node visitor to the Env.
+func (e *Extension) Init(env *stick.Env) error {
+	env.Visitors = append(env.Visitors, &visitor{e})
+	return nil
+}
+
+// shouldAnnotate reports whether the named template should be annotated.
+func (e *Extension) shouldAnnotate(name string) bool {
+	if !e.Enabled {
+		return false
+	}
+	if e.Annotate != nil {
+		return e.Annotate(name)
+	}
+	switch path.Ext(strings.TrimSuffix(name, ".twig")) {
+	case "", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// visitor wraps the body of each module and block in comments.
+type visitor struct {
+	ext *Extension
+}
+
+func (v *visitor) Enter(n parse.Node) {}
+
+func (v *visitor) Leave(n parse.Node) {
+	switch n := n.(type) {
+	case *parse.ModuleNode:
+		// The body of a template that extends another is never rendered.
+		if n.Parent != nil || !v.ext.shouldAnnotate(n.Origin) {
+			return
+		}
+		label := comment(n.Origin)
+		nodes := make([]parse.Node, 0, len(n.Nodes)+2)
+		nodes = append(nodes, parse.NewTextNode("<!-- BEGIN "+label+" -->", n.Pos))
+		nodes = append(nodes, n.Nodes...)
+		n.Nodes = append(nodes, parse.NewTextNode("<!-- END "+label+" -->", n.Pos))
+	case *parse.BlockNode:
+		if !v.ext.shouldAnnotate(n.Origin) {
+			return
+		}
+		label := comment(`block "` + n.Name + `" in ` + n.Origin)
+		n.Body = parse.NewBodyNode(n.Pos,
+			parse.NewTextNode("<!-- BEGIN "+label+" -->", n.Pos),
+			n.Body,
+			parse.NewTextNode("<!-- END "+label+" -->", n.Pos),
+		)
+	}
+}
+
+// comment makes s safe for use inside an HTML comment.
+func comment(s string) string {
+	return strings.Replace(s, "--", "- -", -1)
+}
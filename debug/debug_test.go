@@ -0,0 +1,45 @@
+package debug_test
+
+import (
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/debug"
+)
+
+func TestExtension(t *testing.T) {
+	env := stick.New(&stick.MemoryLoader{Templates: map[string]string{
+		"base.html.twig": "<main>{% block content %}{% endblock %}</main>",
+		"page.html.twig": "{% extends 'base.html.twig' %}{% block content %}{% include 'card.html' %}{% endblock %}",
+		"card.html":      "<div></div>",
+		"other.html":     "<div></div>",
+		"script.js.twig": "var x = 1;",
+	}})
+	ext := debug.New()
+	env.Register(ext)
+	tests := map[string]string{
+		"page.html.twig": "<!-- BEGIN base.html.twig --><main>" +
+			`<!-- BEGIN block "content" in page.html.twig -->` +
+			"<!-- BEGIN card.html --><div></div><!-- END card.html -->" +
+			`<!-- END block "content" in page.html.twig -->` +
+			"</main><!-- END base.html.twig -->",
+		"script.js.twig": "var x = 1;",
+	}
+	for name, expected := range tests {
+		actual, err := env.ExecuteToString(name, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, actual)
+		}
+	}
+
+	ext.Enabled = false
+	actual, err := env.ExecuteToString("other.html", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if actual != "<div></div>" {
+		t.Errorf("expected no annotations when disabled, got %q", actual)
+	}
+}
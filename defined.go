@@ -0,0 +1,99 @@
+package stick
+
+import (
+	"errors"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// isDefinedTest returns true if exp is a "defined" or "not defined" test,
+// such as "{% if footer is defined %}". The defined test is built in, unless
+// the Env has a user-defined test of the same name: its operand is checked
+// without being evaluated, so that undefined variables and missing blocks
+// do not cause errors.
+func (s *state) isDefinedTest(exp *parse.BinaryExpr) bool {
+	if exp.Op != parse.OpBinaryIs && exp.Op != parse.OpBinaryIsNot {
+		return false
+	}
+	t, ok := exp.Right.(*parse.TestExpr)
+	if !ok || t.Name != "defined" || len(t.Args) > 0 {
+		return false
+	}
+	_, ok = s.env.Tests[t.Name]
+	return !ok
+}
+
+// defined returns true if exp, the operand of a defined test, is defined.
+//
+// A variable is defined if it is set, even to null, but not to an Undefined,
+// and an attribute if the value it belongs to is defined and has the
+// attribute. The block function is defined if the named block exists: in
+// the current template and its parents, or in the template given as the
+// second argument. Other expressions are defined if they can be evaluated
+// without referring to an undefined variable.
+func (s *state) defined(exp parse.Expr) (bool, error) {
+	switch exp := exp.(type) {
+	case *parse.NameExpr:
+		if exp.Name == "_self" {
+			return true, nil
+		}
+		v, ok := s.scope.Get(exp.Name)
+		if _, undef := v.(Undefined); undef {
+			return false, nil
+		}
+		return ok, nil
+	case *parse.GroupExpr:
+		return s.defined(exp.X)
+	case *parse.GetAttrExpr:
+		if ok, err := s.defined(exp.Cont); !ok || err != nil {
+			return ok, err
+		}
+		c, err := s.evalExpr(exp.Cont)
+		if err != nil {
+			return false, err
+		}
+		k, err := s.evalExpr(exp.Attr)
+		if err != nil {
+			return false, err
+		}
+		switch c := c.(type) {
+		case selfValue:
+			if _, ok := s.selfMacro(CoerceString(k)); ok {
+				return true, nil
+			}
+		case macroSet:
+			_, ok := c.defs[CoerceString(k)]
+			return ok, nil
+		}
+		args, _, err := s.evalArgs(exp.Args)
+		if err != nil {
+			return false, err
+		}
+		v, ok, err := s.env.readAttr(c, k, args)
+		if _, undef := v.(Undefined); undef {
+			return false, nil
+		}
+		return ok, err
+	case *parse.FuncExpr:
+		if exp.Name == "block" {
+			blk, _, err := s.findBlock(exp)
+			if err != nil {
+				var nf *TemplateNotFoundError
+				if errors.As(err, &nf) {
+					return false, nil
+				}
+				return false, err
+			}
+			return blk != nil, nil
+		}
+	}
+	v, err := s.evalExpr(exp)
+	if err != nil {
+		if errors.Is(err, ErrUndefinedVariable) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, undef := v.(Undefined)
+	return !undef, nil
+}
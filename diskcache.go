@@ -0,0 +1,84 @@
+package stick
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// diskCacheVersion identifies the format of templates stored in a
+// CacheDir. It is changed whenever the format or the parser changes, so
+// that templates stored by older versions are not used.
+const diskCacheVersion = "stick-1"
+
+// diskCachePath returns the path in the Env's CacheDir where the parsed
+// template with the given name and source is stored.
+func (env *Env) diskCachePath(name string, src []byte) string {
+	h := sha256.New()
+	io.WriteString(h, diskCacheVersion)
+	h.Write([]byte{0})
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	h.Write(src)
+	return filepath.Join(env.CacheDir, hex.EncodeToString(h.Sum(nil))+".gob")
+}
+
+// loadCachedTree returns the parsed template stored at path, or nil if it
+// is missing or cannot be decoded.
+func (env *Env) loadCachedTree(path string) *parse.Tree {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	tree := &parse.Tree{}
+	if err := tree.UnmarshalBinary(data); err != nil {
+		env.warnCacheDir("unable to read cached template", path, err)
+		return nil
+	}
+	return tree
+}
+
+// storeCachedTree stores tree at path. The tree is written to a temporary
+// file which is then renamed, so other processes never see a partially
+// written template.
+func (env *Env) storeCachedTree(path string, tree *parse.Tree) {
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		env.warnCacheDir("unable to encode template", path, err)
+		return
+	}
+	if err := os.MkdirAll(env.CacheDir, 0755); err != nil {
+		env.warnCacheDir("unable to create cache directory", path, err)
+		return
+	}
+	f, err := ioutil.TempFile(env.CacheDir, ".tmp-")
+	if err != nil {
+		env.warnCacheDir("unable to write cached template", path, err)
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		env.warnCacheDir("unable to write cached template", path, err)
+	}
+}
+
+// warnCacheDir logs a problem using the Env's CacheDir. Such problems are
+// otherwise ignored; the template is parsed as if CacheDir were unset.
+func (env *Env) warnCacheDir(msg, path string, err error) {
+	if env.Logger != nil {
+		env.Logger.WarnContext(context.Background(), msg, "path", path, "error", err)
+	}
+}
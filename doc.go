@@ -68,6 +68,35 @@ method that should convert a custom type into the specified type.
 		return t.someValue != nil
 	}
 
+Numbers that must not lose precision, such as amounts of money, can be given as a
+decimal.Decimal from github.com/shopspring/decimal, a *big.Int, a *big.Rat, or any
+type implementing stick.ExactNumber. Arithmetic and comparisons involving them are
+exact, and filters such as round and number_format preserve their precision.
+
+Types such as UUIDs and versions can decide how they are compared by implementing
+stick.Equaler, which is used by "==" and "!=", or stick.Comparer, which is also used
+by "<", ">", and sorting.
+
+Strings are converted to numbers as in Twig running on PHP 8. Leading and trailing
+whitespace is ignored and exponents are allowed, but a string that does not contain
+only a number is read as the number it starts with, or 0. When such a string is an
+operand of an arithmetic or bitwise operator, a Warning wrapping stick.ErrNonNumeric is
+also emitted, where PHP would emit a warning or throw a TypeError. Comparisons only
+treat strings containing only a number as numbers.
+
+	Expression         PHP 8                        Stick
+	"10" + 5           15                           15
+	" 1.5 " * 2        3                            3
+	"1e3" + 0          1000                         1000
+	"10abc" + 5        15, warning                  15, warning
+	"abc" + 1          TypeError                    1, warning
+	"0x1A" + 0         0, warning                   0, warning
+	"10abc" == 10      false                        false
+	"1e3" == "1000"    true                         true
+
+Enable the Env's StrictTypes to reject strings as operands of arithmetic operators
+instead.
+
 On a final note, there exists three functions to coerce any type into a string,
 number, or boolean, respectively.
 
@@ -123,5 +152,11 @@ User-defined types are added to an Env after it is created. For example:
 		// Probably not that useful.
 		return stick.CoerceBool(val) == false
 	}
+
+With Go 1.18 or later, typed helpers can be written as ordinary functions and
+adapted with Filter1, Func2, Test1, and similar functions, which coerce the
+arguments to the declared types and check their number:
+
+	env.Filters["repeat"] = stick.Filter2(strings.Repeat)
 */
 package stick
@@ -0,0 +1,478 @@
+package stick
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// Sentinel errors that describe categories of failures. Errors returned by
+// Stick can be tested against these using errors.Is.
+var (
+	// ErrTemplateNotFound is returned when a Loader cannot find a template.
+	ErrTemplateNotFound = errors.New("template not found")
+	// ErrUndefinedVariable is returned when an undefined variable is
+	// referenced and the Env has StrictVariables enabled, or an undefined
+	// variable or attribute is used and the Env's UndefinedMode is
+	// StrictUndefined.
+	ErrUndefinedVariable = errors.New("undefined variable")
+	// ErrUndefinedFilter is returned when an undefined filter is referenced.
+	ErrUndefinedFilter = errors.New("undefined filter")
+	// ErrUndefinedFunction is returned when an undefined function is referenced.
+	ErrUndefinedFunction = errors.New("undefined function")
+	// ErrUndefinedTest is returned when an undefined test is referenced.
+	ErrUndefinedTest = errors.New("undefined test")
+	// ErrOutputLimitExceeded is returned when a template produces more
+	// output than allowed by Env.MaxOutputBytes.
+	ErrOutputLimitExceeded = errors.New("output limit exceeded")
+	// ErrLoopLimitExceeded is returned when a template performs more loop
+	// iterations than allowed by Env.MaxLoopIterations.
+	ErrLoopLimitExceeded = errors.New("loop limit exceeded")
+	// ErrDepthLimitExceeded is returned when included templates, parent
+	// templates, or macro calls are nested too deeply, such as by a
+	// template that includes itself unconditionally.
+	ErrDepthLimitExceeded = errors.New("depth limit exceeded")
+	// ErrSecurityViolation is returned when a template accesses a field or
+	// method that is not allowed by the Env's SecurityPolicy.
+	ErrSecurityViolation = errors.New("security violation")
+	// ErrInvalidTemplateName is returned when a Loader rejects a template
+	// name, such as one referring to a file outside of its root directories.
+	ErrInvalidTemplateName = errors.New("invalid template name")
+	// ErrEscapeContext is returned when Env.ContextualEscaping is enabled
+	// and a template prints a value where it cannot be escaped safely.
+	ErrEscapeContext = errors.New("cannot escape value in context")
+	// ErrTypeMismatch is returned when the Env has StrictTypes enabled and
+	// an operator is applied to values of incompatible types.
+	ErrTypeMismatch = errors.New("type mismatch")
+	// ErrNonNumeric is the error of the Warning emitted when a string that
+	// is not a number is an operand of an arithmetic operator, such as
+	// "10abc" in "10abc" + 5.
+	ErrNonNumeric = errors.New("non-numeric value")
+	// ErrNotLister is returned by Env.WarmupAll when the Env's Loader cannot
+	// list its templates.
+	ErrNotLister = errors.New("loader cannot list templates")
+)
+
+// A ParseError is returned when a template cannot be parsed. Use errors.As
+// to extract the position of the error:
+//
+//	var perr stick.ParseError
+//	if errors.As(err, &perr) {
+//		fmt.Println(perr.Name(), perr.Pos())
+//	}
+type ParseError = parse.ParsingError
+
+// A TemplateNotFoundError is returned when the Loader is unable to find
+// a template. It matches ErrTemplateNotFound when using errors.Is.
+type TemplateNotFoundError struct {
+	Name string // The name of the template.
+	Err  error  // The underlying error returned by the Loader.
+
+	// Candidates contains the names of the templates that were tried, in
+	// order, when a list of templates was included and none were found.
+	Candidates []string
+}
+
+func (e *TemplateNotFoundError) Error() string {
+	if len(e.Candidates) > 0 {
+		return fmt.Sprintf("none of the templates \"%s\" found", strings.Join(e.Candidates, `", "`))
+	}
+	return fmt.Sprintf("template \"%s\" not found", e.Name)
+}
+
+// Is returns true if target is ErrTemplateNotFound.
+func (e *TemplateNotFoundError) Is(target error) bool {
+	return target == ErrTemplateNotFound
+}
+
+// Unwrap returns the underlying error.
+func (e *TemplateNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// An InvalidTemplateNameError is returned when a Loader rejects a template
+// name. It matches ErrInvalidTemplateName when using errors.Is.
+type InvalidTemplateNameError struct {
+	Name string // The name of the template.
+}
+
+func (e *InvalidTemplateNameError) Error() string {
+	return fmt.Sprintf("invalid template name \"%s\"", e.Name)
+}
+
+// Is returns true if target is ErrInvalidTemplateName.
+func (e *InvalidTemplateNameError) Is(target error) bool {
+	return target == ErrInvalidTemplateName
+}
+
+// An OutputLimitError is returned when a template produces more output than
+// allowed by Env.MaxOutputBytes. It matches ErrOutputLimitExceeded when using
+// errors.Is.
+type OutputLimitError struct {
+	Limit int64 // The maximum number of bytes allowed.
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("output exceeds limit of %d bytes", e.Limit)
+}
+
+// Is returns true if target is ErrOutputLimitExceeded.
+func (e *OutputLimitError) Is(target error) bool {
+	return target == ErrOutputLimitExceeded
+}
+
+// A LoopLimitError is returned when a template performs more loop iterations
+// than allowed by Env.MaxLoopIterations. It matches ErrLoopLimitExceeded when
+// using errors.Is.
+type LoopLimitError struct {
+	Limit int // The maximum number of iterations allowed.
+}
+
+func (e *LoopLimitError) Error() string {
+	return fmt.Sprintf("loop iterations exceed limit of %d", e.Limit)
+}
+
+// Is returns true if target is ErrLoopLimitExceeded.
+func (e *LoopLimitError) Is(target error) bool {
+	return target == ErrLoopLimitExceeded
+}
+
+// A DepthLimitError is returned when included templates, parent templates,
+// or macro calls are nested too deeply. It matches ErrDepthLimitExceeded
+// when using errors.Is.
+type DepthLimitError struct {
+	Limit int // The maximum nesting allowed.
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("nesting of templates and macro calls exceeds limit of %d", e.Limit)
+}
+
+// Is returns true if target is ErrDepthLimitExceeded.
+func (e *DepthLimitError) Is(target error) bool {
+	return target == ErrDepthLimitExceeded
+}
+
+// An UndefinedPolicy determines how references to undefined filters,
+// functions, and tests are handled during template execution.
+type UndefinedPolicy int
+
+const (
+	// PolicyError causes execution to fail with an UndeclaredError.
+	PolicyError UndefinedPolicy = iota
+	// PolicyWarn logs an UndeclaredError and continues execution.
+	PolicyWarn
+	// PolicyIgnore silently continues execution.
+	PolicyIgnore
+)
+
+// An UndeclaredError describes a reference to a filter, function, or test
+// that is not defined in the Env.
+type UndeclaredError struct {
+	Kind       string    // The kind of reference: "filter", "function", or "test".
+	Name       string    // The name that was referenced.
+	Template   string    // The name of the template containing the reference.
+	Pos        parse.Pos // The position of the reference in the template.
+	Suggestion string    // A similarly named, defined alternative, if any.
+}
+
+func (e *UndeclaredError) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("Undeclared %s \"%s\" (did you mean \"%s\"?)", e.Kind, e.Name, e.Suggestion)
+	}
+	return fmt.Sprintf("Undeclared %s \"%s\"", e.Kind, e.Name)
+}
+
+// Is returns true if target is the sentinel error matching the Kind of
+// the UndeclaredError, such as ErrUndefinedFilter.
+func (e *UndeclaredError) Is(target error) bool {
+	switch e.Kind {
+	case "filter":
+		return target == ErrUndefinedFilter
+	case "function":
+		return target == ErrUndefinedFunction
+	case "test":
+		return target == ErrUndefinedTest
+	}
+	return false
+}
+
+// An EscapeContextError is returned when Env.ContextualEscaping is enabled
+// and a template prints a value where it cannot be escaped safely, such as
+// outside a string literal in a script element. It matches
+// ErrEscapeContext when using errors.Is.
+type EscapeContextError struct {
+	Template string    // The name of the template.
+	Pos      parse.Pos // The position of the offending node.
+	Reason   string    // A description of the problem.
+}
+
+func (e *EscapeContextError) Error() string {
+	return fmt.Sprintf("Contextual escaping: %s on line %d, column %d in %s", e.Reason, e.Pos.Line, e.Pos.Offset, e.Template)
+}
+
+// Is returns true if target is ErrEscapeContext.
+func (e *EscapeContextError) Is(target error) bool {
+	return target == ErrEscapeContext
+}
+
+// A TypeError is returned when the Env has StrictTypes enabled and an
+// operator is applied to values of incompatible types. It matches
+// ErrTypeMismatch when using errors.Is.
+type TypeError struct {
+	Op    string // The operator, such as "+".
+	Left  string // The type of the left operand, or empty for a unary operator.
+	Right string // The type of the right operand.
+}
+
+func (e *TypeError) Error() string {
+	if e.Left == "" {
+		return fmt.Sprintf("unsupported operand type for unary \"%s\": %s", e.Op, e.Right)
+	}
+	return fmt.Sprintf("unsupported operand types for \"%s\": %s and %s", e.Op, e.Left, e.Right)
+}
+
+// Is returns true if target is ErrTypeMismatch.
+func (e *TypeError) Is(target error) bool {
+	return target == ErrTypeMismatch
+}
+
+// A RuntimeError is returned when an error occurs while executing a template.
+// It describes where in the template the error occurred.
+type RuntimeError struct {
+	Template string     // The name of the template being executed, or empty if loaded by a StringLoader.
+	Pos      parse.Pos  // The position of the offending node.
+	Node     parse.Node // The node being executed when the error occurred.
+	Source   []string   // A few lines of source surrounding the error, if available.
+	Stack    []Frame    // The chain of templates that led to the error, outermost first.
+	Err      error      // The underlying error.
+}
+
+// NodeKind returns the type of the offending node, such as "PrintNode".
+func (e *RuntimeError) NodeKind() string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", e.Node), "*parse.")
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Template == "" {
+		return fmt.Sprintf("%s on line %d, column %d", e.Err, e.Pos.Line, e.Pos.Offset)
+	}
+	return fmt.Sprintf("%s on line %d, column %d in %s", e.Err, e.Pos.Line, e.Pos.Offset, e.Template)
+}
+
+// Unwrap returns the underlying error.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Excerpt returns the lines of source surrounding the error, each prefixed
+// with its line number. The offending line is marked with a ">".
+func (e *RuntimeError) Excerpt() string {
+	first := e.SourceStart()
+	res := ""
+	for i, line := range e.Source {
+		n := first + i
+		marker := " "
+		if n == e.Pos.Line {
+			marker = ">"
+		}
+		res = res + fmt.Sprintf("%s %4d | %s\n", marker, n, line)
+	}
+	return res
+}
+
+// SourceStart returns the line number of the first line in Source.
+func (e *RuntimeError) SourceStart() int {
+	if first := e.Pos.Line - excerptLines; first > 1 {
+		return first
+	}
+	return 1
+}
+
+// StackTrace returns a description of where the error occurred followed by
+// each Frame that led there, innermost first, one per line.
+func (e *RuntimeError) StackTrace() string {
+	res := e.Error()
+	for i := len(e.Stack) - 1; i >= 0; i-- {
+		res = res + "\n\t" + e.Stack[i].String()
+	}
+	return res
+}
+
+// A Frame describes a location in a template that caused execution to
+// continue in another template, such as an include statement.
+type Frame struct {
+	Kind     string    // One of "extends", "include", "embed", "block", or "macro".
+	Template string    // The name of the template containing the statement.
+	Pos      parse.Pos // The position of the statement.
+}
+
+// String returns a string representation of the Frame.
+func (f Frame) String() string {
+	return fmt.Sprintf("%s on line %d, column %d in %s", f.Kind, f.Pos.Line, f.Pos.Offset, f.Template)
+}
+
+// A Warning describes a recoverable problem encountered while executing
+// a template. Warnings do not stop execution.
+type Warning struct {
+	Template string    // The name of the template being executed, or empty if loaded by a StringLoader.
+	Pos      parse.Pos // The position of the node being executed.
+	Err      error     // The problem that occurred.
+}
+
+// String returns a string representation of the Warning.
+func (w Warning) String() string {
+	if w.Template == "" {
+		return fmt.Sprintf("%s on line %d, column %d", w.Err, w.Pos.Line, w.Pos.Offset)
+	}
+	return fmt.Sprintf("%s on line %d, column %d in %s", w.Err, w.Pos.Line, w.Pos.Offset, w.Template)
+}
+
+// A Deprecation describes the use of a deprecated feature in a template,
+// such as deprecated syntax or a deprecated filter.
+type Deprecation struct {
+	Template string    // The name of the template, or empty if loaded by a StringLoader.
+	Pos      parse.Pos // The position of the deprecated usage.
+	Message  string    // Describes the deprecated feature and its replacement.
+}
+
+// String returns a string representation of the Deprecation.
+func (d Deprecation) String() string {
+	if d.Template == "" {
+		return fmt.Sprintf("%s on line %d, column %d", d.Message, d.Pos.Line, d.Pos.Offset)
+	}
+	return fmt.Sprintf("%s on line %d, column %d in %s", d.Message, d.Pos.Line, d.Pos.Offset, d.Template)
+}
+
+// A DeprecationCollector records Deprecations so they can be retrieved
+// after templates are executed. Use its Handle method as an Env's
+// DeprecationHandler.
+//
+// A DeprecationCollector is safe for concurrent use.
+type DeprecationCollector struct {
+	mu           sync.Mutex
+	deprecations []Deprecation
+}
+
+// Handle records the given Deprecation.
+func (c *DeprecationCollector) Handle(d Deprecation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deprecations = append(c.deprecations, d)
+}
+
+// Deprecations returns the recorded Deprecations, in the order they
+// occurred.
+func (c *DeprecationCollector) Deprecations() []Deprecation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]Deprecation, len(c.deprecations))
+	copy(res, c.deprecations)
+	return res
+}
+
+// Reset discards all recorded Deprecations.
+func (c *DeprecationCollector) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deprecations = nil
+}
+
+// excerptLines is the number of lines before and after the offending line
+// that are included in a RuntimeError.
+const excerptLines = 2
+
+// wrapError wraps err in a RuntimeError describing the given node. If err
+// is already a RuntimeError or a parse error, it is returned unchanged.
+func (s *state) wrapError(node parse.Node, err error) error {
+	switch err.(type) {
+	case *RuntimeError, parse.ParsingError:
+		return err
+	}
+	pos := node.Start()
+	stack := make([]Frame, len(s.frames))
+	copy(stack, s.frames)
+	return &RuntimeError{s.templateName(), pos, node, s.sourceExcerpt(pos.Line), stack, err}
+}
+
+// templateName returns the name of the template being executed, to
+// describe where a problem occurred. It is empty if the Env's Loader is a
+// StringLoader, since the name is then the template's source.
+func (s *state) templateName() string {
+	if _, ok := s.env.Loader.(*StringLoader); ok {
+		return ""
+	}
+	return s.name
+}
+
+// sourceExcerpt loads the current template and returns the lines
+// surrounding the given line.
+func (s *state) sourceExcerpt(line int) []string {
+	tpl, err := s.env.Loader.Load(s.name)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(tpl.Contents())
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(b), "\n")
+	start, end := line-1-excerptLines, line+excerptLines
+	if start < 0 {
+		start = 0
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	if start >= end {
+		return nil
+	}
+	return lines[start:end]
+}
+
+// suggest returns the candidate most similar to name, or an empty string
+// if no candidate is similar enough to be a likely typo.
+func suggest(name string, candidates []string) string {
+	sort.Strings(candidates)
+	best := ""
+	bestDist := len(name)/3 + 1
+	for _, c := range candidates {
+		if d := levenshtein(name, c); d <= bestDist && (best == "" || d < levenshtein(name, best)) {
+			best = c
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < curr[j] {
+				curr[j] = d
+			}
+			if d := curr[j-1] + 1; d < curr[j] {
+				curr[j] = d
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
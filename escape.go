@@ -0,0 +1,94 @@
+package stick
+
+import (
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An Escaper returns the escaped input.
+// Escapers should expect to receive unescaped input.
+type Escaper func(string) string
+
+// markupSafeFor is used to mark a SafeValue as safe for any content type.
+const markupSafeFor = "*"
+
+// newMarkup returns a SafeValue that is considered safe for any content type.
+//
+// Output rendered by Stick itself, such as the result of a macro call or
+// a captured set statement, has already been escaped and should not be
+// escaped again when printed.
+func newMarkup(val string) SafeValue {
+	return NewSafeValue(val, markupSafeFor)
+}
+
+// isSafe returns true if val does not need to be escaped using strategy.
+func isSafe(val Value, strategy string) bool {
+	if sv, ok := val.(SafeValue); ok {
+		return sv.IsSafe(strategy) || sv.IsSafe(markupSafeFor)
+	}
+	return false
+}
+
+// escapeFilters are filters that, when applied last in a print statement,
+// disable auto-escaping of the printed value.
+var escapeFilters = map[string]bool{
+	"raw":    true,
+	"escape": true,
+	"e":      true,
+}
+
+// escaper returns the Escaper that val must be escaped with when printed by
+// node, according to the escaping strategy of the current template.
+//
+// Values that are already safe for the strategy are not escaped, nor are
+// values whose last applied filter is "raw" or an explicit "escape".
+func (s *state) escaper(node *parse.PrintNode, val Value) (Escaper, bool) {
+	if f, ok := node.X.(*parse.FilterExpr); ok && escapeFilters[f.Name] {
+		return nil, false
+	}
+	strategy := node.Strategy
+	if strategy == "" {
+		strategy = s.env.escapeStrategy(s.name)
+	}
+	if strategy == "" || isSafe(val, strategy) {
+		return nil, false
+	}
+	esc, ok := s.env.Escapers[strategy]
+	return esc, ok
+}
+
+// print writes val to the output as printed by node. Values that need no
+// escaping are written without first being converted to a string.
+func (s *state) print(node *parse.PrintNode, val Value) error {
+	if err := checkUse(val); err != nil {
+		return err
+	}
+	if esc, ok := s.escaper(node, val); ok {
+		return s.write(node, s.env.applyEscaper(esc, CoerceString(val)))
+	}
+	if str, ok := val.(string); ok {
+		return s.write(node, str)
+	}
+	s.buf = appendString(s.buf[:0], val)
+	return s.writeBytes(node, s.buf)
+}
+
+// Escape returns the string representation of val, escaped according to the
+// escaping strategy of the named template, as though it were printed. Values
+// that are already safe for the strategy are not escaped.
+func (env *Env) Escape(tpl string, val Value) string {
+	return env.EscapeWith(env.escapeStrategy(tpl), val)
+}
+
+// EscapeWith returns the string representation of val, escaped using the
+// given strategy. Values that are already safe for the strategy are not
+// escaped, nor is any value if the Env has no Escaper for the strategy.
+func (env *Env) EscapeWith(strategy string, val Value) string {
+	if strategy == "" || isSafe(val, strategy) {
+		return CoerceString(val)
+	}
+	esc, ok := env.Escapers[strategy]
+	if !ok {
+		return CoerceString(val)
+	}
+	return env.applyEscaper(esc, CoerceString(val))
+}
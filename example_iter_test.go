@@ -0,0 +1,28 @@
+//go:build go1.23
+// +build go1.23
+
+package stick_test
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// An example of looping over Go 1.23 iterators, such as those returned by
+// the slices and maps packages.
+func ExampleIterate_iterators() {
+	env := stick.New(nil)
+
+	res, _ := env.ExecuteToString(`{% for v in names %}{{ v }}{% if not loop.last %}, {% endif %}{% endfor %}
+{% for k, v in ages %}{{ k }}: {{ v }} {% endfor %}`, map[string]stick.Value{
+		"names": slices.Values([]string{"Alice", "Bob", "Carol"}),
+		"ages":  maps.All(map[string]int{"Dave": 42}),
+	})
+	fmt.Println(res)
+	// Output:
+	// Alice, Bob, Carol
+	// Dave: 42
+}
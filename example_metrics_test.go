@@ -0,0 +1,50 @@
+package stick_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// counters is a Metrics that counts renders, cache hits, and parses. An
+// application would instead update Prometheus counters and histograms,
+// labeled by template name.
+type counters struct {
+	renders, hits, misses, parses int64
+	parseTime                     int64
+}
+
+func (c *counters) Render(name string, elapsed time.Duration, err error) {
+	atomic.AddInt64(&c.renders, 1)
+}
+
+func (c *counters) CacheLookup(name string, hit bool) {
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+func (c *counters) Parse(name string, elapsed time.Duration, err error) {
+	atomic.AddInt64(&c.parses, 1)
+	atomic.AddInt64(&c.parseTime, int64(elapsed))
+}
+
+// An example of collecting metrics about rendering and the template cache.
+func ExampleMetrics() {
+	env := stick.New(stick.NewMemoryLoader(map[string]string{
+		"hello.twig": "Hello, {{ name }}!",
+	}))
+	env.CacheMode = stick.CacheForever
+	m := &counters{}
+	env.Metrics = m
+
+	for i := 0; i < 3; i++ {
+		env.ExecuteToString("hello.twig", map[string]stick.Value{"name": "World"})
+	}
+	fmt.Printf("renders: %d, cache hits: %d, misses: %d, parses: %d\n", m.renders, m.hits, m.misses, m.parses)
+	// Output: renders: 3, cache hits: 2, misses: 1, parses: 1
+}
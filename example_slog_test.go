@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package stick_test
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// An example of logging warnings and undefined variables with log/slog.
+func ExampleLogger() {
+	env := stick.New(nil)
+	env.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	res, _ := env.ExecuteToString("Hello, {{ name }}!", nil)
+	fmt.Println(res)
+	// Output:
+	// level=DEBUG msg="template loaded" template="Hello, {{ name }}!"
+	// level=DEBUG msg="undefined variable" template="Hello, {{ name }}!" line=1 column=10 name=name
+	// Hello, !
+}
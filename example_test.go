@@ -31,7 +31,28 @@ func ExampleEnv_ExecuteSafe() {
 	if err != nil {
 		fmt.Println(err)
 	}
-	// Output: Undeclared filter "fakefilter"
+	// Output: Undeclared filter "fakefilter" on line 1, column 18
+}
+
+// An example of executing a template and retrieving the output as a string.
+func ExampleEnv_ExecuteToString() {
+	env := stick.New(nil)
+
+	params := map[string]stick.Value{"name": "World"}
+	res, err := env.ExecuteToString(`Hello, {{ name }}!`, params)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(res)
+	// Output: Hello, World!
+}
+
+// An example of executing a template that is known to be valid.
+func ExampleEnv_MustExecute() {
+	env := stick.New(nil)
+
+	fmt.Println(env.MustExecute(`{{ 1 + 2 }}`, nil))
+	// Output: 3
 }
 
 type exampleType struct{}
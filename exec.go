@@ -2,14 +2,19 @@ package stick
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tyler-sommer/stick/internal/bufpool"
 	"github.com/tyler-sommer/stick/parse"
 )
 
@@ -31,25 +36,57 @@ type state struct {
 
 	env   *Env        // The configured Stick environment.
 	scope *scopeStack // Handles execution scope.
-}
 
-// newState creates a new template execution state, ready for use.
-func newState(name string, out io.Writer, ctx map[string]Value, env *Env) *state {
-	return &state{
-		out:  out,
-		node: nil,
+	frames []Frame // The chain of templates that led to the current one.
+
+	context context.Context // The context of the current execution.
+
+	iterations *int   // Total loop iterations, shared with included templates.
+	depth      *int   // Nesting of templates and macro calls, shared with included templates.
+	written    *int64 // Bytes written and captured, if limited by MaxOutputBytes; shared with included templates.
+
+	trees map[string]*parse.Tree // Templates loaded during execution, shared with included templates.
 
-		name: name,
-		meta: &metadata{make(map[string]string)},
+	stack []Value // Operand stack used by EngineVM.
+	buf   []byte  // Scratch space for printing values.
 
-		blocks: make([]map[string]*parse.BlockNode, 0),
-		macros: make(map[string]*parse.MacroNode),
+	table *blockTable // The table of blocks, computed when first needed.
+}
+
+// pushFrame records that execution is continuing in another template
+// because of the given node.
+func (s *state) pushFrame(kind string, node parse.Node) {
+	s.frames = append(s.frames, Frame{kind, s.name, node.Start()})
+}
 
-		localMacros: make(map[string]*parse.MacroNode),
+// defaultMaxDepth limits the nesting of included and parent templates and
+// macro calls if the Env's MaxDepth is not set, so that recursive templates
+// fail rather than exhausting the stack.
+const defaultMaxDepth = 100
 
-		env:   env,
-		scope: &scopeStack{[]map[string]Value{ctx}},
+// nest records that execution is entering another template or a macro,
+// failing if they are nested too deeply. Each successful call must be
+// followed by a call to unnest.
+func (s *state) nest() error {
+	max := s.env.MaxDepth
+	if max <= 0 {
+		max = defaultMaxDepth
+	}
+	if *s.depth >= max {
+		return &DepthLimitError{max}
 	}
+	*s.depth++
+	return nil
+}
+
+// unnest records that execution has left a template or macro.
+func (s *state) unnest() {
+	*s.depth--
+}
+
+// popFrame removes the most recently pushed frame.
+func (s *state) popFrame() {
+	s.frames = s.frames[:len(s.frames)-1]
 }
 
 // A selfValue represents the special `_self` variable.
@@ -78,6 +115,70 @@ func (s *state) Meta() ContextMetadata {
 	return s.meta
 }
 
+func (s *state) Context() context.Context {
+	return s.context
+}
+
+func (s *state) Warn(err error) {
+	s.warn(s.node, "template warning", "error", err)
+	if s.env.WarningHandler == nil {
+		return
+	}
+	w := Warning{Template: s.templateName(), Err: err}
+	if s.node != nil {
+		w.Pos = s.node.Start()
+	}
+	s.env.WarningHandler(w)
+}
+
+func (s *state) Deprecated(msg string) {
+	var pos parse.Pos
+	if s.node != nil {
+		pos = s.node.Start()
+	}
+	s.deprecated(Deprecation{s.templateName(), pos, msg})
+}
+
+// deprecated reports d to the Env's Logger and DeprecationHandler.
+func (s *state) deprecated(d Deprecation) {
+	if s.env.Logger != nil {
+		s.env.Logger.WarnContext(s.context, "deprecated", "template", d.Template, "line", d.Pos.Line, "column", d.Pos.Offset, "message", d.Message)
+	}
+	if s.env.DeprecationHandler != nil {
+		s.env.DeprecationHandler(d)
+	}
+}
+
+// load loads and parses the named template, reporting any deprecated
+// syntax it contains.
+//
+// Each template is loaded once per execution, including by included
+// templates, so parents, includes, and macros that are used repeatedly
+// are neither checked for freshness nor, if the Env's Loader does not
+// allow caching, parsed again each time.
+func (s *state) load(name string) (*parse.Tree, error) {
+	if tree, ok := s.trees[name]; ok {
+		return tree, nil
+	}
+	tree, err := s.env.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.trees == nil {
+		s.trees = make(map[string]*parse.Tree)
+	}
+	s.trees[name] = tree
+	s.reportDeprecations(tree)
+	return tree, nil
+}
+
+// reportDeprecations reports any deprecated syntax in tree.
+func (s *state) reportDeprecations(tree *parse.Tree) {
+	for _, d := range tree.Deprecations {
+		s.deprecated(Deprecation{tree.Name, d.Pos, d.Message})
+	}
+}
+
 // noexport satisfies the Context interface.
 func (s *state) noexport() {}
 
@@ -113,7 +214,8 @@ func (m *metadata) noexport() {}
 //
 // scopeStack implements the exported ContextScope interface.
 type scopeStack struct {
-	scopes []map[string]Value
+	globals map[string]Value // Read-only values available in every scope.
+	scopes  []map[string]Value
 }
 
 // push adds a scope on top of the stack.
@@ -129,6 +231,9 @@ func (s *scopeStack) pop() {
 // All returns a flat map of the current scope.
 func (s *scopeStack) All() map[string]Value {
 	res := make(map[string]Value)
+	for k, v := range s.globals {
+		res[k] = v
+	}
 	for _, scope := range s.scopes {
 		for k, v := range scope {
 			res[k] = v
@@ -153,6 +258,9 @@ func (s *scopeStack) Get(name string) (Value, bool) {
 			return v, true
 		}
 	}
+	if v, ok := s.globals[name]; ok {
+		return v, true
+	}
 	return nil, false
 }
 
@@ -186,33 +294,56 @@ func (s *scopeStack) setLocal(name string, val Value) {
 	s.scopes[len(s.scopes)-1][name] = val
 }
 
-// Method getBlock iterates through each set of blocks, returning the first
-// block with the given name.
-func (s *state) getBlock(name string) *parse.BlockNode {
-	for _, blocks := range s.blocks {
-		if block, ok := blocks[name]; ok {
-			return block
-		}
+// Method walk is the main entry-point into template execution.
+//
+// Any error that occurs while executing node is returned as a RuntimeError.
+// Execution stops once the state's context is cancelled.
+func (s *state) walk(node parse.Node) error {
+	if err := s.context.Err(); err != nil {
+		return s.wrapError(node, err)
+	}
+	if _, ok := node.(*parse.MacroNode); !ok && s.env.Instrumentation != nil {
+		return s.instrument(node, node)
+	}
+	if err := s.walkNode(node); err != nil {
+		return s.wrapError(node, err)
 	}
-
 	return nil
 }
 
-func (s *state) getParentBlock(name string) *parse.BlockNode {
-	rootFound := false
-	for _, blocks := range s.blocks {
-		if block, ok := blocks[name]; ok {
-			if rootFound {
-				return block
-			}
-			rootFound = true
-		}
+// instrument executes body, notifying the Env's Instrumentation about node
+// before and after. Any error that occurs is returned as a RuntimeError.
+func (s *state) instrument(node parse.Node, body parse.Node) error {
+	s.env.Instrumentation.BeforeNode(s, node)
+	start := time.Now()
+	err := s.walkNode(body)
+	if err != nil {
+		err = s.wrapError(body, err)
 	}
-	return nil
+	s.env.Instrumentation.AfterNode(s, node, time.Since(start), err)
+	return err
 }
 
-// Method walk is the main entry-point into template execution.
-func (s *state) walk(node parse.Node) error {
+// write writes str to the output, attributing it to node.
+func (s *state) write(node parse.Node, str string) error {
+	if w, ok := s.out.(*sourceMapWriter); ok {
+		w.template, w.pos = s.name, node.Start()
+	}
+	_, err := io.WriteString(s.out, str)
+	return err
+}
+
+// writeBytes writes b to the output, attributing it to node.
+func (s *state) writeBytes(node parse.Node, b []byte) error {
+	if w, ok := s.out.(*sourceMapWriter); ok {
+		w.template, w.pos = s.name, node.Start()
+	}
+	_, err := s.out.Write(b)
+	return err
+}
+
+// Method walkNode executes the given node.
+func (s *state) walkNode(node parse.Node) error {
 	switch node := node.(type) {
 	case *parse.ModuleNode:
 		if p := node.Parent; p != nil {
@@ -221,15 +352,21 @@ func (s *state) walk(node parse.Node) error {
 				return err
 			}
 			name := CoerceString(tplName)
-			tree, err := s.env.load(name)
+			tree, err := s.load(name)
 			if err != nil {
 				return err
 			}
+			if err := s.nest(); err != nil {
+				return err
+			}
+			defer s.unnest()
+			s.pushFrame("extends", p)
+			defer s.popFrame()
 			defer func(name string) {
 				s.name = name
 			}(s.name)
 			s.name = name
-			s.blocks = append(s.blocks, tree.Blocks())
+			s.pushBlocks(tree.Blocks())
 			err = s.walkChild(node.BodyNode)
 			if err != nil {
 				return err
@@ -238,6 +375,9 @@ func (s *state) walk(node parse.Node) error {
 		}
 		return s.walk(node.BodyNode)
 	case *parse.BodyNode:
+		if p := s.program(node); p != nil {
+			return s.run(p)
+		}
 		for _, c := range node.All() {
 			err := s.walk(c)
 			if err != nil {
@@ -248,19 +388,19 @@ func (s *state) walk(node parse.Node) error {
 		s.localMacros[node.Name] = node
 		return nil
 	case *parse.TextNode:
-		_, err := io.WriteString(s.out, node.Data)
-		return err
+		return s.write(node, node.Data)
 	case *parse.PrintNode:
 		v, err := s.evalExpr(node.X)
 		if err != nil {
 			return err
 		}
-		_, err = io.WriteString(s.out, CoerceString(v))
-		return err
+		return s.print(node, v)
 	case *parse.BlockNode:
 		name := node.Name
 		if block := s.getBlock(name); block != nil {
-			if block.Origin != "" {
+			if block.Origin != "" && block.Origin != s.name {
+				s.pushFrame("block", node)
+				defer s.popFrame()
 				defer func(name string) {
 					s.name = name
 				}(s.name)
@@ -280,6 +420,9 @@ func (s *state) walk(node parse.Node) error {
 		if err != nil {
 			return err
 		}
+		if err := checkUse(v); err != nil {
+			return err
+		}
 		if CoerceBool(v) {
 			return s.walk(node.Body)
 		} else {
@@ -287,24 +430,53 @@ func (s *state) walk(node parse.Node) error {
 		}
 	case *parse.IncludeNode:
 		tpl, ctx, err := s.walkIncludeNode(node)
-		if err != nil {
+		if err != nil || tpl == "" {
+			return err
+		}
+		si := newState(s.context, tpl, s.out, ctx, s.env)
+		defer si.release()
+		if err := s.nest(); err != nil {
+			return err
+		}
+		defer s.unnest()
+		s.pushFrame("include", node)
+		si.frames = append(si.frames, s.frames...)
+		si.iterations, si.depth, si.written = s.iterations, s.depth, s.written
+		s.popFrame()
+		tree := node.Tree
+		if tree != nil && tree.Name == tpl {
+			s.reportDeprecations(tree)
+		} else if tree, err = s.load(tpl); err != nil {
 			return err
 		}
-		err = execute(tpl, s.out, ctx, s.env)
+		si.trees = s.trees
+		si.pushBlocks(tree.Blocks())
+		err = si.walk(tree.Root())
 		if err != nil {
 			return err
 		}
 	case *parse.EmbedNode:
 		tpl, ctx, err := s.walkIncludeNode(node.IncludeNode)
-		if err != nil {
+		if err != nil || tpl == "" {
+			return err
+		}
+		si := newState(s.context, tpl, s.out, ctx, s.env)
+		defer si.release()
+		if err := s.nest(); err != nil {
 			return err
 		}
-		si := newState(tpl, s.out, ctx, s.env)
-		tree, err := s.env.load(tpl)
+		defer s.unnest()
+		s.pushFrame("embed", node)
+		si.frames = append(si.frames, s.frames...)
+		si.iterations, si.depth, si.written = s.iterations, s.depth, s.written
+		s.popFrame()
+		tree, err := s.load(tpl)
 		if err != nil {
 			return err
 		}
-		si.blocks = append(s.blocks, node.Blocks, tree.Blocks())
+		si.trees = s.trees
+		si.pushBlocks(s.blocks...)
+		si.pushBlocks(node.Blocks, tree.Blocks())
 		err = si.walk(tree.Root())
 		if err != nil {
 			return err
@@ -350,14 +522,43 @@ func (s *state) walkChild(node parse.Node) error {
 	return nil
 }
 
+// countIteration records a single loop iteration, returning an error if
+// the Env's MaxLoopIterations is exceeded.
+func (s *state) countIteration() error {
+	*s.iterations++
+	if max := s.env.MaxLoopIterations; max > 0 && *s.iterations > max {
+		return &LoopLimitError{max}
+	}
+	return nil
+}
+
 func (s *state) walkForNode(node *parse.ForNode) error {
 	res, err := s.evalExpr(node.X)
 	if err != nil {
 		return err
 	}
+	return s.iterate(node, res, func() error {
+		return s.walk(node.Body)
+	}, func() error {
+		return s.walk(node.Else)
+	})
+}
+
+// iterate executes the for loop described by node over res, calling body
+// for each iteration, or els if res is empty.
+func (s *state) iterate(node *parse.ForNode, res Value, body, els func() error) error {
+	if err := checkUse(res); err != nil {
+		return err
+	}
 	kn := node.Key
 	vn := node.Val
 	ct, err := Iterate(res, func(k Value, v Value, l Loop) (bool, error) {
+		if err := s.context.Err(); err != nil {
+			return true, err
+		}
+		if err := s.countIteration(); err != nil {
+			return true, err
+		}
 		s.scope.push()
 		defer s.scope.pop()
 
@@ -365,6 +566,10 @@ func (s *state) walkForNode(node *parse.ForNode) error {
 			s.scope.setLocal(kn, k)
 		}
 		s.scope.setLocal(vn, v)
+		if node.NoLoop {
+			err := body()
+			return err != nil, err
+		}
 		loopValue := map[string]Value{
 			"Last":      l.Last,
 			"Index":     l.Index,
@@ -385,7 +590,7 @@ func (s *state) walkForNode(node *parse.ForNode) error {
 
 		s.scope.setLocal("loop", loopValue)
 
-		err := s.walk(node.Body)
+		err := body()
 		if err != nil {
 			return true, err
 		}
@@ -395,19 +600,23 @@ func (s *state) walkForNode(node *parse.ForNode) error {
 		return err
 	}
 	if ct == 0 {
-		return s.walk(node.Else)
+		return els()
 	}
 	return nil
 }
 
 // Method walkInclude determines the necessary parameters for including or embedding a template.
+// The name returned is empty if a missing template is ignored.
 func (s *state) walkIncludeNode(node *parse.IncludeNode) (tpl string, ctx map[string]Value, err error) {
 	ctx = make(map[string]Value)
 	v, err := s.evalExpr(node.Tpl)
 	if err != nil {
 		return "", nil, err
 	}
-	tpl = CoerceString(v)
+	tpl, err = s.includeName(node, v)
+	if err != nil || tpl == "" {
+		return "", nil, err
+	}
 	var with Value
 	if n := node.With; n != nil {
 		with, err = s.evalExpr(n)
@@ -419,37 +628,96 @@ func (s *state) walkIncludeNode(node *parse.IncludeNode) (tpl string, ctx map[st
 	if !node.Only {
 		ctx = s.scope.All()
 	}
-	if with != nil {
-		if with, ok := with.(map[string]Value); ok {
-			for k, v := range with {
-				ctx[k] = v
-			}
+	switch with := with.(type) {
+	case map[string]Value:
+		for k, v := range with {
+			ctx[k] = v
+		}
+	case *OrderedMap:
+		for _, k := range with.Keys() {
+			ctx[k], _ = with.Get(k)
 		}
 	}
 	return tpl, ctx, err
 }
 
+// includeName returns the name of the template to include or embed, given
+// the value v of the tag's template expression. If v is a list of names,
+// the first template that exists is used. An empty name is returned if no
+// template exists and the tag has "ignore missing".
+func (s *state) includeName(node *parse.IncludeNode, v Value) (string, error) {
+	var names []string
+	if IsArray(v) {
+		vals, err := Values(v)
+		if err != nil {
+			return "", err
+		}
+		for _, n := range vals {
+			names = append(names, CoerceString(n))
+		}
+	} else {
+		names = []string{CoerceString(v)}
+		if !node.IgnoreMissing {
+			// Errors are reported when the template is loaded.
+			return names[0], nil
+		}
+	}
+	var last error
+	for _, name := range names {
+		if node.Tree != nil && node.Tree.Name == name {
+			return name, nil
+		}
+		_, err := s.load(name)
+		if err == nil {
+			return name, nil
+		} else if !errors.Is(err, ErrTemplateNotFound) {
+			return "", err
+		}
+		last = err
+	}
+	if node.IgnoreMissing {
+		return "", nil
+	}
+	err := &TemplateNotFoundError{Candidates: names}
+	if len(names) > 0 {
+		err.Name = names[0]
+	}
+	if nf, ok := last.(*TemplateNotFoundError); ok {
+		err.Err = nf.Err
+	}
+	return "", err
+}
+
 func (s *state) walkUseNode(node *parse.UseNode) error {
 	v, err := s.evalExpr(node.Tpl)
 	if err != nil {
 		return err
 	}
 	tpl := CoerceString(v)
-	tree, err := s.env.load(tpl)
+	tree, err := s.load(tpl)
 	if err != nil {
 		return err
 	}
 	blocks := tree.Blocks()
-	for orig, alias := range node.Aliases {
-		v, ok := blocks[orig]
-		if !ok {
-			return errors.New("Unable to locate block with name \"" + orig + "\"")
+	if len(node.Aliases) > 0 {
+		// The tree is shared, so its blocks are copied before adding aliases.
+		aliased := make(map[string]*parse.BlockNode, len(blocks)+len(node.Aliases))
+		for k, v := range blocks {
+			aliased[k] = v
 		}
-		blocks[alias] = v
+		for orig, alias := range node.Aliases {
+			v, ok := blocks[orig]
+			if !ok {
+				return errors.New("Unable to locate block with name \"" + orig + "\"")
+			}
+			aliased[alias] = v
+		}
+		blocks = aliased
 	}
 	l := len(s.blocks)
 	lb := s.blocks[l-1]
 	s.blocks = append(append(s.blocks[:l-1], blocks), lb)
+	s.table = nil
 	return nil
 }
 
@@ -460,17 +728,11 @@ func (s *state) walkSetNode(node *parse.SetNode) error {
 		// when setting a variable with a body, it may contain any number
 		// of any type of node or expression. because of this, the value is
 		// always converted to a string which is stored in the variable name.
-		prevBuf := s.out
-		defer func() {
-			s.out = prevBuf
-		}()
-		buf := &bytes.Buffer{}
-		s.out = buf
-		err := s.walk(node.X)
+		var err error
+		v, err = s.captureMarkup(node.X)
 		if err != nil {
 			return err
 		}
-		v = string(buf.Bytes())
 	case parse.Expr:
 		// evaluates the right side of a basic set statement
 		var err error
@@ -495,34 +757,28 @@ func (s *state) walkDoNode(node *parse.DoNode) error {
 }
 
 func (s *state) walkFilterNode(node *parse.FilterNode) error {
-	prevBuf := s.out
-	defer func() {
-		s.out = prevBuf
-	}()
-	buf := &bytes.Buffer{}
-	s.out = buf
-	err := s.walk(node.Body)
+	val, err := s.capture(func() error {
+		return s.walk(node.Body)
+	})
 	if err != nil {
 		return err
 	}
-	val := string(buf.Bytes())
 	for _, v := range node.Filters {
 		f, ok := s.env.Filters[v]
 		if !ok {
-			return errors.New("undefined filter \"" + v + "\".")
+			if err := s.undeclared("filter", v, node); err != nil {
+				return err
+			}
+			continue
 		}
+		s.node = node
 		val = CoerceString(f(s, val))
 	}
-	io.WriteString(prevBuf, val)
-	return nil
+	return s.write(node, val)
 }
 
 func (s *state) walkImportNode(node *parse.ImportNode) error {
-	tpl, err := s.evalExpr(node.Tpl)
-	if err != nil {
-		return err
-	}
-	tree, err := s.env.load(CoerceString(tpl))
+	tree, err := s.loadMacros(node.Tpl)
 	if err != nil {
 		return err
 	}
@@ -535,11 +791,7 @@ func (s *state) walkImportNode(node *parse.ImportNode) error {
 }
 
 func (s *state) walkFromNode(node *parse.FromNode) error {
-	tpl, err := s.evalExpr(node.Tpl)
-	if err != nil {
-		return err
-	}
-	tree, err := s.env.load(CoerceString(tpl))
+	tree, err := s.loadMacros(node.Tpl)
 	if err != nil {
 		return err
 	}
@@ -554,8 +806,56 @@ func (s *state) walkFromNode(node *parse.FromNode) error {
 	return nil
 }
 
+// importTopLevel adds the macros imported at the top level of the template
+// being executed to locals, the scope of a macro the template defines, as
+// in Twig 2.11 and later. Arguments of the macro take precedence.
+func (s *state) importTopLevel(locals map[string]Value) error {
+	tree, err := s.load(s.name)
+	if err != nil {
+		return err
+	}
+	for _, n := range tree.Root().Nodes {
+		node, ok := n.(*parse.ImportNode)
+		if !ok {
+			continue
+		}
+		if _, ok := locals[node.Alias]; ok {
+			continue
+		}
+		if err := s.walkImportNode(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMacros loads the template named by the expression tpl of an import or
+// from statement. The expression _self refers to the template being
+// executed, which inside a macro is the template that defines the macro.
+func (s *state) loadMacros(tpl parse.Expr) (*parse.Tree, error) {
+	v, err := s.evalExpr(tpl)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.(selfValue); ok {
+		return s.load(s.name)
+	}
+	return s.load(CoerceString(v))
+}
+
 // Method evalExpr evaluates the given expression, returning a Value or error.
-func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
+//
+// Any error that occurs during evaluation is returned as a RuntimeError.
+func (s *state) evalExpr(exp parse.Expr) (Value, error) {
+	v, err := s.evalExprNode(exp)
+	if err != nil {
+		return nil, s.wrapError(exp, err)
+	}
+	return v, nil
+}
+
+// Method evalExprNode evaluates the given expression.
+func (s *state) evalExprNode(exp parse.Expr) (v Value, e error) {
 	switch exp := exp.(type) {
 	case *parse.NullExpr:
 		return nil, nil
@@ -565,11 +865,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		if exp.Name == "_self" {
 			return s.self(), nil
 		}
-		if val, ok := s.scope.Get(exp.Name); ok {
-			v = val
-		} else {
-			e = errors.New("undefined variable \"" + exp.Name + "\"")
-		}
+		return s.variable(exp)
 	case *parse.NumberExpr:
 		num, err := strconv.ParseFloat(exp.Value, 64)
 		if err != nil {
@@ -585,16 +881,15 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		if err != nil {
 			return nil, err
 		}
-		switch exp.Op {
-		case parse.OpUnaryNot:
-			return !CoerceBool(in), nil
-		case parse.OpUnaryPositive:
-			// no-op, +1 = 1, +(-1) = -1, +(false) = 0
-			return CoerceNumber(in), nil
-		case parse.OpUnaryNegative:
-			return -CoerceNumber(in), nil
-		}
+		return s.evalUnary(exp, in)
 	case *parse.BinaryExpr:
+		if s.isDefinedTest(exp) {
+			ok, err := s.defined(exp.Left)
+			if err != nil {
+				return nil, err
+			}
+			return ok == (exp.Op == parse.OpBinaryIs), nil
+		}
 		left, err := s.evalExpr(exp.Left)
 		if err != nil {
 			return nil, err
@@ -603,83 +898,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		if err != nil {
 			return nil, err
 		}
-		switch exp.Op {
-		case parse.OpBinaryAdd:
-			return CoerceNumber(left) + CoerceNumber(right), nil
-		case parse.OpBinarySubtract:
-			return CoerceNumber(left) - CoerceNumber(right), nil
-		case parse.OpBinaryMultiply:
-			return CoerceNumber(left) * CoerceNumber(right), nil
-		case parse.OpBinaryDivide:
-			return CoerceNumber(left) / CoerceNumber(right), nil
-		case parse.OpBinaryFloorDiv:
-			return math.Floor(CoerceNumber(left) / CoerceNumber(right)), nil
-		case parse.OpBinaryModulo:
-			return float64(int(CoerceNumber(left)) % int(CoerceNumber(right))), nil
-		case parse.OpBinaryPower:
-			return math.Pow(CoerceNumber(left), CoerceNumber(right)), nil
-		case parse.OpBinaryConcat:
-			return CoerceString(left) + CoerceString(right), nil
-		case parse.OpBinaryEndsWith:
-			return strings.HasSuffix(CoerceString(left), CoerceString(right)), nil
-		case parse.OpBinaryStartsWith:
-			return strings.HasPrefix(CoerceString(left), CoerceString(right)), nil
-		case parse.OpBinaryIn:
-			return Contains(right, left)
-		case parse.OpBinaryNotIn:
-			res, err := Contains(right, left)
-			if err != nil {
-				return false, err
-			}
-			return !res, nil
-		case parse.OpBinaryIs:
-			if fn, ok := right.(func(v Value) bool); ok {
-				return fn(left), nil
-			}
-			return nil, errors.New("right operand was of unexpected type")
-		case parse.OpBinaryIsNot:
-			if fn, ok := right.(func(v Value) bool); ok {
-				return !fn(left), nil
-			}
-			return nil, errors.New("right operand was of unexpected type")
-		case parse.OpBinaryMatches:
-			reg, err := regexp.Compile(CoerceString(right))
-			if err != nil {
-				return nil, err
-			}
-			return reg.MatchString(CoerceString(left)), nil
-		case parse.OpBinaryEqual:
-			return Equal(left, right), nil
-		case parse.OpBinaryNotEqual:
-			return !Equal(left, right), nil
-		case parse.OpBinaryGreaterEqual:
-			return CoerceNumber(left) >= CoerceNumber(right), nil
-		case parse.OpBinaryGreaterThan:
-			return CoerceNumber(left) > CoerceNumber(right), nil
-		case parse.OpBinaryLessEqual:
-			return CoerceNumber(left) <= CoerceNumber(right), nil
-		case parse.OpBinaryLessThan:
-			return CoerceNumber(left) < CoerceNumber(right), nil
-		case parse.OpBinaryRange:
-			l, r := CoerceNumber(left), CoerceNumber(right)
-			res := make([]float64, uint(math.Ceil(r-l))+1)
-			for i, k := 0, l; k <= r; i, k = i+1, k+1 {
-				res[i] = k
-			}
-			return res, nil
-		case parse.OpBinaryBitwiseAnd:
-			return int(CoerceNumber(left)) & int(CoerceNumber(right)), nil
-		case parse.OpBinaryBitwiseOr:
-			return int(CoerceNumber(left)) | int(CoerceNumber(right)), nil
-		case parse.OpBinaryBitwiseXor:
-			return int(CoerceNumber(left)) ^ int(CoerceNumber(right)), nil
-		case parse.OpBinaryAnd:
-			return CoerceBool(left) && CoerceBool(right), nil
-		case parse.OpBinaryOr:
-			return CoerceBool(left) || CoerceBool(right), nil
-		default:
-			return nil, fmt.Errorf("unsupported binary operator: %s (bug?)", exp.Op)
-		}
+		return s.evalBinary(exp, left, right)
 	case *parse.FuncExpr:
 		return s.evalFunction(exp)
 	case *parse.FilterExpr:
@@ -693,33 +912,11 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		if err != nil {
 			return nil, err
 		}
-		exargs := exp.Args
-		args := make([]Value, len(exargs))
-		for k, e := range exargs {
-			v, err := s.evalExpr(e)
-			if err != nil {
-				return nil, err
-			}
-			args[k] = v
-		}
-		if _, ok := c.(selfValue); ok {
-			if macro, ok := s.localMacros[CoerceString(k)]; ok {
-				return s.callMacro(macroDef{macro}, args...)
-			}
-			// no locally-defined macro defined with the given name, but the
-			// `_self` variable contains other special values such as `templateName`.
-			// this will be handled below by the main call to GetAttr.
-		}
-		if set, ok := c.(macroSet); ok {
-			if macro, ok := set.defs[CoerceString(k)]; ok {
-				return s.callMacro(macro, args...)
-			}
-			return nil, errors.New("undefined macro: " + CoerceString(k))
-		}
-		v, err = GetAttr(c, k, args...)
+		args, named, err := s.evalArgs(exp.Args)
 		if err != nil {
-			e = err
+			return nil, err
 		}
+		return s.getAttr(exp, c, k, args, named)
 	case *parse.TestExpr:
 		if tfn, ok := s.env.Tests[exp.Name]; ok {
 			eargs := exp.Args
@@ -732,22 +929,31 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 				args[i] = v
 			}
 			return func(v Value) bool {
+				s.node = exp
 				return tfn(s, v, args...)
 			}, nil
 		}
-		return nil, fmt.Errorf(`unknown test "%v"`, exp.Name)
+		if err := s.undeclared("test", exp.Name, exp); err != nil {
+			return nil, err
+		}
+		return func(v Value) bool {
+			return false
+		}, nil
 	case *parse.TernaryIfExpr:
 		cond, err := s.evalExpr(exp.Cond)
 		if err != nil {
 			return nil, err
 		}
+		if err := checkUse(cond); err != nil {
+			return nil, err
+		}
 		if CoerceBool(cond) == true {
 			return s.evalExpr(exp.TrueX)
 		}
 		return s.evalExpr(exp.FalseX)
 
 	case *parse.HashExpr:
-		vals := make(map[string]Value)
+		vals := NewOrderedMap()
 		for _, v := range exp.Elements {
 			var key Value
 			var err error
@@ -758,15 +964,24 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 				if err != nil {
 					return nil, err
 				}
+				if key, err = use(key); err != nil {
+					return nil, err
+				}
 			}
 			val, err := s.evalExpr(v.Value)
 			if err != nil {
 				return nil, err
 			}
-			vals[CoerceString(key)] = val
+			if val, err = use(val); err != nil {
+				return nil, err
+			}
+			vals.Set(CoerceString(key), val)
 		}
 		return vals, nil
 
+	case *parse.NamedArgExpr:
+		return nil, errNamedArgs
+
 	case *parse.ArrayExpr:
 		vals := make([]Value, len(exp.Elements))
 		for i, v := range exp.Elements {
@@ -774,6 +989,9 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 			if err != nil {
 				return nil, err
 			}
+			if val, err = use(val); err != nil {
+				return nil, err
+			}
 			vals[i] = val
 		}
 		return vals, nil
@@ -781,10 +999,302 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 	default:
 		return nil, fmt.Errorf("unable to evaluate unsupported Expr type: %T (bug?)", exp)
 	}
+}
+
+// variable returns the value of the variable referenced by exp.
+func (s *state) variable(exp *parse.NameExpr) (Value, error) {
+	if val, ok := s.scope.Get(exp.Name); ok {
+		return val, nil
+	}
+	if s.env.StrictVariables {
+		return nil, fmt.Errorf("%w \"%s\"", ErrUndefinedVariable, exp.Name)
+	}
+	s.debug(exp, "undefined variable", "name", exp.Name)
+	return s.undefined(exp), nil
+}
+
+// evalUnary applies the operator of exp to the evaluated operand, after
+// checking that it can be used.
+func (s *state) evalUnary(exp *parse.UnaryExpr, in Value) (Value, error) {
+	op := exp.Op
+	in, err := use(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkUnaryType(op, in); err != nil {
+		return nil, err
+	}
+	if op != parse.OpUnaryNot {
+		s.warnNonNumeric(exp, op, in)
+	}
+	return unary(op, in), nil
+}
+
+// warnNonNumeric emits a warning for each of vals that is a string other
+// than a number, which PHP also warns about when it is an operand of an
+// arithmetic operator. The number that such a string starts with is used,
+// or 0 if it does not start with one. Warnings are reported at the position
+// of node.
+func (s *state) warnNonNumeric(node parse.Node, op string, vals ...Value) {
+	for _, v := range vals {
+		if sv, ok := v.(SafeValue); ok {
+			v = sv.Value()
+		}
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if _, kind := parseNumeric(str); kind != numeric {
+			s.node = node
+			s.Warn(fmt.Errorf("%w \"%s\" used with \"%s\"", ErrNonNumeric, str, op))
+		}
+	}
+}
+
+// unary applies the unary operator op to in.
+func unary(op string, in Value) Value {
+	switch op {
+	case parse.OpUnaryNot:
+		return !CoerceBool(in)
+	case parse.OpUnaryPositive:
+		// no-op, +1 = 1, +(-1) = -1, +(false) = 0
+		return CoerceNumber(in)
+	case parse.OpUnaryNegative:
+		return -CoerceNumber(in)
+	}
+	return nil
+}
+
+// evalBinary applies the operator of exp to the evaluated operands.
+func (s *state) evalBinary(exp *parse.BinaryExpr, left, right Value) (Value, error) {
+	if exp.Op == parse.OpBinaryIs || exp.Op == parse.OpBinaryIsNot {
+		// Tests may be applied to any undefined value, which is nil.
+		if _, ok := left.(Undefined); ok {
+			left = nil
+		}
+	} else {
+		var err error
+		if left, err = use(left); err != nil {
+			return nil, err
+		}
+		if right, err = use(right); err != nil {
+			return nil, err
+		}
+		if err = s.checkTypes(exp.Op, left, right); err != nil {
+			return nil, err
+		}
+		switch exp.Op {
+		case parse.OpBinaryAdd, parse.OpBinarySubtract, parse.OpBinaryMultiply,
+			parse.OpBinaryDivide, parse.OpBinaryFloorDiv, parse.OpBinaryModulo,
+			parse.OpBinaryPower, parse.OpBinaryBitwiseAnd, parse.OpBinaryBitwiseOr,
+			parse.OpBinaryBitwiseXor:
+			s.warnNonNumeric(exp, exp.Op, left, right)
+		}
+	}
+	switch exp.Op {
+	case parse.OpBinaryAdd:
+		return Add(left, right), nil
+	case parse.OpBinarySubtract:
+		return Sub(left, right), nil
+	case parse.OpBinaryMultiply:
+		return Mul(left, right), nil
+	case parse.OpBinaryDivide:
+		return Div(left, right), nil
+	case parse.OpBinaryFloorDiv:
+		return math.Floor(CoerceNumber(left) / CoerceNumber(right)), nil
+	case parse.OpBinaryModulo:
+		return modulo(left, right)
+	case parse.OpBinaryPower:
+		return math.Pow(CoerceNumber(left), CoerceNumber(right)), nil
+	case parse.OpBinaryConcat:
+		return CoerceString(left) + CoerceString(right), nil
+	case parse.OpBinaryEndsWith:
+		return strings.HasSuffix(CoerceString(left), CoerceString(right)), nil
+	case parse.OpBinaryStartsWith:
+		return strings.HasPrefix(CoerceString(left), CoerceString(right)), nil
+	case parse.OpBinaryIn:
+		return Contains(right, left)
+	case parse.OpBinaryNotIn:
+		res, err := Contains(right, left)
+		if err != nil {
+			return false, err
+		}
+		return !res, nil
+	case parse.OpBinaryIs:
+		if fn, ok := right.(func(v Value) bool); ok {
+			return fn(left), nil
+		}
+		return nil, errors.New("right operand was of unexpected type")
+	case parse.OpBinaryIsNot:
+		if fn, ok := right.(func(v Value) bool); ok {
+			return !fn(left), nil
+		}
+		return nil, errors.New("right operand was of unexpected type")
+	case parse.OpBinaryMatches:
+		reg, err := regexp.Compile(CoerceString(right))
+		if err != nil {
+			return nil, err
+		}
+		return reg.MatchString(CoerceString(left)), nil
+	case parse.OpBinaryEqual:
+		return Equal(left, right), nil
+	case parse.OpBinaryNotEqual:
+		return !Equal(left, right), nil
+	case parse.OpBinaryGreaterEqual:
+		c := compare(left, right)
+		return c == 0 || c == 1, nil
+	case parse.OpBinaryGreaterThan:
+		return compare(left, right) == 1, nil
+	case parse.OpBinaryLessEqual:
+		c := compare(left, right)
+		return c == 0 || c == -1, nil
+	case parse.OpBinaryLessThan:
+		return compare(left, right) == -1, nil
+	case parse.OpBinaryRange:
+		l, r := CoerceNumber(left), CoerceNumber(right)
+		if max := s.env.MaxLoopIterations; max > 0 && math.Abs(r-l) >= float64(max) {
+			return nil, &LoopLimitError{max}
+		}
+		return numberRange(l, r), nil
+	case parse.OpBinaryBitwiseAnd:
+		return int(CoerceNumber(left)) & int(CoerceNumber(right)), nil
+	case parse.OpBinaryBitwiseOr:
+		return int(CoerceNumber(left)) | int(CoerceNumber(right)), nil
+	case parse.OpBinaryBitwiseXor:
+		return int(CoerceNumber(left)) ^ int(CoerceNumber(right)), nil
+	case parse.OpBinaryAnd:
+		return CoerceBool(left) && CoerceBool(right), nil
+	case parse.OpBinaryOr:
+		return CoerceBool(left) || CoerceBool(right), nil
+	default:
+		if op, ok := s.env.Operators[exp.Op]; ok {
+			return op.Func(s, left, right), nil
+		}
+		return nil, fmt.Errorf("unsupported binary operator: %s (bug?)", exp.Op)
+	}
+}
 
+// findBlock returns the block named by the first argument of a call to the
+// block function and the name, or a nil block if there is none. If a
+// template is given as the second argument, the block is looked up in that
+// template instead of the current template and its parents.
+func (s *state) findBlock(exp *parse.FuncExpr) (*parse.BlockNode, string, error) {
+	if len(exp.Args) != 1 && len(exp.Args) != 2 {
+		return nil, "", errors.New("block expects one or two parameters")
+	}
+	val, err := s.evalExpr(exp.Args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	name := CoerceString(val)
+	if len(exp.Args) == 1 {
+		return s.getBlock(name), name, nil
+	}
+	tpl, err := s.evalExpr(exp.Args[1])
+	if err != nil {
+		return nil, "", err
+	}
+	tree, err := s.load(CoerceString(tpl))
+	if err != nil {
+		return nil, "", err
+	}
+	return tree.Blocks()[name], name, nil
+}
+
+// selfMacro returns the named macro of the template being executed, which
+// inside a macro is the template that defines the macro, so that macros can
+// call themselves and each other using _self.
+func (s *state) selfMacro(name string) (*parse.MacroNode, bool) {
+	if macro, ok := s.localMacros[name]; ok && (macro.Origin == "" || macro.Origin == s.name) {
+		return macro, true
+	}
+	tree, err := s.load(s.name)
+	if err != nil {
+		return nil, false
+	}
+	macro, ok := tree.Macros()[name]
+	return macro, ok
+}
+
+// getAttr returns the attribute k of the evaluated container c, calling
+// macros if c is _self or an imported macro set.
+func (s *state) getAttr(exp *parse.GetAttrExpr, c, k Value, args []Value, named map[string]Value) (Value, error) {
+	if err := checkUse(c); err != nil {
+		return nil, err
+	}
+	if _, ok := c.(selfValue); ok {
+		if macro, ok := s.selfMacro(CoerceString(k)); ok {
+			return s.callMacro(exp, macroDef{macro}, args, named)
+		}
+		// no locally-defined macro defined with the given name, but the
+		// `_self` variable contains other special values such as `templateName`.
+		// this will be handled below by the main call to GetAttr.
+	}
+	if set, ok := c.(macroSet); ok {
+		if macro, ok := set.defs[CoerceString(k)]; ok {
+			return s.callMacro(exp, macro, args, named)
+		}
+		return nil, errors.New("undefined macro: " + CoerceString(k))
+	}
+	if len(named) > 0 {
+		return nil, errNamedArgs
+	}
+	v, ok, err := s.env.readAttr(c, k, args)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		// Attributes that cannot be read are undefined.
+		return s.undefined(exp), nil
+	}
 	return v, nil
 }
 
+// GetAttr returns the attribute of val, called with args if it is a method,
+// as read by templates executed by the Env: using its AttrResolver, if any,
+// and subject to its SecurityPolicy. Attributes that cannot be read are nil.
+func (env *Env) GetAttr(val, attr Value, args ...Value) (Value, error) {
+	v, _, err := env.readAttr(val, attr, args)
+	return v, err
+}
+
+// readAttr returns the attribute k of c, called with args if it is a
+// method, and whether c has such an attribute. The attribute is read by the
+// Env's AttrResolver, if it has one that resolves it, and otherwise by
+// GetAttr.
+//
+// Attributes that c provides itself, as an AttrProvider, are not checked
+// by the SecurityPolicy; any others, including the fields and methods
+// GetAttr falls back to, are.
+func (env *Env) readAttr(c, k Value, args []Value) (Value, bool, error) {
+	name := CoerceString(k)
+	var pv Value
+	provided := false
+	if p, ok := c.(AttrProvider); ok && len(args) == 0 {
+		pv, provided = p.GetAttr(name)
+	}
+	if !provided {
+		if err := env.checkAttr(c, k); err != nil {
+			return nil, false, err
+		}
+	}
+	if r := env.AttrResolver; r != nil && len(args) == 0 {
+		if v, ok, err := r(c, name); ok || err != nil {
+			return v, ok, err
+		}
+	}
+	if provided {
+		if dv, ok := driverValue(pv); ok {
+			return dv, true, nil
+		}
+		return pv, true, nil
+	}
+	v, err := GetAttr(c, k, args...)
+	if err != nil {
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
 func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 	fnName := exp.Name
 	switch fnName {
@@ -794,64 +1304,52 @@ func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 		}
 		name := s.current.Name
 		if blk := s.getParentBlock(name); blk != nil {
-			pout := s.out
-			buf := &bytes.Buffer{}
-			s.out = buf
-			if err := s.walk(blk.Body); err != nil {
-				return nil, err
-			}
-			s.out = pout
-			return buf.String(), nil
+			return s.captureMarkup(blk.Body)
 		}
 		return nil, errors.New("Unable to locate block \"" + name + "\"")
 	case "block":
-		eargs := exp.Args
-		if len(eargs) != 1 {
-			return nil, errors.New("block expects one parameter")
-		}
-		val, err := s.evalExpr(eargs[0])
+		blk, name, err := s.findBlock(exp)
 		if err != nil {
 			return nil, err
 		}
-		name := CoerceString(val)
-		if blk := s.getBlock(name); blk != nil {
-			pout := s.out
-			buf := &bytes.Buffer{}
-			s.out = buf
-			err = s.walk(blk.Body)
-			if err != nil {
-				return nil, err
-			}
-			s.out = pout
-			return buf.String(), nil
+		if blk == nil {
+			return nil, errors.New("Unable to locate block \"" + name + "\"")
 		}
-		return nil, errors.New("Unable to locate block \"" + name + "\"")
+		return s.captureMarkup(blk.Body)
 	}
 	if macro, ok := s.macros[fnName]; ok {
-		eargs := exp.Args
-		args := make([]Value, len(eargs))
-		for i, e := range eargs {
-			v, err := s.evalExpr(e)
-			if err != nil {
-				return nil, err
-			}
-			args[i] = v
+		args, named, err := s.evalArgs(exp.Args)
+		if err != nil {
+			return nil, err
 		}
-		return s.callMacro(macroDef{macro}, args...)
+		return s.callMacro(exp, macroDef{macro}, args, named)
 	}
-	if fn, ok := s.env.Functions[fnName]; ok {
-		eargs := exp.Args
-		args := make([]Value, len(eargs))
-		for i, e := range eargs {
-			v, err := s.evalExpr(e)
-			if err != nil {
-				return nil, err
-			}
-			args[i] = v
+	fn, ok := s.env.Functions[fnName]
+	var callable Callable
+	if !ok {
+		// A variable holding a Callable can be called like a function.
+		v, _ := s.scope.Get(fnName)
+		if callable, ok = v.(Callable); !ok {
+			return nil, s.undeclared("function", fnName, exp)
+		}
+	}
+	eargs := exp.Args
+	args := make([]Value, len(eargs))
+	for i, e := range eargs {
+		v, err := s.evalExpr(e)
+		if err == nil {
+			err = checkUse(v)
 		}
-		return fn(s, args...), nil
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	s.node = exp
+	if callable != nil {
+		return callable.Call(s, args...)
 	}
-	return nil, errors.New("Undeclared function \"" + fnName + "\"")
+	return fn(s, args...), nil
 }
 
 func (s *state) evalFilter(exp *parse.FilterExpr) (Value, error) {
@@ -864,14 +1362,116 @@ func (s *state) evalFilter(exp *parse.FilterExpr) (Value, error) {
 		args := make([]Value, len(eargs))
 		for i, e := range eargs {
 			v, err := s.evalExpr(e)
+			if i == 0 && ftName == "default" {
+				// The default filter is used to handle undefined variables,
+				// so they must not cause an error, even in strict mode.
+				if errors.Is(err, ErrUndefinedVariable) {
+					continue
+				}
+			} else if err == nil {
+				err = checkUse(v)
+			}
 			if err != nil {
 				return nil, err
 			}
 			args[i] = v
 		}
+		s.node = exp
 		return fn(s, args[0], args[1:]...), nil
 	}
-	return nil, errors.New("Undeclared filter \"" + ftName + "\"")
+	if err := s.undeclared("filter", ftName, exp); err != nil {
+		return nil, err
+	}
+	if len(exp.Args) == 0 {
+		return nil, nil
+	}
+	// The filtered value is passed through unchanged.
+	return s.evalExpr(exp.Args[0])
+}
+
+// undeclared handles a reference to an undefined filter, function, or test
+// according to the Env's UndefinedPolicy. A nil error is returned if execution
+// should continue.
+func (s *state) undeclared(kind, name string, node parse.Node) error {
+	if s.env.UndefinedPolicy == PolicyIgnore {
+		return nil
+	}
+	var candidates []string
+	switch kind {
+	case "filter":
+		candidates = filterNames(s.env)
+	case "function":
+		candidates = functionNames(s.env)
+		for k := range s.macros {
+			candidates = append(candidates, k)
+		}
+	case "test":
+		candidates = testNames(s.env)
+	}
+	var pos parse.Pos
+	if node != nil {
+		pos = node.Start()
+	}
+	err := &UndeclaredError{kind, name, s.name, pos, suggest(name, candidates)}
+	if s.env.UndefinedPolicy == PolicyWarn {
+		s.node = node
+		s.Warn(err)
+		return nil
+	}
+	return err
+}
+
+// ApplyFilter applies the named filter to val, as though it were used in the
+// named template. The Context passed to the filter has an empty scope.
+//
+// References to undefined filters are handled according to the Env's
+// UndefinedPolicy; if execution may continue, val is returned unchanged.
+func (env *Env) ApplyFilter(tpl, name string, val Value, args ...Value) (Value, error) {
+	s := newState(context.Background(), tpl, ioutil.Discard, make(map[string]Value), env)
+	defer s.release()
+	fn, ok := env.Filters[name]
+	if !ok {
+		return val, s.undeclared("filter", name, nil)
+	}
+	return fn(s, val, args...), nil
+}
+
+// CallFunction calls the named function, as though it were used in the named
+// template. The Context passed to the function has an empty scope.
+//
+// References to undefined functions are handled according to the Env's
+// UndefinedPolicy; if execution may continue, nil is returned.
+func (env *Env) CallFunction(tpl, name string, args ...Value) (Value, error) {
+	s := newState(context.Background(), tpl, ioutil.Discard, make(map[string]Value), env)
+	defer s.release()
+	fn, ok := env.Functions[name]
+	if !ok {
+		return nil, s.undeclared("function", name, nil)
+	}
+	return fn(s, args...), nil
+}
+
+// CallValue calls fn, as though it were called in the named template. The
+// Context passed to it has an empty scope.
+func (env *Env) CallValue(tpl string, fn Callable, args ...Value) (Value, error) {
+	s := newState(context.Background(), tpl, ioutil.Discard, make(map[string]Value), env)
+	defer s.release()
+	return fn.Call(s, args...)
+}
+
+// ApplyTest applies the named test to val, as though it were used in the
+// named template. The Context passed to the test has an empty scope.
+//
+// References to undefined tests are handled according to the Env's
+// UndefinedPolicy; if execution may continue, false is returned.
+func (env *Env) ApplyTest(tpl, name string, val Value, args ...Value) (bool, error) {
+	s := newState(context.Background(), tpl, ioutil.Discard, make(map[string]Value), env)
+	defer s.release()
+	fn, ok := env.Tests[name]
+	if !ok {
+		return false, s.undeclared("test", name, nil)
+	}
+	return fn(s, val, args...), nil
 }
 
 type macroDef struct {
@@ -882,63 +1482,389 @@ type macroSet struct {
 	defs map[string]macroDef
 }
 
-func (s *state) callMacro(macro macroDef, args ...Value) (Value, error) {
-	s.scope.push()
-	defer s.scope.pop()
-	for i, name := range macro.Args {
-		if i >= len(args) {
-			s.scope.setLocal(name, nil)
+// errNamedArgs is returned when named arguments are used outside of a macro call.
+var errNamedArgs = errors.New("named arguments are only supported in macro calls")
+
+// evalArgs evaluates the given call arguments, returning positional and
+// named arguments separately.
+func (s *state) evalArgs(exprs []parse.Expr) (args []Value, named map[string]Value, err error) {
+	args = make([]Value, 0, len(exprs))
+	for _, e := range exprs {
+		if n, ok := e.(*parse.NamedArgExpr); ok {
+			v, err := s.evalExpr(n.X)
+			if err != nil {
+				return nil, nil, err
+			}
+			if named == nil {
+				named = make(map[string]Value)
+			}
+			named[n.Name] = v
+			continue
+		}
+		v, err := s.evalExpr(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	return args, named, nil
+}
+
+// callMacro executes the given macro, returning its output.
+//
+// Macros are executed in their own scope: they have access only to their
+// arguments, any globals defined on the Env, and the macros imported at the
+// top level of the template defining them, not the caller's context.
+// Arguments are bound by position and then by name. Missing arguments
+// receive their default value, if any, otherwise nil. Extra positional
+// arguments are available in the macro as "varargs".
+func (s *state) callMacro(node parse.Node, macro macroDef, args []Value, named map[string]Value) (Value, error) {
+	if err := s.nest(); err != nil {
+		return nil, err
+	}
+	defer s.unnest()
+	locals := make(map[string]Value)
+	varargs := make([]Value, 0)
+	for i, v := range args {
+		if i < len(macro.Args) {
+			locals[macro.Args[i]] = v
 		} else {
-			s.scope.setLocal(name, args[i])
+			varargs = append(varargs, v)
 		}
 	}
-	defer func(buf io.Writer) {
-		s.out = buf
-	}(s.out)
-	buf := &bytes.Buffer{}
-	s.out = buf
-	if macro.Origin != "" {
+	for name, v := range named {
+		if _, ok := locals[name]; ok {
+			return nil, fmt.Errorf(`argument "%s" is defined twice for macro "%s"`, name, macro.Name)
+		}
+		if !contains(macro.Args, name) {
+			return nil, fmt.Errorf(`macro "%s" has no argument named "%s"`, macro.Name, name)
+		}
+		locals[name] = v
+	}
+	locals["varargs"] = varargs
+
+	prevScope := s.scope
+	s.scope = &scopeStack{s.env.Globals, []map[string]Value{locals}}
+	defer func() {
+		s.scope = prevScope
+	}()
+	if macro.Origin != "" && macro.Origin != s.name {
+		s.pushFrame("macro", node)
+		defer s.popFrame()
 		defer func(name string) {
 			s.name = name
 		}(s.name)
 		s.name = macro.Origin
 	}
-	err := s.walk(macro.Body)
+	if err := s.importTopLevel(locals); err != nil {
+		return nil, err
+	}
+	// Default values are evaluated lazily, in the macro's scope.
+	for _, name := range macro.Args {
+		if _, ok := locals[name]; ok {
+			continue
+		}
+		var v Value
+		if def, ok := macro.Defaults[name]; ok {
+			var err error
+			v, err = s.evalExpr(def)
+			if err != nil {
+				return nil, err
+			}
+		}
+		locals[name] = v
+	}
+	res, err := s.capture(func() error {
+		if s.env.Instrumentation != nil {
+			return s.instrument(macro.MacroNode, macro.Body)
+		}
+		return s.walk(macro.Body)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return buf.String(), nil
+	return newMarkup(res), nil
+}
+
+// contains returns true if needle is in haystack.
+func contains(haystack []string, needle string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
 }
 
 // execute kicks off execution of the given template.
-func execute(name string, out io.Writer, ctx map[string]Value, env *Env) error {
-	if ctx == nil {
-		ctx = make(map[string]Value)
+func execute(c context.Context, name string, out io.Writer, ctx map[string]Value, env *Env) error {
+	s := newRootState(c, name, out, ctx, env)
+	defer s.release()
+	return s.executeRoot()
+}
+
+// executeRoot executes the state's template from the beginning.
+func (s *state) executeRoot() (err error) {
+	if m := s.env.Metrics; m != nil {
+		defer measureRender(m, s.name, time.Now(), &err)
 	}
-	s := newState(name, out, ctx, env)
-	tree, err := s.env.load(name)
+	tree, err := s.load(s.name)
 	if err != nil {
 		return err
 	}
-	s.blocks = append(s.blocks, tree.Blocks())
-	err = s.walk(tree.Root())
+	s.pushBlocks(tree.Blocks())
+	return s.walk(tree.Root())
+}
+
+// executeBlock executes only the named block of the given template. The
+// block is resolved through the template's inheritance chain.
+func executeBlock(c context.Context, name, block string, out io.Writer, ctx map[string]Value, env *Env) (err error) {
+	s := newRootState(c, name, out, ctx, env)
+	defer s.release()
+	if m := env.Metrics; m != nil {
+		defer measureRender(m, name, time.Now(), &err)
+	}
+	tree, err := s.load(name)
 	if err != nil {
 		return err
 	}
-	return nil
+	s.pushBlocks(tree.Blocks())
+	for module := tree.Root(); module.Parent != nil; module = tree.Root() {
+		if err := s.walkChild(module.BodyNode); err != nil {
+			return s.wrapError(module, err)
+		}
+		v, err := s.evalExpr(module.Parent.Tpl)
+		if err != nil {
+			return err
+		}
+		tree, err = s.load(CoerceString(v))
+		if err != nil {
+			return s.wrapError(module.Parent, err)
+		}
+		s.pushBlocks(tree.Blocks())
+	}
+	blk := s.getBlock(block)
+	if blk == nil {
+		return fmt.Errorf("block \"%s\" not found in template \"%s\"", block, name)
+	}
+	return s.walk(blk)
+}
+
+// measureRender reports the rendering of the named template, which started
+// at start and resulted in *err, to m.
+func measureRender(m Metrics, name string, start time.Time, err *error) {
+	m.Render(name, time.Since(start), *err)
+}
+
+// executeMacro calls the named macro defined in the given template,
+// returning its output.
+func executeMacro(c context.Context, name, macro string, args []Value, env *Env) (string, error) {
+	s := newRootState(c, name, ioutil.Discard, nil, env)
+	defer s.release()
+	tree, err := s.load(name)
+	if err != nil {
+		return "", err
+	}
+	macros := tree.Macros()
+	def, ok := macros[macro]
+	if !ok {
+		return "", fmt.Errorf("macro \"%s\" not found in template \"%s\"", macro, name)
+	}
+	for k, v := range macros {
+		s.localMacros[k] = v
+	}
+	v, err := s.callMacro(def, macroDef{def}, args, nil)
+	if err != nil {
+		return "", s.wrapError(def, err)
+	}
+	return CoerceString(v), nil
+}
+
+// newRootState returns a state for executing the named template with the
+// given context data.
+func newRootState(c context.Context, name string, out io.Writer, ctx map[string]Value, env *Env) *state {
+	if c == nil {
+		c = context.Background()
+	}
+	// the root scope is copied so that set statements never modify the
+	// caller's map.
+	root := make(map[string]Value, len(ctx))
+	for k, v := range ctx {
+		root[k] = v
+	}
+	if env.ContextDecorator != nil {
+		env.ContextDecorator(c, root)
+	}
+	var written *int64
+	if env.MaxOutputBytes > 0 {
+		written = new(int64)
+		out = &limitWriter{w: out, limit: env.MaxOutputBytes, n: written}
+	}
+	out = &errWriter{w: out}
+	s := newState(c, name, out, root, env)
+	s.written = written
+	return s
+}
+
+// executeBuffered executes the named template, writing the output to out
+// only if execution succeeds.
+func executeBuffered(c context.Context, name string, out io.Writer, ctx map[string]Value, env *Env) error {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := execute(c, name, buf, ctx, env); err != nil {
+		return err
+	}
+	return env.writeOutput(name, buf, out)
 }
 
-// Method load attempts to load and parse the given template.
+// writeOutput writes the buffered output of the named template to out,
+// after passing it through the Env's OutputFilter, if any.
+func (env *Env) writeOutput(name string, buf *bytes.Buffer, out io.Writer) error {
+	if env.OutputFilter == nil {
+		_, err := buf.WriteTo(out)
+		return err
+	}
+	res, err := env.OutputFilter(name, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("output filter: %w", err)
+	}
+	_, err = out.Write(res)
+	return err
+}
+
+// Method load attempts to load and parse the given template, applying the
+// Env's Optimizations. Parsed templates are cached; the returned Tree is
+// shared and must not be modified.
 func (env *Env) load(name string) (*parse.Tree, error) {
-	tpl, err := env.Loader.Load(name)
+	return env.cached(name)
+}
+
+// Method compile loads and parses the given template, then applies the
+// Env's Optimizations.
+func (env *Env) compile(name string) (*cacheEntry, error) {
+	tree, size, err := env.prepare(name)
 	if err != nil {
 		return nil, err
 	}
-	tree := parse.NewNamedTree(name, tpl.Contents())
+	if env.Optimizations == 0 {
+		return &cacheEntry{tree: tree, size: size}, nil
+	}
+	o := &optimizer{env: env}
+	o.optimize(tree)
+	return &cacheEntry{tree: tree, deps: o.inlined, size: size + o.size}, nil
+}
+
+// prepare loads and parses the given template, then applies contextual
+// escaping if it is enabled for the template. The size of the template's
+// source, in bytes, is also returned.
+func (env *Env) prepare(name string) (*parse.Tree, int64, error) {
+	tree, size, err := env.parse(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if env.ContextualEscaping && env.escapeStrategy(name) == "html" {
+		if err := env.contextualize(tree); err != nil {
+			return nil, 0, err
+		}
+	}
+	return tree, size, nil
+}
+
+// Method parse attempts to load and parse the given template. The size of
+// the template's source, in bytes, is also returned.
+func (env *Env) parse(name string) (*parse.Tree, int64, error) {
+	tpl, err := env.Loader.Load(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, &TemplateNotFoundError{Name: name, Err: err}
+		}
+		return nil, 0, err
+	}
+	if env.CacheDir != "" {
+		return env.parseCached(name, tpl)
+	}
+	r := &countingReader{r: tpl.Contents()}
+	tree, err := env.parseTree(name, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tree, r.n, nil
+}
+
+// parseCached parses the given template, using the parsed template stored
+// in the Env's CacheDir if there is one.
+func (env *Env) parseCached(name string, tpl Template) (*parse.Tree, int64, error) {
+	src, err := ioutil.ReadAll(tpl.Contents())
+	if err != nil {
+		return nil, 0, err
+	}
+	path := env.diskCachePath(name, src)
+	if tree := env.loadCachedTree(path); tree != nil {
+		if env.Logger != nil {
+			env.Logger.DebugContext(context.Background(), "template loaded from cache directory", "template", name)
+		}
+		return tree, int64(len(src)), nil
+	}
+	tree, err := env.parseTree(name, bytes.NewReader(src))
+	if err != nil {
+		return nil, 0, err
+	}
+	env.storeCachedTree(path, tree)
+	return tree, int64(len(src)), nil
+}
+
+// parseTree parses the named template from r.
+func (env *Env) parseTree(name string, r io.Reader) (*parse.Tree, error) {
+	tree := parse.NewNamedTree(name, r)
 	tree.Visitors = append(tree.Visitors, env.Visitors...)
-	err = tree.Parse()
+	tree.Tags = env.Tags
+	for k, op := range env.Operators {
+		tree.DefineOperator(k, op.Precedence, op.RightAssoc)
+	}
+	err := tree.Parse()
 	if err != nil {
 		return nil, err
 	}
+	if env.Logger != nil {
+		env.Logger.DebugContext(context.Background(), "template loaded", "template", name)
+	}
 	return tree, nil
 }
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// numberRange returns the numbers from l to r, inclusive, counting down if
+// r is less than l. No numbers are returned if either is not finite.
+func numberRange(l, r float64) []float64 {
+	n, step := r-l, 1.0
+	if n < 0 {
+		n, step = -n, -1
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return []float64{}
+	}
+	res := make([]float64, int(n)+1)
+	for i := range res {
+		res[i] = l + float64(i)*step
+	}
+	return res
+}
+
+// modulo returns the remainder of dividing left by right, as integers.
+func modulo(left, right Value) (Value, error) {
+	r := int(CoerceNumber(right))
+	if r == 0 {
+		return nil, errors.New("modulo by zero")
+	}
+	return float64(int(CoerceNumber(left)) % r), nil
+}
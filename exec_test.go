@@ -2,11 +2,19 @@ package stick
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/tyler-sommer/stick/parse"
 )
 
@@ -82,11 +90,17 @@ var tests = []execTest{
 		`{% for i in 1..3 %}{{ i }}{{ loop.index }}{{ loop.index0 }}{{ loop.revindex }}{{ loop.revindex0 }}{{ loop.length }}{% if loop.first %}f{% endif %}{% if loop.last %}l{% endif %}{% endfor %}`,
 		expect(`110323f221213332103l`),
 	),
+	newExecTest(
+		"For iterator",
+		`{% for v in seq %}{{ loop.index }}:{{ v }}{% if not loop.last %}, {% endif %}{% endfor %}`,
+		expect(`1:a, 2:b`),
+		withContext(map[string]Value{"seq": testSeq("a", "b")}),
+	),
 	newExecTest("For else", `{% for i in emptySet %}{{ i }}{% else %}No results.{% endfor %}`, expect(`No results.`), withContext(map[string]Value{"emptySet": []int{}})),
 	newExecTest(
 		"For map",
 		`{% for k, v in data %}Record {{ loop.index }}: {{ k }}: {{ v }}{% if not loop.last %} - {% endif %}{% endfor %}`,
-		expect(`Record 1: Group A: 5.12 - Record 2: Group B: 5.09`, `Record 1: Group B: 5.09 - Record 2: Group A: 5.12`),
+		expect(`Record 1: Group A: 5.12 - Record 2: Group B: 5.09`),
 		withContext(map[string]Value{"data": map[string]float64{"Group A": 5.12, "Group B": 5.09}}),
 	),
 	newExecTest(
@@ -94,8 +108,51 @@ var tests = []execTest{
 		`{{ 4.5 * 10 }} - {{ 3 + true }} - {{ 3 + 4 == 7.0 }} - {{ 10 % 2 == 0 }} - {{ 10 ** 2 > 99.9 and 10 ** 2 <= 100 }}`,
 		expect(`45 - 4 - 1 - 1 - 1`),
 	),
+	newExecTest("Number printing", `{{ 7.0 }} {{ 10 / 4 }} {{ 10 / 3 }} {{ 0.1 + 0.2 }} {{ 10 ** 21 }}`, expect(`7 2.5 3.3333333333333 0.3 1.0E+21`)),
+	newExecTest("Iterable and AttrProvider", `{% for r in rows %}{{ r.name }} ({{ r.Kind }}){{ loop.revindex }}{% endfor %}`, expect(`Ann (record)2Bo (record)1`), withContext(map[string]Value{
+		"rows": &testSizedCursor{testCursor{vals: []Value{testRecord{map[string]Value{"name": "Ann"}}, testRecord{map[string]Value{"name": "Bo"}}}}},
+	})),
+	newExecTest("Custom comparison", `{{ (v > '1.9') ? 'newer' : 'older' }} {{ (v == '1.10.0') ? 'same' : 'different' }} {{ (id == 'ABC-1') ? 'match' : 'mismatch' }} {{ ('abc-1' in [id]) ? 'found' : 'missing' }}`, expect(`newer same match found`), withContext(map[string]Value{
+		"v":  testVersion("1.10"),
+		"id": testUUID("abc-1"),
+	})),
+	newExecTest("Exact arithmetic", `{{ price * qty }} {{ price + 0.01 }} {{ (a + b == c) ? 'exact' : 'inexact' }} {{ big * 1000 + 1 }}`, expect(`59.97 20 exact 123456789012345678901001`), withContext(map[string]Value{
+		"price": decimal.RequireFromString("19.99"),
+		"qty":   3,
+		"a":     decimal.RequireFromString("0.1"),
+		"b":     decimal.RequireFromString("0.2"),
+		"c":     decimal.RequireFromString("0.3"),
+		"big":   bigInt("123456789012345678901"),
+	})),
+	newExecTest("Loose comparison", `{{ "10" == "1e1" }}-{{ 0 == "a" }}-{{ "abc" < "abd" }}-{{ "10" > "9" }}-{{ [1, 2] == [1, 2] }}-{{ null == false }}`, expect(`1--1-1-1-1`)),
 	newExecTest("In and not in", `{{ 5 in set and 4 not in set }}`, expect(`1`), withContext(map[string]Value{"set": []int{5, 10}})),
 	newExecTest("Function call", `{{ multiply(num, 5) }}`, expect(`50`), withContext(map[string]Value{"num": 10})),
+	newExecTest(
+		"Callable call",
+		`{{ greet("Tyler") }} {{ multiply(2, 3) }}`,
+		expect(`Hello, Tyler! 6`),
+		withContext(map[string]Value{
+			"greet": CallableFunc(func(ctx Context, args ...Value) (Value, error) {
+				if ctx.Env() == nil {
+					return nil, errors.New("expected a Context")
+				}
+				return "Hello, " + CoerceString(args[0]) + "!", nil
+			}),
+			// Functions defined in the Env take precedence.
+			"multiply": CallableFunc(func(ctx Context, args ...Value) (Value, error) {
+				return "shadowed", nil
+			}),
+		}),
+	),
+	newExecTest(
+		"Callable error",
+		`{{ fail() }}`,
+		expectErrorContains(`fail failed`),
+		withContext(map[string]Value{"fail": CallableFunc(func(ctx Context, args ...Value) (Value, error) {
+			return nil, errors.New("fail failed")
+		})}),
+	),
+	newExecTest("Non-callable call", `{{ num() }}`, expectErrorContains(`Undeclared function "num"`), withContext(map[string]Value{"num": 10})),
 	newExecTest("Filter call", `Welcome, {{ name }}`, expect(`Welcome, `)),
 	newExecTest("Filter call", `Welcome, {{ name|default('User') }}`, expect(`Welcome, User`), withContext(map[string]Value{"name": nil})),
 	newExecTest("Filter call", `Welcome, {{ surname|default('User') }}`, expect(`Welcome, User`), withContext(map[string]Value{"name": nil})),
@@ -130,7 +187,8 @@ var tests = []execTest{
 {{ var0 }}
 {{ var2 }}
 {{ var0 }}`,
-		expectContains("Hello, World!\n1\n\n\nHello, World!\n1"),
+		// Macros execute in an isolated scope, so var0 is never modified.
+		expectContains("Hello, World!\n0\n\n\nHello, World!\n0"),
 	),
 	newExecTest(
 		"Set statement invalid expr type",
@@ -163,6 +221,37 @@ var tests = []execTest{
 		`{% from 'macros.twig' import test, def as other %}{{ other("", "HI!") }}`,
 		expect("HI!"),
 	),
+	newExecTest(
+		"Macro isolated scope",
+		`{% macro m(a) %}{{ a }}{{ b }}{{ g }}{% set a = "x" %}{% endmacro %}{% set a = 1 %}{{ _self.m(2) }}{{ a }}`,
+		expect("2global1"),
+		withContext(map[string]Value{"b": "caller"}),
+	),
+	newExecTest(
+		"Macro defaults",
+		`{% macro m(a, b = a ~ "!", c = "c") %}{{ a }}{{ b }}{{ c }}{% endmacro %}{{ _self.m("a") }} {{ _self.m("a", "b") }}`,
+		expect("aa!c abc"),
+	),
+	newExecTest(
+		"Macro named arguments",
+		`{% macro m(a, b = "b", c = "c") %}{{ a }}{{ b }}{{ c }}{% endmacro %}{{ _self.m("a", c = "C") }} {{ _self.m(c = 3, a = 1) }}`,
+		expect("abC 1b3"),
+	),
+	newExecTest(
+		"Macro varargs",
+		`{% macro m(a) %}{{ a }}{% for v in varargs %},{{ v }}{% endfor %}{% endmacro %}{{ _self.m(1, 2, 3) }}`,
+		expect("1,2,3"),
+	),
+	newExecTest(
+		"Macro unknown named argument",
+		`{% macro m(a) %}{% endmacro %}{{ _self.m(b = 1) }}`,
+		expectErrorContains(`macro "m" has no argument named "b"`),
+	),
+	newExecTest(
+		"Named arguments outside macros",
+		`{{ multiply(a = 1) }}`,
+		expectErrorContains(`named arguments are only supported in macro calls`),
+	),
 	newExecTest(
 		"Ternary if",
 		`{{ false ? (true ? "Hello" : "World") : "Words" }}`,
@@ -173,6 +262,11 @@ var tests = []execTest{
 		`{{ {"test": 1}["test"] }}`,
 		expect("1"),
 	),
+	newExecTest(
+		"Hash literal order",
+		`{% for k, v in {b: 1, a: 2, c: 3} %}{{ k }}{{ v }}{% endfor %}`,
+		expect("b1a2c3"),
+	),
 	newExecTest(
 		"Another hash literal",
 		`{% set v = {quadruple: "to the power of four!", 0: "ew", "0": "it's not that bad"} %}ew? {{ v.0 }} {{ v.quadruple }}`,
@@ -402,7 +496,7 @@ func (v *testVisitor) Leave(n parse.Node) {
 
 func evaluateTest(t *testing.T, env *Env, test execTest) {
 	w := &bytes.Buffer{}
-	err := execute(test.tpl, w, test.ctx, env)
+	err := execute(context.Background(), test.tpl, w, test.ctx, env)
 
 	out := w.String()
 	if err := test.checkResult(out, err); err != nil {
@@ -441,6 +535,7 @@ func TestExec(t *testing.T) {
 		}
 		return val
 	}
+	env.Globals["g"] = "global"
 	tv := &testVisitor{}
 	env.Visitors = append(env.Visitors, tv)
 	for _, test := range tests {
@@ -449,11 +544,2209 @@ func TestExec(t *testing.T) {
 	}
 }
 
-type fakePerson struct {
-	name string
+func TestUndefinedPolicy(t *testing.T) {
+	env := New(nil)
+	env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value {
+		return strings.ToUpper(CoerceString(val))
+	}
+	tests := []struct {
+		policy UndefinedPolicy
+		tpl    string
+		check  testValidator
+	}{
+		{PolicyError, `{{ "a"|uper }}`, expectErrorContains(`Undeclared filter "uper" on line 1, column 7`, `did you mean "upper"?`)},
+		{PolicyError, `{{ nope() }}`, expectErrorContains(`Undeclared function "nope"`)},
+		{PolicyError, `{{ 1 is odd }}`, expectErrorContains(`Undeclared test "odd"`)},
+		{PolicyError, `{% filter uper %}a{% endfilter %}`, expectErrorContains(`Undeclared filter "uper"`)},
+		{PolicyIgnore, `{{ "a"|uper }}`, expect("a")},
+		{PolicyIgnore, `{{ ("a"|uper)|upper }}`, expect("A")},
+		{PolicyIgnore, `[{{ nope() }}]`, expect("[]")},
+		{PolicyIgnore, `{% if 1 is odd %}odd{% else %}even{% endif %}`, expect("even")},
+		{PolicyIgnore, `{% filter uper|upper %}a{% endfilter %}`, expect("A")},
+	}
+	for _, test := range tests {
+		env.UndefinedPolicy = test.policy
+		evaluateTest(t, env, newExecTest(test.tpl, test.tpl, test.check))
+	}
 }
 
-func (p *fakePerson) Name(prefix string) string {
-	p.name = prefix + p.name
-	return p.name
+func TestRuntimeError(t *testing.T) {
+	env := New(newTestLoader([]Template{
+		tpl("error.twig", "line 1\nline 2\nline 3\n{{ nope() }}\nline 5\nline 6\nline 7"),
+	}))
+	err := env.Execute("error.twig", ioutil.Discard, nil)
+	rerr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected *RuntimeError, got %T: %s", err, err)
+	}
+	if rerr.Template != "error.twig" || rerr.Pos.Line != 4 || rerr.NodeKind() != "FuncExpr" {
+		t.Errorf("unexpected error details: %s %v %s", rerr.Template, rerr.Pos, rerr.NodeKind())
+	}
+	expected := `Undeclared function "nope" on line 4, column 3 in error.twig`
+	if rerr.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, rerr.Error())
+	}
+	expected = "     2 | line 2\n     3 | line 3\n>    4 | {{ nope() }}\n     5 | line 5\n     6 | line 6\n"
+	if rerr.Excerpt() != expected {
+		t.Errorf("expected excerpt %q, got %q", expected, rerr.Excerpt())
+	}
+}
+
+func TestRuntimeErrorStack(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"base.twig":    "<html>\n{% block content %}{% endblock %}\n</html>",
+		"page.twig":    "{% extends 'base.twig' %}\n{% block content %}\n  {% include 'partial.twig' %}\n{% endblock %}",
+		"partial.twig": "\n{{ nope() }}",
+	}})
+	err := env.Execute("page.twig", ioutil.Discard, nil)
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected RuntimeError, got %v", err)
+	}
+	expected := `Undeclared function "nope" on line 2, column 3 in partial.twig
+	include on line 3, column 5 in page.twig
+	block on line 2, column 3 in base.twig
+	extends on line 1, column 3 in page.twig`
+	if actual := rerr.StackTrace(); actual != expected {
+		t.Errorf("expected stack trace:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"filter.twig":   `{{ 1|nope }}`,
+		"function.twig": `{{ nope() }}`,
+		"test.twig":     `{{ 1 is nope }}`,
+		"var.twig":      `{{ nope }}`,
+		"default.twig":  `{{ nope|default("ok") }}`,
+		"include.twig":  `{% include "missing.twig" %}`,
+		"parse.twig":    `{{ 1 + }}`,
+	}})
+	env.StrictVariables = true
+	env.Filters["default"] = func(ctx Context, val Value, args ...Value) Value {
+		if val == nil {
+			return args[0]
+		}
+		return val
+	}
+	tests := map[string]error{
+		"filter.twig":   ErrUndefinedFilter,
+		"function.twig": ErrUndefinedFunction,
+		"test.twig":     ErrUndefinedTest,
+		"var.twig":      ErrUndefinedVariable,
+		"missing.twig":  ErrTemplateNotFound,
+		"include.twig":  ErrTemplateNotFound,
+	}
+	for name, expected := range tests {
+		err := env.Execute(name, ioutil.Discard, nil)
+		if !errors.Is(err, expected) {
+			t.Errorf("%s: expected error to match %q, got %v", name, expected, err)
+		}
+	}
+	err := env.Execute("include.twig", ioutil.Discard, nil)
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) || rerr.NodeKind() != "IncludeNode" {
+		t.Errorf("expected RuntimeError for include, got %v", err)
+	}
+	var perr ParseError
+	if err := env.Execute("parse.twig", ioutil.Discard, nil); !errors.As(err, &perr) || perr.Name() != "parse.twig" {
+		t.Errorf("expected ParseError, got %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := env.Execute("default.twig", buf, nil); err != nil || buf.String() != "ok" {
+		t.Errorf("expected default filter to handle undefined variable, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestIncludeCandidates(t *testing.T) {
+	env := New(NewMemoryLoader(map[string]string{
+		"pages/default.twig": "default {{ slug }}",
+		"pages/about.twig":   "about",
+		"page.twig":          "{% include ['pages/' ~ slug ~ '.twig', 'pages/default.twig'] %}",
+		"ignore.twig":        "[{% include 'missing.twig' ignore missing %}{% include ['a.twig', 'b.twig'] ignore missing %}]",
+		"embed.twig":         "[{% embed ['missing.twig', 'pages/about.twig'] %}{% endembed %}{% embed 'missing.twig' ignore missing %}{% endembed %}]",
+		"none.twig":          "{% include ['a.twig', 'b.twig'] %}",
+		"broken.twig":        "{% include ['pages/bad.twig', 'pages/default.twig'] %}",
+		"pages/bad.twig":     "{{ 1 + }}",
+	}))
+	tests := []struct {
+		name     string
+		ctx      map[string]Value
+		expected string
+	}{
+		{"page.twig", map[string]Value{"slug": "about"}, "about"},
+		{"page.twig", map[string]Value{"slug": "contact"}, "default contact"},
+		{"ignore.twig", nil, "[]"},
+		{"embed.twig", nil, "[about]"},
+	}
+	for _, test := range tests {
+		actual, err := env.ExecuteToString(test.name, test.ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+	err := env.Execute("none.twig", ioutil.Discard, nil)
+	var nf *TemplateNotFoundError
+	if !errors.As(err, &nf) || len(nf.Candidates) != 2 || !strings.Contains(err.Error(), `none of the templates "a.twig", "b.twig" found`) {
+		t.Errorf("expected TemplateNotFoundError listing the candidates, got %v", err)
+	}
+	var perr ParseError
+	if err := env.Execute("broken.twig", ioutil.Discard, nil); !errors.As(err, &perr) {
+		t.Errorf("expected a broken candidate to return a ParseError, got %v", err)
+	}
+}
+
+func TestWarningHandler(t *testing.T) {
+	env := New(nil)
+	var warnings []string
+	env.WarningHandler = func(w Warning) {
+		warnings = append(warnings, w.String())
+	}
+	env.UndefinedPolicy = PolicyWarn
+	env.Functions["check"] = func(ctx Context, args ...Value) Value {
+		ctx.Warn(errors.New("check failed"))
+		return "checked"
+	}
+	evaluateTest(t, env, newExecTest("Warnings", "{{ check() }}\n{{ 'a'|nope }}", expect("checked\na")))
+	expected := []string{
+		`check failed on line 1, column 3`,
+		`Undeclared filter "nope" on line 2, column 6`,
+	}
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected %d warnings, got %v", len(expected), warnings)
+	}
+	for i, w := range warnings {
+		if w != expected[i] {
+			t.Errorf("expected warning %q, got %q", expected[i], w)
+		}
+	}
+}
+
+func TestEscapeStrategy(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"page":   "{{ v }}|{{ v|raw }}|{% include 'script' %}|{% include 'plain' %}",
+		"script": "{{ v }}",
+		"plain":  "{{ v }}",
+	}})
+	env.RegisterEscaper("html", strings.NewReplacer("<", "&lt;", ">", "&gt;").Replace)
+	env.RegisterEscaper("shell", func(s string) string {
+		return "'" + s + "'"
+	})
+	env.Filters["raw"] = func(ctx Context, val Value, args ...Value) Value {
+		return val
+	}
+	env.DefaultEscapeStrategy = "html"
+	env.TemplateEscapeStrategies["script"] = "shell"
+	env.TemplateEscapeStrategies["plain"] = ""
+	evaluateTest(t, env, newExecTest("Escape strategies", "page", expect("&lt;b&gt;|<b>|'<b>'|<b>"), withContext(map[string]Value{"v": "<b>"})))
+
+	env.RegisterEscaper("html", strings.ToUpper)
+	evaluateTest(t, env, newExecTest("Overridden escaper", "script", expect("'<b>'"), withContext(map[string]Value{"v": "<b>"})))
+	evaluateTest(t, env, newExecTest("Overridden escaper", "page", expect("<B>|<b>|'<b>'|<b>"), withContext(map[string]Value{"v": "<b>"})))
+
+	// EscapeStrategy falls back to DefaultEscapeStrategy if it returns
+	// false.
+	env.TemplateEscapeStrategies = map[string]string{}
+	env.EscapeStrategy = func(name string) (string, bool) {
+		switch name {
+		case "script":
+			return "shell", true
+		case "plain":
+			return "", true
+		}
+		return "", false
+	}
+	evaluateTest(t, env, newExecTest("EscapeStrategy", "page", expect("<B>|<b>|'<b>'|<b>"), withContext(map[string]Value{"v": "<b>"})))
+}
+
+func TestExecuteContext(t *testing.T) {
+	type key struct{}
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig": "{{ user() }}|{% include 'user.twig' %}",
+		"user.twig":  "{{ 'x'|user }}",
+	}})
+	env.Functions["user"] = func(ctx Context, args ...Value) Value {
+		return ctx.Context().Value(key{})
+	}
+	env.Filters["user"] = func(ctx Context, val Value, args ...Value) Value {
+		return ctx.Context().Value(key{})
+	}
+	buf := &bytes.Buffer{}
+	c := context.WithValue(context.Background(), key{}, "tyler")
+	if err := env.ExecuteContext(c, "index.twig", buf, nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if buf.String() != "tyler|tyler" {
+		t.Errorf("expected context values to be available, got %q", buf.String())
+	}
+}
+
+func TestExecuteContextCancel(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"loop.twig": "{% for i in items %}{{ i }}{% if i == 3 %}{{ cancel() }}{% endif %}{% endfor %}",
+		"slow.twig": "{% for i in 1..10000 %}{% for j in 1..10000 %}{% endfor %}{% endfor %}",
+	}})
+	c, cancel := context.WithCancel(context.Background())
+	env.Functions["cancel"] = func(ctx Context, args ...Value) Value {
+		cancel()
+		return ""
+	}
+	buf := &bytes.Buffer{}
+	err := env.ExecuteContext(c, "loop.twig", buf, map[string]Value{"items": []int{1, 2, 3, 4, 5}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if buf.String() != "123" {
+		t.Errorf("expected loop to stop after cancellation, got %q", buf.String())
+	}
+
+	c, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = env.ExecuteContext(c, "slow.twig", ioutil.Discard, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	env := New(nil)
+	env.MaxOutputBytes = 10
+	buf := &bytes.Buffer{}
+	err := env.Execute("{% for i in items %}abc{% endfor %}", buf, map[string]Value{"items": make([]int, 100)})
+	if !errors.Is(err, ErrOutputLimitExceeded) {
+		t.Errorf("expected ErrOutputLimitExceeded, got %v", err)
+	}
+	var lerr *OutputLimitError
+	if !errors.As(err, &lerr) || lerr.Limit != 10 {
+		t.Errorf("expected OutputLimitError with limit 10, got %v", err)
+	}
+	if buf.Len() != 10 {
+		t.Errorf("expected 10 bytes of output, got %d", buf.Len())
+	}
+	buf.Reset()
+	if err := env.Execute("{{ 'abcdefghij' }}", buf, nil); err != nil || buf.String() != "abcdefghij" {
+		t.Errorf("expected output within limit to succeed, got %q, %v", buf.String(), err)
+	}
+
+	// Captured output is limited too.
+	env = New(&MemoryLoader{Templates: map[string]string{
+		"set.twig":     "{% set x %}{% for i in items %}abc{% endfor %}{% endset %}",
+		"macro.twig":   "{% macro m(items) %}{% for i in items %}abc{% endfor %}{% endmacro %}{% set x = _self.m(items) %}",
+		"apply.twig":   "{% apply upper %}{% for i in items %}abc{% endfor %}{% endapply %}",
+		"include.twig": "{% set x %}{% include 'set.twig' %}{% endset %}",
+		"parent.twig":  "{% extends 'base.twig' %}{% block b %}{% set x = parent() %}{% endblock %}",
+		"base.twig":    "{% block b %}{% for i in items %}abc{% endfor %}{% endblock %}",
+	}})
+	env.MaxOutputBytes = 100
+	env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value {
+		return strings.ToUpper(CoerceString(val))
+	}
+	for _, name := range []string{"set.twig", "macro.twig", "apply.twig", "include.twig", "parent.twig"} {
+		for _, engine := range []Engine{EngineTree, EngineVM} {
+			env.Engine = engine
+			err := env.Execute(name, ioutil.Discard, map[string]Value{"items": make([]int, 1000)})
+			if !errors.Is(err, ErrOutputLimitExceeded) {
+				t.Errorf("%s (engine %d): expected ErrOutputLimitExceeded, got %v", name, engine, err)
+			}
+		}
+	}
+}
+
+func TestMaxLoopIterations(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig": "{% for i in 1..3 %}{% include 'inner.twig' %}{% endfor %}",
+		"inner.twig": "{% for i in 1..3 %}{{ i }}{% endfor %}",
+		"range.twig": "{% for i in 1..100000000 %}{{ i }}{% endfor %}",
+	}})
+	env.MaxLoopIterations = 12
+	buf := &bytes.Buffer{}
+	if err := env.Execute("index.twig", buf, nil); err != nil || buf.String() != "123123123" {
+		t.Errorf("expected loops within limit to succeed, got %q, %v", buf.String(), err)
+	}
+	env.MaxLoopIterations = 11
+	err := env.Execute("index.twig", ioutil.Discard, nil)
+	var lerr *LoopLimitError
+	if !errors.Is(err, ErrLoopLimitExceeded) || !errors.As(err, &lerr) || lerr.Limit != 11 {
+		t.Errorf("expected LoopLimitError, got %v", err)
+	}
+	if err := env.Execute("range.twig", ioutil.Discard, nil); !errors.Is(err, ErrLoopLimitExceeded) {
+		t.Errorf("expected ErrLoopLimitExceeded for large range, got %v", err)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"include.twig": "{% include 'include.twig' %}",
+		"extends.twig": "{% extends 'extends.twig' %}",
+		"macro.twig":   "{% macro m() %}{% import 'macro.twig' as self %}{{ self.m() }}{% endmacro %}{% import 'macro.twig' as self %}{{ self.m() }}",
+		"nested.twig":  "{% if depth > 0 %}{{ depth }}{% include 'nested.twig' with {depth: depth - 1} %}{% endif %}",
+	}})
+	for _, name := range []string{"include.twig", "extends.twig", "macro.twig"} {
+		err := env.Execute(name, ioutil.Discard, nil)
+		var derr *DepthLimitError
+		if !errors.Is(err, ErrDepthLimitExceeded) || !errors.As(err, &derr) || derr.Limit != defaultMaxDepth {
+			t.Errorf("%s: expected DepthLimitError, got %v", name, err)
+		}
+	}
+	res, err := env.ExecuteToString("nested.twig", map[string]Value{"depth": 5})
+	if err != nil || res != "54321" {
+		t.Errorf("expected nesting within limit to succeed, got %q, %v", res, err)
+	}
+	env.MaxDepth = 4
+	_, err = env.ExecuteToString("nested.twig", map[string]Value{"depth": 5})
+	var derr *DepthLimitError
+	if !errors.As(err, &derr) || derr.Limit != 4 {
+		t.Errorf("expected DepthLimitError with a limit of 4, got %v", err)
+	}
+}
+
+func TestDefined(t *testing.T) {
+	templates := map[string]string{
+		"layout.twig":  "<{% block body %}{% endblock %}{% if block('footer') is defined %}|{{ block('footer') }}{% endif %}>",
+		"with.twig":    "{% extends 'layout.twig' %}{% block body %}body{% endblock %}{% block footer %}footer{% endblock %}",
+		"without.twig": "{% extends 'layout.twig' %}{% block body %}body{% endblock %}",
+		"blocks.twig":  "{% block shared %}shared{% endblock %}",
+		"other.twig":   "{{ block('shared', 'blocks.twig') is defined }}{{ block('missing', 'blocks.twig') is defined }}{{ block('shared', 'missing.twig') is defined }}{{ block('shared', 'blocks.twig') }}",
+		"macros.twig":  "{% macro m() %}{% endmacro %}{% import _self as lib %}{{ lib.m is defined }}{{ lib.x is defined }}{{ _self.m is defined }}",
+		"vars.twig":    "{{ null is defined }}{{ missing is defined }}{{ missing is not defined }}",
+		"attrs.twig":   "{{ hash.a is defined }}{{ hash.b is defined }}{{ missing.a is defined }}{{ (hash) is defined }}",
+		"methods.twig": "{{ acct.Email is defined }}{{ acct.Nope is defined }}{{ acct.Delete() is defined }}",
+		"exprs.twig":   "{{ (1 + 2) is defined }}{{ (missing + 2) is defined }}",
+	}
+	tests := map[string]string{
+		"with.twig":    "<body|footer>",
+		"without.twig": "<body>",
+		"other.twig":   "1shared",
+		"macros.twig":  "11",
+		"vars.twig":    "11",
+		"attrs.twig":   "11",
+		"methods.twig": "11",
+		"exprs.twig":   "1",
+	}
+	ctx := map[string]Value{"null": nil, "hash": map[string]Value{"a": 1}, "acct": &fakeAccount{Email: "a@b"}}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env := New(NewMemoryLoader(templates))
+		env.Engine = engine
+		env.StrictVariables = true
+		for name, expected := range tests {
+			actual, err := env.ExecuteToString(name, ctx)
+			if err != nil {
+				t.Errorf("%s (engine %d): unexpected error: %s", name, engine, err)
+			} else if actual != expected {
+				t.Errorf("%s (engine %d): expected %q, got %q", name, engine, expected, actual)
+			}
+		}
+		if errs := env.Validate("vars.twig"); len(errs) > 0 {
+			t.Errorf("expected the defined test to be valid, got %v", errs)
+		}
+	}
+}
+
+func TestUndefinedMode(t *testing.T) {
+	templates := map[string]string{
+		"print.twig":   "[{{ missing }}][{{ missing.a.b }}][{{ user.nope }}][{{ user.Email }}]",
+		"cond.twig":    "{% if missing %}yes{% else %}no{% endif %}{{ missing ? 'yes' : 'no' }}{{ not missing }}",
+		"loop.twig":    "{% for v in missing %}{{ v }}{% else %}empty{% endfor %}",
+		"ops.twig":     "{{ missing + 1 }}{{ missing == null }}{{ missing is nil }}",
+		"filters.twig": "{{ missing|default('d') }}{{ user.nope|default('e') }}",
+		"defined.twig": "{% set x = missing %}{{ x is defined }}{{ user.nope is defined }}{{ missing is not defined }}",
+		"macro.twig":   "{% macro m(v) %}{{ v is defined }}{% endmacro %}{{ _self.m(missing) }}",
+		"array.twig":   "{% for v in [1, missing] %}x{% endfor %}",
+		"hash.twig":    "{% for k, v in {'a': missing, 'b': 1} %}{{ k }}{% endfor %}",
+	}
+	ctx := map[string]Value{"user": &fakeAccount{Email: "a@b"}}
+	tests := []struct {
+		tpl     string
+		nil     string
+		lenient string
+		strict  string // An error message, unless it starts with "=".
+	}{
+		{"print.twig", "[][][][a@b]", "[][][][a@b]", `undefined variable "missing"`},
+		{"cond.twig", "nono1", "nono1", `undefined variable "missing"`},
+		{"loop.twig", "empty", "empty", `undefined variable "missing"`},
+		{"ops.twig", "111", "111", `undefined variable "missing"`},
+		{"filters.twig", "de", "de", "=de"},
+		{"defined.twig", "11", "1", "=1"},
+		{"macro.twig", "1", "", "="},
+		{"array.twig", "xx", "xx", `undefined variable "missing"`},
+		{"hash.twig", "ab", "ab", `undefined variable "missing"`},
+	}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		for _, mode := range []UndefinedMode{NilUndefined, LenientUndefined, StrictUndefined} {
+			env := New(NewMemoryLoader(templates))
+			env.Engine = engine
+			env.UndefinedMode = mode
+			env.Filters["default"] = func(ctx Context, val Value, args ...Value) Value {
+				if CoerceString(val) == "" {
+					return args[0]
+				}
+				return val
+			}
+			env.Tests["nil"] = func(ctx Context, val Value, args ...Value) bool {
+				return val == nil
+			}
+			for _, test := range tests {
+				expected := []string{test.nil, test.lenient, test.strict}[mode]
+				actual, err := env.ExecuteToString(test.tpl, ctx)
+				if mode == StrictUndefined && !strings.HasPrefix(expected, "=") {
+					if err == nil || !errors.Is(err, ErrUndefinedVariable) || !strings.Contains(err.Error(), expected) {
+						t.Errorf("%s (engine %d, mode %d): expected error %q, got %q, %v", test.tpl, engine, mode, expected, actual, err)
+					}
+					continue
+				}
+				expected = strings.TrimPrefix(expected, "=")
+				if err != nil {
+					t.Errorf("%s (engine %d, mode %d): unexpected error: %s", test.tpl, engine, mode, err)
+				} else if actual != expected {
+					t.Errorf("%s (engine %d, mode %d): expected %q, got %q", test.tpl, engine, mode, expected, actual)
+				}
+			}
+		}
+	}
+	env := New(nil)
+	env.UndefinedMode = StrictUndefined
+	if _, err := env.ExecuteToString("{{ user.nope }}", ctx); err == nil || !strings.Contains(err.Error(), `undefined variable "user.nope"`) {
+		t.Errorf("expected strict undefined attribute error, got %v", err)
+	}
+}
+
+func TestAttrResolver(t *testing.T) {
+	templates := map[string]string{
+		"virtual.twig": "{{ acct.domain_name }}|{{ acct.Email }}|{{ acct.Domain() }}|{{ acct.domain_name is defined }}",
+		"hash.twig":    "{{ h.a }}{{ h.b }}",
+		"error.twig":   "{{ acct.broken }}",
+		"denied.twig":  "{{ acct.secret }}",
+	}
+	resolver := func(val Value, name string) (Value, bool, error) {
+		switch v := val.(type) {
+		case *fakeAccount:
+			switch name {
+			case "domain_name":
+				return v.Domain(), true, nil
+			case "broken":
+				return nil, false, errors.New("broken relation")
+			case "secret":
+				return "hunter2", true, nil
+			}
+		case map[string]Value:
+			if name == "b" {
+				return "B", true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	ctx := map[string]Value{"acct": &fakeAccount{Email: "a@example.com"}, "h": map[string]Value{"a": "A", "b": "b"}}
+	tests := map[string]string{
+		"virtual.twig": "example.com|a@example.com|example.com|1",
+		"hash.twig":    "AB",
+	}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env := New(NewMemoryLoader(templates))
+		env.Engine = engine
+		env.AttrResolver = resolver
+		env.SecurityPolicy = &AllowListPolicy{Properties: map[string][]string{"stick.fakeAccount": {"Email", "domain_name", "broken"}}, Methods: map[string][]string{"stick.fakeAccount": {"Domain"}}}
+		for name, expected := range tests {
+			actual, err := env.ExecuteToString(name, ctx)
+			if err != nil {
+				t.Errorf("%s (engine %d): unexpected error: %s", name, engine, err)
+			} else if actual != expected {
+				t.Errorf("%s (engine %d): expected %q, got %q", name, engine, expected, actual)
+			}
+		}
+		if _, err := env.ExecuteToString("error.twig", ctx); err == nil || !strings.Contains(err.Error(), "broken relation") {
+			t.Errorf("expected resolver error, got %v", err)
+		}
+		if _, err := env.ExecuteToString("denied.twig", ctx); !errors.Is(err, ErrSecurityViolation) {
+			t.Errorf("expected the policy to deny a resolved attribute, got %v", err)
+		}
+	}
+	env := New(nil)
+	env.AttrResolver = resolver
+	if v, err := env.GetAttr(ctx["acct"], "domain_name"); err != nil || v != "example.com" {
+		t.Errorf("expected Env.GetAttr to use the resolver, got %v, %v", v, err)
+	}
+	if v, err := env.GetAttr(ctx["acct"], "nope"); err != nil || v != nil {
+		t.Errorf("expected a missing attribute to be nil, got %v, %v", v, err)
+	}
+}
+
+func TestUncomparableValues(t *testing.T) {
+	ctx := map[string]Value{"a": testSliceStruct{A: []int{1}}, "b": testSliceStruct{A: []int{1}}}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env := New(nil)
+		env.Engine = engine
+		actual, err := env.ExecuteToString("{% if a == b %}equal{% else %}not equal{% endif %}{{ a in [b] }}", ctx)
+		if err != nil {
+			t.Errorf("engine %d: unexpected error: %s", engine, err)
+		} else if expected := "not equal"; actual != expected {
+			t.Errorf("engine %d: expected %q, got %q", engine, expected, actual)
+		}
+	}
+}
+
+func TestStrictTypes(t *testing.T) {
+	ctx := map[string]Value{
+		"n":    5,
+		"d":    decimal.RequireFromString("1.5"),
+		"s":    "10",
+		"b":    true,
+		"list": []int{1, 2},
+		"hash": map[string]Value{"a": 1},
+		"safe": NewSafeValue("x", "html"),
+		"ver":  testVersion("1.2"),
+		"acct": &fakeAccount{},
+	}
+	tests := []struct {
+		tpl      string
+		expected string // An error message, unless it starts with "=".
+	}{
+		{"{{ n + 1 }}{{ n * d }}{{ n // 2 }}{% for i in 1..2 %}{{ i }}{% endfor %}", "=67.5212"},
+		{"{{ n - 1 }}{{ (n / 1) > 4 }}", "=41"},
+		{"{{ s ~ n ~ null ~ b ~ safe }}", "=1051x"},
+		{"{{ s == '10' }}{{ n == null }}{{ list == [1, 2] }}{{ s < 'a' }}{{ uuid != 5 }}", "=1111"},
+		{"{{ -n }}{{ not s }}", "=-5"},
+		{"{{ s + n }}", `unsupported operand types for "+": string and number`},
+		{"{{ n * null }}", `unsupported operand types for "*": number and null`},
+		{"{{ b == list }}", `unsupported operand types for "==": bool and array`},
+		{"{{ s > n }}", `unsupported operand types for ">": string and number`},
+		{"{{ list < list }}", `unsupported operand types for "<": array and array`},
+		{"{{ hash ~ s }}", `unsupported operand types for "~": map and string`},
+		{"{{ -s }}", `unsupported operand type for unary "-": string`},
+		{"{% for i in 1..s %}{% endfor %}", `unsupported operand types for "..": number and string`},
+	}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env := New(nil)
+		env.Engine = engine
+		env.StrictTypes = true
+		for _, test := range tests {
+			actual, err := env.ExecuteToString(test.tpl, ctx)
+			if strings.HasPrefix(test.expected, "=") {
+				if err != nil {
+					t.Errorf("%s (engine %d): unexpected error: %s", test.tpl, engine, err)
+				} else if expected := test.expected[1:]; actual != expected {
+					t.Errorf("%s (engine %d): expected %q, got %q", test.tpl, engine, expected, actual)
+				}
+			} else if !errors.Is(err, ErrTypeMismatch) || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s (engine %d): expected error %q, got %q, %v", test.tpl, engine, test.expected, actual, err)
+			}
+		}
+	}
+	if _, err := New(nil).ExecuteToString("{{ '10' + 5 }}{{ true == [1] }}", nil); err != nil {
+		t.Errorf("expected values to be converted without StrictTypes, got %v", err)
+	}
+}
+
+// TestNumericStrings checks that strings are converted to numbers by
+// arithmetic operators with the same results as Twig on PHP 8.
+func TestNumericStrings(t *testing.T) {
+	tests := []struct {
+		tpl      string
+		expected string
+		warnings []string
+	}{
+		{"{{ '10' + 5 }}", "15", nil},
+		{"{{ '1e3' + 0 }}", "1000", nil},
+		{"{{ ' 1.5 ' * 2 }}", "3", nil},
+		{"{{ '.5' + '-.25' }}", "0.25", nil},
+		{"{{ '10' / '4' }}", "2.5", nil},
+		{"{{ '7' // 2 }}{{ '7' % 4 }}{{ '2' ** '3' }}", "338", nil},
+		{"{{ '6' b-and '3' }}", "2", nil},
+		{"{{ -'3' }}", "-3", nil},
+		{"{{ '10abc' + 5 }}", "15", []string{`non-numeric value "10abc" used with "+"`}},
+		{"{{ 2 * '1e3 apples' }}", "2000", []string{`non-numeric value "1e3 apples" used with "*"`}},
+		{"{{ 'abc' - 1 }}", "-1", []string{`non-numeric value "abc" used with "-"`}},
+		{"{{ '0x1A' + 0 }}", "0", []string{`non-numeric value "0x1A" used with "+"`}},
+		{"{{ '' + 'INF' }}", "0", []string{`non-numeric value "" used with "+"`, `non-numeric value "INF" used with "+"`}},
+		{"{{ -'5px' }}", "-5", []string{`non-numeric value "5px" used with "-"`}},
+		{"{{ '10abc' ~ 5 }}{{ '10abc' == 10 }}", "10abc5", nil},
+		{"{{ '1e3' == '1000' }}{{ ' 10' == 10 }}{{ '10 ' < 9 }}", "11", nil},
+	}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env := New(nil)
+		env.Engine = engine
+		var warnings []string
+		env.WarningHandler = func(w Warning) {
+			if !errors.Is(w.Err, ErrNonNumeric) {
+				t.Errorf("unexpected warning %v", w.Err)
+			}
+			warnings = append(warnings, w.Err.Error())
+		}
+		for _, test := range tests {
+			warnings = nil
+			actual, err := env.ExecuteToString(test.tpl, nil)
+			if err != nil {
+				t.Errorf("%s (engine %d): unexpected error: %s", test.tpl, engine, err)
+			} else if actual != test.expected {
+				t.Errorf("%s (engine %d): expected %q, got %q", test.tpl, engine, test.expected, actual)
+			}
+			if !reflect.DeepEqual(warnings, test.warnings) {
+				t.Errorf("%s (engine %d): expected warnings %q, got %q", test.tpl, engine, test.warnings, warnings)
+			}
+		}
+
+		// Warnings are reported at the position of the operator's
+		// expression, even after a filter has run.
+		env.Filters["id"] = func(ctx Context, val Value, args ...Value) Value { return val }
+		var pos []parse.Pos
+		env.WarningHandler = func(w Warning) {
+			pos = append(pos, w.Pos)
+		}
+		tpl := "{{ 'abc' + 1 }}\n{{ 1|id }} {{ -'x' }}"
+		if _, err := env.ExecuteToString(tpl, nil); err != nil {
+			t.Errorf("engine %d: unexpected error: %s", engine, err)
+		}
+		if expected := []parse.Pos{{Line: 1, Offset: 4}, {Line: 2, Offset: 14}}; !reflect.DeepEqual(pos, expected) {
+			t.Errorf("engine %d: expected warnings at %v, got %v", engine, expected, pos)
+		}
+	}
+}
+
+func TestRecursiveMacros(t *testing.T) {
+	tree := map[string]Value{"name": "a", "children": []Value{
+		map[string]Value{"name": "b", "children": []Value{map[string]Value{"name": "c"}}},
+		map[string]Value{"name": "d"},
+	}}
+	env := New(NewMemoryLoader(map[string]string{
+		"self.twig":   "{% macro tree(node) %}{{ node.name }}{% for c in node.children %}({{ _self.tree(c) }}){% endfor %}{% endmacro %}{{ _self.tree(root) }}",
+		"import.twig": "{% import _self as m %}{% macro tree(node) %}{% import _self as m %}{{ node.name }}{% for c in node.children %}({{ m.tree(c) }}){% endfor %}{% endmacro %}{{ m.tree(root) }}",
+		"top.twig":    "{% import _self as m %}{% macro tree(node) %}{{ node.name }}{% for c in node.children %}({{ m.tree(c) }}){% endfor %}{% endmacro %}{{ m.tree(root) }}",
+		"shadow.twig": "{% import _self as m %}{% macro show(m) %}{{ m }}{% endmacro %}{{ m.show('arg') }}",
+		"from.twig":   "{% from _self import tree as t %}{% macro tree(node) %}{{ node.name }}{% for c in node.children %}({{ _self.tree(c) }}){% endfor %}{% endmacro %}{{ t(root) }}",
+		"lib.twig":    "{% macro tree(node) %}{{ node.name }}{% for c in node.children %}({{ _self.tree(c) }}){% endfor %}{% endmacro %}",
+		"caller.twig": "{% macro tree(node) %}wrong{% endmacro %}{% import 'lib.twig' as lib %}{{ lib.tree(root) }}",
+		"scope.twig":  "{% macro m(v) %}{% if v == 1 %}{% set seen = v %}{% endif %}[{{ seen }}]{% endmacro %}{{ _self.m(1) }}{{ _self.m(2) }}",
+	}))
+	tests := map[string]string{
+		"self.twig":   "a(b(c))(d)",
+		"import.twig": "a(b(c))(d)",
+		"top.twig":    "a(b(c))(d)",
+		"shadow.twig": "arg",
+		"from.twig":   "a(b(c))(d)",
+		"caller.twig": "a(b(c))(d)",
+		"scope.twig":  "[1][]",
+	}
+	for name, expected := range tests {
+		actual, err := env.ExecuteToString(name, map[string]Value{"root": tree})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+type fakeAccount struct {
+	Email   string
+	Deleted bool
+}
+
+func (a *fakeAccount) Delete() string {
+	a.Deleted = true
+	return "deleted"
+}
+
+func (a *fakeAccount) Domain() string {
+	return strings.SplitN(a.Email, "@", 2)[1]
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	env := New(nil)
+	env.SecurityPolicy = &AllowListPolicy{
+		Properties: map[string][]string{"stick.fakeAccount": {"Email"}},
+		Methods:    map[string][]string{"stick.fakeAccount": {"Domain"}},
+	}
+	account := &fakeAccount{Email: "tyler@example.com"}
+	ctx := map[string]Value{"account": account, "m": map[string]Value{"Delete": "ok"}}
+	evaluateTest(t, env, newExecTest("Allowed access", "{{ account.Email }} {{ account.Domain() }} {{ m.Delete }}", expect("tyler@example.com example.com ok"), withContext(ctx)))
+
+	tests := map[string]string{
+		"{{ account.Delete() }}": `method "Delete" of "stick.fakeAccount" is not allowed`,
+		"{{ account.Deleted }}":  `property "Deleted" of "stick.fakeAccount" is not allowed`,
+	}
+	for tpl, expected := range tests {
+		err := env.Execute(tpl, ioutil.Discard, ctx)
+		var serr *SecurityError
+		if !errors.Is(err, ErrSecurityViolation) || !errors.As(err, &serr) {
+			t.Errorf("%s: expected SecurityError, got %v", tpl, err)
+		} else if serr.Error() != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, serr.Error())
+		}
+	}
+	if account.Deleted {
+		t.Errorf("expected disallowed method not to be called")
+	}
+
+	// Methods with pointer receivers are checked as methods when they are
+	// called on a struct value, even if a property has the same name.
+	deletes := 0
+	ctx = map[string]Value{"u": fakeUser{deletes: &deletes}}
+	env.SecurityPolicy = &AllowListPolicy{Properties: map[string][]string{"stick.fakeUser": {"DeleteAccount"}}}
+	for _, engine := range []Engine{EngineTree, EngineVM} {
+		env.Engine = engine
+		err := env.Execute("{{ u.DeleteAccount() }}", ioutil.Discard, ctx)
+		var serr *SecurityError
+		if !errors.As(err, &serr) || serr.Kind != "method" {
+			t.Errorf("engine %d: expected a method SecurityError, got %v", engine, err)
+		}
+	}
+	if deletes != 0 {
+		t.Errorf("expected disallowed pointer method not to be called, called %d times", deletes)
+	}
+
+	// Fields and methods of an AttrProvider that it does not resolve
+	// itself are checked.
+	ctx = map[string]Value{"r": fakeRecord{attrs: map[string]Value{"name": "Bo"}, deletes: &deletes}}
+	env.SecurityPolicy = &AllowListPolicy{}
+	if actual, err := env.ExecuteToString("{{ r.name }}", ctx); err != nil || actual != "Bo" {
+		t.Errorf("expected provided attribute to be allowed, got %q, %v", actual, err)
+	}
+	for _, tpl := range []string{"{{ r.DeleteAccount() }}", "{{ r.DeleteAccount }}", "{{ r.Secret }}"} {
+		if err := env.Execute(tpl, ioutil.Discard, ctx); !errors.Is(err, ErrSecurityViolation) {
+			t.Errorf("%s: expected SecurityError, got %v", tpl, err)
+		}
+	}
+	if deletes != 0 {
+		t.Errorf("expected disallowed AttrProvider method not to be called, called %d times", deletes)
+	}
+}
+
+// fakeRecord is an AttrProvider that also has a field and a method.
+type fakeRecord struct {
+	attrs   map[string]Value
+	deletes *int
+	Secret  string
+}
+
+func (r fakeRecord) GetAttr(name string) (Value, bool) {
+	v, ok := r.attrs[name]
+	return v, ok
+}
+
+func (r fakeRecord) DeleteAccount() string {
+	*r.deletes++
+	return "deleted"
+}
+
+// fakeUser has a method with a pointer receiver, which templates can call
+// on a fakeUser value.
+type fakeUser struct {
+	deletes *int
+}
+
+func (u *fakeUser) DeleteAccount() string {
+	*u.deletes++
+	return "deleted"
+}
+
+func TestContextNotModified(t *testing.T) {
+	env := New(nil)
+	ctx := map[string]Value{"name": "Tyler"}
+	evaluateTest(t, env, newExecTest("Set does not modify context", "{% set name = 'John' %}{% set other = 1 %}{{ name }}", expect("John"), withContext(ctx)))
+	if len(ctx) != 1 || ctx["name"] != "Tyler" {
+		t.Errorf("expected context to be unmodified, got %v", ctx)
+	}
+}
+
+func TestExecuteJSONYAML(t *testing.T) {
+	env := New(nil)
+	tpl := "{{ id }} {{ price }} {{ price * 2 }}{% for t in tags %} {{ t.name }}{% endfor %}"
+	tests := []struct {
+		name     string
+		yaml     bool
+		data     string
+		expected string
+		err      string
+	}{
+		{"json", false, `{"id": 9007199254740993, "price": 1.50, "tags": [{"name": "a"}, {"name": "b"}]}`, "9007199254740993 1.50 3 a b", ""},
+		{"yaml", true, "id: 7\nprice: 1.5\ntags:\n  - name: a\n  - {name: b}\n", "7 1.5 3 a b", ""},
+		{"empty yaml", true, "# nothing\n", "  0", ""},
+		{"json array", false, `[1]`, "", "stick: JSON data must be an object"},
+		{"yaml scalar", true, "hello", "", "stick: YAML data must be an object"},
+		{"json trailing", false, `{} {}`, "", "stick: unexpected data after JSON value"},
+		{"json syntax", false, `{"id": }`, "", "invalid character '}' looking for beginning of value"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		var err error
+		if test.yaml {
+			err = env.ExecuteYAML(tpl, buf, []byte(test.data))
+		} else {
+			err = env.ExecuteJSON(tpl, buf, []byte(test.data))
+		}
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, buf.String())
+		}
+	}
+}
+
+type dataBase struct {
+	Site  string
+	Title string
+}
+
+type dataPage struct {
+	dataBase
+	*dataMeta
+	Title  string
+	Tags   []string
+	hidden string
+}
+
+type dataMeta struct {
+	Author string
+}
+
+func TestExecuteData(t *testing.T) {
+	env := New(nil)
+	page := dataPage{dataBase{"Stick", "Base"}, &dataMeta{"Tyler"}, "Home", []string{"a", "b"}, "x"}
+	tpl := "{{ Site }}: {{ Title }} by {{ Author }}{% for t in Tags %} #{{ t }}{% endfor %}{{ hidden }}"
+	tests := []struct {
+		name     string
+		tpl      string
+		data     interface{}
+		expected string
+		err      string
+	}{
+		{"struct", tpl, page, "Stick: Home by Tyler #a #b", ""},
+		{"pointer", tpl, &page, "Stick: Home by Tyler #a #b", ""},
+		{"nil pointer", tpl, (*dataPage)(nil), ":  by ", ""},
+		{"map", "{{ a }} {{ b.Title }}", map[string]interface{}{"a": 1, "b": page}, "1 Home", ""},
+		{"string map", "{{ a }}", map[string]string{"a": "x"}, "x", ""},
+		{"nil", "{{ a }}", nil, "", ""},
+		{"unsupported", "{{ a }}", []string{"a"}, "", "stick: cannot use data of type []string as a template context"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		err := env.ExecuteData(test.tpl, buf, test.data)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, buf.String())
+		}
+	}
+}
+
+func TestConcurrentExecute(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"layout.twig": "<{% block content %}{% endblock %}>",
+		"child.twig":  "{% extends 'layout.twig' %}{% block content %}{% import 'macros.twig' as m %}{% for i in items %}{{ m.item(i|double) }}{% endfor %}{% include 'footer.twig' %}{% endblock %}",
+		"macros.twig": "{% macro item(v) %}[{{ v }}]{% endmacro %}",
+		"footer.twig": "{% set done = true %}{{ name }}",
+	}})
+	env.Filters["double"] = func(ctx Context, val Value, args ...Value) Value {
+		return CoerceNumber(val) * 2
+	}
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			buf := &bytes.Buffer{}
+			name := fmt.Sprintf("worker%d", i)
+			err := env.Execute("child.twig", buf, map[string]Value{"items": []int{1, 2, i}, "name": name})
+			if err == nil && buf.String() != fmt.Sprintf("<[2][4][%d]%s>", i*2, name) {
+				err = fmt.Errorf("unexpected output %q", buf.String())
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 2 {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func TestWriterError(t *testing.T) {
+	env := New(nil)
+	calls := 0
+	env.Functions["count"] = func(ctx Context, args ...Value) Value {
+		calls++
+		return calls
+	}
+	tests := []string{
+		"{% for i in 1..10 %}{{ count() }}{% endfor %}",
+		"{% for i in 1..10 %}{% filter upper %}{{ count() }}{% endfilter %}{% endfor %}",
+	}
+	env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value {
+		return strings.ToUpper(CoerceString(val))
+	}
+	for _, tpl := range tests {
+		calls = 0
+		w := &failingWriter{}
+		err := env.Execute(tpl, w, nil)
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("%s: expected io.ErrClosedPipe, got %v", tpl, err)
+		}
+		if calls != 3 || w.writes != 3 {
+			t.Errorf("%s: expected execution to stop after the first failed write, got %d calls and %d writes", tpl, calls, w.writes)
+		}
+	}
+}
+
+func TestAtomicOutput(t *testing.T) {
+	env := New(nil)
+	env.AtomicOutput = true
+	tpl := "Hello, {{ fail() }}"
+	buf := &bytes.Buffer{}
+	if err := env.Execute(tpl, buf, nil); err == nil || buf.Len() != 0 {
+		t.Errorf("expected error and no output, got %q, %v", buf.String(), err)
+	}
+	if err := env.ExecuteStream(tpl, buf, nil); err == nil || buf.String() != "Hello, " {
+		t.Errorf("expected error and partial output, got %q, %v", buf.String(), err)
+	}
+	buf.Reset()
+	if err := env.Execute("Hello, {{ name }}", buf, map[string]Value{"name": "World"}); err != nil || buf.String() != "Hello, World" {
+		t.Errorf("expected successful output, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestOutputFilter(t *testing.T) {
+	env := New(nil)
+	var names []string
+	env.OutputFilter = func(name string, out []byte) ([]byte, error) {
+		names = append(names, name)
+		if bytes.Contains(out, []byte("bad")) {
+			return nil, errors.New("bad output")
+		}
+		return bytes.ToUpper(out), nil
+	}
+	buf := &bytes.Buffer{}
+	if err := env.Execute("Hello, {{ name }}", buf, map[string]Value{"name": "World"}); err != nil || buf.String() != "HELLO, WORLD" {
+		t.Errorf("expected filtered output, got %q, %v", buf.String(), err)
+	}
+	buf.Reset()
+	if err := env.ExecuteStream("Hello, {{ fail() }}", buf, nil); err == nil || buf.Len() != 0 {
+		t.Errorf("expected error and no output, got %q, %v", buf.String(), err)
+	}
+	if err := env.Execute("Hello, bad", buf, nil); err == nil || err.Error() != "output filter: bad output" || buf.Len() != 0 {
+		t.Errorf("expected output filter error and no output, got %q, %v", buf.String(), err)
+	}
+	if err := env.ExecuteBlock("{% block a %}a{% endblock %}b", "a", buf, nil); err != nil || buf.String() != "A" {
+		t.Errorf("expected filtered block output, got %q, %v", buf.String(), err)
+	}
+	if len(names) != 3 || names[0] != "Hello, {{ name }}" {
+		t.Errorf("expected the filter to be called with each template's name, got %q", names)
+	}
+}
+
+// closeWriter is an output middleware writer that writes a suffix when it
+// is closed.
+type closeWriter struct {
+	io.Writer
+	suffix string
+}
+
+func (w *closeWriter) Close() error {
+	_, err := io.WriteString(w.Writer, w.suffix)
+	return err
+}
+
+func TestOutputMiddleware(t *testing.T) {
+	env := New(nil)
+	env.OutputFilter = func(name string, out []byte) ([]byte, error) {
+		return append(out, '.'), nil
+	}
+	env.UseOutputMiddleware(func(next io.Writer) io.Writer {
+		return &closeWriter{next, "1"}
+	})
+	env.UseOutputMiddleware(func(next io.Writer) io.Writer {
+		return &closeWriter{next, "2"}
+	}, func(next io.Writer) io.Writer {
+		return next
+	})
+	tests := []struct {
+		exec     func(out io.Writer) error
+		expected string
+	}{
+		{func(out io.Writer) error { return env.Execute("a", out, nil) }, "a.21"},
+		{func(out io.Writer) error { return env.ExecuteStream("a", out, nil) }, "a.21"},
+		{func(out io.Writer) error { return env.ExecuteSafe("a", out, nil) }, "a.21"},
+		{func(out io.Writer) error { return env.ExecuteBlock("{% block b %}b{% endblock %}", "b", out, nil) }, "b.21"},
+		{func(out io.Writer) error { return env.Execute("{{ fail() }}", out, nil) }, "21"},
+	}
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		err := test.exec(buf)
+		if i < len(tests)-1 && err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, buf.String())
+		}
+	}
+	if _, err := env.ExecuteMacro("{% macro m() %}m{% endmacro %}", "m"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestExecuteBlock(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"base.twig":   "<html>{% block title %}Base{% endblock %}{% block body %}<main>{% block content %}{% endblock %}</main>{% endblock %}</html>",
+		"layout.twig": "{% extends 'base.twig' %}{% block title %}Layout - {{ parent() }}{% endblock %}",
+		"page.twig":   "{% extends 'layout.twig' %}{% block content %}Hello, {{ name }}!{% endblock %}",
+	}})
+	tests := []struct {
+		block    string
+		expected string
+	}{
+		{"title", "Layout - Base"},
+		{"content", "Hello, Tyler!"},
+		{"body", "<main>Hello, Tyler!</main>"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := env.ExecuteBlock("page.twig", test.block, buf, map[string]Value{"name": "Tyler"}); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.block, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.block, test.expected, buf.String())
+		}
+	}
+	err := env.ExecuteBlock("page.twig", "sidebar", ioutil.Discard, nil)
+	if err == nil || err.Error() != `block "sidebar" not found in template "page.twig"` {
+		t.Errorf("expected block not found error, got %v", err)
+	}
+}
+
+func TestExecuteMacro(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"forms.twig": `{% macro input(name, value, type = "text") %}<input type="{{ type }}" name="{{ name }}" value="{{ value }}">{% endmacro %}` +
+			`{% macro field(name) %}<p>{{ _self.input(name, varargs[0]) }}</p>{% endmacro %}`,
+	}})
+	tests := []struct {
+		macro    string
+		args     []Value
+		expected string
+	}{
+		{"input", []Value{"user", "tyler"}, `<input type="text" name="user" value="tyler">`},
+		{"input", []Value{"pass", "", "password"}, `<input type="password" name="pass" value="">`},
+		{"field", []Value{"user", "tyler"}, `<p><input type="text" name="user" value="tyler"></p>`},
+	}
+	for _, test := range tests {
+		res, err := env.ExecuteMacro("forms.twig", test.macro, test.args...)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.macro, err)
+		} else if res != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.macro, test.expected, res)
+		}
+	}
+	_, err := env.ExecuteMacro("forms.twig", "select")
+	if err == nil || err.Error() != `macro "select" not found in template "forms.twig"` {
+		t.Errorf("expected macro not found error, got %v", err)
+	}
+}
+
+func TestMustExecute(t *testing.T) {
+	env := New(nil)
+	if res, err := env.ExecuteToString("Hello, {{ nope() }}", nil); err == nil || res != "" {
+		t.Errorf("expected error and no output, got %q, %v", res, err)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected MustExecute to panic")
+		} else if _, ok := r.(error); !ok {
+			t.Errorf("expected MustExecute to panic with an error, got %v", r)
+		}
+	}()
+	env.MustExecute("{{ nope() }}", nil)
+}
+
+func TestInspect(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"page.twig": `{% extends 'layout.twig' %}{% import 'forms.twig' as forms %}` +
+			`{% block title %}{{ title|upper }}{% endblock %}` +
+			`{% block content %}{% set count = 0 %}{% for k, item in items %}{{ loop.index }}{{ item.name }}{{ k }}{{ count }}{% endfor %}` +
+			`{{ forms.input(user.name) }}{% include template %}{% include 'footer.twig' %}{{ _self.row(0) }}` +
+			`{% set h = {key: val, (dynamic): 1, 'str': 2} %}{% endblock %}` +
+			`{% macro row(value, class = default_class) %}{{ value }}{{ varargs }}{{ other }}{% endmacro %}`,
+	}})
+	info, err := env.Inspect("page.twig")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := &TemplateInfo{
+		Name:      "page.twig",
+		Parent:    "layout.twig",
+		Blocks:    []string{"content", "title"},
+		Macros:    []MacroInfo{{"row", []string{"value", "class"}}},
+		Variables: []string{"default_class", "dynamic", "items", "other", "template", "title", "user", "val"},
+		Templates: []string{"footer.twig", "forms.twig", "layout.twig"},
+	}
+	if fmt.Sprint(info) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, info)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"page.twig": "{% extends 'layout.twig' %}{% from 'forms.twig' import input %}" +
+			"{% block content %}{{ input('name') }}{{ name|uper }}{% include 'missing.twig' %}{% include 'footer.twig' %}{% endblock %}",
+		"layout.twig": "{% block content %}{% endblock %}{% filter upper|nope %}{% endfilter %}",
+		"forms.twig":  "{% macro input(name) %}{% if name is empty %}{{ parent() }}{% endif %}{% endmacro %}",
+		"footer.twig": "{{ now() }}{% if x is odd %}{% endif %}",
+		"broken.twig": "{% if %}",
+	}})
+	env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value { return val }
+	env.Tests["empty"] = func(ctx Context, val Value, args ...Value) bool { return false }
+	var actual []string
+	for _, err := range env.Validate("page.twig") {
+		actual = append(actual, err.Error())
+	}
+	expected := []string{
+		`Undeclared filter "uper" (did you mean "upper"?)`,
+		`Undeclared filter "nope"`,
+		`template "missing.twig" not found`,
+		`Undeclared function "now"`,
+		`Undeclared test "odd"`,
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	if errs := env.Validate("forms.twig"); errs != nil {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	var perr ParseError
+	if errs := env.Validate("broken.twig"); len(errs) != 1 || !errors.As(errs[0], &perr) {
+		t.Errorf("expected a ParseError, got %v", errs)
+	}
+}
+
+func TestLint(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"page.twig":   "{% extends 'base.twig' %}{% block content %}{{ x|nope }}{% endblock %}{% block extra %}{% endblock %}",
+		"base.twig":   "{% extends 'layout.twig' %}{% block title %}{% endblock %}",
+		"layout.twig": "{% block content %}{% block nested %}{% endblock %}{% endblock %}",
+		"nested.twig": "{% extends 'layout.twig' %}{% block nested %}{% endblock %}{% block title %}{% endblock %}",
+		"broken.twig": "\n{% if %}",
+	}})
+	tests := []struct {
+		names    []string
+		expected []string
+	}{
+		{[]string{"page.twig"}, []string{
+			`base.twig:1:30: warning: block "title" is not defined in any parent template (undefined-block)`,
+			`page.twig:1:48: error: Undeclared filter "nope" (undeclared-filter)`,
+			`page.twig:1:73: warning: block "extra" is not defined in any parent template (undefined-block)`,
+		}},
+		{[]string{"nested.twig"}, []string{
+			`nested.twig:1:62: warning: block "title" is not defined in any parent template (undefined-block)`,
+		}},
+		{[]string{"layout.twig", "missing.twig"}, []string{
+			`missing.twig: error: template "missing.twig" not found (not-found)`,
+		}},
+	}
+	for _, test := range tests {
+		var actual []string
+		for _, d := range env.Lint(test.names...) {
+			actual = append(actual, d.String())
+		}
+		if strings.Join(actual, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%v: expected:\n%s\ngot:\n%s", test.names, strings.Join(test.expected, "\n"), strings.Join(actual, "\n"))
+		}
+	}
+	ds := env.Lint("broken.twig")
+	if len(ds) != 1 || ds[0].Code != "syntax" || ds[0].Line != 2 || ds[0].Severity != SeverityError {
+		t.Errorf("expected a syntax error on line 2, got %v", ds)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"a.twig": "{% trans %}Hello {{ name|title }}{% endtrans %}\n{{ x ?? 'y' }}{{ f() }}\n{% verbatim %}{% nope %}{% endverbatim %}",
+		"b.twig": "{% trans with {'%n%': n} %}{% endtrans %}{% if x is iterable %}{{ name|title }}{% endif %}",
+		"c.twig": "{% sandbox %}{% if a === b %}{% endif %}{% endsandbox %}{{ ok }}",
+	}})
+	r := env.Audit("a.twig", "b.twig", "c.twig", "missing.twig")
+	var actual []string
+	for _, f := range r.Findings {
+		var locs []string
+		for _, l := range f.Locations {
+			locs = append(locs, fmt.Sprintf("%s:%d:%d", l.Template, l.Line, l.Column))
+		}
+		actual = append(actual, fmt.Sprintf("%s %s: %s", f.Kind, f.Name, strings.Join(locs, " ")))
+	}
+	expected := []string{
+		"filter title: a.twig:1:24 b.twig:1:70",
+		"tag trans: a.twig:1:3 b.twig:1:3",
+		"function f: a.twig:2:17",
+		`load template "missing.twig" not found: missing.twig:0:0`,
+		"operator ===: c.twig:1:21",
+		"operator ??: a.twig:2:5",
+		"tag sandbox: c.twig:1:3",
+		"test iterable: b.twig:1:52",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	if r.Templates != 4 || len(r.Unparsable) != 1 || r.Unparsable[0] != "c.twig" {
+		t.Errorf("expected 4 templates with c.twig unparsable, got %d and %v", r.Templates, r.Unparsable)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"page.twig": "{% extends 'layout.twig' %}{% set title = page.title %}" +
+			"{% block content %}{% for item in items %}{{ loop.index }}{{ item.name }}{{ item.tags[tag].label }}{% endfor %}" +
+			"{% include 'card.twig' with {card: user} %}{% include 'footer.twig' with {year: 1} only %}{% endblock %}",
+		"layout.twig": "<title>{{ title }}</title>{% block content %}{{ unused }}{% endblock %}{% block side %}{{ user['address'].city }}{% endblock %}",
+		"card.twig":   "{{ card.name }}{{ user.email() }}{{ site_name }}",
+		"footer.twig": "{{ year }}{{ company }}{% macro m(x) %}{{ x }}{{ y }}{% endmacro %}",
+	}})
+	env.Globals["site_name"] = "Site"
+	vars, err := env.Variables("page.twig")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var actual []string
+	for _, v := range vars {
+		actual = append(actual, fmt.Sprintf("%s %v %v", v.Name, v.Local, v.Attrs))
+	}
+	expected := []string{
+		"card true [name]",
+		"company false []",
+		"item true [name tags]",
+		"items false []",
+		"page false [title]",
+		"tag false []",
+		"title true []",
+		"user false [address.city email]",
+		"year true []",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	if _, err := env.Variables("missing.twig"); err == nil {
+		t.Errorf("expected an error for a missing template")
+	}
+}
+
+type recordingInstrumentation struct {
+	events []string
+}
+
+func (r *recordingInstrumentation) BeforeNode(ctx Context, node parse.Node) {
+	r.events = append(r.events, fmt.Sprintf("before %T %s %s", node, ctx.Name(), node.Start()))
+}
+
+func (r *recordingInstrumentation) AfterNode(ctx Context, node parse.Node, elapsed time.Duration, err error) {
+	if elapsed < 0 {
+		r.events = append(r.events, "negative duration")
+	}
+	if err != nil {
+		r.events = append(r.events, fmt.Sprintf("error %T", node))
+	}
+}
+
+func TestInstrumentation(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig": "{% macro m() %}{{ nope() }}{% endmacro %}A{{ _self.m() }}",
+	}})
+	rec := &recordingInstrumentation{}
+	env.Instrumentation = rec
+	if err := env.Execute("index.twig", ioutil.Discard, nil); err == nil {
+		t.Errorf("expected error")
+	}
+	expected := []string{
+		"before *parse.ModuleNode index.twig 1:0",
+		"before *parse.BodyNode index.twig 1:0",
+		"before *parse.TextNode index.twig 1:41",
+		"before *parse.PrintNode index.twig 1:42",
+		"before *parse.MacroNode index.twig 1:3",
+		"before *parse.PrintNode index.twig 1:15",
+		"error *parse.PrintNode",
+		"error *parse.MacroNode",
+		"error *parse.PrintNode",
+		"error *parse.BodyNode",
+		"error *parse.ModuleNode",
+	}
+	if strings.Join(rec.events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rec.events, "\n"))
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(append([]interface{}{"DEBUG", msg}, args...)...), "\n"))
+}
+
+func (l *recordingLogger) WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(append([]interface{}{"WARN", msg}, args...)...), "\n"))
+}
+
+func TestLogger(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig": "{{ name }}{{ check() }}",
+	}})
+	logger := &recordingLogger{}
+	env.Logger = logger
+	env.Functions["check"] = func(ctx Context, args ...Value) Value {
+		ctx.Warn(errors.New("check failed"))
+		return nil
+	}
+	if err := env.Execute("index.twig", ioutil.Discard, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{
+		"DEBUG template loaded template index.twig",
+		"DEBUG undefined variable template index.twig line 1 column 3 name name",
+		"WARN template warning template index.twig line 1 column 13 error check failed",
+	}
+	if strings.Join(logger.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(logger.lines, "\n"))
+	}
+}
+
+func TestDeprecations(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig":   "{% include 'partial.twig' %}{{ name|old }}",
+		"partial.twig": "{% filter old %}text{% endfilter %}",
+	}})
+	env.Filters["old"] = func(ctx Context, val Value, args ...Value) Value {
+		ctx.Deprecated(`The "old" filter is deprecated.`)
+		return val
+	}
+	collector := &DeprecationCollector{}
+	env.DeprecationHandler = collector.Handle
+	if err := env.Execute("index.twig", ioutil.Discard, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{
+		`The "filter" tag is deprecated, use the "apply" tag instead. on line 1, column 3 in partial.twig`,
+		`The "old" filter is deprecated. on line 1, column 3 in partial.twig`,
+		`The "old" filter is deprecated. on line 1, column 35 in index.twig`,
+	}
+	var actual []string
+	for _, d := range collector.Deprecations() {
+		actual = append(actual, d.String())
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+	collector.Reset()
+	if len(collector.Deprecations()) != 0 {
+		t.Errorf("expected no deprecations after Reset")
+	}
+}
+
+func TestExecuteWithSourceMap(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"index.twig":  "Hello, {{ name }}!\n{% include 'footer.twig' %}",
+		"footer.twig": "Bye",
+	}})
+	buf := &bytes.Buffer{}
+	m, err := env.ExecuteWithSourceMap("index.twig", buf, map[string]Value{"name": "World"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if buf.String() != "Hello, World!\nBye" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+	expected := []Mapping{
+		{0, 7, "index.twig", 1, 0},
+		{7, 12, "index.twig", 1, 7},
+		{12, 14, "index.twig", 1, 17},
+		{14, 17, "footer.twig", 1, 0},
+	}
+	if !reflect.DeepEqual(m.Mappings, expected) {
+		t.Errorf("expected %+v, got %+v", expected, m.Mappings)
+	}
+	if mp, ok := m.Lookup(15); !ok || mp.Template != "footer.twig" {
+		t.Errorf("expected offset 15 to map to footer.twig, got %+v", mp)
+	}
+	if _, ok := m.Lookup(17); ok {
+		t.Errorf("expected no mapping past the end of output")
+	}
+
+	env.UseOutputMiddleware(func(next io.Writer) io.Writer {
+		io.WriteString(next, "> ")
+		return next
+	})
+	buf.Reset()
+	if m, err = env.ExecuteWithSourceMap("index.twig", buf, map[string]Value{"name": "World"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if buf.String() != "> Hello, World!\nBye" {
+		t.Errorf("expected middleware to be applied, got %q", buf.String())
+	}
+	if !reflect.DeepEqual(m.Mappings, expected) {
+		t.Errorf("expected %+v, got %+v", expected, m.Mappings)
+	}
+}
+
+// testExtension contributes to the Env through every provider interface.
+type testExtension struct {
+	initialized bool
+}
+
+func (e *testExtension) Init(env *Env) error {
+	e.initialized = true
+	return nil
+}
+
+func (e *testExtension) Filters() map[string]Filter {
+	return map[string]Filter{"shout": func(ctx Context, val Value, args ...Value) Value {
+		return strings.ToUpper(CoerceString(val)) + "!"
+	}}
+}
+
+func (e *testExtension) Functions() map[string]Func {
+	return map[string]Func{"answer": func(ctx Context, args ...Value) Value {
+		return 42
+	}}
+}
+
+func (e *testExtension) Tests() map[string]Test {
+	return map[string]Test{"answer": func(ctx Context, val Value, args ...Value) bool {
+		return CoerceNumber(val) == 42
+	}}
+}
+
+func (e *testExtension) Globals() map[string]Value {
+	return map[string]Value{"site": "Stick"}
+}
+
+func (e *testExtension) Operators() map[string]Operator {
+	return map[string]Operator{"<=>": {20, false, func(ctx Context, left, right Value) Value {
+		return compare(left, right)
+	}}}
+}
+
+func (e *testExtension) Visitors() []parse.NodeVisitor {
+	return []parse.NodeVisitor{}
+}
+
+func (e *testExtension) Tags() map[string]parse.TagParser {
+	// {% shout %}...{% endshout %} applies the shout filter to its body.
+	return map[string]parse.TagParser{"shout": func(t *parse.Tree, start parse.Pos) (parse.Node, error) {
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		body, err := t.ParseUntilEndTag("shout", start)
+		if err != nil {
+			return nil, err
+		}
+		return parse.NewFilterNode([]string{"shout"}, body, start), nil
+	}}
+}
+
+func TestRegisterExtension(t *testing.T) {
+	env := New(nil)
+	ext := &testExtension{}
+	if err := env.Register(ext); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ext.initialized {
+		t.Errorf("expected Init to be called")
+	}
+	tests := map[string]string{
+		"{{ site|shout }}": "STICK!",
+		"{{ answer() }}":   "42",
+		"{{ (answer() is answer) ? 'yes' : 'no' }}":   "yes",
+		"{{ 1 <=> 2 }}{{ 2 <=> 2 }}{{ 1 + 2 <=> 2 }}": "-101",
+		"{% shout %}hello {{ site }}{% endshout %}":   "HELLO STICK!",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestContextDecorator(t *testing.T) {
+	type userKey struct{}
+	env := New(nil)
+	env.ContextDecorator = func(c context.Context, data map[string]Value) {
+		if user, ok := c.Value(userKey{}).(string); ok {
+			data["user"] = user
+		}
+	}
+	c := context.WithValue(context.Background(), userKey{}, "Alice")
+	ctx := map[string]Value{"greeting": "Hello"}
+	buf := &bytes.Buffer{}
+	if err := env.ExecuteContext(c, "{{ greeting }}, {{ user }}", buf, ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if buf.String() != "Hello, Alice" {
+		t.Errorf("expected %q, got %q", "Hello, Alice", buf.String())
+	}
+	if _, ok := ctx["user"]; ok {
+		t.Errorf("expected caller's map to be unmodified")
+	}
+}
+
+// countingLoader counts the number of times each template is loaded.
+type countingLoader struct {
+	MemoryLoader
+	loads map[string]int
+	cache bool // If false, templates are never fresh, so are never cached.
+
+	mu sync.Mutex
+}
+
+func (l *countingLoader) Load(name string) (Template, error) {
+	l.mu.Lock()
+	l.loads[name]++
+	l.mu.Unlock()
+	return l.MemoryLoader.Load(name)
+}
+
+func (l *countingLoader) IsFresh(name string, since time.Time) bool {
+	return l.cache && l.MemoryLoader.IsFresh(name, since)
+}
+
+func TestOptimizations(t *testing.T) {
+	templates := map[string]string{
+		"index.twig": "{% for i in 1..3 %}{% include 'item.twig' %}{% endfor %}" +
+			"{% for i in 1..2 %}{{ loop.index }}{% endfor %}" +
+			"{{ html|raw }}{{ (html|raw)|upper }}{% set x = html|raw %}{{ x }}" +
+			"{% include 'tree.twig' with {'depth': 2} %}",
+		"item.twig": "[{{ i }}]",
+		"tree.twig": "{{ depth }}{% if depth > 0 %}{% include 'tree.twig' with {'depth': depth - 1} %}{% endif %}",
+	}
+	expected := "[1][2][3]12<b>&lt;B&gt;&lt;b&gt;210"
+	ctx := map[string]Value{"html": "<b>"}
+	escape := func(s string) string {
+		return strings.Replace(strings.Replace(s, "<", "&lt;", -1), ">", "&gt;", -1)
+	}
+	for _, flags := range []int{0, OptimizeRawFilter, OptimizeLoopVariable, OptimizeInclude, OptimizeAll} {
+		loader := &countingLoader{MemoryLoader: MemoryLoader{Templates: templates}, loads: make(map[string]int)}
+		env := New(loader)
+		env.Optimizations = flags
+		env.DefaultEscapeStrategy = "html"
+		env.RegisterEscaper("html", escape)
+		env.Filters["raw"] = func(ctx Context, val Value, args ...Value) Value { return val }
+		env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value {
+			return strings.ToUpper(CoerceString(val))
+		}
+		actual, err := env.ExecuteToString("index.twig", ctx)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", flags, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%d: expected %q, got %q", flags, expected, actual)
+		}
+		// Templates that cannot be cached are still only loaded once per execution.
+		if loader.loads["item.twig"] != 1 {
+			t.Errorf("%d: expected item.twig to be loaded once, got %d", flags, loader.loads["item.twig"])
+		}
+	}
+
+	env := New(&MemoryLoader{Templates: templates})
+	env.Optimizations = OptimizeAll
+	tree, err := env.Parse("index.twig")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	nodes := tree.Root().Nodes
+	if f := nodes[0].(*parse.ForNode); f.NoLoop {
+		t.Errorf("expected loop to be kept for a for loop containing an include")
+	}
+	if f := nodes[1].(*parse.ForNode); f.NoLoop {
+		t.Errorf("expected loop to be kept for a for loop using it")
+	}
+	if _, ok := nodes[2].(*parse.PrintNode).X.(*parse.FilterExpr); !ok {
+		t.Errorf("expected last raw filter to be kept")
+	}
+	if _, ok := nodes[4].(*parse.SetNode).X.(*parse.NameExpr); !ok {
+		t.Errorf("expected raw filter to be removed from set statement")
+	}
+	tree, _ = env.Parse("tree.twig")
+	body := tree.Root().Nodes[1].(*parse.IfNode).Body.(*parse.BodyNode)
+	if body.Nodes[0].(*parse.IncludeNode).Tree != nil {
+		t.Errorf("expected recursive include not to be loaded ahead of time")
+	}
+	templates["loop.twig"] = "{% for i in items %}{{ i }}{% endfor %}"
+	tree, _ = env.Parse("loop.twig")
+	if !tree.Root().Nodes[0].(*parse.ForNode).NoLoop {
+		t.Errorf("expected loop variable to be optimized away")
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"upper", "lower", "length", "title"}
+	tests := map[string]string{
+		"uper":   "upper",
+		"lenght": "length",
+		"titel":  "title",
+		"xyz":    "",
+	}
+	for name, expected := range tests {
+		if actual := suggest(name, candidates); actual != expected {
+			t.Errorf("suggest(%q): expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+type fakePerson struct {
+	name string
+}
+
+func (p *fakePerson) Name(prefix string) string {
+	p.name = prefix + p.name
+	return p.name
+}
+
+func BenchmarkExecute(b *testing.B) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"layout.twig": "<html>{% block content %}{% endblock %}</html>",
+		"page.twig":   "{% extends 'layout.twig' %}{% block content %}{% import 'macros.twig' as m %}{% for item in items %}{{ m.item(item) }}{% endfor %}{% set footer %}{{ title }}{% endset %}{{ footer }}{% endblock %}",
+		"macros.twig": "{% macro item(v) %}<li>{{ v }}</li>{% endmacro %}",
+	}})
+	ctx := map[string]Value{"title": "Benchmark", "items": []string{"a", "b", "c", "d", "e"}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := env.Execute("page.twig", ioutil.Discard, ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine(b *testing.B) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+	ctx := map[string]Value{"items": items}
+	for _, engine := range []struct {
+		name   string
+		engine Engine
+	}{{"tree", EngineTree}, {"vm", EngineVM}} {
+		b.Run(engine.name, func(b *testing.B) {
+			env := New(NewMemoryLoader(map[string]string{
+				"loop.twig": "{% for i in items %}{% if i % 2 == 0 %}{{ loop.index * 2 }}{% else %}{{ i ~ '-' ~ loop.length }}{% endif %}{% endfor %}",
+			}))
+			env.Engine = engine.engine
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := env.Execute("loop.twig", ioutil.Discard, ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOptimizeIncludeLoadsOnce(t *testing.T) {
+	loader := &countingLoader{
+		MemoryLoader: MemoryLoader{Templates: map[string]string{
+			"a.twig": "{% include 'b.twig' %}{% include 'b.twig' %}",
+			"b.twig": "{% include 'c.twig' %}{% include 'c.twig' %}",
+			"c.twig": "{% include 'd.twig' %}{% include 'd.twig' %}",
+			"d.twig": "{% include 'e.twig' %}{% include 'e.twig' %}",
+			"e.twig": "x{% include 'missing.twig' ignore missing %}",
+		}},
+		loads: make(map[string]int),
+		cache: true,
+	}
+	env := New(loader)
+	env.Optimizations = OptimizeInclude
+	actual, err := env.ExecuteToString("a.twig", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := strings.Repeat("x", 16); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	for _, name := range []string{"a.twig", "b.twig", "c.twig", "d.twig", "e.twig"} {
+		if loader.loads[name] != 1 {
+			t.Errorf("expected %s to be loaded once, got %d", name, loader.loads[name])
+		}
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	loader := &countingLoader{
+		MemoryLoader: MemoryLoader{Templates: map[string]string{
+			"base.twig":  "<{% block body %}{% endblock %}>",
+			"child.twig": "{% extends 'base.twig' %}{% block body %}{% include 'item.twig' %}{% endblock %}",
+			"item.twig":  "item",
+		}},
+		loads: make(map[string]int),
+		cache: true,
+	}
+	env := New(loader)
+	env.Optimizations = OptimizeInclude
+	for i := 0; i < 3; i++ {
+		actual, err := env.ExecuteToString("child.twig", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if actual != "<item>" {
+			t.Errorf("expected %q, got %q", "<item>", actual)
+		}
+	}
+	for _, name := range []string{"base.twig", "child.twig", "item.twig"} {
+		if loader.loads[name] != 1 {
+			t.Errorf("expected %s to be loaded once, got %d", name, loader.loads[name])
+		}
+	}
+
+	// Modifying an inlined template invalidates the template it is inlined in.
+	loader.Add("item.twig", "changed")
+	actual, err := env.ExecuteToString("child.twig", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if actual != "<changed>" {
+		t.Errorf("expected %q, got %q", "<changed>", actual)
+	}
+	if loader.loads["child.twig"] != 2 || loader.loads["base.twig"] != 1 {
+		t.Errorf("expected only child.twig to be reloaded, got %v", loader.loads)
+	}
+
+	// Trees returned by Parse are not cached.
+	tree, err := env.Parse("base.twig")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tree.Root().Nodes = nil
+	if actual, _ := env.ExecuteToString("child.twig", nil); actual != "<changed>" {
+		t.Errorf("expected %q, got %q", "<changed>", actual)
+	}
+}
+
+func TestLoadOncePerExecution(t *testing.T) {
+	loader := &countingLoader{
+		MemoryLoader: MemoryLoader{Templates: map[string]string{
+			"base.twig":  "<{% block body %}{% endblock %}>",
+			"child.twig": "{% extends 'base.twig' %}{% block body %}{% for i in 1..3 %}{% include 'item.twig' %}{% endfor %}{% endblock %}",
+			"item.twig":  "{% embed 'base.twig' %}{% block body %}{{ i }}{% endblock %}{% endembed %}",
+		}},
+		loads: make(map[string]int),
+	}
+	env := New(loader)
+	for i := 1; i <= 2; i++ {
+		actual, err := env.ExecuteToString("child.twig", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if actual != "<<1><2><3>>" {
+			t.Errorf("expected %q, got %q", "<<1><2><3>>", actual)
+		}
+		for _, name := range []string{"base.twig", "child.twig", "item.twig"} {
+			if loader.loads[name] != i {
+				t.Errorf("expected %s to be loaded %d time(s), got %d", name, i, loader.loads[name])
+			}
+		}
+	}
+}
+
+// recordingMetrics records the calls made to a Metrics.
+type recordingMetrics struct {
+	calls []string
+}
+
+func (m *recordingMetrics) Render(name string, elapsed time.Duration, err error) {
+	m.calls = append(m.calls, fmt.Sprintf("render %s %t", name, err == nil))
+}
+
+func (m *recordingMetrics) CacheLookup(name string, hit bool) {
+	m.calls = append(m.calls, fmt.Sprintf("lookup %s %t", name, hit))
+}
+
+func (m *recordingMetrics) Parse(name string, elapsed time.Duration, err error) {
+	m.calls = append(m.calls, fmt.Sprintf("parse %s %t", name, err == nil))
+}
+
+func TestMetrics(t *testing.T) {
+	env := New(NewMemoryLoader(map[string]string{
+		"base.twig":  "{% block body %}{% endblock %}",
+		"child.twig": "{% extends 'base.twig' %}{% block body %}{{ 1 in 2 }}{% endblock %}",
+		"bad.twig":   "{{ 1 +",
+	}))
+	env.CacheMode = CacheForever
+	m := &recordingMetrics{}
+	env.Metrics = m
+	env.ExecuteToString("child.twig", nil)
+	env.ExecuteToString("base.twig", nil)
+	env.ExecuteBlock("base.twig", "body", ioutil.Discard, nil)
+	env.ExecuteToString("bad.twig", nil)
+	expected := []string{
+		"lookup child.twig false", "parse child.twig true", "lookup base.twig false", "parse base.twig true", "render child.twig false",
+		"lookup base.twig true", "render base.twig true",
+		"lookup base.twig true", "render base.twig true",
+		"lookup bad.twig false", "parse bad.twig false", "render bad.twig false",
+	}
+	if !reflect.DeepEqual(m.calls, expected) {
+		t.Errorf("expected calls:\n\t%s\ngot:\n\t%s", strings.Join(expected, "\n\t"), strings.Join(m.calls, "\n\t"))
+	}
+}
+
+func TestBlockTable(t *testing.T) {
+	env := New(NewMemoryLoader(map[string]string{
+		"base.twig":   "<{% block title %}Base{% endblock %}|{% block body %}{% endblock %}>",
+		"middle.twig": "{% extends 'base.twig' %}{% block title %}Middle {{ parent() }}{% endblock %}",
+		"child.twig":  "{% extends 'middle.twig' %}{% use 'blocks.twig' with item as alias %}{% block body %}{{ block('alias') }}{% endblock %}",
+		"blocks.twig": "{% block item %}item{% endblock %}",
+	}))
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"child.twig", "<Middle Base|item>"},
+		{"child.twig", "<Middle Base|item>"},
+		{"middle.twig", "<Middle Base|>"},
+	}
+	for _, test := range tests {
+		actual, err := env.ExecuteToString(test.name, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+
+	// Aliases are not added to the shared tree of the used template.
+	tree, err := env.load("blocks.twig")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := tree.Blocks()["alias"]; ok {
+		t.Errorf("expected blocks.twig not to be modified")
+	}
+
+	// The tables of cached templates and their parents are reused.
+	var chain []map[string]*parse.BlockNode
+	for _, name := range []string{"middle.twig", "base.twig"} {
+		tree, err := env.load(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		chain = append(chain, tree.Blocks())
+	}
+	tbl := env.cache.blockTable(chain)
+	if tbl != env.cache.blockTable(chain) {
+		t.Errorf("expected the block table to be cached")
+	}
+	if blk := tbl.parents["title"]; blk == nil || blk.Origin != "base.twig" {
+		t.Errorf("expected the parent of the title block to be from base.twig, got %v", blk)
+	}
+}
+
+func TestTemplateCacheLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxTemplates int
+		maxBytes     int64
+		expected     CacheStats
+	}{
+		{"unlimited", 0, 0, CacheStats{Hits: 3, Misses: 3, Templates: 3, Bytes: 12}},
+		{"templates", 2, 0, CacheStats{Hits: 2, Misses: 4, Evictions: 2, Templates: 2, Bytes: 8}},
+		{"bytes", 0, 5, CacheStats{Hits: 0, Misses: 6, Evictions: 5, Templates: 1, Bytes: 4}},
+	}
+	for _, test := range tests {
+		env := New(NewMemoryLoader(map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc"}))
+		env.MaxCachedTemplates = test.maxTemplates
+		env.MaxCachedBytes = test.maxBytes
+		// The least recently used template is "b" when "c" is added.
+		for _, name := range []string{"a", "b", "a", "c", "a", "b"} {
+			if _, err := env.ExecuteToString(name, nil); err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.name, err)
+			}
+		}
+		if stats := env.CacheStats(); stats != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, stats)
+		}
+	}
+}
+
+func TestCacheMode(t *testing.T) {
+	loader := NewMemoryLoader(map[string]string{"index.twig": "before"})
+	env := New(loader)
+	env.CacheMode = CacheForever
+	tests := []struct {
+		before   func()
+		expected string
+	}{
+		{func() {}, "before"},
+		{func() { loader.Add("index.twig", "after") }, "before"},
+		{func() { env.ClearTemplateCache() }, "after"},
+		{func() { loader.Add("index.twig", "reloaded"); env.CacheMode = CacheAutoReload }, "reloaded"},
+	}
+	for i, test := range tests {
+		test.before()
+		actual, err := env.ExecuteToString("index.twig", nil)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %s", i, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, actual)
+		}
+	}
+
+	// Templates from any Loader are cached forever.
+	calls := 0
+	env = New(FuncLoader(func(name string) (string, time.Time, error) {
+		calls++
+		return "func", time.Time{}, nil
+	}))
+	env.CacheMode = CacheForever
+	env.ExecuteToString("index.twig", nil)
+	env.ExecuteToString("index.twig", nil)
+	if calls != 1 {
+		t.Errorf("expected template to be loaded once, got %d", calls)
+	}
+}
+
+// countingVisitor counts the templates it visits.
+type countingVisitor struct {
+	modules int
+}
+
+func (v *countingVisitor) Enter(parse.Node) {}
+
+func (v *countingVisitor) Leave(n parse.Node) {
+	if _, ok := n.(*parse.ModuleNode); ok {
+		v.modules++
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templates := map[string]string{
+		"layout.twig": "<{% block content %}{% endblock %}>",
+		"page.twig":   "{% extends 'layout.twig' %}{% import _self as m %}{% macro item(v) %}[{{ v }}]{% endmacro %}{% block content %}{% for v in items %}{{ m.item(v) }}{% endfor %}{% include 'card.twig' with {'v': 1} %}{% endblock %}",
+		"card.twig":   "{% embed 'layout.twig' %}{% block content %}card {{ v }}{% endblock %}{% endembed %}",
+	}
+	ctx := map[string]Value{"items": []string{"a", "b"}}
+	newEnv := func() (*Env, *countingVisitor) {
+		v := &countingVisitor{}
+		env := New(NewMemoryLoader(templates))
+		env.CacheDir = dir
+		env.Visitors = append(env.Visitors, v)
+		env.Optimizations = OptimizeAll
+		return env, v
+	}
+	tests := []struct {
+		name    string
+		before  func()
+		modules int
+	}{
+		{"empty", func() {}, 3},
+		{"cached", func() {}, 0},
+		{"modified", func() {
+			templates["card.twig"] = "{% embed 'layout.twig' %}{% block content %}modified {{ v }}{% endblock %}{% endembed %}"
+		}, 1},
+	}
+	for _, test := range tests {
+		test.before()
+		env, v := newEnv()
+		expected, err := New(NewMemoryLoader(templates)).ExecuteToString("page.twig", ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		actual, err := env.ExecuteToString("page.twig", ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %q, got %q", test.name, expected, actual)
+		}
+		if v.modules != test.modules {
+			t.Errorf("%s: expected %d templates to be parsed, got %d", test.name, test.modules, v.modules)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	loader := &countingLoader{
+		MemoryLoader: MemoryLoader{Templates: map[string]string{
+			"a.twig":   "a",
+			"b.twig":   "b",
+			"bad.twig": "{% if %}",
+		}},
+		loads: make(map[string]int),
+		cache: true,
+	}
+	env := New(loader)
+	errs := env.Warmup("a.twig", "missing.twig", "b.twig")
+	if len(errs) != 1 || !errors.Is(errs[0], ErrTemplateNotFound) {
+		t.Errorf("expected a single ErrTemplateNotFound, got %v", errs)
+	}
+	errs = env.WarmupAll()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "bad.twig") {
+		t.Errorf("expected a single error for bad.twig, got %v", errs)
+	}
+	for _, name := range []string{"a.twig", "b.twig"} {
+		if _, err := env.ExecuteToString(name, nil); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+		if loader.loads[name] != 1 {
+			t.Errorf("%s: expected template to be loaded once, got %d", name, loader.loads[name])
+		}
+	}
+
+	env = New(&StringLoader{})
+	if errs := env.WarmupAll(); len(errs) != 1 || errs[0] != ErrNotLister {
+		t.Errorf("expected ErrNotLister, got %v", errs)
+	}
+}
+
+func TestEngineVM(t *testing.T) {
+	templates := map[string]string{
+		"text":      "Hello, World!",
+		"print":     `{{ name }} {{ 1 + 2 * 3 }} {{ -count }} {{ not false }} {{ "a" ~ "b" }} {{ html }}`,
+		"exact":     `{{ price * 3 }} {{ price / 2 > 9.99 }}`,
+		"if":        `{% if count > 5 %}big{% elseif count > 1 %}medium{% else %}small{% endif %}`,
+		"ternary":   `{{ count % 2 == 0 ? "even" : "odd" }} {{ missing ? "yes" : "no" }}`,
+		"for":       `{% for i, v in items %}{{ loop.index }}:{{ i }}={{ v }}{% if not loop.last %}, {% endif %}{% endfor %}`,
+		"for else":  `{% for v in missing %}{{ v }}{% else %}empty{% endfor %}`,
+		"nested":    `{% for a in 1..2 %}{% for b in 1..2 %}{{ loop.parent.loop.index }}{{ loop.index }} {% endfor %}{% endfor %}`,
+		"set":       `{% set total = 0 %}{% for v in 1..4 %}{% set total = total + v %}{% endfor %}{{ total }}`,
+		"set block": `{% set x %}captured {{ name }}{% endset %}{{ x }}`,
+		"attr":      `{{ account.Email }} {{ account.Domain() }} {{ hash.key }} {{ items[1] }} {{ hash["missing"] }}`,
+		"filter":    `{% for v in items %}{{ v|upper }}{% endfor %} {{ range(1, 3)|join(",") }}`,
+		"range":     `{% for v in 1..5 %}{{ v }}{% endfor %} {{ 2 in [1, 2] }} {{ 7 // 2 }} {{ 2 ** 3 }}`,
+		"include":   `{% for v in items %}{% include "partial" with {"v": v} %}{% endfor %}`,
+		"partial":   `[{{ v }}]`,
+		"macro":     `{% macro wrap(v) %}<{{ v }}>{% endmacro %}{% import _self as m %}{% for v in items %}{{ m.wrap(v) }}{% endfor %}`,
+		"child":     `{% extends "layout" %}{% block content %}{% for v in items %}{{ v }}{% endfor %}{% endblock %}`,
+		"layout":    `<{% block content %}{% endblock %}>`,
+		"error":     `{% for v in items %}{{ v }}{% endfor %}{{ 1 in 2 }}`,
+	}
+	ctx := map[string]Value{
+		"name":    "stick",
+		"count":   4,
+		"items":   []string{"a", "b", "c"},
+		"html":    "<b>",
+		"account": &fakeAccount{Email: "user@example.com"},
+		"hash":    map[string]Value{"key": "value"},
+		"price":   decimal.RequireFromString("19.99"),
+	}
+	newEnv := func(engine Engine) *Env {
+		env := New(NewMemoryLoader(templates))
+		env.CacheMode = CacheForever
+		env.Engine = engine
+		env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value {
+			return strings.ToUpper(CoerceString(val))
+		}
+		env.Filters["join"] = func(ctx Context, val Value, args ...Value) Value {
+			var res []string
+			Iterate(val, func(k, v Value, l Loop) (bool, error) {
+				res = append(res, CoerceString(v))
+				return false, nil
+			})
+			return strings.Join(res, CoerceString(args[0]))
+		}
+		env.Functions["range"] = func(ctx Context, args ...Value) Value {
+			var res []float64
+			for i := CoerceNumber(args[0]); i <= CoerceNumber(args[1]); i++ {
+				res = append(res, i)
+			}
+			return res
+		}
+		return env
+	}
+	tree, vm := newEnv(EngineTree), newEnv(EngineVM)
+	for name := range templates {
+		// Execute each template twice, so it is executed from the cache.
+		for i := 0; i < 2; i++ {
+			expected, expectedErr := tree.ExecuteToString(name, ctx)
+			actual, err := vm.ExecuteToString(name, ctx)
+			if actual != expected {
+				t.Errorf("%s: expected %q, got %q", name, expected, actual)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+				t.Errorf("%s: expected error %v, got %v", name, expectedErr, err)
+			}
+		}
+	}
+	programs := 0
+	vm.cache.programs.Range(func(k, v interface{}) bool {
+		programs++
+		return true
+	})
+	if programs == 0 {
+		t.Error("expected templates to be compiled")
+	}
+	vm.ClearTemplateCache()
+	vm.cache.programs.Range(func(k, v interface{}) bool {
+		t.Error("expected programs to be removed with the cached templates")
+		return false
+	})
+}
+
+func TestApplyFilterCallFunction(t *testing.T) {
+	env := New(nil)
+	env.Filters["suffix"] = func(ctx Context, val Value, args ...Value) Value {
+		return CoerceString(val) + CoerceString(args[0]) + " in " + ctx.Name()
+	}
+	env.Functions["answer"] = func(ctx Context, args ...Value) Value { return 42 }
+	env.Tests["big"] = func(ctx Context, val Value, args ...Value) bool { return CoerceNumber(val) > 10 }
+	if v, err := env.ApplyFilter("tpl", "suffix", "a", "b"); err != nil || v != "ab in tpl" {
+		t.Errorf("unexpected filter result %v, %v", v, err)
+	}
+	if v, err := env.CallFunction("tpl", "answer"); err != nil || v != 42 {
+		t.Errorf("unexpected function result %v, %v", v, err)
+	}
+	if v, err := env.ApplyTest("tpl", "big", 42); err != nil || !v {
+		t.Errorf("unexpected test result %v, %v", v, err)
+	}
+	if _, err := env.ApplyFilter("tpl", "missing", "a"); !errors.Is(err, ErrUndefinedFilter) {
+		t.Errorf("expected ErrUndefinedFilter, got %v", err)
+	}
+	env.UndefinedPolicy = PolicyIgnore
+	if v, err := env.ApplyFilter("tpl", "missing", "a"); err != nil || v != "a" {
+		t.Errorf("expected value to be passed through, got %v, %v", v, err)
+	}
+}
+
+// testSeq returns an iterator function yielding vals.
+func testSeq(vals ...Value) func(yield func(Value) bool) {
+	return func(yield func(Value) bool) {
+		for _, v := range vals {
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+func BenchmarkGetAttr(b *testing.B) {
+	items := make([]*testStruct, 100)
+	for i := range items {
+		items[i] = &testStruct{name: "item"}
+	}
+	env := New(nil)
+	ctx := map[string]Value{"items": items}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := env.Execute("{% for i in items %}{{ i.Name }}{{ i.VName }}{% endfor %}", ioutil.Discard, ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package stick
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzExecute checks that executing arbitrary templates does not panic or
+// run without bound. Run it with:
+//
+//	go test -fuzz FuzzExecute
+func FuzzExecute(f *testing.F) {
+	for _, test := range tests {
+		f.Add(test.tpl, false)
+	}
+	ctx := map[string]Value{
+		"name":  "Tyler",
+		"num":   3.5,
+		"items": []Value{1, "two", nil, map[string]Value{"a": 1}},
+		"hash":  map[string]Value{"key": "value", "list": []int{1, 2}},
+		"user":  struct{ Name string }{"Tyler"},
+	}
+	f.Fuzz(func(t *testing.T, tpl string, vm bool) {
+		env := New(&MemoryLoader{Templates: map[string]string{
+			"fuzz":  tpl,
+			"other": "{{ name }}{% block content %}{% endblock %}",
+		}})
+		env.MaxLoopIterations = 1000
+		env.MaxOutputBytes = 1 << 16
+		if vm {
+			env.Engine = EngineVM
+		}
+		// Errors are expected; only panics and hangs are failures.
+		_ = env.Execute("fuzz", ioutil.Discard, ctx)
+	})
+}
@@ -1,5 +1,5 @@
 module github.com/tyler-sommer/stick
 
-go 1.12
+go 1.13
 
 require github.com/shopspring/decimal v1.3.1
@@ -0,0 +1,58 @@
+package httpstick
+
+import (
+	"io"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// An Adapter executes templates for web frameworks that render views
+// through a method of the form:
+//
+//	Render(w io.Writer, name string, data interface{}) error
+//
+// Frameworks whose interfaces take additional arguments, such as Echo's
+// Renderer, can be satisfied by a small wrapper that calls Render. Parsed
+// templates are cached by the Env, which is shared by all requests.
+type Adapter struct {
+	Env *stick.Env
+
+	// Extension, if set, is appended to template names that do not
+	// already end with it, so that "index" renders "index.html.twig" when
+	// Extension is ".html.twig".
+	Extension string
+}
+
+// NewAdapter returns an Adapter for templates executed by env.
+func NewAdapter(env *stick.Env) *Adapter {
+	return &Adapter{Env: env}
+}
+
+// Load parses every template the Env's Loader can list ahead of time,
+// returning the first error encountered. It does nothing if the Loader is
+// not a stick.Lister.
+func (a *Adapter) Load() error {
+	for _, err := range a.Env.WarmupAll() {
+		if err != stick.ErrNotLister {
+			return err
+		}
+	}
+	return nil
+}
+
+// Render executes the named template, writing the output to w.
+//
+// The data may be a map with string keys, such as a map[string]interface{}
+// or gin.H, whose entries become the template's variables, a struct whose
+// fields do, or any other data accepted by stick.ContextOf.
+func (a *Adapter) Render(w io.Writer, name string, data interface{}) error {
+	ctx, err := stick.ContextOf(data)
+	if err != nil {
+		return err
+	}
+	if a.Extension != "" && !strings.HasSuffix(name, a.Extension) {
+		name += a.Extension
+	}
+	return a.Env.Execute(name, w, ctx)
+}
@@ -0,0 +1,78 @@
+package httpstick
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// ErrorDetails returns a description of err for use in error templates.
+// The returned map contains:
+//
+//	message   the error message, without its location
+//	template  the name of the template where the error occurred
+//	line      the line number where the error occurred
+//	column    the column where the error occurred
+//	source    the surrounding lines of source, each a map with "number",
+//	          "text", and "current", true for the line of the error
+//	stack     the templates that led to the error, innermost first, each a
+//	          map with "kind", "template", "line", and "column"
+//	trace     the stack trace as text
+//
+// Only message and trace are set for errors not caused by a template.
+func ErrorDetails(err error) map[string]stick.Value {
+	if err == nil {
+		return map[string]stick.Value{"message": "", "trace": ""}
+	}
+	res := map[string]stick.Value{"message": err.Error(), "trace": err.Error()}
+	var rerr *stick.RuntimeError
+	var perr stick.ParseError
+	if errors.As(err, &rerr) {
+		res["message"] = rerr.Err.Error()
+		res["template"] = rerr.Template
+		res["line"] = rerr.Pos.Line
+		res["column"] = rerr.Pos.Offset
+		res["trace"] = rerr.StackTrace()
+		source := make([]stick.Value, len(rerr.Source))
+		for i, text := range rerr.Source {
+			n := rerr.SourceStart() + i
+			source[i] = map[string]stick.Value{"number": n, "text": text, "current": n == rerr.Pos.Line}
+		}
+		res["source"] = source
+		stack := make([]stick.Value, len(rerr.Stack))
+		for i, f := range rerr.Stack {
+			stack[len(stack)-1-i] = map[string]stick.Value{
+				"kind":     f.Kind,
+				"template": f.Template,
+				"line":     f.Pos.Line,
+				"column":   f.Pos.Offset,
+			}
+		}
+		res["stack"] = stack
+	} else if errors.As(err, &perr) {
+		res["template"] = perr.Name()
+		res["line"] = perr.Pos().Line
+		res["column"] = perr.Pos().Offset
+	}
+	return res
+}
+
+// debugText returns a plain text error page describing err.
+func debugText(status int, err error) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s\n\n", status, http.StatusText(status))
+	var rerr *stick.RuntimeError
+	if errors.As(err, &rerr) {
+		b.WriteString(rerr.StackTrace())
+		if len(rerr.Source) > 0 {
+			b.WriteString("\n\n")
+			b.WriteString(rerr.Excerpt())
+		}
+	} else {
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+// Package httpstick renders Stick templates as HTTP responses.
+//
+// A Renderer buffers each template's output, so that the status code and
+// headers are only written once the template has executed successfully. If
+// it fails, an error page is written instead:
+//
+//	r := httpstick.New(env)
+//	r.ErrorTemplate = "error.html.twig"
+//
+//	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+//		err := r.HTML(w, http.StatusOK, "index.html.twig", map[string]stick.Value{
+//			"user": currentUser(req),
+//		})
+//		if err != nil {
+//			log.Println(err)
+//		}
+//	})
+//
+// During development, set Debug to show where in the templates an error
+// occurred.
+package httpstick // import "github.com/tyler-sommer/stick/httpstick"
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/internal/bufpool"
+)
+
+// A Renderer writes the output of templates executed by an Env to HTTP
+// responses. It is safe for concurrent use.
+type Renderer struct {
+	Env *stick.Env
+
+	// ErrorTemplate, if set, is the template rendered by Error, and when
+	// executing a template fails. It is given the variables "status", the
+	// HTTP status code, "status_text", its description, and "error", the
+	// error message. Error messages may reveal details of the application,
+	// so templates used in production should not print them.
+	//
+	// If Debug is true, ErrorTemplate is also given "exception", the
+	// details of the error returned by ErrorDetails.
+	ErrorTemplate string
+
+	// Debug, if true, makes error pages describe where in the templates
+	// errors occurred. If there is no ErrorTemplate, or it fails, the
+	// error's stack trace and source excerpt are written as plain text.
+	// Debug must not be enabled in production.
+	Debug bool
+}
+
+// New returns a Renderer for templates executed by env.
+func New(env *stick.Env) *Renderer {
+	return &Renderer{Env: env}
+}
+
+// HTML executes the named template and writes the output to w as an HTML
+// document with the given status code.
+//
+// If execution fails, nothing is written, and an error page is written in
+// its place with status 500, as by Error. The error from executing the
+// template is returned, so that it can be logged.
+func (r *Renderer) HTML(w http.ResponseWriter, status int, name string, data map[string]stick.Value) error {
+	return r.render(w, status, "text/html", name, data)
+}
+
+// Render executes the named template and writes the output to w, as with
+// HTML, but with a content type determined by the template's name, such as
+// "application/json" for "data.json.twig". The ".twig" extension, if any,
+// is ignored; templates with no other extension are written as plain text.
+func (r *Renderer) Render(w http.ResponseWriter, status int, name string, data map[string]stick.Value) error {
+	typ := mime.TypeByExtension(path.Ext(strings.TrimSuffix(name, ".twig")))
+	if typ == "" {
+		typ = "text/plain"
+	}
+	return r.render(w, status, typ, name, data)
+}
+
+// Error writes an error page to w with the given status code, rendering
+// ErrorTemplate for err, or writing the status text as plain text if there
+// is no ErrorTemplate or it fails.
+func (r *Renderer) Error(w http.ResponseWriter, status int, err error) {
+	// A content type set for the intended response does not apply.
+	w.Header().Del("Content-Type")
+	if r.ErrorTemplate != "" {
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		buf := bufpool.Get()
+		defer bufpool.Put(buf)
+		data := map[string]stick.Value{
+			"status":      status,
+			"status_text": http.StatusText(status),
+			"error":       msg,
+		}
+		if r.Debug {
+			data["exception"] = ErrorDetails(err)
+		}
+		rerr := r.Env.Execute(r.ErrorTemplate, buf, data)
+		if rerr == nil {
+			r.write(w, status, "text/html", buf.Bytes())
+			return
+		}
+	}
+	if r.Debug && err != nil {
+		r.write(w, status, "text/plain", []byte(debugText(status, err)))
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+func (r *Renderer) render(w http.ResponseWriter, status int, typ, name string, data map[string]stick.Value) error {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := r.Env.Execute(name, buf, data); err != nil {
+		r.Error(w, http.StatusInternalServerError, err)
+		return err
+	}
+	r.write(w, status, typ, buf.Bytes())
+	return nil
+}
+
+// write writes a response with the given body and content type, unless a
+// content type has already been set. The Env's charset is added to the
+// content type if it does not specify one.
+func (r *Renderer) write(w http.ResponseWriter, status int, typ string, body []byte) {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		if !strings.Contains(typ, "charset=") {
+			charset := r.Env.Charset
+			if charset == "" {
+				charset = stick.DefaultCharset
+			}
+			typ += "; charset=" + strings.ToLower(charset)
+		}
+		h.Set("Content-Type", typ)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
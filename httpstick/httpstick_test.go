@@ -0,0 +1,177 @@
+package httpstick_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/httpstick"
+)
+
+func newRenderer() *httpstick.Renderer {
+	env := stick.New(&stick.MemoryLoader{Templates: map[string]string{
+		"index.html.twig": "<h1>{{ title }}</h1>",
+		"data.json.twig":  `{"title": "{{ title }}"}`,
+		"notes.twig":      "{{ title }}",
+		"broken.twig":     "before{{ missing() }}after",
+		"error.html.twig": "<p>{{ status }} {{ status_text }}: {{ error }}</p>",
+		"debug.html.twig": "{{ exception.message }} at {{ exception.template }}:{{ exception.line }}" +
+			"{% for l in exception.source %}|{{ l.current ? '>' : '' }}{{ l.number }} {{ l.text }}{% endfor %}" +
+			"{% for f in exception.stack %}|{{ f.kind }} {{ f.template }}:{{ f.line }}{% endfor %}",
+		"page.twig":    "{% include 'partial.twig' %}",
+		"partial.twig": "a\nb\n{{ missing() }}\nc",
+	}})
+	return httpstick.New(env)
+}
+
+func TestRenderer(t *testing.T) {
+	data := map[string]stick.Value{"title": "Hello"}
+	tests := []struct {
+		name     string
+		tpl      string
+		render   func(r *httpstick.Renderer, w http.ResponseWriter, status int, name string, data map[string]stick.Value) error
+		errorTpl string
+		status   int
+		typ      string
+		body     string
+		err      bool
+	}{
+		{"html", "index.html.twig", (*httpstick.Renderer).HTML, "", http.StatusCreated, "text/html; charset=utf-8", "<h1>Hello</h1>", false},
+		{"json", "data.json.twig", (*httpstick.Renderer).Render, "", http.StatusOK, "application/json; charset=utf-8", `{"title": "Hello"}`, false},
+		{"plain", "notes.twig", (*httpstick.Renderer).Render, "", http.StatusOK, "text/plain; charset=utf-8", "Hello", false},
+		{"error", "broken.twig", (*httpstick.Renderer).HTML, "", http.StatusInternalServerError, "text/plain; charset=utf-8", "Internal Server Error\n", true},
+		{"error template", "broken.twig", (*httpstick.Renderer).HTML, "error.html.twig", http.StatusInternalServerError, "text/html; charset=utf-8", `<p>500 Internal Server Error: Undeclared function "missing" on line 1, column 9 in broken.twig</p>`, true},
+		{"broken error template", "broken.twig", (*httpstick.Renderer).HTML, "broken.twig", http.StatusInternalServerError, "text/plain; charset=utf-8", "Internal Server Error\n", true},
+	}
+	for _, test := range tests {
+		r := newRenderer()
+		r.ErrorTemplate = test.errorTpl
+		w := httptest.NewRecorder()
+		err := test.render(r, w, test.status, test.tpl, data)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		if typ := w.Header().Get("Content-Type"); typ != test.typ {
+			t.Errorf("%s: expected content type %q, got %q", test.name, test.typ, typ)
+		}
+		if body := w.Body.String(); body != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.name, test.body, body)
+		}
+	}
+}
+
+func TestRendererError(t *testing.T) {
+	r := newRenderer()
+	r.ErrorTemplate = "error.html.twig"
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	r.Error(w, http.StatusNotFound, errors.New("no such page"))
+	if w.Code != http.StatusNotFound || w.Body.String() != "<p>404 Not Found: no such page</p>" {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if typ := w.Header().Get("Content-Type"); typ != "text/html; charset=utf-8" {
+		t.Errorf("expected content type to be replaced, got %q", typ)
+	}
+}
+
+func TestRendererDebug(t *testing.T) {
+	r := newRenderer()
+	r.Debug = true
+	r.ErrorTemplate = "debug.html.twig"
+	w := httptest.NewRecorder()
+	if err := r.HTML(w, http.StatusOK, "page.twig", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := `Undeclared function "missing" at partial.twig:3|1 a|2 b|>3 {{ missing() }}|4 c|include page.twig:1`
+	if w.Code != http.StatusInternalServerError || w.Body.String() != expected {
+		t.Errorf("unexpected response %d\n\t%q\nexpected\n\t%q", w.Code, w.Body.String(), expected)
+	}
+
+	r.ErrorTemplate = ""
+	w = httptest.NewRecorder()
+	r.HTML(w, http.StatusOK, "page.twig", nil)
+	if body := w.Body.String(); !strings.HasPrefix(body, "500 Internal Server Error\n\n") || !strings.Contains(body, ">    3 | {{ missing() }}") {
+		t.Errorf("expected a plain text stack trace and excerpt, got %q", body)
+	}
+	if typ := w.Header().Get("Content-Type"); typ != "text/plain; charset=utf-8" {
+		t.Errorf("expected plain text, got %q", typ)
+	}
+
+	r.Debug = false
+	w = httptest.NewRecorder()
+	r.HTML(w, http.StatusOK, "page.twig", nil)
+	if body := w.Body.String(); body != "Internal Server Error\n" {
+		t.Errorf("expected no details without Debug, got %q", body)
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	details := httpstick.ErrorDetails(errors.New("plain"))
+	if details["message"] != "plain" || details["trace"] != "plain" || details["template"] != nil {
+		t.Errorf("unexpected details for a plain error: %v", details)
+	}
+	_, err := stick.New(nil).ExecuteToString("{{ 1 + }}", nil)
+	details = httpstick.ErrorDetails(err)
+	if details["template"] != "{{ 1 + }}" || details["line"] != 1 {
+		t.Errorf("unexpected details for a parse error: %v", details)
+	}
+}
+
+// H mimics the map types frameworks use for template data, such as gin.H.
+type H map[string]interface{}
+
+type page struct{ title string }
+
+func (p page) TemplateName() string { return "index.html.twig" }
+
+func (p page) Context() map[string]stick.Value {
+	return map[string]stick.Value{"title": p.title}
+}
+
+func TestAdapter(t *testing.T) {
+	env := stick.New(stick.NewMemoryLoader(map[string]string{
+		"index.html.twig": "<h1>{{ title }}</h1>",
+	}))
+	a := httpstick.NewAdapter(env)
+	a.Extension = ".html.twig"
+	if err := a.Load(); err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+	tests := []struct {
+		name     string
+		tpl      string
+		data     interface{}
+		expected string
+		err      string
+	}{
+		{"stick map", "index", map[string]stick.Value{"title": "A"}, "<h1>A</h1>", ""},
+		{"named map", "index", H{"title": "B"}, "<h1>B</h1>", ""},
+		{"string map", "index.html.twig", map[string]string{"title": "C"}, "<h1>C</h1>", ""},
+		{"typed context", "index", page{"D"}, "<h1>D</h1>", ""},
+		{"nil", "index", nil, "<h1></h1>", ""},
+		{"unsupported", "index", []string{"E"}, "", "stick: cannot use data of type []string as a template context"},
+		{"missing", "missing", nil, "", `template "missing.html.twig" not found`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := a.Render(&buf, test.tpl, test.data)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package stick
+
+import (
+	"sort"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// TemplateInfo describes the structure of a template.
+type TemplateInfo struct {
+	Name      string      // The name of the template.
+	Parent    string      // The name of the extended template, if any.
+	Blocks    []string    // Names of blocks defined in the template.
+	Macros    []MacroInfo // Macros defined in the template.
+	Variables []string    // Names of variables read, but not defined, by the template.
+	Templates []string    // Names of other templates referenced by the template.
+}
+
+// MacroInfo describes a macro defined in a template.
+type MacroInfo struct {
+	Name string   // The name of the macro.
+	Args []string // The names of the arguments the macro receives.
+}
+
+// Inspect parses the named template and returns information about its
+// structure. The results are sorted by name.
+//
+// Only template references using a string literal, such as
+// {% include 'footer.twig' %}, are included in Parent and Templates.
+func (env *Env) Inspect(name string) (*TemplateInfo, error) {
+	tree, err := env.load(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &TemplateInfo{Name: name}
+	for n := range tree.Blocks() {
+		info.Blocks = append(info.Blocks, n)
+	}
+	sort.Strings(info.Blocks)
+	for _, m := range tree.Macros() {
+		info.Macros = append(info.Macros, MacroInfo{m.Name, m.Args})
+	}
+	sort.Slice(info.Macros, func(i, j int) bool {
+		return info.Macros[i].Name < info.Macros[j].Name
+	})
+	in := &inspector{
+		scopes:    []map[string]bool{{"_self": true}},
+		variables: make(map[string]bool),
+		templates: make(map[string]bool),
+	}
+	root := tree.Root()
+	if root.Parent != nil {
+		info.Parent = staticName(root.Parent.Tpl)
+		in.visit(root.Parent)
+	}
+	in.visit(root)
+	info.Variables = sortedKeys(in.variables)
+	info.Templates = sortedKeys(in.templates)
+	return info, nil
+}
+
+// inspector walks a template, recording the variables and templates it
+// references.
+type inspector struct {
+	scopes    []map[string]bool // Names defined by the template.
+	variables map[string]bool   // Names read, but not defined.
+	templates map[string]bool   // Template names referenced.
+}
+
+func (in *inspector) defined(name string) bool {
+	for _, scope := range in.scopes {
+		if scope[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *inspector) define(names ...string) {
+	for _, n := range names {
+		if n != "" {
+			in.scopes[len(in.scopes)-1][n] = true
+		}
+	}
+}
+
+func (in *inspector) push(names ...string) {
+	in.scopes = append(in.scopes, make(map[string]bool))
+	in.define(names...)
+}
+
+func (in *inspector) pop() {
+	in.scopes = in.scopes[:len(in.scopes)-1]
+}
+
+func (in *inspector) reference(tpl parse.Expr) {
+	if n := staticName(tpl); n != "" {
+		in.templates[n] = true
+	}
+}
+
+func (in *inspector) visit(node parse.Node) {
+	switch node := node.(type) {
+	case nil:
+		return
+	case *parse.NameExpr:
+		if !in.defined(node.Name) {
+			in.variables[node.Name] = true
+		}
+		return
+	case *parse.ExtendsNode:
+		in.reference(node.Tpl)
+	case *parse.IncludeNode:
+		in.reference(node.Tpl)
+	case *parse.EmbedNode:
+		in.reference(node.Tpl)
+	case *parse.UseNode:
+		in.reference(node.Tpl)
+	case *parse.ImportNode:
+		in.reference(node.Tpl)
+		in.define(node.Alias)
+	case *parse.FromNode:
+		in.reference(node.Tpl)
+		for _, alias := range node.Imports {
+			in.define(alias)
+		}
+	case *parse.SetNode:
+		in.visit(node.X)
+		in.define(node.Name)
+		return
+	case *parse.ForNode:
+		in.visit(node.X)
+		in.push(node.Key, node.Val, "loop")
+		in.visit(node.Body)
+		in.pop()
+		in.visit(node.Else)
+		return
+	case *parse.HashExpr:
+		for _, kv := range node.Elements {
+			// Keys given by name are literal.
+			if _, ok := kv.Key.(*parse.NameExpr); !ok {
+				in.visit(kv.Key)
+			}
+			in.visit(kv.Value)
+		}
+		return
+	case *parse.MacroNode:
+		in.push(append([]string{"varargs"}, node.Args...)...)
+		defer in.pop()
+	}
+	for _, c := range node.All() {
+		in.visit(c)
+	}
+}
+
+// visitAll calls fn for node and each of its descendants.
+func visitAll(node parse.Node, fn func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	for _, c := range node.All() {
+		visitAll(c, fn)
+	}
+}
+
+// staticName returns the template name given by tpl, if it is a string
+// literal.
+func staticName(tpl parse.Expr) string {
+	if s, ok := tpl.(*parse.StringExpr); ok {
+		return s.Text
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
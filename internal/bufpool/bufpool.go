@@ -0,0 +1,36 @@
+// Package bufpool provides the pool of buffers shared by Stick's packages
+// for capturing output and reading input, so that features such as
+// captured set statements, the apply tag, macros, and ExecuteToString do
+// not each allocate a new buffer when a template is rendered.
+package bufpool
+
+import (
+	"bytes"
+	"sync"
+)
+
+// MaxSize is the largest buffer capacity that is returned to the pool.
+// Larger buffers are left for the garbage collector, so that a single large
+// render does not pin memory indefinitely.
+const MaxSize = 64 << 10
+
+var pool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// Get returns an empty buffer from the pool.
+func Get() *bytes.Buffer {
+	return pool.Get().(*bytes.Buffer)
+}
+
+// Put resets buf and returns it to the pool. The buffer, and any slice of
+// its contents, must not be used after it is returned.
+func Put(buf *bytes.Buffer) {
+	if buf.Cap() > MaxSize {
+		return
+	}
+	buf.Reset()
+	pool.Put(buf)
+}
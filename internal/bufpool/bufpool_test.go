@@ -0,0 +1,22 @@
+package bufpool
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPut(t *testing.T) {
+	buf := Get()
+	buf.WriteString("hello")
+	Put(buf)
+	if buf.Len() != 0 {
+		t.Errorf("expected a returned buffer to be reset, got %q", buf.String())
+	}
+
+	large := Get()
+	large.WriteString(strings.Repeat("x", MaxSize+1))
+	Put(large)
+	if large.Len() == 0 {
+		t.Errorf("expected a buffer larger than MaxSize not to be reset")
+	}
+}
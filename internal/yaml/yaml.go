@@ -0,0 +1,533 @@
+// Package yaml decodes the commonly used subset of YAML into the same Go
+// values encoding/json produces: map[string]interface{}, []interface{},
+// string, float64, bool, and nil.
+//
+// Supported are block mappings and sequences, flow collections such as
+// [a, b] and {a: 1}, plain, single-quoted, and double-quoted scalars,
+// literal (|) and folded (>) block scalars, and comments. Anchors, aliases,
+// tags, and multiple documents are not supported.
+package yaml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A SyntaxError describes invalid or unsupported YAML.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("yaml: line %d: %s", e.Line, e.Msg)
+}
+
+// Unmarshal decodes the YAML document in data.
+func Unmarshal(data []byte) (interface{}, error) {
+	p := &parser{}
+	for i, raw := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		p.lines = append(p.lines, line{num: i + 1, raw: raw})
+	}
+	p.prepare()
+	p.skip()
+	if p.eof() {
+		return nil, nil
+	}
+	v, err := p.node(p.cur().indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); !p.eof() {
+		return nil, p.errorf("unexpected content %q", p.cur().text)
+	}
+	return v, nil
+}
+
+// A line is a line of input.
+type line struct {
+	num    int
+	raw    string
+	indent int    // Number of leading spaces.
+	text   string // The line without indentation and comments.
+	tab    bool   // Whether the indentation is followed by a tab.
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// prepare computes the indentation and text of each line.
+func (p *parser) prepare() {
+	for i := range p.lines {
+		l := &p.lines[i]
+		trimmed := strings.TrimLeft(l.raw, " ")
+		l.indent = len(l.raw) - len(trimmed)
+		l.tab = strings.HasPrefix(trimmed, "\t")
+		l.text = strings.TrimSpace(stripComment(trimmed))
+	}
+}
+
+// stripComment removes a trailing comment from s.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" \t[{,:-", s[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == '\t' {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.lines)
+}
+
+func (p *parser) cur() *line {
+	return &p.lines[p.pos]
+}
+
+// skip advances past blank lines, comments, and document markers.
+func (p *parser) skip() {
+	for !p.eof() {
+		if t := p.cur().text; t != "" && t != "---" && t != "..." {
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	num := 0
+	if !p.eof() {
+		num = p.cur().num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return &SyntaxError{num, fmt.Sprintf(format, args...)}
+}
+
+// node parses the collection or scalar starting at the current line, which
+// has the given indentation.
+func (p *parser) node(indent int) (interface{}, error) {
+	l := p.cur()
+	if l.tab {
+		return nil, p.errorf("tabs are not allowed for indentation")
+	}
+	if isSeqItem(l.text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return p.scalar(l.text, indent)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// sequence parses a block sequence whose items have the given indentation.
+func (p *parser) sequence(indent int) (interface{}, error) {
+	res := []interface{}{}
+	for p.skip(); !p.eof(); p.skip() {
+		l := p.cur()
+		if l.tab {
+			return nil, p.errorf("tabs are not allowed for indentation")
+		}
+		if l.indent != indent || !isSeqItem(l.text) {
+			break
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+			continue
+		}
+		// The item starts on the same line; treat it as if it were on its
+		// own line, indented past the dash.
+		l.indent += len(l.text) - len(rest)
+		l.text = rest
+		v, err := p.node(l.indent)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// mapping parses a block mapping whose keys have the given indentation.
+func (p *parser) mapping(indent int) (interface{}, error) {
+	res := map[string]interface{}{}
+	for p.skip(); !p.eof(); p.skip() {
+		l := p.cur()
+		if l.tab {
+			return nil, p.errorf("tabs are not allowed for indentation")
+		}
+		if l.indent != indent {
+			if l.indent > indent {
+				return nil, p.errorf("unexpected indentation")
+			}
+			break
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, p.errorf("expected a mapping key, got %q", l.text)
+		}
+		k, err := p.key(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := res[k]; dup {
+			return nil, p.errorf("duplicate key %q", k)
+		}
+		p.pos++
+		var v interface{}
+		if rest == "" {
+			v, err = p.nested(indent)
+			if err == nil && v == nil && p.seqAt(indent) {
+				// Sequences may be at the same indentation as their key.
+				v, err = p.sequence(indent)
+			}
+		} else {
+			v, err = p.scalar(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+// seqAt reports whether a sequence item with the given indentation is next.
+func (p *parser) seqAt(indent int) bool {
+	p.skip()
+	return !p.eof() && p.cur().indent == indent && isSeqItem(p.cur().text)
+}
+
+// nested parses the node on the following lines if it is indented past
+// indent, returning nil otherwise.
+func (p *parser) nested(indent int) (interface{}, error) {
+	p.skip()
+	if p.eof() || p.cur().indent <= indent {
+		return nil, nil
+	}
+	return p.node(p.cur().indent)
+}
+
+// splitKey splits a "key: value" line, reporting whether it is one.
+func splitKey(text string) (key, rest string, ok bool) {
+	i := 0
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		end := closingQuote(text)
+		if end < 0 {
+			return "", "", false
+		}
+		i = end + 1
+	} else if text != "" && strings.IndexByte("[{", text[0]) >= 0 {
+		return "", "", false
+	}
+	for ; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// closingQuote returns the index of the quote closing the quoted scalar at
+// the start of s, or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case q == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *parser) key(s string) (string, error) {
+	v, err := p.scalar(s, 0)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "null", nil
+	}
+	return s, nil
+}
+
+// scalar parses a value given on a single line. Block scalars continue on
+// the lines following it, indented past indent.
+func (p *parser) scalar(s string, indent int) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s[0] == '|' || s[0] == '>':
+		return p.block(s, indent)
+	case s[0] == '[' || s[0] == '{':
+		f := &flow{s: s, p: p}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if f.skipSpace(); f.i < len(s) {
+			return nil, p.errorf("unexpected %q after flow collection", s[f.i:])
+		}
+		return v, nil
+	case s[0] == '"' || s[0] == '\'':
+		end := closingQuote(s)
+		if end != len(s)-1 {
+			return nil, p.errorf("invalid quoted scalar %s", s)
+		}
+		return p.unquote(s)
+	case strings.IndexByte("&*!%@`", s[0]) >= 0:
+		return nil, p.errorf("unsupported syntax %q", s)
+	}
+	return plain(s), nil
+}
+
+// unquote returns the value of a quoted scalar.
+func (p *parser) unquote(s string) (interface{}, error) {
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return nil, p.errorf("invalid quoted scalar %s", s)
+	}
+	return v, nil
+}
+
+// plain returns the value of a plain scalar.
+func plain(s string) interface{} {
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, ok := number(s); ok {
+		return n
+	}
+	return s
+}
+
+// number parses s as a YAML number.
+func number(s string) (float64, bool) {
+	if s == "" || strings.IndexByte("+-.0123456789", s[0]) < 0 {
+		return 0, false
+	}
+	if strings.HasPrefix(s, "0o") {
+		n, err := strconv.ParseInt(s[2:], 8, 64)
+		return float64(n), err == nil
+	}
+	if strings.HasPrefix(s, "0x") {
+		n, err := strconv.ParseInt(s[2:], 16, 64)
+		return float64(n), err == nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n, err == nil
+}
+
+// block parses a literal or folded block scalar with the given header.
+func (p *parser) block(header string, indent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := byte(0)
+	for _, c := range []byte(header[1:]) {
+		switch {
+		case c == '-' || c == '+':
+			chomp = c
+		case c >= '1' && c <= '9':
+		default:
+			return nil, p.errorf("invalid block scalar header %q", header)
+		}
+	}
+	var lines []string
+	blockIndent := -1
+	for ; !p.eof(); p.pos++ {
+		l := p.cur()
+		if strings.TrimSpace(l.raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+		if l.indent < blockIndent {
+			break
+		}
+		lines = append(lines, l.raw[blockIndent:])
+	}
+	// Trailing blank lines are kept only with the "+" indicator.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var res string
+	if folded {
+		var b strings.Builder
+		for i, l := range lines {
+			if i > 0 {
+				prev := lines[i-1]
+				switch {
+				case l == "":
+					b.WriteByte('\n')
+				case prev == "":
+					// The blank line already supplied the line break.
+				case strings.HasPrefix(l, " ") || strings.HasPrefix(prev, " "):
+					b.WriteByte('\n')
+				default:
+					b.WriteByte(' ')
+				}
+			}
+			b.WriteString(l)
+		}
+		res = b.String()
+	} else {
+		res = strings.Join(lines, "\n")
+	}
+	switch chomp {
+	case '-':
+	case '+':
+		res += "\n" + strings.Repeat("\n", trailing)
+	default:
+		if len(lines) > 0 {
+			res += "\n"
+		}
+	}
+	return res, nil
+}
+
+// flow parses a flow collection.
+type flow struct {
+	s string
+	i int
+	p *parser
+}
+
+func (f *flow) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *flow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, f.p.errorf("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		res := []interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return res, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		res := map[string]interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return res, nil
+			}
+			k, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			if f.skipSpace(); f.i >= len(f.s) || f.s[f.i] != ':' {
+				return nil, f.p.errorf("expected ':' in flow mapping")
+			}
+			f.i++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			res[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		end := closingQuote(f.s[f.i:])
+		if end < 0 {
+			return nil, f.p.errorf("unterminated quoted scalar")
+		}
+		s := f.s[f.i : f.i+end+1]
+		f.i += end + 1
+		return f.p.unquote(s)
+	}
+	start := f.i
+	for f.i < len(f.s) && strings.IndexByte(",]}", f.s[f.i]) < 0 {
+		if f.s[f.i] == ':' && (f.i+1 == len(f.s) || strings.IndexByte(" ,]}", f.s[f.i+1]) >= 0) {
+			break
+		}
+		f.i++
+	}
+	return plain(strings.TrimSpace(f.s[start:f.i])), nil
+}
+
+// separator consumes the comma between items, or stops before end.
+func (f *flow) separator(end byte) error {
+	f.skipSpace()
+	if f.i < len(f.s) {
+		switch f.s[f.i] {
+		case ',':
+			f.i++
+			return nil
+		case end:
+			return nil
+		}
+	}
+	return f.p.errorf("expected ',' or '%c' in flow collection", end)
+}
@@ -0,0 +1,59 @@
+package yaml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type m = map[string]interface{}
+type s = []interface{}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{"empty", "", nil},
+		{"scalar", "hello", "hello"},
+		{"mapping", "a: 1\nb: two\nc: true\nd: ~\ne: 1.5", m{"a": 1.0, "b": "two", "c": true, "d": nil, "e": 1.5}},
+		{"nested", "a:\n  b:\n    c: 1\n  d: 2\ne: 3", m{"a": m{"b": m{"c": 1.0}, "d": 2.0}, "e": 3.0}},
+		{"sequence", "- a\n- 2\n-\n  - nested", s{"a", 2.0, s{"nested"}}},
+		{"sequence in mapping", "items:\n  - a\n  - b\nsame:\n- c", m{"items": s{"a", "b"}, "same": s{"c"}}},
+		{"mappings in sequence", "- name: a\n  tags: [x, y]\n- name: b", s{m{"name": "a", "tags": s{"x", "y"}}, m{"name": "b"}}},
+		{"quoted", `a: "line\nbreak"` + "\nb: 'it''s'\n'c d': \"#not a comment\"", m{"a": "line\nbreak", "b": "it's", "c d": "#not a comment"}},
+		{"comments", "# heading\n---\na: 1 # one\nb: a#b\n", m{"a": 1.0, "b": "a#b"}},
+		{"flow", `{a: [1, "two", {b: null}], c: []}`, m{"a": s{1.0, "two", m{"b": nil}}, "c": s{}}},
+		{"literal", "a: |\n  one\n   two\n\nb: |-\n  three\n", m{"a": "one\n two\n", "b": "three"}},
+		{"folded", "a: >\n  one\n  two\n\n  three\n", m{"a": "one two\nthree\n"}},
+		{"strings", "a: 1.2.3\nb: yes\nc: '1'\nd: http://example.com", m{"a": "1.2.3", "b": "yes", "c": "1", "d": "http://example.com"}},
+	}
+	for _, test := range tests {
+		actual, err := Unmarshal([]byte(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]string{
+		"a: 1\n  b: 2":   "line 2: unexpected indentation",
+		"a: 1\na: 2":     `line 2: duplicate key "a"`,
+		"a: &anchor 1":   "unsupported syntax",
+		"a: [1, 2":       "expected ',' or ']'",
+		"a: 'unclosed":   "invalid quoted scalar",
+		"a:\n\t- b":      "tabs are not allowed",
+		"- a\nb: 1":      `unexpected content "b: 1"`,
+		"a: {b: 1} junk": "after flow collection",
+	}
+	for input, expected := range tests {
+		_, err := Unmarshal([]byte(input))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing %q, got %v", input, expected, err)
+		}
+	}
+}
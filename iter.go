@@ -0,0 +1,156 @@
+package stick
+
+import (
+	"reflect"
+)
+
+var boolType = reflect.TypeOf(false)
+
+// An Iterable is a collection that iterates over its own elements, such as
+// a generic collection type or a database cursor. Iterables can be looped
+// over with the for tag and used with filters such as first and join,
+// without Stick inspecting them with reflection.
+//
+// If the Iterable also has a "Len() int" method, it is used as the length
+// of the collection; otherwise the length is unknown, as with channels.
+type Iterable interface {
+	// Iterate calls yield for each key and value in the collection, in
+	// order, stopping early if yield returns false. An error stops the
+	// loop and is returned by the template.
+	Iterate(yield func(k, v Value) bool) error
+}
+
+// lener is implemented by collections that know their length.
+type lener interface {
+	Len() int
+}
+
+// isStream returns true if t is the type of a stream: a value that produces
+// its elements one at a time, without a known length. Streams are channels
+// that can be received from, and iterator functions of the form used by
+// the iter package since Go 1.23:
+//
+//	func(yield func(V) bool)
+//	func(yield func(K, V) bool)
+func isStream(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan:
+		return t.ChanDir()&reflect.RecvDir != 0
+	case reflect.Func:
+		if t.NumIn() != 1 || t.NumOut() != 0 {
+			return false
+		}
+		y := t.In(0)
+		return y.Kind() == reflect.Func && (y.NumIn() == 1 || y.NumIn() == 2) &&
+			y.NumOut() == 1 && y.Out(0) == boolType
+	}
+	return false
+}
+
+// streamLoop returns the Loop for the i-th element of a stream of length
+// ln, or -1 if the length is unknown.
+func streamLoop(i int, last bool, ln int) Loop {
+	l := Loop{
+		Last:      last,
+		Index:     i + 1,
+		Index0:    i,
+		Revindex:  -1,
+		Revindex0: -1,
+		First:     i == 0,
+		Length:    ln,
+	}
+	if ln >= 0 {
+		l.Revindex, l.Revindex0 = ln-i, ln-i-1
+	}
+	return l
+}
+
+// A streamIterator calls an Iteratee for the elements of a stream, one
+// element behind, so that the last element can be recognized.
+type streamIterator struct {
+	it      Iteratee
+	ln      int
+	n       int
+	pending bool
+	k, v    Value
+	err     error
+	brk     bool
+}
+
+// push passes the pending element, if any, to the Iteratee and makes k and
+// v pending. False is returned if iteration must stop.
+func (s *streamIterator) push(k, v Value) bool {
+	if s.brk || s.err != nil {
+		return false
+	}
+	if s.pending && !s.call(false) {
+		return false
+	}
+	s.k, s.v, s.pending = k, v, true
+	return true
+}
+
+// call passes the pending element to the Iteratee.
+func (s *streamIterator) call(last bool) bool {
+	s.pending = false
+	s.brk, s.err = s.it(s.k, s.v, streamLoop(s.n, last, s.ln))
+	s.n++
+	return !s.brk && s.err == nil
+}
+
+// done passes the final pending element, if any, to the Iteratee.
+func (s *streamIterator) done() (int, error) {
+	if s.pending {
+		s.call(true)
+	}
+	return s.n, s.err
+}
+
+// iterateStream calls it for each element received from the channel, or
+// yielded by the iterator function, r.
+func iterateStream(r reflect.Value, it Iteratee) (int, error) {
+	s := &streamIterator{it: it, ln: -1}
+	if r.Kind() == reflect.Chan {
+		if r.IsNil() {
+			return 0, nil
+		}
+		for i := 0; ; i++ {
+			v, ok := r.Recv()
+			if !ok || !s.push(i, v.Interface()) {
+				break
+			}
+		}
+		return s.done()
+	}
+	if r.IsNil() {
+		return 0, nil
+	}
+	yt := r.Type().In(0)
+	i := 0
+	yield := reflect.MakeFunc(yt, func(args []reflect.Value) []reflect.Value {
+		var ok bool
+		if len(args) == 2 {
+			ok = s.push(args[0].Interface(), args[1].Interface())
+		} else {
+			ok = s.push(i, args[0].Interface())
+		}
+		i++
+		return []reflect.Value{reflect.ValueOf(ok)}
+	})
+	r.Call([]reflect.Value{yield})
+	return s.done()
+}
+
+// iterateIterable calls it for each element of the Iterable c.
+func iterateIterable(c Iterable, it Iteratee) (int, error) {
+	s := &streamIterator{it: it, ln: -1}
+	if l, ok := c.(lener); ok {
+		s.ln = l.Len()
+	}
+	err := c.Iterate(s.push)
+	n, itErr := s.done()
+	if itErr != nil {
+		return n, itErr
+	}
+	return n, err
+}
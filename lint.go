@@ -0,0 +1,123 @@
+package stick
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// Severity describes how serious a Diagnostic is.
+type Severity string
+
+// Supported severities.
+const (
+	SeverityError   Severity = "error"   // The template will fail to load or execute.
+	SeverityWarning Severity = "warning" // The template works, but likely not as intended.
+)
+
+// A Diagnostic describes a problem found by Lint.
+type Diagnostic struct {
+	Template string   `json:"template"` // The template the problem was found in.
+	Line     int      `json:"line"`     // The line the problem was found on, or 0 if unknown.
+	Column   int      `json:"column"`   // The column the problem was found at.
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"` // Identifies the kind of problem, such as "undeclared-filter".
+	Message  string   `json:"message"`
+}
+
+// String returns the Diagnostic in the form "template:line:column: severity:
+// message (code)". The line and column are omitted if unknown.
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s (%s)", d.Template, d.Severity, d.Message, d.Code)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s (%s)", d.Template, d.Line, d.Column, d.Severity, d.Message, d.Code)
+}
+
+// Lint checks the named templates and every template they statically
+// reference, without executing them, and returns the problems found,
+// ordered by template and position.
+//
+// In addition to the errors reported by Validate, Lint warns about uses of
+// deprecated syntax and blocks in a child template that are not defined by
+// any of its parents, and so are never rendered.
+func (env *Env) Lint(names ...string) []Diagnostic {
+	var res []Diagnostic
+	env.validate(names, func(name string, tree *parse.Tree, errs []error) {
+		for _, err := range errs {
+			res = append(res, diagnose(name, err))
+		}
+		if tree == nil {
+			return
+		}
+		for _, d := range tree.Deprecations {
+			res = append(res, Diagnostic{name, d.Line, d.Offset, SeverityWarning, "deprecated", d.Message})
+		}
+		for _, blk := range env.orphanBlocks(tree) {
+			msg := fmt.Sprintf("block %q is not defined in any parent template", blk.Name)
+			res = append(res, Diagnostic{name, blk.Line, blk.Offset, SeverityWarning, "undefined-block", msg})
+		}
+	})
+	sort.SliceStable(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Template != b.Template {
+			return a.Template < b.Template
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return res
+}
+
+// diagnose converts an error returned by validate into a Diagnostic.
+func diagnose(name string, err error) Diagnostic {
+	d := Diagnostic{Template: name, Severity: SeverityError, Code: "error", Message: err.Error()}
+	var uerr *UndeclaredError
+	var perr ParseError
+	var nerr *TemplateNotFoundError
+	switch {
+	case errors.As(err, &uerr):
+		d.Line, d.Column, d.Code = uerr.Pos.Line, uerr.Pos.Offset, "undeclared-"+uerr.Kind
+	case errors.As(err, &perr):
+		d.Line, d.Column, d.Code = perr.Pos().Line, perr.Pos().Offset, "syntax"
+	case errors.As(err, &nerr):
+		d.Code = "not-found"
+	}
+	return d
+}
+
+// orphanBlocks returns the top-level blocks in tree that are not defined
+// in any of its parents. Nothing is returned if tree does not extend a
+// template, or if a parent cannot be loaded statically.
+func (env *Env) orphanBlocks(tree *parse.Tree) []*parse.BlockNode {
+	defined := make(map[string]bool)
+	seen := map[string]bool{tree.Name: true}
+	for t := tree; t.Root().Parent != nil; {
+		name := staticName(t.Root().Parent.Tpl)
+		if name == "" || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		var err error
+		if t, err = env.load(name); err != nil {
+			return nil
+		}
+		for k := range t.Blocks() {
+			defined[k] = true
+		}
+	}
+	if tree.Root().Parent == nil {
+		return nil
+	}
+	var res []*parse.BlockNode
+	for _, n := range tree.Root().Nodes {
+		if blk, ok := n.(*parse.BlockNode); ok && !defined[blk.Name] {
+			res = append(res, blk)
+		}
+	}
+	return res
+}
@@ -2,17 +2,88 @@ package stick
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Loader defines a type that can load Stick templates using the given name.
+//
+// A Loader may be called from multiple goroutines simultaneously.
 type Loader interface {
 	// Load attempts to load the specified template, returning a Template or an error.
 	Load(name string) (Template, error)
 }
 
+// An ExistsChecker is a Loader that can efficiently check whether a
+// template exists without loading it.
+type ExistsChecker interface {
+	// Exists returns true if the named template exists.
+	Exists(name string) bool
+}
+
+// A FreshnessChecker is a Loader that can check whether a previously loaded
+// template has changed.
+type FreshnessChecker interface {
+	// IsFresh returns true if the named template has not been modified
+	// since the given time.
+	IsFresh(name string, since time.Time) bool
+}
+
+// A Lister is a Loader that can list the names of the templates it can
+// load.
+type Lister interface {
+	// List returns the names of all templates, sorted.
+	List() ([]string, error)
+}
+
+// A modTimer is a Template that knows when it was last modified.
+type modTimer interface {
+	ModTime() time.Time
+}
+
+// Exists returns true if the named template exists. If the Env's Loader is
+// an ExistsChecker, it is used; otherwise the template is loaded.
+func (env *Env) Exists(name string) bool {
+	if c, ok := env.Loader.(ExistsChecker); ok {
+		return c.Exists(name)
+	}
+	_, err := env.Loader.Load(name)
+	return err == nil
+}
+
+// IsFresh returns true if the named template has not been modified since
+// the given time. If the Env's Loader is a FreshnessChecker, it is used;
+// otherwise the template is loaded and, if it has a ModTime method, its
+// modification time is compared. Templates whose freshness cannot be
+// determined are not considered fresh.
+func (env *Env) IsFresh(name string, since time.Time) bool {
+	if c, ok := env.Loader.(FreshnessChecker); ok {
+		return c.IsFresh(name, since)
+	}
+	return isFresh(env.Loader, name, since)
+}
+
+// isFresh loads the named template using l, comparing its modification
+// time to since.
+func isFresh(l Loader, name string, since time.Time) bool {
+	tpl, err := l.Load(name)
+	if err != nil {
+		return false
+	}
+	if mt, ok := tpl.(modTimer); ok {
+		t := mt.ModTime()
+		return !t.IsZero() && !t.After(since)
+	}
+	return false
+}
+
 type stringTemplate struct {
 	name     string
 	contents string
@@ -34,23 +105,379 @@ func (l *StringLoader) Load(name string) (Template, error) {
 	return &stringTemplate{name, name}, nil
 }
 
+// Exists always returns true, as every name is a valid template.
+func (l *StringLoader) Exists(name string) bool {
+	return true
+}
+
+// IsFresh always returns true, as a template's contents never change.
+func (l *StringLoader) IsFresh(name string, since time.Time) bool {
+	return true
+}
+
 // MemoryLoader loads templates from an in-memory map.
+//
+// Templates may be set directly before the MemoryLoader is used. Once it is
+// in use, templates should only be changed using Add and Remove.
 type MemoryLoader struct {
 	Templates map[string]string
+
+	mu       sync.RWMutex
+	modTimes map[string]time.Time // When templates were last added or removed.
+	loaded   map[string]string    // Contents last returned by Load.
+}
+
+// NewMemoryLoader creates a MemoryLoader containing the given templates,
+// keyed by name. The map is copied.
+func NewMemoryLoader(templates map[string]string) *MemoryLoader {
+	l := &MemoryLoader{Templates: make(map[string]string, len(templates))}
+	for k, v := range templates {
+		l.Templates[k] = v
+	}
+	return l
 }
 
 // Load tries to load the template from the in-memory map.
 func (l *MemoryLoader) Load(name string) (Template, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	v, ok := l.Templates[name]
 	if !ok {
 		return nil, os.ErrNotExist
 	}
+	if l.loaded == nil {
+		l.loaded = make(map[string]string)
+	}
+	l.loaded[name] = v
 	return &stringTemplate{name, v}, nil
 }
 
+// Add adds a template with the given name and contents, replacing any
+// existing template with the same name. It is safe to call Add while the
+// MemoryLoader is in use.
+func (l *MemoryLoader) Add(name, contents string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Templates == nil {
+		l.Templates = make(map[string]string)
+	}
+	l.Templates[name] = contents
+	l.touch(name)
+}
+
+// Remove removes the named template, if it exists. It is safe to call
+// Remove while the MemoryLoader is in use.
+func (l *MemoryLoader) Remove(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.Templates, name)
+	l.touch(name)
+}
+
+// touch records that the named template was modified. The caller must hold
+// the write lock.
+func (l *MemoryLoader) touch(name string) {
+	if l.modTimes == nil {
+		l.modTimes = make(map[string]time.Time)
+	}
+	l.modTimes[name] = time.Now()
+}
+
+// Exists returns true if the named template exists.
+func (l *MemoryLoader) Exists(name string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.Templates[name]
+	return ok
+}
+
+// List returns the names of all templates, sorted.
+func (l *MemoryLoader) List() ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	res := make([]string, 0, len(l.Templates))
+	for k := range l.Templates {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// IsFresh returns true if the named template exists and has not been added
+// or removed using Add or Remove since the given time. Templates changed
+// directly in the Templates map since they were last loaded are not fresh.
+func (l *MemoryLoader) IsFresh(name string, since time.Time) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	v, ok := l.Templates[name]
+	if !ok || v != l.loaded[name] {
+		return false
+	}
+	return !l.modTimes[name].After(since)
+}
+
+// A FuncLoader loads templates using a function that returns the source of
+// the named template and the time it was last modified. It can be used to
+// load templates stored in a database or other external store.
+//
+// The function should return an error matching os.ErrNotExist if the
+// template does not exist. It may be called from multiple goroutines
+// simultaneously.
+//
+// Templates loaded by a FuncLoader have a ModTime method that returns the
+// modification time returned by the function.
+type FuncLoader func(name string) (source string, modTime time.Time, err error)
+
+type funcTemplate struct {
+	stringTemplate
+	modTime time.Time
+}
+
+// ModTime returns the time the template was last modified.
+func (t *funcTemplate) ModTime() time.Time {
+	return t.modTime
+}
+
+// Load calls the function to load the named template.
+func (l FuncLoader) Load(name string) (Template, error) {
+	source, modTime, err := l(name)
+	if err != nil {
+		return nil, err
+	}
+	return &funcTemplate{stringTemplate{name, source}, modTime}, nil
+}
+
+// Exists returns true if the named template can be loaded.
+func (l FuncLoader) Exists(name string) bool {
+	_, _, err := l(name)
+	return err == nil
+}
+
+// IsFresh returns true if the named template has a modification time that
+// is not after the given time.
+func (l FuncLoader) IsFresh(name string, since time.Time) bool {
+	_, modTime, err := l(name)
+	return err == nil && !modTime.IsZero() && !modTime.After(since)
+}
+
+// A ChainLoader loads templates using an ordered list of Loaders, returning
+// the template from the first Loader that has it. It can be used to overlay
+// application templates on top of defaults provided by a library.
+//
+// A Loader is considered not to have a template when it returns an error
+// matching os.ErrNotExist or ErrTemplateNotFound; any other error is
+// returned immediately.
+type ChainLoader struct {
+	Loaders []Loader
+}
+
+// NewChainLoader creates a ChainLoader using the given Loaders, in order.
+func NewChainLoader(loaders ...Loader) *ChainLoader {
+	return &ChainLoader{loaders}
+}
+
+// Load tries each Loader in turn, returning the first template found.
+func (l *ChainLoader) Load(name string) (Template, error) {
+	err := os.ErrNotExist
+	for _, loader := range l.Loaders {
+		var tpl Template
+		tpl, err = loader.Load(name)
+		if err == nil {
+			return tpl, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrTemplateNotFound) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Exists returns true if any of the Loaders has the named template.
+func (l *ChainLoader) Exists(name string) bool {
+	return l.find(name) != nil
+}
+
+// IsFresh returns true if the named template, as loaded from the first
+// Loader that has it, has not been modified since the given time.
+func (l *ChainLoader) IsFresh(name string, since time.Time) bool {
+	loader := l.find(name)
+	if loader == nil {
+		return false
+	}
+	if c, ok := loader.(FreshnessChecker); ok {
+		return c.IsFresh(name, since)
+	}
+	return isFresh(loader, name, since)
+}
+
+// List returns the names of the templates in each of the Loaders that is a
+// Lister, sorted. Loaders that are not Listers are skipped.
+func (l *ChainLoader) List() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, loader := range l.Loaders {
+		lister, ok := loader.(Lister)
+		if !ok {
+			continue
+		}
+		names, err := lister.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			seen[n] = true
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+// find returns the first Loader that has the named template, or nil.
+func (l *ChainLoader) find(name string) Loader {
+	for _, loader := range l.Loaders {
+		if c, ok := loader.(ExistsChecker); ok {
+			if c.Exists(name) {
+				return loader
+			}
+			continue
+		}
+		if _, err := loader.Load(name); err == nil {
+			return loader
+		}
+	}
+	return nil
+}
+
+// An AliasLoader rewrites template names before loading them using another
+// Loader. Each alias maps a name prefix to a replacement; names are
+// rewritten using the longest matching prefix, at most once.
+//
+// For example, aliasing "themes/dark/" to "" strips the prefix, and aliasing
+// "emails/" to "emails/v2/" loads a versioned set of templates. Aliases may
+// be changed while the AliasLoader is in use, to switch themes or run
+// experiments without changing templates.
+type AliasLoader struct {
+	Loader Loader
+
+	mu      sync.RWMutex
+	aliases map[string]string
+	changed time.Time // When the aliases were last changed.
+}
+
+// NewAliasLoader creates an AliasLoader that loads templates using loader,
+// with the given aliases, keyed by prefix. The map is copied.
+func NewAliasLoader(loader Loader, aliases map[string]string) *AliasLoader {
+	l := &AliasLoader{Loader: loader, aliases: make(map[string]string, len(aliases))}
+	for k, v := range aliases {
+		l.aliases[k] = v
+	}
+	return l
+}
+
+// Alias causes names starting with prefix to have it replaced with
+// replacement, replacing any existing alias for prefix.
+func (l *AliasLoader) Alias(prefix, replacement string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.aliases == nil {
+		l.aliases = make(map[string]string)
+	}
+	l.aliases[prefix] = replacement
+	l.changed = time.Now()
+}
+
+// Unalias removes the alias for prefix, if it exists.
+func (l *AliasLoader) Unalias(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.aliases, prefix)
+	l.changed = time.Now()
+}
+
+// Resolve returns the name the named template is loaded with.
+func (l *AliasLoader) Resolve(name string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	match, ok := "", false
+	for prefix := range l.aliases {
+		if strings.HasPrefix(name, prefix) && (!ok || len(prefix) > len(match)) {
+			match, ok = prefix, true
+		}
+	}
+	if !ok {
+		return name
+	}
+	return l.aliases[match] + name[len(match):]
+}
+
+// Load loads the named template using its resolved name.
+func (l *AliasLoader) Load(name string) (Template, error) {
+	return l.Loader.Load(l.Resolve(name))
+}
+
+// Exists returns true if the template with the resolved name exists.
+func (l *AliasLoader) Exists(name string) bool {
+	name = l.Resolve(name)
+	if c, ok := l.Loader.(ExistsChecker); ok {
+		return c.Exists(name)
+	}
+	_, err := l.Loader.Load(name)
+	return err == nil
+}
+
+// IsFresh returns true if the aliases have not changed since the given
+// time and the template with the resolved name has not been modified.
+func (l *AliasLoader) IsFresh(name string, since time.Time) bool {
+	l.mu.RLock()
+	changed := l.changed
+	l.mu.RUnlock()
+	if changed.After(since) {
+		return false
+	}
+	name = l.Resolve(name)
+	if c, ok := l.Loader.(FreshnessChecker); ok {
+		return c.IsFresh(name, since)
+	}
+	return isFresh(l.Loader, name, since)
+}
+
+// List returns, sorted, the names that resolve to the templates listed by
+// the underlying Loader, which must be a Lister.
+func (l *AliasLoader) List() ([]string, error) {
+	lister, ok := l.Loader.(Lister)
+	if !ok {
+		return nil, ErrNotLister
+	}
+	names, err := lister.List()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	aliases := make(map[string]string, len(l.aliases))
+	for k, v := range l.aliases {
+		aliases[k] = v
+	}
+	l.mu.RUnlock()
+	seen := make(map[string]bool)
+	for _, n := range names {
+		candidates := []string{n}
+		for prefix, replacement := range aliases {
+			if strings.HasPrefix(n, replacement) {
+				candidates = append(candidates, prefix+n[len(replacement):])
+			}
+		}
+		for _, c := range candidates {
+			if l.Resolve(c) == n {
+				seen[c] = true
+			}
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
 type fileTemplate struct {
-	name   string
-	reader io.Reader
+	name     string
+	path     string
+	modTime  time.Time
+	contents []byte
 }
 
 func (t *fileTemplate) Name() string {
@@ -58,26 +485,178 @@ func (t *fileTemplate) Name() string {
 }
 
 func (t *fileTemplate) Contents() io.Reader {
-	return t.reader
+	return bytes.NewReader(t.contents)
+}
+
+// Path returns the path of the file the template was loaded from.
+func (t *fileTemplate) Path() string {
+	return t.path
 }
 
-// A FilesystemLoader loads templates from a filesystem.
+// ModTime returns the modification time of the file the template was
+// loaded from.
+func (t *fileTemplate) ModTime() time.Time {
+	return t.modTime
+}
+
+// A FilesystemLoader loads templates from one or more root directories.
+//
+// Template names are slash-separated paths relative to the roots, which are
+// searched in order. Names that are absolute or refer to a location outside
+// of the roots, such as "../secret.txt", are rejected with an
+// InvalidTemplateNameError.
+//
+// Additional root directories can be registered under a namespace using
+// AddPath. Templates in a namespace are referenced by prefixing their name
+// with "@" and the namespace, such as "@admin/dashboard.twig".
+//
+// Templates loaded by a FilesystemLoader have Path and ModTime methods
+// that return the resolved file path and its modification time.
 type FilesystemLoader struct {
-	rootDir string
+	rootDirs   []string
+	namespaces map[string][]string
+}
+
+// NewFilesystemLoader creates a new FilesystemLoader with the specified root
+// directories.
+func NewFilesystemLoader(rootDirs ...string) *FilesystemLoader {
+	return &FilesystemLoader{rootDirs: rootDirs}
 }
 
-// NewFilesystemLoader creates a new FilesystemLoader with the specified root directory.
-func NewFilesystemLoader(rootDir string) *FilesystemLoader {
-	return &FilesystemLoader{rootDir}
+// AddPath adds a root directory to the given namespace. Directories are
+// searched in the order they are added. An empty namespace adds the
+// directory to the main, unprefixed, root directories.
+//
+// AddPath must not be called while the FilesystemLoader is in use.
+func (l *FilesystemLoader) AddPath(dir, namespace string) {
+	if namespace == "" {
+		l.rootDirs = append(l.rootDirs, dir)
+		return
+	}
+	if l.namespaces == nil {
+		l.namespaces = make(map[string][]string)
+	}
+	l.namespaces[namespace] = append(l.namespaces[namespace], dir)
 }
 
 // Load on a FileSystemLoader attempts to load the given file, relative to the
-// configured root directory.
+// configured root directories.
 func (l *FilesystemLoader) Load(name string) (Template, error) {
-	path := filepath.Join(l.rootDir, name)
-	f, err := os.Open(path)
+	path, info, err := l.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTemplate{name, path, info.ModTime(), contents}, nil
+}
+
+// Path returns the path of the file the named template would be loaded from.
+func (l *FilesystemLoader) Path(name string) (string, error) {
+	path, _, err := l.resolve(name)
+	return path, err
+}
+
+// ModTime returns the modification time of the file the named template
+// would be loaded from.
+func (l *FilesystemLoader) ModTime(name string) (time.Time, error) {
+	_, info, err := l.resolve(name)
 	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Exists returns true if the named template exists.
+func (l *FilesystemLoader) Exists(name string) bool {
+	_, _, err := l.resolve(name)
+	return err == nil
+}
+
+// IsFresh returns true if the named template's file has not been modified
+// since the given time.
+func (l *FilesystemLoader) IsFresh(name string, since time.Time) bool {
+	_, info, err := l.resolve(name)
+	return err == nil && !info.ModTime().After(since)
+}
+
+// List returns the names of all files in the root directories and
+// namespaces, sorted. Files in namespaces are prefixed with "@namespace/".
+func (l *FilesystemLoader) List() ([]string, error) {
+	seen := make(map[string]bool)
+	add := func(prefix string, roots []string) error {
+		for _, root := range roots {
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					if path == root && os.IsNotExist(err) {
+						return nil
+					}
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				seen[prefix+filepath.ToSlash(rel)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add("", l.rootDirs); err != nil {
 		return nil, err
 	}
-	return &fileTemplate{name, f}, nil
+	for ns, roots := range l.namespaces {
+		if err := add("@"+ns+"/", roots); err != nil {
+			return nil, err
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+// resolve finds the file for the named template in the first root
+// directory that contains it.
+func (l *FilesystemLoader) resolve(name string) (string, os.FileInfo, error) {
+	roots, rel := l.rootDirs, name
+	if strings.HasPrefix(name, "@") {
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return "", nil, &InvalidTemplateNameError{name}
+		}
+		var ok bool
+		if roots, ok = l.namespaces[name[1:i]]; !ok {
+			return "", nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		rel = name[i+1:]
+	}
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, &InvalidTemplateNameError{name}
+	}
+	var err error
+	for _, root := range roots {
+		path := filepath.Join(root, rel)
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if err == nil && !info.IsDir() {
+			return path, info, nil
+		}
+		if err == nil {
+			err = &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		} else if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+	if err == nil {
+		err = os.ErrNotExist
+	}
+	return "", nil, err
 }
@@ -0,0 +1,239 @@
+package stick
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHTTPTimeout is the timeout used by an HTTPLoader with no Client or
+// Timeout configured.
+const DefaultHTTPTimeout = 10 * time.Second
+
+// DefaultHTTPMaxBytes is the maximum size of a template loaded by an
+// HTTPLoader with no MaxBytes configured.
+const DefaultHTTPMaxBytes = 10 << 20
+
+// An HTTPLoader loads templates over HTTP or HTTPS.
+//
+// Template names are URLs, resolved relative to BaseURL. Responses are
+// cached, and later loads of the same template make a conditional request
+// using the ETag and Last-Modified headers of the cached response.
+//
+// Templates loaded by an HTTPLoader have a ModTime method that returns the
+// time given by the Last-Modified header, if any.
+type HTTPLoader struct {
+	// BaseURL is the URL template names are resolved against, such as
+	// "https://templates.example.com/email/".
+	BaseURL string
+
+	// AllowedHosts, if not empty, lists the hosts templates may be loaded
+	// from. Loading a template from any other host, or following a
+	// redirect to one, fails with an InvalidTemplateNameError.
+	AllowedHosts []string
+
+	// Client is used to make requests. If nil, a client with Timeout is
+	// used. Redirects are checked against AllowedHosts before the Client's
+	// own CheckRedirect is called.
+	Client *http.Client
+
+	// MaxBytes limits the size of each template. Loading a larger template
+	// fails. If zero, DefaultHTTPMaxBytes is used.
+	MaxBytes int64
+
+	// Timeout limits the time taken by each request when Client is nil. If
+	// zero, DefaultHTTPTimeout is used.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	client *http.Client
+	cache  map[string]*httpTemplate
+}
+
+// NewHTTPLoader creates an HTTPLoader that loads templates relative to
+// baseURL, only from the given hosts. If no hosts are given, the host of
+// baseURL is allowed.
+func NewHTTPLoader(baseURL string, allowedHosts ...string) *HTTPLoader {
+	if len(allowedHosts) == 0 {
+		if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+			allowedHosts = []string{u.Host}
+		}
+	}
+	return &HTTPLoader{BaseURL: baseURL, AllowedHosts: allowedHosts}
+}
+
+type httpTemplate struct {
+	name         string
+	contents     string
+	etag         string
+	lastModified string
+	modTime      time.Time
+}
+
+func (t *httpTemplate) Name() string {
+	return t.name
+}
+
+func (t *httpTemplate) Contents() io.Reader {
+	return strings.NewReader(t.contents)
+}
+
+// ModTime returns the time given by the Last-Modified header of the
+// response the template was loaded from, or the zero time if it was not
+// present.
+func (t *httpTemplate) ModTime() time.Time {
+	return t.modTime
+}
+
+// IsFresh returns true if the named template has a Last-Modified time that
+// is not after the given time.
+func (l *HTTPLoader) IsFresh(name string, since time.Time) bool {
+	return isFresh(l, name, since)
+}
+
+// Load fetches the named template, making a conditional request if the
+// template was loaded before.
+func (l *HTTPLoader) Load(name string) (Template, error) {
+	u, err := l.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	cached := l.cache[u]
+	client := l.httpClient()
+	l.mu.Unlock()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		return &httpTemplate{name, cached.contents, cached.etag, cached.lastModified, cached.modTime}, nil
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return nil, &os.PathError{Op: "get", Path: u, Err: os.ErrNotExist}
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("get %s: unexpected status %s", u, res.Status)
+	}
+	max := l.MaxBytes
+	if max <= 0 {
+		max = DefaultHTTPMaxBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("get %s: template exceeds limit of %d bytes", u, max)
+	}
+	tpl := &httpTemplate{
+		name:         name,
+		contents:     string(body),
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+	if tpl.lastModified != "" {
+		tpl.modTime, _ = http.ParseTime(tpl.lastModified)
+	}
+	if tpl.etag != "" || tpl.lastModified != "" {
+		l.mu.Lock()
+		if l.cache == nil {
+			l.cache = make(map[string]*httpTemplate)
+		}
+		l.cache[u] = tpl
+		l.mu.Unlock()
+	}
+	return tpl, nil
+}
+
+// httpClient returns the client used to make requests, which only follows
+// redirects to allowed hosts. The caller must hold l.mu.
+func (l *HTTPLoader) httpClient() *http.Client {
+	if l.Client != nil {
+		// The Client may be shared, so a copy is changed instead.
+		c := *l.Client
+		c.CheckRedirect = l.checkRedirect(l.Client.CheckRedirect)
+		return &c
+	}
+	if l.client == nil {
+		timeout := l.Timeout
+		if timeout == 0 {
+			timeout = DefaultHTTPTimeout
+		}
+		l.client = &http.Client{Timeout: timeout, CheckRedirect: l.checkRedirect(nil)}
+	}
+	return l.client
+}
+
+// checkRedirect returns a CheckRedirect function for an http.Client that
+// rejects redirects to hosts that are not allowed, and otherwise calls
+// next, or follows up to 10 redirects if next is nil, as http.Client does.
+func (l *HTTPLoader) checkRedirect(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !l.allowed(req.URL) {
+			return &InvalidTemplateNameError{req.URL.String()}
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+// resolve returns the absolute URL of the named template, ensuring it is
+// allowed to be loaded.
+func (l *HTTPLoader) resolve(name string) (string, error) {
+	base, err := url.Parse(l.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(name)
+	if err != nil {
+		return "", &InvalidTemplateNameError{name}
+	}
+	u := base.ResolveReference(ref)
+	if !l.allowed(u) {
+		return "", &InvalidTemplateNameError{name}
+	}
+	return u.String(), nil
+}
+
+// allowed returns true if templates may be loaded from u: it must be an
+// HTTP or HTTPS URL, with one of the AllowedHosts if there are any.
+func (l *HTTPLoader) allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if len(l.AllowedHosts) == 0 {
+		return true
+	}
+	for _, h := range l.AllowedHosts {
+		if strings.EqualFold(h, u.Host) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,19 @@
 package stick
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestFilesystemLoader(t *testing.T) {
@@ -24,6 +34,370 @@ func TestFilesystemLoader(t *testing.T) {
 	}
 }
 
+func TestFilesystemLoaderRoots(t *testing.T) {
+	overlay, err := ioutil.TempDir("", "stick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(overlay)
+	if err := ioutil.WriteFile(filepath.Join(overlay, "base.txt.twig"), []byte("overridden"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := NewFilesystemLoader(overlay, "testdata")
+
+	f, err := l.Load("base.txt.twig")
+	if err != nil {
+		t.Fatalf("expected load to succeed. %s", err)
+	}
+	b, _ := ioutil.ReadAll(f.Contents())
+	if string(b) != "overridden" {
+		t.Errorf("expected template from first root, got %q", string(b))
+	}
+	if p := f.(*fileTemplate).Path(); p != filepath.Join(overlay, "base.txt.twig") {
+		t.Errorf("unexpected path: %s", p)
+	}
+
+	f, err = l.Load("parts.txt.twig")
+	if err != nil {
+		t.Fatalf("expected load to succeed. %s", err)
+	}
+	if p, _ := l.Path("parts.txt.twig"); p != filepath.Join("testdata", "parts.txt.twig") {
+		t.Errorf("unexpected path: %s", p)
+	}
+	mt, err := l.ModTime("parts.txt.twig")
+	if err != nil || !mt.Equal(f.(*fileTemplate).ModTime()) {
+		t.Errorf("expected ModTime to match loaded template, got %s (%v)", mt, err)
+	}
+
+	for _, name := range []string{"../loader.go", "/etc/passwd", "a/../../loader.go"} {
+		_, err := l.Load(name)
+		if !errors.Is(err, ErrInvalidTemplateName) {
+			t.Errorf("%s: expected ErrInvalidTemplateName, got %v", name, err)
+		}
+	}
+	if _, err := l.Load("a/../parts.txt.twig"); err != nil {
+		t.Errorf("expected load of path within root to succeed. %s", err)
+	}
+	if _, err := l.Load("missing.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error, got %v", err)
+	}
+}
+
+func TestFilesystemLoaderNamespaces(t *testing.T) {
+	l := NewFilesystemLoader()
+	l.AddPath("testdata", "")
+	l.AddPath(".", "root")
+	l.AddPath("testdata", "data")
+	for _, name := range []string{"base.txt.twig", "@data/base.txt.twig", "@root/testdata/base.txt.twig"} {
+		if _, err := l.Load(name); err != nil {
+			t.Errorf("%s: expected load to succeed. %s", name, err)
+		}
+	}
+	if _, err := l.Load("@unknown/base.txt.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error for unknown namespace, got %v", err)
+	}
+	for _, name := range []string{"@data", "@data/../loader.go"} {
+		if _, err := l.Load(name); !errors.Is(err, ErrInvalidTemplateName) {
+			t.Errorf("%s: expected ErrInvalidTemplateName, got %v", name, err)
+		}
+	}
+	env := New(l)
+	if _, err := env.ExecuteToString("@data/main.txt.twig", nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestMemoryLoaderAddRemove(t *testing.T) {
+	templates := map[string]string{"a.twig": "a"}
+	l := NewMemoryLoader(templates)
+	l.Add("b.twig", "b")
+	if _, ok := templates["b.twig"]; ok {
+		t.Errorf("expected NewMemoryLoader to copy the given map")
+	}
+	for _, name := range []string{"a.twig", "b.twig"} {
+		if _, err := l.Load(name); err != nil {
+			t.Errorf("%s: expected load to succeed. %s", name, err)
+		}
+	}
+	l.Remove("a.twig")
+	if _, err := l.Load("a.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error after Remove, got %v", err)
+	}
+	var empty MemoryLoader
+	empty.Add("c.twig", "c")
+	if _, err := empty.Load("c.twig"); err != nil {
+		t.Errorf("expected Add to initialize an empty MemoryLoader. %s", err)
+	}
+}
+
+func TestChainLoader(t *testing.T) {
+	l := NewChainLoader(
+		&MemoryLoader{Templates: map[string]string{"a.twig": "first"}},
+		&MemoryLoader{Templates: map[string]string{"a.twig": "second", "b.twig": "fallback"}},
+	)
+	tests := map[string]string{
+		"a.twig": "first",
+		"b.twig": "fallback",
+	}
+	for name, expected := range tests {
+		tpl, err := l.Load(name)
+		if err != nil {
+			t.Errorf("%s: expected load to succeed. %s", name, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(tpl.Contents())
+		if string(b) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, string(b))
+		}
+	}
+	if _, err := l.Load("c.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error, got %v", err)
+	}
+	if _, err := NewChainLoader().Load("c.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error from empty chain, got %v", err)
+	}
+	l.Loaders = append([]Loader{NewFilesystemLoader("testdata")}, l.Loaders...)
+	if _, err := l.Load("../a.twig"); !errors.Is(err, ErrInvalidTemplateName) {
+		t.Errorf("expected ErrInvalidTemplateName to be returned immediately, got %v", err)
+	}
+}
+
+func TestAliasLoader(t *testing.T) {
+	l := NewAliasLoader(NewMemoryLoader(map[string]string{
+		"base.twig":             "base",
+		"themes/dark/base.twig": "dark",
+		"emails/v1/hello.twig":  "hello v1",
+		"emails/v2/hello.twig":  "hello v2",
+	}), map[string]string{
+		"themes/active/": "themes/dark/",
+		"emails/":        "emails/v1/",
+	})
+	tests := []struct {
+		before   func()
+		name     string
+		expected string
+	}{
+		{func() {}, "base.twig", "base"},
+		{func() {}, "themes/active/base.twig", "dark"},
+		{func() {}, "emails/hello.twig", "hello v1"},
+		{func() {}, "emails/v2/hello.twig", ""}, // Resolves to emails/v1/v2/hello.twig.
+		{func() { l.Alias("emails/v2/", "emails/v2/") }, "emails/v2/hello.twig", "hello v2"},
+		{func() { l.Alias("emails/", "emails/v2/") }, "emails/hello.twig", "hello v2"},
+		{func() { l.Unalias("themes/active/") }, "themes/active/base.twig", ""},
+	}
+	for _, test := range tests {
+		test.before()
+		tpl, err := l.Load(test.name)
+		if test.expected == "" {
+			if !os.IsNotExist(err) || l.Exists(test.name) {
+				t.Errorf("%s: expected os.NotExist error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected load to succeed. %s", test.name, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(tpl.Contents())
+		if string(b) != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, string(b))
+		}
+		if !l.Exists(test.name) {
+			t.Errorf("%s: expected template to exist", test.name)
+		}
+	}
+
+	since := time.Now()
+	if !l.IsFresh("emails/hello.twig", since) {
+		t.Error("expected template to be fresh")
+	}
+	time.Sleep(time.Millisecond)
+	l.Alias("emails/", "emails/v1/")
+	if l.IsFresh("emails/hello.twig", since) {
+		t.Error("expected template not to be fresh after aliases changed")
+	}
+
+	names, err := l.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"base.twig", "emails/hello.twig", "emails/v2/hello.twig", "themes/dark/base.twig"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestHTTPLoader(t *testing.T) {
+	var conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tpl/hello.twig" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		io.WriteString(w, "Hello, {{ name }}!")
+	}))
+	defer srv.Close()
+
+	l := NewHTTPLoader(srv.URL + "/tpl/")
+	for i := 0; i < 2; i++ {
+		tpl, err := l.Load("hello.twig")
+		if err != nil {
+			t.Fatalf("expected load to succeed. %s", err)
+		}
+		b, _ := ioutil.ReadAll(tpl.Contents())
+		if string(b) != "Hello, {{ name }}!" {
+			t.Errorf("unexpected contents %q", string(b))
+		}
+		if mt := tpl.(*httpTemplate).ModTime(); mt.Year() != 2006 {
+			t.Errorf("unexpected ModTime %s", mt)
+		}
+	}
+	if conditional != 1 {
+		t.Errorf("expected 1 conditional request, got %d", conditional)
+	}
+	if _, err := l.Load("missing.twig"); !os.IsNotExist(err) {
+		t.Errorf("expected os.NotExist error, got %v", err)
+	}
+	for _, name := range []string{"http://example.com/hello.twig", "file:///etc/passwd"} {
+		if _, err := l.Load(name); !errors.Is(err, ErrInvalidTemplateName) {
+			t.Errorf("%s: expected ErrInvalidTemplateName, got %v", name, err)
+		}
+	}
+}
+
+func TestHTTPLoaderRedirects(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away.twig":
+			http.Redirect(w, r, other.URL+"/secret", http.StatusFound)
+		case "/moved.twig":
+			http.Redirect(w, r, "/hello.twig", http.StatusMovedPermanently)
+		case "/big.twig":
+			io.WriteString(w, strings.Repeat("x", 101))
+		default:
+			io.WriteString(w, "Hello")
+		}
+	}))
+	defer srv.Close()
+
+	clients := map[string]*http.Client{"default": nil, "custom": {}}
+	for name, client := range clients {
+		l := NewHTTPLoader(srv.URL + "/")
+		l.Client = client
+		l.MaxBytes = 100
+		if _, err := l.Load("away.twig"); !errors.Is(err, ErrInvalidTemplateName) {
+			t.Errorf("%s: expected a redirect to another host to fail with ErrInvalidTemplateName, got %v", name, err)
+		}
+		if tpl, err := l.Load("moved.twig"); err != nil {
+			t.Errorf("%s: expected a redirect to the same host to succeed, got %v", name, err)
+		} else if b, _ := ioutil.ReadAll(tpl.Contents()); string(b) != "Hello" {
+			t.Errorf("%s: unexpected contents %q", name, string(b))
+		}
+		if _, err := l.Load("big.twig"); err == nil || !strings.Contains(err.Error(), "exceeds limit of 100 bytes") {
+			t.Errorf("%s: expected a template over MaxBytes to fail, got %v", name, err)
+		}
+	}
+}
+
+func TestFuncLoader(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := FuncLoader(func(name string) (string, time.Time, error) {
+		if name != "db.twig" {
+			return "", time.Time{}, os.ErrNotExist
+		}
+		return "Hello from the database", modified, nil
+	})
+	tpl, err := l.Load("db.twig")
+	if err != nil {
+		t.Fatalf("expected load to succeed. %s", err)
+	}
+	b, _ := ioutil.ReadAll(tpl.Contents())
+	if tpl.Name() != "db.twig" || string(b) != "Hello from the database" {
+		t.Errorf("unexpected template %s: %q", tpl.Name(), string(b))
+	}
+	if mt := tpl.(*funcTemplate).ModTime(); !mt.Equal(modified) {
+		t.Errorf("unexpected ModTime %s", mt)
+	}
+	if _, err := New(l).ExecuteToString("other.twig", nil); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("expected ErrTemplateNotFound, got %v", err)
+	}
+}
+
+func TestLoaderExistsIsFresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.twig"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	mem := NewMemoryLoader(map[string]string{"mem.twig": "memory"})
+	fn := FuncLoader(func(name string) (string, time.Time, error) {
+		if name != "func.twig" {
+			return "", time.Time{}, os.ErrNotExist
+		}
+		return "func", past, nil
+	})
+	tests := []struct {
+		name   string
+		loader Loader
+		tpl    string
+		exists bool
+		fresh  bool // Fresh since one hour from now.
+	}{
+		{"string", &StringLoader{}, "anything", true, true},
+		{"memory", mem, "mem.twig", true, true},
+		{"memory missing", mem, "missing.twig", false, false},
+		{"filesystem", NewFilesystemLoader(dir), "file.twig", true, true},
+		{"filesystem missing", NewFilesystemLoader(dir), "missing.twig", false, false},
+		{"func", fn, "func.twig", true, true},
+		{"func missing", fn, "missing.twig", false, false},
+		{"chain", NewChainLoader(mem, fn), "func.twig", true, true},
+		{"chain missing", NewChainLoader(mem, fn), "missing.twig", false, false},
+	}
+	for _, test := range tests {
+		env := New(test.loader)
+		// Freshness is only meaningful for templates that were loaded.
+		test.loader.Load(test.tpl)
+		if e := env.Exists(test.tpl); e != test.exists {
+			t.Errorf("%s: expected Exists to be %v, got %v", test.name, test.exists, e)
+		}
+		if f := env.IsFresh(test.tpl, future); f != test.fresh {
+			t.Errorf("%s: expected IsFresh to be %v, got %v", test.name, test.fresh, f)
+		}
+	}
+
+	mem.Add("mem.twig", "changed")
+	if mem.IsFresh("mem.twig", past) {
+		t.Errorf("expected modified template not to be fresh")
+	}
+	mem.Load("mem.twig")
+	if !mem.IsFresh("mem.twig", future) {
+		t.Errorf("expected template to be fresh after modification")
+	}
+	mem.Templates["mem.twig"] = "changed directly"
+	if mem.IsFresh("mem.twig", future) {
+		t.Errorf("expected template changed directly not to be fresh")
+	}
+	if fn.IsFresh("func.twig", past.Add(-time.Minute)) {
+		t.Errorf("expected template modified after since not to be fresh")
+	}
+}
+
 func TestStringLoader(t *testing.T) {
 	l := &StringLoader{}
 	b, e := l.Load("test string")
@@ -35,7 +409,7 @@ func TestStringLoader(t *testing.T) {
 }
 
 func TestMemoryLoader(t *testing.T) {
-	l := &MemoryLoader{map[string]string{"test.twig": "some text"}}
+	l := &MemoryLoader{Templates: map[string]string{"test.twig": "some text"}}
 	b, e := l.Load("test.twig")
 	if e != nil {
 		t.Fatalf("expected load to succeed got %s", e)
@@ -50,3 +424,138 @@ func TestMemoryLoader(t *testing.T) {
 		t.Fatalf("expected 'some text' got '%s'", string(s))
 	}
 }
+
+func TestLoaderList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"main/index.twig", "main/partials/item.twig", "admin/index.twig"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := NewFilesystemLoader(filepath.Join(dir, "main"), filepath.Join(dir, "missing"))
+	fs.AddPath(filepath.Join(dir, "admin"), "admin")
+	mem := NewMemoryLoader(map[string]string{"mem.twig": "", "index.twig": ""})
+	tests := []struct {
+		name     string
+		loader   Lister
+		expected []string
+	}{
+		{"memory", mem, []string{"index.twig", "mem.twig"}},
+		{"filesystem", fs, []string{"@admin/index.twig", "index.twig", "partials/item.twig"}},
+		{"chain", NewChainLoader(mem, &StringLoader{}, fs), []string{"@admin/index.twig", "index.twig", "mem.twig", "partials/item.twig"}},
+	}
+	for _, test := range tests {
+		actual, err := test.loader.List()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string, mod time.Time) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("index.twig", "before", start)
+	write("other.twig", "other", start)
+	env := New(NewFilesystemLoader(dir))
+	if _, err := env.ExecuteToString("index.twig", nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan []string)
+	done := make(chan error)
+	go func() {
+		done <- env.Watch(ctx, 5*time.Millisecond, func(names []string) {
+			changes <- names
+		})
+	}()
+	tests := []struct {
+		change   func()
+		expected []string
+	}{
+		{func() { write("index.twig", "after", start.Add(time.Minute)) }, []string{"index.twig"}},
+		{func() { write("new.twig", "new", start) }, []string{"new.twig"}},
+		{func() { os.Remove(filepath.Join(dir, "other.twig")) }, []string{"other.twig"}},
+	}
+	// Let the watcher take its initial snapshot.
+	time.Sleep(20 * time.Millisecond)
+	for _, test := range tests {
+		test.change()
+		select {
+		case names := <-changes:
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, names)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected change to %v", test.expected)
+		}
+	}
+	if stats := env.CacheStats(); stats.Templates != 0 {
+		t.Errorf("expected the template cache to be cleared, got %d templates", stats.Templates)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if err := New(&StringLoader{}).Watch(context.Background(), time.Second, nil); err != ErrNotLister {
+		t.Errorf("expected ErrNotLister, got %v", err)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := env.Watch(context.Background(), interval, nil); err == nil {
+			t.Errorf("expected an error for interval %s", interval)
+		}
+	}
+}
+
+// modTimeOnlyLoader counts the templates it loads, and reports a fixed
+// modification time for each template without loading it.
+type modTimeOnlyLoader struct {
+	MemoryLoader
+	loads int32
+}
+
+func (l *modTimeOnlyLoader) Load(name string) (Template, error) {
+	atomic.AddInt32(&l.loads, 1)
+	return l.MemoryLoader.Load(name)
+}
+
+func (l *modTimeOnlyLoader) ModTime(name string) (time.Time, error) {
+	return time.Unix(0, 0), nil
+}
+
+func TestWatchModTime(t *testing.T) {
+	l := &modTimeOnlyLoader{MemoryLoader: MemoryLoader{Templates: map[string]string{"a.twig": "a", "b.twig": "b"}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := New(l).Watch(ctx, time.Millisecond, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := atomic.LoadInt32(&l.loads); n != 0 {
+		t.Errorf("expected no templates to be loaded, got %d loads", n)
+	}
+}
@@ -0,0 +1,44 @@
+package stick
+
+import (
+	"context"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A Logger receives structured log messages from an Env, such as warnings
+// and references to undefined variables. A *slog.Logger satisfies this
+// interface.
+//
+// Arguments following the message are alternating keys and values.
+type Logger interface {
+	DebugContext(ctx context.Context, msg string, args ...interface{})
+	WarnContext(ctx context.Context, msg string, args ...interface{})
+}
+
+// logArgs returns the attributes describing the given node in the current
+// template, followed by args.
+func (s *state) logArgs(node parse.Node, args []interface{}) []interface{} {
+	res := []interface{}{"template", s.name}
+	if node != nil {
+		pos := node.Start()
+		res = append(res, "line", pos.Line, "column", pos.Offset)
+	}
+	return append(res, args...)
+}
+
+// debug logs a debug message about node to the Env's Logger, if any.
+func (s *state) debug(node parse.Node, msg string, args ...interface{}) {
+	if s.env.Logger == nil {
+		return
+	}
+	s.env.Logger.DebugContext(s.context, msg, s.logArgs(node, args)...)
+}
+
+// warn logs a warning about node to the Env's Logger, if any.
+func (s *state) warn(node parse.Node, msg string, args ...interface{}) {
+	if s.env.Logger == nil {
+		return
+	}
+	s.env.Logger.WarnContext(s.context, msg, s.logArgs(node, args)...)
+}
@@ -0,0 +1,217 @@
+// Package minify provides output filters that shrink rendered templates
+// without changing how they are displayed.
+//
+// Set an Env's OutputFilter to minify the output of every template:
+//
+//	env.OutputFilter = minify.HTML
+//
+// Or add it as output middleware, to combine it with other middleware:
+//
+//	env.UseOutputMiddleware(gzipMiddleware, minify.HTMLMiddleware)
+package minify // import "github.com/tyler-sommer/stick/minify"
+
+import (
+	"bytes"
+	"io"
+)
+
+// HTML minifies the HTML output of the named template. It removes comments,
+// other than conditional comments, and collapses runs of whitespace in text
+// and within tags to a single space. Whitespace next to block-level
+// elements, such as div and li, is removed entirely, since it is not
+// displayed. The contents of pre, textarea, script, and style elements are
+// left as they are.
+//
+// HTML has the signature of stick.Env's OutputFilter.
+func HTML(name string, out []byte) ([]byte, error) {
+	m := minifier{src: out, out: make([]byte, 0, len(out)), block: true}
+	m.run()
+	return m.out, nil
+}
+
+// HTMLMiddleware returns a writer that minifies HTML written to it, as with
+// HTML. The output is buffered and written to next when the writer is
+// closed.
+//
+// HTMLMiddleware has the signature of stick.OutputMiddleware.
+func HTMLMiddleware(next io.Writer) io.Writer {
+	return &htmlWriter{next: next}
+}
+
+type htmlWriter struct {
+	next io.Writer
+	buf  bytes.Buffer
+}
+
+func (w *htmlWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *htmlWriter) Close() error {
+	out, err := HTML("", w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.next.Write(out)
+	return err
+}
+
+// rawElements contains the elements whose contents are left as they are.
+var rawElements = map[string]bool{
+	"pre": true, "textarea": true, "script": true, "style": true,
+}
+
+// blockElements contains the elements that whitespace can be removed
+// around.
+var blockElements = map[string]bool{
+	"!doctype": true, "html": true, "head": true, "body": true, "title": true,
+	"meta": true, "link": true, "base": true, "script": true, "style": true,
+	"noscript": true, "div": true, "p": true, "ul": true, "ol": true,
+	"li": true, "dl": true, "dt": true, "dd": true, "table": true,
+	"thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true,
+	"th": true, "caption": true, "colgroup": true, "col": true,
+	"form": true, "fieldset": true, "legend": true, "option": true,
+	"optgroup": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "footer": true, "nav": true,
+	"main": true, "section": true, "article": true, "aside": true,
+	"figure": true, "figcaption": true, "blockquote": true, "hr": true,
+	"br": true, "address": true, "details": true, "summary": true,
+	"template": true,
+}
+
+type minifier struct {
+	src   []byte
+	out   []byte
+	pos   int
+	space bool // Whitespace was skipped since the last output.
+	block bool // The last output was a block-level tag, or nothing.
+}
+
+func (m *minifier) run() {
+	for m.pos < len(m.src) {
+		rest := m.src[m.pos:]
+		switch c := rest[0]; {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			m.comment()
+		case c == '<' && len(rest) > 1 && (isLetter(rest[1]) || rest[1] == '/' || rest[1] == '!'):
+			m.tag()
+		case isSpace(c):
+			m.space = true
+			m.pos++
+		default:
+			m.text(c)
+			m.pos++
+		}
+	}
+}
+
+// text writes c, preceded by a space if whitespace was skipped.
+func (m *minifier) text(c byte) {
+	if m.space && !m.block {
+		m.out = append(m.out, ' ')
+	}
+	m.out = append(m.out, c)
+	m.space, m.block = false, false
+}
+
+// comment skips a comment, or writes it if it is a conditional comment.
+func (m *minifier) comment() {
+	rest := m.src[m.pos:]
+	end := bytes.Index(rest[4:], []byte("-->"))
+	if end < 0 {
+		end = len(rest)
+	} else {
+		end += 4 + 3
+	}
+	if bytes.HasPrefix(rest, []byte("<!--[")) {
+		m.flush(false)
+		m.out = append(m.out, rest[:end]...)
+	}
+	m.pos += end
+}
+
+// flush writes a space if whitespace was skipped and it is displayed
+// before an element, which is block-level if block is true.
+func (m *minifier) flush(block bool) {
+	if m.space && !m.block && !block {
+		m.out = append(m.out, ' ')
+	}
+	m.space = false
+}
+
+// tag writes a start or end tag, followed by the element's contents if it
+// is a raw element.
+func (m *minifier) tag() {
+	rest := m.src[m.pos:]
+	closing := rest[1] == '/'
+	i := 1
+	if closing {
+		i++
+	}
+	start := i
+	for i < len(rest) && !isSpace(rest[i]) && rest[i] != '>' && rest[i] != '/' {
+		i++
+	}
+	name := string(bytes.ToLower(rest[start:i]))
+	block := blockElements[name]
+	m.flush(block)
+
+	// Whitespace between attributes is collapsed, but not within quoted
+	// values.
+	m.out = append(m.out, rest[:i]...)
+	var quote byte
+	space := false
+	for ; i < len(rest); i++ {
+		c := rest[i]
+		if quote != 0 {
+			m.out = append(m.out, c)
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if isSpace(c) {
+			space = true
+			continue
+		}
+		if space && c != '>' && !(c == '/' && i+1 < len(rest) && rest[i+1] == '>') {
+			m.out = append(m.out, ' ')
+		}
+		space = false
+		m.out = append(m.out, c)
+		if c == '>' {
+			i++
+			break
+		} else if c == '"' || c == '\'' {
+			quote = c
+		}
+	}
+	m.pos += i
+	m.block = block
+
+	if rawElements[name] && !closing {
+		m.raw(name)
+	}
+}
+
+// raw writes the contents of the named raw element, up to its end tag.
+func (m *minifier) raw(name string) {
+	rest := m.src[m.pos:]
+	end := bytes.Index(bytes.ToLower(rest), []byte("</"+name))
+	if end < 0 {
+		end = len(rest)
+	}
+	if end > 0 {
+		m.out = append(m.out, rest[:end]...)
+		m.block = false
+	}
+	m.pos += end
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
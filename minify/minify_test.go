@@ -0,0 +1,78 @@
+package minify_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/minify"
+)
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"text", "  Hello,\n\t  world!  ", "Hello, world!"},
+		{"block elements", "<ul>\n  <li>One</li>\n  <li>Two</li>\n</ul>\n<p>\n  Text\n</p>", "<ul><li>One</li><li>Two</li></ul><p>Text</p>"},
+		{"inline elements", "<b>bold</b>  \n <i>italic</i> <a href=\"#\">link</a>", "<b>bold</b> <i>italic</i> <a href=\"#\">link</a>"},
+		{"comments", "<div>a<!-- note --> b<!---->c</div>", "<div>a bc</div>"},
+		{"conditional comments", "<head>\n<!--[if IE]><link rel=\"stylesheet\" href=\"ie.css\"><![endif]-->\n</head>", "<head><!--[if IE]><link rel=\"stylesheet\" href=\"ie.css\"><![endif]--></head>"},
+		{"attributes", "<input\n    type=\"text\"\n    value=\"a   b\"   data-x='c  d' />", "<input type=\"text\" value=\"a   b\" data-x='c  d'/>"},
+		{"raw elements", "<pre>\n  keep  this\n</pre>\n<script>\n  // <!-- not a comment -->\n  var a  = 1;\n</script>", "<pre>\n  keep  this\n</pre><script>\n  // <!-- not a comment -->\n  var a  = 1;\n</script>"},
+		{"raw elements case", "<TEXTAREA> a  b </TEXTAREA>", "<TEXTAREA> a  b </TEXTAREA>"},
+		{"doctype", "<!DOCTYPE html>\n<html>\n<head>\n  <title> Page </title>\n</head>\n</html>\n", "<!DOCTYPE html><html><head><title>Page</title></head></html>"},
+		{"less than", "1 < 2 <3", "1 < 2 <3"},
+		{"unclosed", "<div>a <!-- b", "<div>a"},
+	}
+	for _, test := range tests {
+		actual, err := minify.HTML("test", []byte(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if string(actual) != test.expected {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.name, test.expected, string(actual))
+		}
+	}
+}
+
+func TestOutputFilter(t *testing.T) {
+	env := stick.New(stick.NewMemoryLoader(map[string]string{
+		"page.twig": "<ul>\n{% for item in items %}\n  <li>{{ item }}</li>\n{% endfor %}\n</ul>\n",
+	}))
+	env.OutputFilter = minify.HTML
+	actual, err := env.ExecuteToString("page.twig", map[string]stick.Value{"items": []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "<ul><li>a</li><li>b</li></ul>"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestHTMLMiddleware(t *testing.T) {
+	env := stick.New(stick.NewMemoryLoader(map[string]string{
+		"page.twig": "<p>\n  {{ text }}\n</p>\n",
+	}))
+	env.UseOutputMiddleware(func(next io.Writer) io.Writer {
+		return gzip.NewWriter(next)
+	}, minify.HTMLMiddleware)
+	buf := &bytes.Buffer{}
+	if err := env.Execute("page.twig", buf, map[string]stick.Value{"text": "Hello"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("expected gzipped output: %s", err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "<p>Hello</p>"; string(actual) != expected {
+		t.Errorf("expected %q, got %q", expected, string(actual))
+	}
+}
@@ -0,0 +1,289 @@
+package stick
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// An ExactNumber is a number that supports exact arithmetic, such as a
+// decimal or rational number type. When both operands of an arithmetic
+// operator or comparison are ExactNumbers of the same type, their methods
+// are used instead of converting them to float64, so that no precision is
+// lost.
+//
+// The decimal.Decimal type from github.com/shopspring/decimal, *big.Int,
+// and *big.Rat are treated as ExactNumbers, and may also be combined with
+// each other and with ordinary numbers, such as the literals in a template.
+type ExactNumber interface {
+	// Add returns the sum of the number and y.
+	Add(y ExactNumber) ExactNumber
+	// Sub returns the difference of the number and y.
+	Sub(y ExactNumber) ExactNumber
+	// Mul returns the product of the number and y.
+	Mul(y ExactNumber) ExactNumber
+	// Div returns the quotient of the number and y. It is never called
+	// with a y of zero.
+	Div(y ExactNumber) ExactNumber
+	// Cmp returns -1, 0, or 1 if the number is less than, equal to, or
+	// greater than y.
+	Cmp(y ExactNumber) int
+	// String returns the number in decimal notation.
+	String() string
+}
+
+// IsExact returns true if the given Value is an ExactNumber, a
+// decimal.Decimal, a *big.Int, or a *big.Rat.
+func IsExact(val Value) bool {
+	_, ok := exactOf(val)
+	return ok
+}
+
+// Add returns the sum of left and right, as with the "+" operator.
+func Add(left, right Value) Value {
+	if x, y, ok := exactOperands(left, right); ok {
+		return exactValue(x.Add(y))
+	}
+	return CoerceNumber(left) + CoerceNumber(right)
+}
+
+// Sub returns the difference of left and right, as with the "-" operator.
+func Sub(left, right Value) Value {
+	if x, y, ok := exactOperands(left, right); ok {
+		return exactValue(x.Sub(y))
+	}
+	return CoerceNumber(left) - CoerceNumber(right)
+}
+
+// Mul returns the product of left and right, as with the "*" operator.
+func Mul(left, right Value) Value {
+	if x, y, ok := exactOperands(left, right); ok {
+		return exactValue(x.Mul(y))
+	}
+	return CoerceNumber(left) * CoerceNumber(right)
+}
+
+// Div returns the quotient of left and right, as with the "/" operator.
+// Dividing by zero results in an infinity or NaN.
+func Div(left, right Value) Value {
+	if x, y, ok := exactOperands(left, right); ok && y.Cmp(y.Sub(y)) != 0 {
+		return exactValue(x.Div(y))
+	}
+	return CoerceNumber(left) / CoerceNumber(right)
+}
+
+// compareExact compares left and right exactly, if they are ExactNumbers
+// that can be combined.
+func compareExact(left, right Value) (int, bool) {
+	x, y, ok := exactOperands(left, right)
+	if !ok {
+		return 0, false
+	}
+	return x.Cmp(y), true
+}
+
+// exactOperands returns left and right as ExactNumbers of the same type,
+// if at least one of them is exact and the other can be converted.
+func exactOperands(left, right Value) (ExactNumber, ExactNumber, bool) {
+	x, lok := exactOf(left)
+	y, rok := exactOf(right)
+	switch {
+	case !lok && !rok:
+		return nil, nil, false
+	case !lok:
+		x, lok = convertExact(y, left)
+	case !rok:
+		y, rok = convertExact(x, right)
+	}
+	if !lok || !rok {
+		return nil, nil, false
+	}
+	if reflect.TypeOf(x) == reflect.TypeOf(y) {
+		return x, y, true
+	}
+	// Decimals and big numbers are combined as rationals.
+	xr, lok := x.(exactParser)
+	yr, rok := y.(exactParser)
+	if !lok || !rok {
+		return nil, nil, false
+	}
+	return xr.rat(), yr.rat(), true
+}
+
+// exactOf returns v as an ExactNumber, adapting the supported types from
+// other packages.
+func exactOf(v Value) (ExactNumber, bool) {
+	switch vc := v.(type) {
+	case SafeValue:
+		return exactOf(vc.Value())
+	case ExactNumber:
+		return vc, true
+	case decimal.Decimal:
+		return decimalNumber{vc}, true
+	case *big.Int:
+		if vc == nil {
+			return nil, false
+		}
+		return ratNumber{new(big.Rat).SetInt(vc), true}, true
+	case *big.Rat:
+		if vc == nil {
+			return nil, false
+		}
+		return ratNumber{vc, false}, true
+	}
+	return nil, false
+}
+
+// exactValue returns the value represented by n, unwrapping adapted types.
+func exactValue(n ExactNumber) Value {
+	switch n := n.(type) {
+	case decimalNumber:
+		return n.d
+	case ratNumber:
+		if n.isInt && n.r.IsInt() {
+			return new(big.Int).Set(n.r.Num())
+		}
+		return n.r
+	}
+	return n
+}
+
+// convertExact converts the ordinary number v to the type of n, if n is
+// one of the adapted types.
+func convertExact(n ExactNumber, v Value) (ExactNumber, bool) {
+	p, ok := n.(exactParser)
+	if !ok {
+		return nil, false
+	}
+	s, ok := exactString(v)
+	if !ok {
+		return nil, false
+	}
+	return p.parse(s)
+}
+
+// exactString returns the ordinary number v in decimal notation, without
+// rounding.
+func exactString(v Value) (string, bool) {
+	switch vc := v.(type) {
+	case SafeValue:
+		return exactString(vc.Value())
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return CoerceString(vc), true
+	case json.Number:
+		return string(vc), true
+	case string:
+		if !isNumericString(vc) {
+			return "", false
+		}
+		return strings.TrimSpace(vc), true
+	}
+	if kindOf(v) != kindNumber {
+		return "", false
+	}
+	return strconv.FormatFloat(CoerceNumber(v), 'g', -1, 64), true
+}
+
+// An exactParser is an adapted ExactNumber that ordinary numbers can be
+// converted to.
+type exactParser interface {
+	ExactNumber
+
+	// parse returns the number s, in decimal notation, as the same type.
+	parse(s string) (ExactNumber, bool)
+
+	// rat returns the number as a rational.
+	rat() ratNumber
+}
+
+// decimalNumber adapts a decimal.Decimal to an ExactNumber.
+type decimalNumber struct {
+	d decimal.Decimal
+}
+
+func (n decimalNumber) Add(y ExactNumber) ExactNumber {
+	return decimalNumber{n.d.Add(y.(decimalNumber).d)}
+}
+
+func (n decimalNumber) Sub(y ExactNumber) ExactNumber {
+	return decimalNumber{n.d.Sub(y.(decimalNumber).d)}
+}
+
+func (n decimalNumber) Mul(y ExactNumber) ExactNumber {
+	return decimalNumber{n.d.Mul(y.(decimalNumber).d)}
+}
+
+func (n decimalNumber) Div(y ExactNumber) ExactNumber {
+	return decimalNumber{n.d.Div(y.(decimalNumber).d)}
+}
+
+func (n decimalNumber) Cmp(y ExactNumber) int {
+	return n.d.Cmp(y.(decimalNumber).d)
+}
+
+func (n decimalNumber) String() string {
+	return n.d.String()
+}
+
+func (n decimalNumber) parse(s string) (ExactNumber, bool) {
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return nil, false
+	}
+	return decimalNumber{d}, true
+}
+
+func (n decimalNumber) rat() ratNumber {
+	return ratNumber{n.d.Rat(), false}
+}
+
+// ratNumber adapts a *big.Rat, or a *big.Int if isInt is set, to an
+// ExactNumber. Results are never stored in the operands.
+type ratNumber struct {
+	r     *big.Rat
+	isInt bool
+}
+
+func (n ratNumber) Add(y ExactNumber) ExactNumber {
+	m := y.(ratNumber)
+	return ratNumber{new(big.Rat).Add(n.r, m.r), n.isInt && m.isInt}
+}
+
+func (n ratNumber) Sub(y ExactNumber) ExactNumber {
+	m := y.(ratNumber)
+	return ratNumber{new(big.Rat).Sub(n.r, m.r), n.isInt && m.isInt}
+}
+
+func (n ratNumber) Mul(y ExactNumber) ExactNumber {
+	m := y.(ratNumber)
+	return ratNumber{new(big.Rat).Mul(n.r, m.r), n.isInt && m.isInt}
+}
+
+func (n ratNumber) Div(y ExactNumber) ExactNumber {
+	m := y.(ratNumber)
+	return ratNumber{new(big.Rat).Quo(n.r, m.r), n.isInt && m.isInt}
+}
+
+func (n ratNumber) Cmp(y ExactNumber) int {
+	return n.r.Cmp(y.(ratNumber).r)
+}
+
+func (n ratNumber) String() string {
+	return n.r.RatString()
+}
+
+func (n ratNumber) parse(s string) (ExactNumber, bool) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, false
+	}
+	return ratNumber{r, n.isInt && r.IsInt()}, true
+}
+
+func (n ratNumber) rat() ratNumber {
+	return n
+}
@@ -0,0 +1,192 @@
+package stick
+
+import (
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// Optimizations that can be applied to templates when they are loaded.
+// Combine them to set an Env's Optimizations.
+const (
+	// OptimizeRawFilter removes uses of the "raw" filter that have no
+	// effect, such as a raw filter whose result is passed to another filter.
+	OptimizeRawFilter = 1 << iota
+
+	// OptimizeLoopVariable skips defining the "loop" variable in for loops
+	// that never reference it.
+	OptimizeLoopVariable
+
+	// OptimizeInclude loads templates included using a string literal, such
+	// as {% include 'footer.twig' %}, along with the including template,
+	// rather than each time the include is executed. Each such template is
+	// loaded once, even if it is included several times, and even if the
+	// include is never executed.
+	OptimizeInclude
+
+	// OptimizeAll enables all optimizations.
+	OptimizeAll = OptimizeRawFilter | OptimizeLoopVariable | OptimizeInclude
+)
+
+// optimizer applies an Env's Optimizations to parsed templates.
+type optimizer struct {
+	env     *Env
+	loading []string               // Names of the templates currently being optimized.
+	inlined []string               // Names of the templates inlined by OptimizeInclude.
+	size    int64                  // Total size of the inlined templates' source.
+	trees   map[string]*parse.Tree // Templates loaded for inlining, or nil if they could not be.
+}
+
+// optimize applies the Env's Optimizations to tree.
+func (o *optimizer) optimize(tree *parse.Tree) {
+	o.loading = append(o.loading, tree.Name)
+	defer func() {
+		o.loading = o.loading[:len(o.loading)-1]
+	}()
+	visitAll(tree.Root(), o.visit)
+}
+
+func (o *optimizer) visit(node parse.Node) {
+	flags := o.env.Optimizations
+	switch node := node.(type) {
+	case *parse.PrintNode:
+		if flags&OptimizeRawFilter == 0 {
+			return
+		}
+		// A raw filter applied last controls escaping, so it must be kept.
+		if f, ok := node.X.(*parse.FilterExpr); ok && f.Name == "raw" {
+			stripRawArgs(f.FuncExpr)
+			return
+		}
+		node.X = stripRaw(node.X)
+	case *parse.SetNode:
+		if x, ok := node.X.(parse.Expr); ok && flags&OptimizeRawFilter != 0 {
+			node.X = stripRaw(x)
+		}
+	case *parse.DoNode:
+		if flags&OptimizeRawFilter != 0 {
+			node.X = stripRaw(node.X)
+		}
+	case *parse.IfNode:
+		if flags&OptimizeRawFilter != 0 {
+			node.Cond = stripRaw(node.Cond)
+		}
+	case *parse.ForNode:
+		if flags&OptimizeRawFilter != 0 {
+			node.X = stripRaw(node.X)
+		}
+		if flags&OptimizeLoopVariable != 0 && !usesLoop(node.Body) {
+			node.NoLoop = true
+		}
+	case *parse.IncludeNode:
+		if flags&OptimizeInclude == 0 {
+			return
+		}
+		name := staticName(node.Tpl)
+		if name == "" || o.isLoading(name) {
+			return
+		}
+		if tree := o.load(name); tree != nil {
+			node.Tree = tree
+		}
+	}
+}
+
+// load returns the named template, optimized, to be inlined. Each template
+// is loaded only once, however many times it is included. Nil is returned
+// if the template cannot be loaded, in which case the error is reported
+// when the include is executed.
+func (o *optimizer) load(name string) *parse.Tree {
+	if tree, ok := o.trees[name]; ok {
+		return tree
+	}
+	if o.trees == nil {
+		o.trees = make(map[string]*parse.Tree)
+	}
+	// Included templates are contextualized on their own, as when they are
+	// loaded by the include.
+	tree, size, err := o.env.prepare(name)
+	if err != nil {
+		o.trees[name] = nil
+		return nil
+	}
+	o.trees[name] = tree
+	o.optimize(tree)
+	o.inlined = append(o.inlined, name)
+	o.size += size
+	return tree
+}
+
+// isLoading returns true if the named template is being optimized, which
+// is the case for recursive includes.
+func (o *optimizer) isLoading(name string) bool {
+	for _, n := range o.loading {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usesLoop returns true if the "loop" variable may be read within node.
+// Included templates and the block and parent functions can read it
+// implicitly.
+func usesLoop(node parse.Node) bool {
+	res := false
+	visitAll(node, func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.NameExpr:
+			res = res || n.Name == "loop"
+		case *parse.IncludeNode, *parse.EmbedNode:
+			res = true
+		case *parse.FuncExpr:
+			res = res || n.Name == "include" || n.Name == "block" || n.Name == "parent"
+		}
+	})
+	return res
+}
+
+// stripRaw returns exp with all uses of the raw filter removed.
+func stripRaw(exp parse.Expr) parse.Expr {
+	switch e := exp.(type) {
+	case *parse.FilterExpr:
+		if e.Name == "raw" && len(e.Args) == 1 {
+			return stripRaw(e.Args[0])
+		}
+		stripRawArgs(e.FuncExpr)
+	case *parse.FuncExpr:
+		stripRawArgs(e)
+	case *parse.BinaryExpr:
+		e.Left = stripRaw(e.Left)
+		e.Right = stripRaw(e.Right)
+	case *parse.UnaryExpr:
+		e.X = stripRaw(e.X)
+	case *parse.GroupExpr:
+		e.X = stripRaw(e.X)
+	case *parse.GetAttrExpr:
+		e.Cont = stripRaw(e.Cont)
+		e.Attr = stripRaw(e.Attr)
+		for i, a := range e.Args {
+			e.Args[i] = stripRaw(a)
+		}
+	case *parse.TernaryIfExpr:
+		e.Cond = stripRaw(e.Cond)
+		e.TrueX = stripRaw(e.TrueX)
+		e.FalseX = stripRaw(e.FalseX)
+	case *parse.HashExpr:
+		for _, kv := range e.Elements {
+			kv.Key = stripRaw(kv.Key)
+			kv.Value = stripRaw(kv.Value)
+		}
+	case *parse.ArrayExpr:
+		for i, el := range e.Elements {
+			e.Elements[i] = stripRaw(el)
+		}
+	}
+	return exp
+}
+
+// stripRawArgs removes uses of the raw filter from the arguments of fn.
+func stripRawArgs(fn *parse.FuncExpr) {
+	for i, a := range fn.Args {
+		fn.Args[i] = stripRaw(a)
+	}
+}
@@ -0,0 +1,109 @@
+package stick
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// An OrderedMap is a map with string keys that remembers the order in which
+// its keys were added. Hash literals, such as {"a": 1, "b": 2}, evaluate to
+// an *OrderedMap, so that iterating over them, printing them, and filters
+// such as first, last, and keys follow the order in which they were
+// written, as in Twig.
+//
+// The zero value is an empty map ready to use.
+type OrderedMap struct {
+	keys []string
+	vals map[string]Value
+}
+
+// NewOrderedMap returns an empty OrderedMap.
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{}
+}
+
+// Len returns the number of entries in the map.
+func (m *OrderedMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.keys)
+}
+
+// Get returns the value for key k, and whether it exists.
+func (m *OrderedMap) Get(k string) (Value, bool) {
+	if m == nil {
+		return nil, false
+	}
+	v, ok := m.vals[k]
+	return v, ok
+}
+
+// Set sets the value for key k. A new key is added after all existing keys;
+// an existing key keeps its position.
+func (m *OrderedMap) Set(k string, v Value) {
+	if m.vals == nil {
+		m.vals = make(map[string]Value)
+	}
+	if _, ok := m.vals[k]; !ok {
+		m.keys = append(m.keys, k)
+	}
+	m.vals[k] = v
+}
+
+// Delete removes key k from the map, if it exists.
+func (m *OrderedMap) Delete(k string) {
+	if _, ok := m.vals[k]; !ok {
+		return
+	}
+	delete(m.vals, k)
+	for i, key := range m.keys {
+		if key == k {
+			m.keys = append(m.keys[:i:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys of the map, in order.
+func (m *OrderedMap) Keys() []string {
+	if m == nil {
+		return nil
+	}
+	return append([]string(nil), m.keys...)
+}
+
+// Map returns the entries of the map as an ordinary, unordered map.
+func (m *OrderedMap) Map() map[string]Value {
+	res := make(map[string]Value, m.Len())
+	if m != nil {
+		for k, v := range m.vals {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// MarshalJSON encodes the map as a JSON object with its keys in order.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.Keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(m.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,136 @@
+package parse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Dump writes an indented description of the syntax tree to w, intended
+// for debugging. Each Node is written on its own line with its kind,
+// position, and any literal values, followed by its children.
+//
+//	ModuleNode 1:0
+//	  Nodes[0]: PrintNode 1:0
+//	    X: NameExpr 1:3 Name="name"
+//
+// Children are labeled with the name of the field containing them. The
+// Tree of an IncludeNode, if it was loaded ahead of time, is not written.
+func Dump(w io.Writer, tree *Tree) error {
+	d := &dumper{bufio.NewWriter(w)}
+	d.node(0, "", reflect.ValueOf(tree.Root()))
+	return d.w.Flush()
+}
+
+var (
+	posType       = reflect.TypeOf(Pos{})
+	trimmableType = reflect.TypeOf(TrimmableNode{})
+)
+
+type dumper struct {
+	w *bufio.Writer
+}
+
+// node writes the Node n, labeled with label, and its children.
+func (d *dumper) node(depth int, label string, n reflect.Value) {
+	for n.Kind() == reflect.Interface || n.Kind() == reflect.Ptr {
+		if n.IsNil() {
+			return
+		}
+		n = n.Elem()
+	}
+	var children []func()
+	var values []string
+	d.fields(depth+1, n, &values, &children)
+	fmt.Fprintf(d.w, "%s%s%s", strings.Repeat("  ", depth), label, n.Type().Name())
+	if n.CanAddr() {
+		if node, ok := n.Addr().Interface().(Node); ok {
+			fmt.Fprintf(d.w, " %s", node.Start())
+		}
+	}
+	for _, v := range values {
+		d.w.WriteString(" " + v)
+	}
+	d.w.WriteString("\n")
+	for _, fn := range children {
+		fn()
+	}
+}
+
+// fields collects the literal values and children of the struct v. The
+// fields of embedded structs are included, as if they belonged to v.
+func (d *dumper) fields(depth int, v reflect.Value, values *[]string, children *[]func()) {
+	for i := 0; i < v.NumField(); i++ {
+		f, fv := v.Type().Field(i), v.Field(i)
+		if f.PkgPath != "" || fv.Type() == treeType || f.Type == posType {
+			continue
+		}
+		if f.Type == trimmableType {
+			// Whitespace control is only noted when in use.
+			if fv.Field(0).Bool() {
+				*values = append(*values, "TrimBefore")
+			}
+			if fv.Field(1).Bool() {
+				*values = append(*values, "TrimAfter")
+			}
+			continue
+		}
+		if f.Name == "Strategy" && fv.String() == "" {
+			// A PrintNode's escaping strategy is only noted when chosen.
+			continue
+		}
+		if f.Anonymous {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			d.fields(depth, fv, values, children)
+			continue
+		}
+		name := f.Name
+		switch {
+		case isNode(fv.Type()):
+			*children = append(*children, func() { d.node(depth, name+": ", fv) })
+		case fv.Kind() == reflect.Slice && isNode(fv.Type().Elem()):
+			*children = append(*children, func() {
+				for j := 0; j < fv.Len(); j++ {
+					d.node(depth, fmt.Sprintf("%s[%d]: ", name, j), fv.Index(j))
+				}
+			})
+		case fv.Kind() == reflect.Map && isNode(fv.Type().Elem()):
+			*children = append(*children, func() {
+				for _, k := range sortedMapKeys(fv) {
+					d.node(depth, fmt.Sprintf("%s[%s]: ", name, k), fv.MapIndex(k))
+				}
+			})
+		case fv.Kind() == reflect.Map:
+			var entries []string
+			for _, k := range sortedMapKeys(fv) {
+				entries = append(entries, fmt.Sprintf("%v: %v", k, fv.MapIndex(k)))
+			}
+			*values = append(*values, fmt.Sprintf("%s={%s}", name, strings.Join(entries, ", ")))
+		case fv.Kind() == reflect.String:
+			*values = append(*values, fmt.Sprintf("%s=%q", name, fv.String()))
+		default:
+			*values = append(*values, fmt.Sprintf("%s=%v", name, fv.Interface()))
+		}
+	}
+}
+
+// isNode returns true if values of type t may hold a Node.
+func isNode(t reflect.Type) bool {
+	return t.Implements(nodeType) || t.Kind() == reflect.Interface && nodeType.Implements(t)
+}
+
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
@@ -0,0 +1,275 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+func init() {
+	for _, n := range []Node{
+		&ModuleNode{}, &BodyNode{}, &TextNode{}, &CommentNode{}, &PrintNode{},
+		&BlockNode{}, &IfNode{}, &ExtendsNode{}, &ForNode{}, &IncludeNode{},
+		&EmbedNode{}, &UseNode{}, &SetNode{}, &DoNode{}, &FilterNode{},
+		&MacroNode{}, &ImportNode{}, &FromNode{},
+		&NameExpr{}, &NullExpr{}, &BoolExpr{}, &NumberExpr{}, &StringExpr{},
+		&FuncExpr{}, &FilterExpr{}, &TestExpr{}, &BinaryExpr{}, &UnaryExpr{},
+		&GroupExpr{}, &GetAttrExpr{}, &TernaryIfExpr{}, &KeyValueExpr{},
+		&HashExpr{}, &ArrayExpr{}, &NamedArgExpr{},
+		&encodedIncludeNode{}, &encodedEmbedNode{},
+	} {
+		gob.Register(n)
+	}
+}
+
+// encodedTree is the form in which a Tree is encoded.
+type encodedTree struct {
+	Name         string
+	Root         *ModuleNode
+	Deprecations []Deprecation
+}
+
+// MarshalBinary encodes the parsed syntax tree using encoding/gob.
+//
+// Nodes of types defined outside this package, such as those returned by
+// custom tags, must be registered with gob.Register.
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	root, err := mapNodes(reflect.ValueOf(t.root), encodeNode)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(encodedTree{t.Name, root.Interface().(*ModuleNode), t.Deprecations})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a syntax tree encoded by MarshalBinary into t,
+// replacing its name, root, blocks and macros.
+func (t *Tree) UnmarshalBinary(data []byte) error {
+	var enc encodedTree
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&enc); err != nil {
+		return err
+	}
+	if enc.Root == nil {
+		enc.Root = NewModuleNode(enc.Name)
+	}
+	root, err := mapNodes(reflect.ValueOf(enc.Root), decodeNode)
+	if err != nil {
+		return err
+	}
+	enc.Root = root.Interface().(*ModuleNode)
+	if enc.Root.BodyNode == nil {
+		enc.Root.BodyNode = NewBodyNode(Pos{1, 0})
+	}
+	t.Name = enc.Name
+	t.root = enc.Root
+	t.Deprecations = enc.Deprecations
+	t.blocks = []map[string]*BlockNode{make(map[string]*BlockNode)}
+	t.macros = make(map[string]*MacroNode)
+	t.index(t.root.BodyNode)
+	return nil
+}
+
+// index records the blocks and macros defined in n, as the parser does.
+// Blocks within an embed tag belong to the EmbedNode instead.
+func (t *Tree) index(n Node) {
+	switch n := n.(type) {
+	case nil:
+		return
+	case *BlockNode:
+		t.setBlock(n.Name, n)
+	case *MacroNode:
+		t.macros[n.Name] = n
+	case *EmbedNode:
+		t.pushBlockStack()
+		for _, c := range n.All() {
+			t.index(c)
+		}
+		t.popBlockStack()
+		return
+	}
+	for _, c := range n.All() {
+		t.index(c)
+	}
+}
+
+// encodedIncludeNode is the form in which an IncludeNode is encoded. Since
+// encoding/gob cannot describe the Tree type, an included Tree is stored
+// in its encoded form.
+type encodedIncludeNode struct {
+	Pos
+	TrimmableNode
+	Tpl  Expr
+	With Expr
+	Only bool
+	Tree []byte
+
+	IgnoreMissing bool
+}
+
+// String returns a string representation of an encodedIncludeNode.
+func (t *encodedIncludeNode) String() string {
+	return fmt.Sprintf("EncodedInclude(%s with %s %v)", t.Tpl, t.With, t.Only)
+}
+
+// All returns all the child Nodes in an encodedIncludeNode.
+func (t *encodedIncludeNode) All() []Node {
+	return []Node{t.Tpl, t.With}
+}
+
+// encodedEmbedNode is the form in which an EmbedNode is encoded.
+type encodedEmbedNode struct {
+	Pos
+	Include encodedIncludeNode
+	Blocks  map[string]*BlockNode
+}
+
+// String returns a string representation of an encodedEmbedNode.
+func (t *encodedEmbedNode) String() string {
+	return fmt.Sprintf("EncodedEmbed(%s: %v)", t.Include.String(), t.Blocks)
+}
+
+// All returns all the child Nodes in an encodedEmbedNode.
+func (t *encodedEmbedNode) All() []Node {
+	r := t.Include.All()
+	for _, blk := range t.Blocks {
+		r = append(r, blk)
+	}
+	return r
+}
+
+func encodeInclude(n *IncludeNode) (encodedIncludeNode, error) {
+	enc := encodedIncludeNode{n.Pos, n.TrimmableNode, n.Tpl, n.With, n.Only, nil, n.IgnoreMissing}
+	if n.Tree != nil {
+		data, err := n.Tree.MarshalBinary()
+		if err != nil {
+			return enc, err
+		}
+		enc.Tree = data
+	}
+	return enc, nil
+}
+
+func decodeInclude(enc *encodedIncludeNode) (*IncludeNode, error) {
+	n := &IncludeNode{enc.Pos, enc.TrimmableNode, enc.Tpl, enc.With, enc.Only, enc.IgnoreMissing, nil}
+	if enc.Tree != nil {
+		n.Tree = &Tree{}
+		if err := n.Tree.UnmarshalBinary(enc.Tree); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// encodeNode replaces nodes that encoding/gob cannot handle.
+func encodeNode(n Node) (Node, error) {
+	switch n := n.(type) {
+	case *IncludeNode:
+		enc, err := encodeInclude(n)
+		return &enc, err
+	case *EmbedNode:
+		enc, err := encodeInclude(n.IncludeNode)
+		return &encodedEmbedNode{n.Pos, enc, n.Blocks}, err
+	}
+	return n, nil
+}
+
+// decodeNode reverses encodeNode.
+func decodeNode(n Node) (Node, error) {
+	switch n := n.(type) {
+	case *encodedIncludeNode:
+		return decodeInclude(n)
+	case *encodedEmbedNode:
+		inc, err := decodeInclude(&n.Include)
+		if err != nil {
+			return nil, err
+		}
+		return &EmbedNode{inc, n.Blocks}, nil
+	}
+	return n, nil
+}
+
+var (
+	nodeType = reflect.TypeOf((*Node)(nil)).Elem()
+	treeType = reflect.TypeOf(&Tree{})
+)
+
+// mapNodes returns a copy of v, which may be or contain Nodes, in which each
+// Node held in an interface is replaced with the result of calling fn with
+// a copy of it. Trees referenced by v are not copied.
+func mapNodes(v reflect.Value, fn func(Node) (Node, error)) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || !v.Type().Implements(nodeType) {
+			return v, nil
+		}
+		c, err := mapNodes(v.Elem(), fn)
+		if err != nil {
+			return v, err
+		}
+		n, err := fn(c.Interface().(Node))
+		if err != nil {
+			return v, err
+		}
+		res := reflect.New(v.Type()).Elem()
+		res.Set(reflect.ValueOf(n))
+		return res, nil
+	case reflect.Ptr:
+		if v.IsNil() || v.Type() == treeType || v.Elem().Kind() != reflect.Struct {
+			return v, nil
+		}
+		res := reflect.New(v.Type().Elem())
+		c, err := mapNodes(v.Elem(), fn)
+		if err != nil {
+			return v, err
+		}
+		res.Elem().Set(c)
+		return res, nil
+	case reflect.Struct:
+		res := reflect.New(v.Type()).Elem()
+		res.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			f, err := mapNodes(v.Field(i), fn)
+			if err != nil {
+				return v, err
+			}
+			res.Field(i).Set(f)
+		}
+		return res, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return v, nil
+		}
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			e, err := mapNodes(v.Index(i), fn)
+			if err != nil {
+				return v, err
+			}
+			res.Index(i).Set(e)
+		}
+		return res, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return v, nil
+		}
+		res := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			e, err := mapNodes(iter.Value(), fn)
+			if err != nil {
+				return v, err
+			}
+			res.SetMapIndex(iter.Key(), e)
+		}
+		return res, nil
+	}
+	return v, nil
+}
@@ -19,7 +19,7 @@ type DebugError interface {
 }
 
 type parseError struct {
-	Pos
+	pos  Pos    // The position where the error originated.
 	name string // The template this error occurred in.
 }
 
@@ -27,6 +27,10 @@ func newParseError(p Pos) parseError {
 	return parseError{p, ""}
 }
 
+func (e *parseError) Pos() Pos {
+	return e.pos
+}
+
 func (e *parseError) Name() string {
 	return e.name
 }
@@ -38,9 +42,9 @@ func (e *parseError) setTree(t *Tree) {
 func (e *parseError) sprintf(format string, a ...interface{}) string {
 	res := fmt.Sprintf(format, a...)
 	if e.name == "" {
-		return fmt.Sprintf("parse: %s on line %d, column %d", res, e.Line, e.Offset)
+		return fmt.Sprintf("parse: %s on line %d, column %d", res, e.pos.Line, e.pos.Offset)
 	}
-	return fmt.Sprintf("parse: %s on line %d, column %d in %s", res, e.Line, e.Offset, e.name)
+	return fmt.Sprintf("parse: %s on line %d, column %d in %s", res, e.pos.Line, e.pos.Offset, e.name)
 }
 
 // UnexpectedTokenError is generated when the current token
@@ -90,6 +94,20 @@ func newUnclosedTagError(tagName string, start Pos) error {
 	return &UnclosedTagError{newBaseError(start), tagName}
 }
 
+// NestingError is generated when tags or expressions are nested too deeply.
+type NestingError struct {
+	baseError
+}
+
+func (e *NestingError) Error() string {
+	return e.sprintf("nesting exceeds limit of %d", maxNesting)
+}
+
+// newNestingError returns a new NestingError.
+func newNestingError(p Pos) error {
+	return &NestingError{newBaseError(p)}
+}
+
 // UnexpectedEOFError describes an unexpected end of input.
 type UnexpectedEOFError struct {
 	baseError
@@ -133,3 +151,12 @@ func (e *MultipleExtendsError) Error() string {
 func newMultipleExtendsError(start Pos) error {
 	return &MultipleExtendsError{newBaseError(start)}
 }
+
+// Ensure each error type satisfies the ParsingError interface.
+var (
+	_ ParsingError = &UnexpectedTokenError{}
+	_ ParsingError = &UnclosedTagError{}
+	_ ParsingError = &UnexpectedEOFError{}
+	_ ParsingError = &UnexpectedValueError{}
+	_ ParsingError = &MultipleExtendsError{}
+)
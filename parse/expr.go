@@ -357,3 +357,27 @@ func (exp *ArrayExpr) All() []Node {
 func (exp *ArrayExpr) String() string {
 	return fmt.Sprintf("ArrayExpr%v", exp.Elements)
 }
+
+// NamedArgExpr represents a named argument in a function or macro call.
+//
+//	{{ input(name = "email", type = "email") }}
+type NamedArgExpr struct {
+	Pos
+	Name string // Name of the argument.
+	X    Expr   // Value of the argument.
+}
+
+// NewNamedArgExpr returns a NamedArgExpr.
+func NewNamedArgExpr(name string, x Expr, pos Pos) *NamedArgExpr {
+	return &NamedArgExpr{pos, name, x}
+}
+
+// All returns all the child Nodes in a NamedArgExpr.
+func (exp *NamedArgExpr) All() []Node {
+	return []Node{exp.X}
+}
+
+// String returns a string representation of a NamedArgExpr.
+func (exp *NamedArgExpr) String() string {
+	return fmt.Sprintf("NamedArgExpr(%s = %s)", exp.Name, exp.X)
+}
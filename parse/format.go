@@ -0,0 +1,410 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// formatIndent is the indentation added for each level of nested tags.
+const formatIndent = "    "
+
+// Format writes the source of the syntax tree to w in canonical form.
+//
+// Delimiters contain exactly one space, as in "{{ name }}". Operators,
+// commas and colons are spaced as recommended by the Twig coding standards.
+// String literals are written in single quotes unless they contain one.
+// A tag or comment that begins a line is indented by four spaces for each
+// tag enclosing it; other text is written unchanged.
+//
+// Formatting a template and parsing the result produces an equivalent tree.
+// Deprecated syntax is rewritten where an equivalent exists, such as the
+// filter tag, which is written as apply. Whitespace control modifiers are
+// not written, as they are not recorded by the parser. The Nodes returned
+// by custom tags are written as the built-in tags they consist of.
+func Format(w io.Writer, tree *Tree) error {
+	f := &formatter{}
+	f.node(tree.Root().BodyNode)
+	if f.err != nil {
+		return f.err
+	}
+	_, err := w.Write(f.buf.Bytes())
+	return err
+}
+
+// formatter writes the canonical source of a tree. The first error
+// encountered is recorded and formatting continues.
+type formatter struct {
+	buf   bytes.Buffer
+	depth int
+	err   error
+}
+
+func (f *formatter) fail(n Node) string {
+	if f.err == nil {
+		f.err = fmt.Errorf("parse: unable to format %T on line %d, column %d", n, n.Start().Line, n.Start().Offset)
+	}
+	return ""
+}
+
+// indent replaces the indentation of the current line with that of the
+// current depth, if the line contains only whitespace.
+func (f *formatter) indent() {
+	b := f.buf.Bytes()
+	i := len(b)
+	for i > 0 && (b[i-1] == ' ' || b[i-1] == '\t') {
+		i--
+	}
+	if i > 0 && b[i-1] != '\n' {
+		return
+	}
+	f.buf.Truncate(i)
+	f.buf.WriteString(strings.Repeat(formatIndent, f.depth))
+}
+
+func (f *formatter) tag(s string) {
+	f.indent()
+	f.buf.WriteString("{% " + s + " %}")
+}
+
+// nested writes the body of a tag.
+func (f *formatter) nested(n Node) {
+	f.depth++
+	f.node(n)
+	f.depth--
+}
+
+func (f *formatter) node(n Node) {
+	switch n := n.(type) {
+	case nil:
+	case *BodyNode:
+		for _, c := range n.Nodes {
+			f.node(c)
+		}
+	case *ModuleNode:
+		f.node(n.BodyNode)
+	case *CommentNode:
+		f.indent()
+		f.buf.WriteString("{#" + comment(n.Data) + "#}")
+	case *TextNode:
+		if strings.Contains(n.Data, "{{") || strings.Contains(n.Data, "{%") || strings.Contains(n.Data, "{#") {
+			f.tag("verbatim")
+			f.buf.WriteString(n.Data + "{% endverbatim %}")
+			return
+		}
+		f.buf.WriteString(n.Data)
+	case *PrintNode:
+		f.buf.WriteString("{{ " + f.expr(n.X) + " }}")
+	case *ExtendsNode:
+		f.tag("extends " + f.expr(n.Tpl))
+	case *BlockNode:
+		f.tag("block " + n.Name)
+		f.nested(n.Body)
+		f.tag("endblock")
+	case *IfNode:
+		f.tag("if " + f.expr(n.Cond))
+		f.nested(n.Body)
+		els := n.Else
+		for {
+			if b, ok := els.(*BodyNode); ok && len(b.Nodes) == 1 {
+				if in, ok := b.Nodes[0].(*IfNode); ok {
+					f.tag("elseif " + f.expr(in.Cond))
+					f.nested(in.Body)
+					els = in.Else
+					continue
+				}
+			}
+			break
+		}
+		if !isEmpty(els) {
+			f.tag("else")
+			f.nested(els)
+		}
+		f.tag("endif")
+	case *ForNode:
+		s := n.Val
+		if n.Key != "" {
+			s = n.Key + ", " + n.Val
+		}
+		s += " in " + f.expr(n.X)
+		body := n.Body
+		if in, ok := body.(*IfNode); ok && in.Else == nil {
+			s += " if " + f.expr(in.Cond)
+			body = in.Body
+		}
+		f.tag("for " + s)
+		f.nested(body)
+		if !isEmpty(n.Else) {
+			f.tag("else")
+			f.nested(n.Else)
+		}
+		f.tag("endfor")
+	case *EmbedNode:
+		f.tag("embed " + f.include(n.IncludeNode))
+		blocks := make([]*BlockNode, 0, len(n.Blocks))
+		for _, blk := range n.Blocks {
+			blocks = append(blocks, blk)
+		}
+		sort.Slice(blocks, func(i, j int) bool {
+			a, b := blocks[i].Pos, blocks[j].Pos
+			return a.Line < b.Line || a.Line == b.Line && a.Offset < b.Offset
+		})
+		f.depth++
+		for _, blk := range blocks {
+			f.buf.WriteString("\n")
+			f.node(blk)
+		}
+		f.depth--
+		f.buf.WriteString("\n")
+		f.tag("endembed")
+	case *IncludeNode:
+		f.tag("include " + f.include(n))
+	case *UseNode:
+		s := "use " + f.expr(n.Tpl)
+		var aliases []string
+		for orig, alias := range n.Aliases {
+			aliases = append(aliases, orig+" as "+alias)
+		}
+		if len(aliases) > 0 {
+			sort.Strings(aliases)
+			s += " with " + strings.Join(aliases, ", ")
+		}
+		f.tag(s)
+	case *SetNode:
+		switch x := n.X.(type) {
+		case *BodyNode:
+			f.tag("set " + n.Name)
+			f.nested(x)
+			f.tag("endset")
+		case Expr:
+			f.tag("set " + n.Name + " = " + f.expr(x))
+		default:
+			f.fail(n)
+		}
+	case *DoNode:
+		f.tag("do " + f.expr(n.X))
+	case *FilterNode:
+		f.tag("apply " + strings.Join(n.Filters, "|"))
+		f.nested(n.Body)
+		f.tag("endapply")
+	case *MacroNode:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = arg
+			if def, ok := n.Defaults[arg]; ok {
+				args[i] += " = " + f.expr(def)
+			}
+		}
+		f.tag("macro " + n.Name + "(" + strings.Join(args, ", ") + ")")
+		f.nested(n.Body)
+		f.tag("endmacro")
+	case *ImportNode:
+		f.tag("import " + f.expr(n.Tpl) + " as " + n.Alias)
+	case *FromNode:
+		var imports []string
+		for name, alias := range n.Imports {
+			if alias != name {
+				name += " as " + alias
+			}
+			imports = append(imports, name)
+		}
+		sort.Strings(imports)
+		f.tag("from " + f.expr(n.Tpl) + " import " + strings.Join(imports, ", "))
+	default:
+		f.fail(n)
+	}
+}
+
+func (f *formatter) include(n *IncludeNode) string {
+	s := f.expr(n.Tpl)
+	if n.IgnoreMissing {
+		s += " ignore missing"
+	}
+	if n.With != nil {
+		s += " with " + f.expr(n.With)
+	}
+	if n.Only {
+		s += " only"
+	}
+	return s
+}
+
+// expr returns the source of the expression e.
+func (f *formatter) expr(e Expr) string {
+	switch e := e.(type) {
+	case *NameExpr:
+		return e.Name
+	case *NullExpr:
+		return "null"
+	case *BoolExpr:
+		if e.Value {
+			return "true"
+		}
+		return "false"
+	case *NumberExpr:
+		return e.Value
+	case *StringExpr:
+		return quote(e.Text)
+	case *FilterExpr:
+		if len(e.Args) == 0 {
+			return f.fail(e)
+		}
+		s := f.operand(e.Args[0]) + "|" + e.Name
+		if len(e.Args) > 1 {
+			s += "(" + f.exprs(e.Args[1:]) + ")"
+		}
+		return s
+	case *TestExpr:
+		if len(e.Args) > 0 {
+			return e.Name + "(" + f.exprs(e.Args) + ")"
+		}
+		return e.Name
+	case *FuncExpr:
+		return e.Name + "(" + f.exprs(e.Args) + ")"
+	case *BinaryExpr:
+		left, right := f.expr(e.Left), f.expr(e.Right)
+		if f.needsGroup(e.Left, e.Op, false) {
+			left = "(" + left + ")"
+		}
+		if f.needsGroup(e.Right, e.Op, true) {
+			right = "(" + right + ")"
+		}
+		if e.Op == OpBinaryRange {
+			return left + e.Op + right
+		}
+		return left + " " + e.Op + " " + right
+	case *UnaryExpr:
+		if e.Op == OpUnaryNot {
+			return e.Op + " " + f.expr(e.X)
+		}
+		return e.Op + f.expr(e.X)
+	case *GroupExpr:
+		return "(" + f.expr(e.X) + ")"
+	case *GetAttrExpr:
+		s := f.operand(e.Cont)
+		if attr, ok := e.Attr.(*StringExpr); ok && isAttrName(attr.Text) && !endsWithNumber(s) {
+			s += "." + attr.Text
+			if len(e.Args) > 0 {
+				s += "(" + f.exprs(e.Args) + ")"
+			}
+			return s
+		}
+		if len(e.Args) > 0 {
+			return f.fail(e)
+		}
+		return s + "[" + f.expr(e.Attr) + "]"
+	case *TernaryIfExpr:
+		return f.expr(e.Cond) + " ? " + f.expr(e.TrueX) + " : " + f.expr(e.FalseX)
+	case *HashExpr:
+		els := make([]string, len(e.Elements))
+		for i, kv := range e.Elements {
+			els[i] = f.expr(kv.Key) + ": " + f.expr(kv.Value)
+		}
+		return "{" + strings.Join(els, ", ") + "}"
+	case *ArrayExpr:
+		return "[" + f.exprs(e.Elements) + "]"
+	case *NamedArgExpr:
+		return e.Name + "=" + f.expr(e.X)
+	case nil:
+		return ""
+	}
+	return f.fail(e)
+}
+
+func (f *formatter) exprs(es []Expr) string {
+	res := make([]string, len(es))
+	for i, e := range es {
+		res[i] = f.expr(e)
+	}
+	return strings.Join(res, ", ")
+}
+
+// operand returns the source of e, grouped if it is an operation that
+// would otherwise take a following filter or attribute as its own.
+func (f *formatter) operand(e Expr) string {
+	switch e.(type) {
+	case *BinaryExpr, *UnaryExpr, *TernaryIfExpr, *FilterExpr:
+		return "(" + f.expr(e) + ")"
+	}
+	return f.expr(e)
+}
+
+// needsGroup returns true if e, an operand of op, is an operation of lower
+// precedence, such as an interpolated expression within a string.
+func (f *formatter) needsGroup(e Expr, op string, right bool) bool {
+	b, ok := e.(*BinaryExpr)
+	if !ok {
+		return false
+	}
+	inner, ok1 := binaryOperators[b.Op]
+	outer, ok2 := binaryOperators[op]
+	if !ok1 || !ok2 {
+		return false
+	}
+	return inner.precedence < outer.precedence
+}
+
+// comment returns the canonical form of a comment's text.
+func comment(s string) string {
+	if strings.Contains(s, "\n") {
+		return s
+	}
+	if s = strings.TrimSpace(s); s == "" {
+		return " "
+	}
+	return " " + s + " "
+}
+
+// quote returns s as a string literal.
+func quote(s string) string {
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'"
+	}
+	if !strings.Contains(s, `"`) && !strings.Contains(s, delimOpenInterpolate) {
+		return `"` + s + `"`
+	}
+	// The lexer does not support escape sequences.
+	parts := strings.Split(s, "'")
+	for i, p := range parts {
+		parts[i] = quote(p)
+	}
+	return "(" + strings.Join(parts, ` ~ "'" ~ `) + ")"
+}
+
+// isAttrName returns true if s can follow a "." in an attribute access.
+func isAttrName(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := true
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			digits = false
+		}
+	}
+	if !digits && s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	return isName(s)
+}
+
+// endsWithNumber returns true if s ends with a number, which would be
+// combined with a following "." and number.
+func endsWithNumber(s string) bool {
+	i := len(s)
+	for i > 0 && s[i-1] >= '0' && s[i-1] <= '9' {
+		i--
+	}
+	return i < len(s) && (i == 0 || s[i-1] == '.')
+}
+
+// isEmpty returns true if n is nil or an empty BodyNode.
+func isEmpty(n Node) bool {
+	if n == nil {
+		return true
+	}
+	b, ok := n.(*BodyNode)
+	return ok && len(b.Nodes) == 0
+}
@@ -0,0 +1,31 @@
+//go:build go1.18
+// +build go1.18
+
+package parse
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// FuzzParse checks that parsing, formatting, and dumping arbitrary input
+// does not panic. Run it with:
+//
+//	go test ./parse -fuzz FuzzParse
+func FuzzParse(f *testing.F) {
+	for _, test := range parseTests {
+		f.Add(test.input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		tree := NewTree(strings.NewReader(input))
+		if err := tree.Parse(); err != nil {
+			return
+		}
+		// Formatting may fail for valid trees, but must not panic.
+		_ = Format(ioutil.Discard, tree)
+		if err := Dump(ioutil.Discard, tree); err != nil {
+			t.Errorf("unexpected error dumping tree: %s", err)
+		}
+	})
+}
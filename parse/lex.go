@@ -3,9 +3,10 @@ package parse
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"strings"
 	"unicode"
+
+	"github.com/tyler-sommer/stick/internal/bufpool"
 )
 
 // tokenType defines a unique type of token
@@ -106,58 +107,82 @@ const (
 )
 
 // lexer contains the current state of a lexer.
+//
+// The lexer works on demand: each call to nextToken runs state functions
+// until at least one token has been emitted. Token values are slices of the
+// input, so tokenizing does not copy it.
 type lexer struct {
 	start  int // The position of the last emission
 	pos    int // The position of the cursor
+	width  int // The width of the last character read, 0 at the end of input
 	line   int // The current line number
 	offset int // The current character offset on the current line
 	input  string
-	tokens chan token
+	queue  []token // Tokens emitted but not yet returned by nextToken
+	head   int     // The index of the next token in queue
 	state  stateFn
 	mode   mode
 	last   token // The last emitted token
 	parens int   // Number of open parenthesis
+
+	operators *opMatcher // Matches operators
 }
 
-// nextToken returns the next token emitted by the lexer.
+// nextToken returns the next token emitted by the lexer. Once tokenizing
+// has ended, an EOF token is returned, following the last token emitted.
 func (l *lexer) nextToken() token {
-	for v, ok := <-l.tokens; ok; {
-		l.last = v
-		return v
+	for l.head == len(l.queue) {
+		if l.state == nil {
+			if l.last.tokenType != tokenEOF {
+				l.last = token{delimEOF, tokenEOF, l.last.Pos}
+			}
+			return l.last
+		}
+		l.queue, l.head = l.queue[:0], 0
+		l.state = l.state(l)
 	}
-
+	l.last = l.queue[l.head]
+	l.head++
 	return l.last
 }
 
-// tokenize kicks things off.
-func (l *lexer) tokenize() {
-	for l.state = lexData; l.state != nil; {
-		l.state = l.state(l)
-	}
+// newLexer creates a lexer, ready to begin tokenizing input.
+func newLexer(input io.Reader) *lexer {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	buf.ReadFrom(input)
+	return newStringLexer(buf.String())
 }
 
-// newLexer creates a lexer, ready to begin tokenizing.
-func newLexer(input io.Reader) *lexer {
-	// TODO: lexer should use the reader.
-	i, _ := ioutil.ReadAll(input)
-	return &lexer{0, 0, 1, 0, string(i), make(chan token), nil, modeNormal, token{}, 0}
+// newStringLexer creates a lexer, ready to begin tokenizing input.
+func newStringLexer(input string) *lexer {
+	return &lexer{
+		line:      1,
+		input:     input,
+		queue:     make([]token, 0, 8),
+		state:     lexData,
+		mode:      modeNormal,
+		operators: operatorMatcher,
+	}
 }
 
 func (l *lexer) next() (val string) {
 	if l.pos >= len(l.input) {
 		val = delimEOF
-
+		l.width = 0
 	} else {
 		val = l.input[l.pos : l.pos+1]
-
+		l.width = 1
 		l.pos++
 	}
 
 	return
 }
 
+// backup steps back over the last character read. Reaching the end of
+// input is not undone, as no character was read.
 func (l *lexer) backup() {
-	l.pos--
+	l.pos -= l.width
 }
 
 func (l *lexer) peek() string {
@@ -184,17 +209,17 @@ func (l *lexer) emit(t tokenType) {
 		l.offset += len(val)
 	}
 
-	l.tokens <- tok
+	l.queue = append(l.queue, tok)
 	l.start = l.pos
 	if tok.tokenType == tokenEOF {
-		close(l.tokens)
 		l.mode = modeClosed
 	}
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	tok := token{fmt.Sprintf(format, args...), tokenError, Pos{l.line, l.offset}}
-	l.tokens <- tok
+	l.queue = append(l.queue, tok)
+	l.mode = modeClosed
 
 	return nil
 }
@@ -289,13 +314,13 @@ func lexExpression(l *lexer) stateFn {
 // This is implemented this way because Twig supports many alphabetical operators like "in",
 // which require more than just a check of the next character.
 func (l *lexer) tryLexOperator() bool {
-	op := operatorMatcher.FindString(l.input[l.pos:])
+	op := l.operators.FindString(l.input[l.pos:])
 	if op == "" {
 		return false
 	} else if op == "%" {
 		// Ensure this is not a tag close token "%}".
 		// Go's regexp engine does not support negative lookahead.
-		if l.input[l.pos+1:l.pos+2] == "}" {
+		if strings.HasPrefix(l.input[l.pos+1:], "}") {
 			return false
 		}
 	} else if isAlpha(op) {
@@ -307,8 +332,8 @@ func (l *lexer) tryLexOperator() bool {
 			return false
 		}
 	} else if op == delimTrimWhitespace {
-		switch l.input[l.pos+1 : l.pos+3] {
-		case delimClosePrint, delimCloseTag:
+		rest := l.input[l.pos+1:]
+		if strings.HasPrefix(rest, delimClosePrint) || strings.HasPrefix(rest, delimCloseTag) {
 			return false
 		}
 	}
@@ -345,7 +370,7 @@ func lexSpace(l *lexer) stateFn {
 func lexNumber(l *lexer) stateFn {
 	for {
 		str := l.next()
-		if !isNumeric(str) {
+		if str == delimEOF || !isNumeric(str) {
 			l.backup()
 			break
 		}
@@ -359,7 +384,7 @@ func lexNumber(l *lexer) stateFn {
 func lexPunctuation(l *lexer) stateFn {
 	for {
 		str := l.next()
-		if !isPunctuation(str) {
+		if str == delimEOF || !isPunctuation(str) {
 			l.backup()
 			break
 		}
@@ -483,8 +508,8 @@ func lexCommentOpen(l *lexer) stateFn {
 		til = len(l.input[l.start:])
 	}
 	l.pos += til
-	if string(l.input[l.pos-1]) == delimTrimWhitespace {
-		l.backup()
+	if l.pos > l.start && string(l.input[l.pos-1]) == delimTrimWhitespace {
+		l.pos--
 		l.emit(tokenText)
 		l.next()
 	} else {
@@ -551,7 +576,7 @@ func isSpace(str string) bool {
 
 func isName(str string) bool {
 	for _, s := range str {
-		if string(s) != "_" && !unicode.IsLetter(s) && !unicode.IsDigit(s) {
+		if s != '_' && !unicode.IsLetter(s) && !unicode.IsDigit(s) {
 			return false
 		}
 	}
@@ -571,7 +596,7 @@ func isNumeric(str string) bool {
 
 func isPunctuation(str string) bool {
 	for _, s := range str {
-		if !strings.ContainsAny(string(s), ",|?:.=") {
+		if !strings.ContainsRune(",|?:.=", s) {
 			return false
 		}
 	}
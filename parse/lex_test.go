@@ -324,7 +324,6 @@ var lexTests = []lexTest{
 
 func collect(t *lexTest) (tokens []token) {
 	lex := newLexer(bytes.NewReader([]byte(t.input)))
-	go lex.tokenize()
 	for {
 		tok := lex.nextToken()
 		tokens = append(tokens, tok)
@@ -359,3 +358,44 @@ func TestLex(t *testing.T) {
 		}
 	}
 }
+
+const benchTemplate = `{% extends "layout.twig" %}
+{% block content %}
+	<h1>{{ title|upper }}</h1>
+	{# A list of items. #}
+	<ul>
+	{% for item in items if item.visible and not item.hidden %}
+		<li class="{{ (loop.index is odd) ? 'odd' : 'even' }}">{{ item.name ~ " (#{item.count * 2})" }}</li>
+	{% else %}
+		<li>{{ 'None'|trans }}</li>
+	{% endfor %}
+	</ul>
+{% endblock %}
+`
+
+func BenchmarkLex(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lex := newStringLexer(benchTemplate)
+		for tok := lex.nextToken(); tok.tokenType != tokenEOF; tok = lex.nextToken() {
+			if tok.tokenType == tokenError {
+				b.Fatal(tok)
+			}
+		}
+	}
+}
+
+func TestLex_afterError(t *testing.T) {
+	lex := newStringLexer(`{{ "#{ a }}`)
+	var tok token
+	for tok = lex.nextToken(); tok.tokenType != tokenError; tok = lex.nextToken() {
+		if tok.tokenType == tokenEOF {
+			t.Fatalf("expected an error token")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if next := lex.nextToken(); next.tokenType != tokenEOF || next.Pos != tok.Pos {
+			t.Errorf("expected EOF at %s after an error, got %s", tok.Pos, next)
+		}
+	}
+}
@@ -116,11 +116,15 @@ type PrintNode struct {
 	Pos
 	TrimmableNode
 	X Expr // Expression to print.
+
+	// Strategy, if set, is the escaping strategy used for the printed
+	// value instead of the template's, as chosen by contextual escaping.
+	Strategy string
 }
 
 // NewPrintNode returns a PrintNode.
 func NewPrintNode(exp Expr, p Pos) *PrintNode {
-	return &PrintNode{p, TrimmableNode{}, exp}
+	return &PrintNode{p, TrimmableNode{}, exp, ""}
 }
 
 // String returns a string representation of a PrintNode.
@@ -212,11 +216,13 @@ type ForNode struct {
 	X    Expr   // Expression to iterate over.
 	Body Node   // Body of the for loop.
 	Else Node   // Body of the else section if X is empty.
+
+	NoLoop bool // If true, the "loop" variable is not defined.
 }
 
 // NewForNode returns a ForNode.
 func NewForNode(k, v string, expr Expr, body, els Node, p Pos) *ForNode {
-	return &ForNode{p, TrimmableNode{}, k, v, expr, body, els}
+	return &ForNode{p, TrimmableNode{}, k, v, expr, body, els, false}
 }
 
 // String returns a string representation of a ForNode.
@@ -236,11 +242,17 @@ type IncludeNode struct {
 	Tpl  Expr // Expression evaluating to the name of the template to include.
 	With Expr // Explicit list of variables to include in the included template.
 	Only bool // If true, only vars defined in With will be passed.
+
+	// IgnoreMissing is true if nothing should be rendered when the template
+	// does not exist, rather than returning an error.
+	IgnoreMissing bool
+
+	Tree *Tree // The included template, if it was loaded ahead of time.
 }
 
 // NewIncludeNode returns a IncludeNode.
 func NewIncludeNode(tmpl Expr, with Expr, only bool, pos Pos) *IncludeNode {
-	return &IncludeNode{pos, TrimmableNode{}, tmpl, with, only}
+	return &IncludeNode{Pos: pos, Tpl: tmpl, With: with, Only: only}
 }
 
 // String returns a string representation of an IncludeNode.
@@ -390,25 +402,40 @@ func (t *FilterNode) All() []Node {
 type MacroNode struct {
 	Pos
 	TrimmableNode
-	Name   string    // Name of the macro.
-	Args   []string  // Args the macro receives.
-	Body   *BodyNode // Body of the macro.
-	Origin string    // The name where this macro is originally defined.
+	Name     string          // Name of the macro.
+	Args     []string        // Args the macro receives.
+	Defaults map[string]Expr // Default values for args, if any.
+	Body     *BodyNode       // Body of the macro.
+	Origin   string          // The name where this macro is originally defined.
 }
 
 // NewMacroNode returns a MacroNode.
 func NewMacroNode(name string, args []string, body *BodyNode, p Pos) *MacroNode {
-	return &MacroNode{p, TrimmableNode{}, name, args, body, ""}
+	return &MacroNode{p, TrimmableNode{}, name, args, make(map[string]Expr), body, ""}
 }
 
 // String returns a string representation of a MacroNode.
 func (t *MacroNode) String() string {
-	return fmt.Sprintf("Macro %s(%s): %s", t.Name, strings.Join(t.Args, ", "), t.Body)
+	args := make([]string, len(t.Args))
+	for i, name := range t.Args {
+		if def, ok := t.Defaults[name]; ok {
+			args[i] = fmt.Sprintf("%s = %s", name, def)
+		} else {
+			args[i] = name
+		}
+	}
+	return fmt.Sprintf("Macro %s(%s): %s", t.Name, strings.Join(args, ", "), t.Body)
 }
 
 // All returns all the child Nodes in a MacroNode.
 func (t *MacroNode) All() []Node {
-	return []Node{t.Body}
+	res := []Node{}
+	for _, name := range t.Args {
+		if def, ok := t.Defaults[name]; ok {
+			res = append(res, def)
+		}
+	}
+	return append(res, t.Body)
 }
 
 // ImportNode represents importing macros from another template.
@@ -1,24 +1,68 @@
 package parse
 
 import (
-	"regexp"
+	"sort"
 	"strings"
 )
 
 func init() {
-	var ops = make([]string, 0)
-	for op := range binaryOperators {
-		// Because there is overlap between operators (like "*" and "**") we have to
-		// ensure that some ordering is forced.
-		if op != "**" && op != "is not" && op != "//" && op != "not in" && op != ">=" && op != "<=" {
-			ops = append(ops, regexp.QuoteMeta(op))
+	operatorMatcher = newOperatorMatcher(nil)
+}
+
+// An opMatcher matches the operator at the start of the input.
+type opMatcher struct {
+	ops [256][]string // Operators by their first byte, in order of preference.
+}
+
+// FindString returns the operator that s starts with, or an empty string if
+// there is none.
+func (m *opMatcher) FindString(s string) string {
+	if s == "" {
+		return ""
+	}
+	for _, op := range m.ops[s[0]] {
+		if strings.HasPrefix(s, op) {
+			return op
 		}
 	}
+	return ""
+}
+
+// add adds the given operators to m, longest first, so that an operator
+// like "**" is not lexed as "*".
+func (m *opMatcher) add(ops []string) {
+	sort.Slice(ops, func(i, j int) bool {
+		if len(ops[i]) != len(ops[j]) {
+			return len(ops[i]) > len(ops[j])
+		}
+		return ops[i] < ops[j]
+	})
+	for _, op := range ops {
+		m.ops[op[0]] = append(m.ops[op[0]], op)
+	}
+}
+
+// newOperatorMatcher returns an opMatcher matching the built-in operators
+// and the given custom operators.
+func newOperatorMatcher(custom map[string]operator) *opMatcher {
+	m := &opMatcher{}
+	// Custom operators are matched first, so that an operator like "<=>" is
+	// not lexed as the built-in "<=".
+	var extra = make([]string, 0, len(custom))
+	for op := range custom {
+		extra = append(extra, op)
+	}
+	m.add(extra)
 	// Additionally, we add the unary "not" operator since it has no binary counterpart.
-	operatorMatcher = regexp.MustCompile(`^(not in|not|\*\*|is not|//|>=|<=|` + strings.Join(ops, "|") + ")")
+	var ops = []string{OpUnaryNot}
+	for op := range binaryOperators {
+		ops = append(ops, op)
+	}
+	m.add(ops)
+	return m
 }
 
-var operatorMatcher *regexp.Regexp
+var operatorMatcher *opMatcher
 
 type associativity int
 
@@ -117,3 +161,32 @@ var binaryOperators = map[string]operator{
 	OpBinaryIsNot:        {OpBinaryIsNot, 100, opLeftAssoc, false},
 	OpBinaryPower:        {OpBinaryPower, 200, opRightAssoc, false},
 }
+
+// DefineOperator adds a custom binary operator to the Tree. Operators with
+// a higher precedence bind more tightly; for reference, "+" has a precedence
+// of 30 and "*" a precedence of 60.
+//
+// Built-in operators cannot be redefined, and op must not be empty.
+// DefineOperator must be called before the Tree is parsed.
+func (t *Tree) DefineOperator(op string, precedence int, rightAssoc bool) {
+	if _, ok := binaryOperators[op]; ok || op == "" {
+		return
+	}
+	if t.operators == nil {
+		t.operators = make(map[string]operator)
+	}
+	assoc := opLeftAssoc
+	if rightAssoc {
+		assoc = opRightAssoc
+	}
+	t.operators[op] = operator{op, precedence, assoc, false}
+}
+
+// binaryOperator returns the built-in or custom binary operator op.
+func (t *Tree) binaryOperator(op string) (operator, bool) {
+	if o, ok := binaryOperators[op]; ok {
+		return o, true
+	}
+	o, ok := t.operators[op]
+	return o, ok
+}
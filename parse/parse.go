@@ -3,7 +3,6 @@
 package parse // import "github.com/tyler-sommer/stick/parse"
 
 import (
-	"bytes"
 	"io"
 )
 
@@ -21,12 +20,30 @@ type Tree struct {
 	blocks []map[string]*BlockNode // Contains each block available to this template.
 	macros map[string]*MacroNode   // All macros defined on this template.
 
+	operators map[string]operator // Custom binary operators.
+
 	unread []token // Any tokens received by the lexer but not yet read.
 	read   []token // Tokens that have already been read.
+	depth  int     // Current nesting of tags and expressions being parsed.
 
 	Name string // A name identifying this tree; the template name.
 
 	Visitors []NodeVisitor
+
+	Tags map[string]TagParser // Custom tags, by name.
+
+	Deprecations []Deprecation // Uses of deprecated syntax found while parsing.
+}
+
+// A Deprecation describes the use of deprecated syntax in a template.
+type Deprecation struct {
+	Pos
+	Message string // Describes the deprecated syntax and its replacement.
+}
+
+// deprecated records the use of deprecated syntax at the given position.
+func (t *Tree) deprecated(pos Pos, msg string) {
+	t.Deprecations = append(t.Deprecations, Deprecation{pos, msg})
 }
 
 // NewTree creates a new parser Tree, ready for use.
@@ -36,8 +53,13 @@ func NewTree(input io.Reader) *Tree {
 
 // NewNamedTree is an alternative constructor which creates a Tree with a name
 func NewNamedTree(name string, input io.Reader) *Tree {
+	return newTree(name, newLexer(input))
+}
+
+// newTree creates a Tree with the given name, parsing the tokens from lex.
+func newTree(name string, lex *lexer) *Tree {
 	return &Tree{
-		lex: newLexer(input),
+		lex: lex,
 
 		root:   NewModuleNode(name),
 		blocks: []map[string]*BlockNode{make(map[string]*BlockNode)},
@@ -87,6 +109,26 @@ func (t *Tree) enrichError(err error) error {
 	return err
 }
 
+// maxNesting limits the nesting of tags and expressions, bounding the
+// recursion needed to parse and execute a template.
+const maxNesting = 1000
+
+// nest records the start of a nested tag or expression at pos, failing if
+// the nesting is too deep. Each successful call must be followed by a call
+// to unnest.
+func (t *Tree) nest(pos Pos) error {
+	if t.depth >= maxNesting {
+		return newNestingError(pos)
+	}
+	t.depth++
+	return nil
+}
+
+// unnest records the end of a nested tag or expression.
+func (t *Tree) unnest() {
+	t.depth--
+}
+
 // peek returns the next unread token without advancing the internal cursor.
 func (t *Tree) peek() token {
 	tok := t.next()
@@ -119,12 +161,6 @@ func (t *Tree) backup2() {
 	t.backup()
 }
 
-func (t *Tree) backup3() {
-	t.backup()
-	t.backup()
-	t.backup()
-}
-
 // next returns the next unread token and advances the internal cursor by one.
 func (t *Tree) next() token {
 	var tok token
@@ -206,13 +242,15 @@ func (t *Tree) traverse(n Node) {
 
 // Parse parses the given input.
 func Parse(input string) (*Tree, error) {
-	t := NewTree(bytes.NewReader([]byte(input)))
+	t := newTree("", newStringLexer(input))
 	return t, t.Parse()
 }
 
 // Parse begins parsing, returning an error, if any.
 func (t *Tree) Parse() error {
-	go t.lex.tokenize()
+	if len(t.operators) > 0 {
+		t.lex.operators = newOperatorMatcher(t.operators)
+	}
 	for {
 		n, err := t.parse()
 		if err != nil {
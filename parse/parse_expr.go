@@ -17,6 +17,10 @@ func (t *Tree) parseExpr() (Expr, error) {
 // An outer expression is defined as a modification to an inner expression.
 // Examples include attribute accessing, filter application, or binary operations.
 func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
+	if err := t.nest(expr.Start()); err != nil {
+		return nil, err
+	}
+	defer t.unnest()
 	switch nt := t.nextNonSpace(); nt.tokenType {
 	case tokenParensOpen:
 		switch name := expr.(type) {
@@ -118,7 +122,7 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 		}
 
 	case tokenOperator:
-		op, ok := binaryOperators[nt.value]
+		op, ok := t.binaryOperator(nt.value)
 		if !ok {
 			return nil, newUnexpectedTokenError(nt)
 		}
@@ -136,7 +140,7 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 				return nil, err
 			}
 			if v, ok := right.(*BinaryExpr); ok {
-				nxop := binaryOperators[v.Op]
+				nxop, _ := t.binaryOperator(v.Op)
 				if nxop.precedence < op.precedence || (nxop.precedence == op.precedence && op.leftAssoc()) {
 					left := v.Left
 					res := NewBinaryExpr(expr, op.Operator(), left, expr.Start())
@@ -189,6 +193,10 @@ func (t *Tree) parseRightTestOperand(prev *NameExpr) (*TestExpr, error) {
 // parseInnerExpr attempts to parse an inner expression.
 // An inner expression is defined as a cohesive expression, such as a literal.
 func (t *Tree) parseInnerExpr() (Expr, error) {
+	if err := t.nest(t.peekNonSpace().Pos); err != nil {
+		return nil, err
+	}
+	defer t.unnest()
 	switch tok := t.nextNonSpace(); tok.tokenType {
 	case tokenEOF:
 		return nil, newUnexpectedEOFError(tok)
@@ -355,7 +363,7 @@ func (t *Tree) parseFunc(name *NameExpr) (Expr, error) {
 		// do nothing
 
 		default:
-			argexp, err := t.parseExpr()
+			argexp, err := t.parseArg()
 			if err != nil {
 				return nil, err
 			}
@@ -380,3 +388,23 @@ func (t *Tree) parseFunc(name *NameExpr) (Expr, error) {
 		}
 	}
 }
+
+// parseArg parses a single argument in a function call, which may be named.
+//
+//	name = <expr>
+func (t *Tree) parseArg() (Expr, error) {
+	mark := len(t.read)
+	if name := t.nextNonSpace(); name.tokenType == tokenName {
+		if eq := t.nextNonSpace(); eq.tokenType == tokenPunctuation && eq.value == "=" {
+			x, err := t.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return NewNamedArgExpr(name.value, x, name.Pos), nil
+		}
+	}
+	for len(t.read) > mark {
+		t.backup()
+	}
+	return t.parseExpr()
+}
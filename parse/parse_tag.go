@@ -5,9 +5,13 @@ import (
 	"errors"
 )
 
-// A tagParser can parse the body of a tag, returning the resulting Node or an error.
-// TODO: This will be used to implement user-defined tags.
-type tagParser func(t *Tree, start Pos) (Node, error)
+// A TagParser parses a custom tag, returning the resulting Node or an error.
+//
+// The TagParser is called after the tag's name has been read; start is the
+// position of the name. It must consume the rest of the tag, including the
+// closing "%}", using the Tree's exported parsing methods. The resulting
+// Node should be composed of the built-in node types.
+type TagParser func(t *Tree, start Pos) (Node, error)
 
 // parseTag parses the opening of a tag "{%", then delegates to a more specific parser function
 // based on the tag's name.
@@ -16,6 +20,10 @@ func (t *Tree) parseTag() (Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := t.nest(name.Pos); err != nil {
+		return nil, err
+	}
+	defer t.unnest()
 	switch name.value {
 	case "extends":
 		return parseExtends(t, name.Pos)
@@ -36,7 +44,10 @@ func (t *Tree) parseTag() (Node, error) {
 	case "do":
 		return parseDo(t, name.Pos)
 	case "filter":
-		return parseFilter(t, name.Pos)
+		t.deprecated(name.Pos, `The "filter" tag is deprecated, use the "apply" tag instead.`)
+		return parseFilter(t, "filter", name.Pos)
+	case "apply":
+		return parseFilter(t, "apply", name.Pos)
 	case "macro":
 		return parseMacro(t, name.Pos)
 	case "import":
@@ -46,10 +57,42 @@ func (t *Tree) parseTag() (Node, error) {
 	case "verbatim":
 		return parseVerbatim(t, name.Pos)
 	default:
+		if p, ok := t.Tags[name.value]; ok {
+			return p(t, name.Pos)
+		}
 		return nil, newUnexpectedTokenError(name)
 	}
 }
 
+// ParseExpr parses an expression. It is intended for use by TagParsers.
+func (t *Tree) ParseExpr() (Expr, error) {
+	return t.parseExpr()
+}
+
+// ExpectName reads a name, such as a variable name, returning an error if
+// the next token is not a name. It is intended for use by TagParsers.
+func (t *Tree) ExpectName() (string, error) {
+	tok, err := t.expect(tokenName)
+	if err != nil {
+		return "", err
+	}
+	return tok.value, nil
+}
+
+// ExpectTagClose reads the end of a tag, "%}", returning an error if the
+// next token is not a tag close. It is intended for use by TagParsers.
+func (t *Tree) ExpectTagClose() error {
+	_, err := t.expect(tokenTagClose)
+	return err
+}
+
+// ParseUntilEndTag parses a tag's body until it reaches "end" followed by
+// the tag's name, such as "{% endspaceless %}". It is intended for use by
+// TagParsers.
+func (t *Tree) ParseUntilEndTag(name string, start Pos) (*BodyNode, error) {
+	return t.parseUntilEndTag(name, start)
+}
+
 // parseUntilEndTag parses until it reaches the specified tag's "end", returning a specific error otherwise.
 func (t *Tree) parseUntilEndTag(name string, start Pos) (*BodyNode, error) {
 	tok := t.peek()
@@ -86,6 +129,7 @@ func (t *Tree) parseUntilTag(start Pos, names ...string) (*BodyNode, error) {
 			return n, newUnexpectedEOFError(tok)
 
 		case tokenTagOpen:
+			mark := len(t.read)
 			t.next()
 			tok, err := t.expect(tokenName)
 			if err != nil {
@@ -94,7 +138,11 @@ func (t *Tree) parseUntilTag(start Pos, names ...string) (*BodyNode, error) {
 			if contains(names, tok.value) {
 				return n, nil
 			}
-			t.backup3()
+			// Unread the tag's opening, including any whitespace before
+			// its name.
+			for len(t.read) > mark {
+				t.backup()
+			}
 			o, err := t.parse()
 			if err != nil {
 				return n, err
@@ -286,6 +334,7 @@ func parseFor(t *Tree, start Pos) (*ForNode, error) {
 		if tok.value != "if" {
 			return nil, errors.New("parse error: a parse error occured")
 		}
+		t.deprecated(tok.Pos, `Using an "if" condition on a "for" tag is deprecated, use an "if" tag inside the loop instead.`)
 		ifCond, err = t.parseExpr()
 		if err != nil {
 			return nil, err
@@ -325,16 +374,18 @@ func parseFor(t *Tree, start Pos) (*ForNode, error) {
 
 // parseInclude parses an include statement.
 func parseInclude(t *Tree, start Pos) (Node, error) {
-	expr, with, only, err := parseIncludeOrEmbed(t)
+	expr, ignoreMissing, with, only, err := parseIncludeOrEmbed(t)
 	if err != nil {
 		return nil, err
 	}
-	return NewIncludeNode(expr, with, only, start), nil
+	n := NewIncludeNode(expr, with, only, start)
+	n.IgnoreMissing = ignoreMissing
+	return n, nil
 }
 
 // parseEmbed parses an embed statement and body.
 func parseEmbed(t *Tree, start Pos) (Node, error) {
-	expr, with, only, err := parseIncludeOrEmbed(t)
+	expr, ignoreMissing, with, only, err := parseIncludeOrEmbed(t)
 	if err != nil {
 		return nil, err
 	}
@@ -343,6 +394,8 @@ func parseEmbed(t *Tree, start Pos) (Node, error) {
 		tok := t.nextNonSpace()
 		if tok.tokenType == tokenEOF {
 			return nil, newUnclosedTagError("embed", start)
+		} else if tok.tokenType == tokenError {
+			return nil, newUnexpectedTokenError(tok)
 		} else if tok.tokenType == tokenTagOpen {
 			tok, err := t.expect(tokenName)
 			if err != nil {
@@ -356,7 +409,7 @@ func parseEmbed(t *Tree, start Pos) (Node, error) {
 				}
 				break
 			} else if tok.value == "block" {
-				n, err := parseBlock(t, start)
+				n, err := parseBlock(t, tok.Pos)
 				if err != nil {
 					return nil, err
 				}
@@ -369,21 +422,30 @@ func parseEmbed(t *Tree, start Pos) (Node, error) {
 		}
 	}
 	blockRefs := t.popBlockStack()
-	return NewEmbedNode(expr, with, only, blockRefs, start), nil
+	n := NewEmbedNode(expr, with, only, blockRefs, start)
+	n.IgnoreMissing = ignoreMissing
+	return n, nil
 }
 
 // parseIncludeOrEmbed parses an include or embed tag's parameters.
-// TODO: Implement "ignore missing" support
 //
 //	{% include <expr> %}
+//	{% include <expr> ignore missing %}
 //	{% include <expr> with <expr> %}
 //	{% include <expr> with <expr> only %}
 //	{% include <expr> only %}
-func parseIncludeOrEmbed(t *Tree) (expr Expr, with Expr, only bool, err error) {
+func parseIncludeOrEmbed(t *Tree) (expr Expr, ignoreMissing bool, with Expr, only bool, err error) {
 	expr, err = t.parseExpr()
 	if err != nil {
 		return
 	}
+	if tok := t.peekNonSpace(); tok.tokenType == tokenName && tok.value == "ignore" {
+		t.nextNonSpace()
+		if _, err = t.expectValue(tokenName, "missing"); err != nil {
+			return
+		}
+		ignoreMissing = true
+	}
 	only = false
 	switch tok := t.peekNonSpace(); tok.tokenType {
 	case tokenEOF:
@@ -397,7 +459,7 @@ func parseIncludeOrEmbed(t *Tree) (expr Expr, with Expr, only bool, err error) {
 				return
 			}
 			only = true
-			return expr, with, only, nil
+			return expr, ignoreMissing, with, only, nil
 		} else if tok.value != "with" {
 			err = newUnexpectedTokenError(tok)
 			return
@@ -526,14 +588,14 @@ func parseDo(t *Tree, start Pos) (Node, error) {
 	return NewDoNode(expr, start), nil
 }
 
-// parseFilter parses a filter statement.
+// parseFilter parses an apply statement, or the deprecated filter statement.
 //
-//	{% filter <name> %}
+//	{% apply <name> %}
 //
 // Multiple filters can be applied to a block:
 //
-//	{% filter <name>|<name>|<name> %}
-func parseFilter(t *Tree, start Pos) (Node, error) {
+//	{% apply <name>|<name>|<name> %}
+func parseFilter(t *Tree, tag string, start Pos) (Node, error) {
 	var filters []string
 	for {
 		tok, err := t.expect(tokenName)
@@ -556,7 +618,7 @@ func parseFilter(t *Tree, start Pos) (Node, error) {
 		}
 	}
 body:
-	body, err := t.parseUntilEndTag("filter", start)
+	body, err := t.parseUntilEndTag(tag, start)
 	if err != nil {
 		return nil, err
 	}
@@ -579,6 +641,7 @@ func parseMacro(t *Tree, start Pos) (Node, error) {
 		return nil, err
 	}
 	var args []string
+	defaults := make(map[string]Expr)
 	for {
 		tok = t.nextNonSpace()
 		switch tok.tokenType {
@@ -587,6 +650,15 @@ func parseMacro(t *Tree, start Pos) (Node, error) {
 		case tokenName:
 			args = append(args, tok.value)
 		case tokenPunctuation:
+			if tok.value == "=" && len(args) > 0 {
+				// Default value for the previous argument.
+				def, err := t.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				defaults[args[len(args)-1]] = def
+				continue
+			}
 			if tok.value != "," {
 				return nil, newUnexpectedValueError(tok, ",")
 			}
@@ -606,6 +678,7 @@ body:
 		return nil, err
 	}
 	n := NewMacroNode(name, args, body, start)
+	n.Defaults = defaults
 	n.Origin = t.Name
 	t.macros[name] = n
 	return n, nil
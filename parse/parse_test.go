@@ -1,6 +1,7 @@
 package parse
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -208,6 +209,11 @@ var parseTests = []parseTest{
 		"{% include '::_subnav.html.twig' only %}",
 		mkModule(NewIncludeNode(NewStringExpr("::_subnav.html.twig", noPos), nil, true, noPos)),
 	),
+	newParseTest(
+		"include ignore missing",
+		"{% include ['a.twig', 'b.twig'] ignore missing with var only %}",
+		mkModule(&IncludeNode{Tpl: NewArrayExpr(noPos, NewStringExpr("a.twig", noPos), NewStringExpr("b.twig", noPos)), With: NewNameExpr("var", noPos), Only: true, IgnoreMissing: true}),
+	),
 	newParseTest(
 		"embed",
 		"{% embed '::_modal.html.twig' %}{% block title %}Hello{% endblock %}{% endembed  %}",
@@ -278,6 +284,11 @@ var parseTests = []parseTest{
 		"{% filter upper|escape %}Some text{% endfilter %}",
 		mkModule(NewFilterNode([]string{"upper", "escape"}, NewBodyNode(noPos, NewTextNode("Some text", noPos)), noPos)),
 	),
+	newParseTest(
+		"apply statement",
+		"{% apply upper|escape %}Some text{% endapply %}",
+		mkModule(NewFilterNode([]string{"upper", "escape"}, NewBodyNode(noPos, NewTextNode("Some text", noPos)), noPos)),
+	),
 	newParseTest(
 		"simple macro",
 		"{% macro thing(var1, var2) %}Hello{% endmacro %}",
@@ -288,6 +299,25 @@ var parseTests = []parseTest{
 		"{% macro thing(var2) %}Hello{% endmacro %}",
 		mkModule(NewMacroNode("thing", []string{"var2"}, NewBodyNode(noPos, NewTextNode("Hello", noPos)), noPos)),
 	),
+	newParseTest(
+		"macro with defaults",
+		"{% macro thing(var1, var2 = 'a', var3 = 1 + 2) %}Hello{% endmacro %}",
+		mkModule(func() Node {
+			n := NewMacroNode("thing", []string{"var1", "var2", "var3"}, NewBodyNode(noPos, NewTextNode("Hello", noPos)), noPos)
+			n.Defaults["var2"] = NewStringExpr("a", noPos)
+			n.Defaults["var3"] = NewBinaryExpr(NewNumberExpr("1", noPos), OpBinaryAdd, NewNumberExpr("2", noPos), noPos)
+			return n
+		}()),
+	),
+	newParseTest(
+		"named arguments",
+		"{{ func(1, name = 'a', other=b) }}",
+		mkModule(NewPrintNode(NewFuncExpr("func", []Expr{
+			NewNumberExpr("1", noPos),
+			NewNamedArgExpr("name", NewStringExpr("a", noPos), noPos),
+			NewNamedArgExpr("other", NewNameExpr("b", noPos), noPos),
+		}, noPos), noPos)),
+	),
 	newParseTest(
 		"import statement",
 		"{% import '::macros.html.twig' as mac %}",
@@ -400,3 +430,255 @@ func TestParse(t *testing.T) {
 		evaluateTest(t, test)
 	}
 }
+
+func TestParseMalformed(t *testing.T) {
+	tests := map[string]string{
+		"{%":                            `expected "NAME"`,
+		"{{ ":                           "unexpected end of input",
+		"{%=":                           `expected "NAME"`,
+		"{#-":                           `expected "COMMENT_CLOSE"`,
+		"{% macro m() %}x{%endmacro %}": "",
+		"{% macro m() %}x{%endx %}":     `unexpected token "NAME"`,
+		"{% embed 'a' %}{{ 'x }}":       `unexpected token "ERROR"`,
+		"{{ " + strings.Repeat("(", 2000) + "1" + strings.Repeat(")", 2000) + " }}": "nesting exceeds limit of 1000",
+		strings.Repeat("{% if x %}", 2000):                                          "nesting exceeds limit of 1000",
+	}
+	for input, expected := range tests {
+		_, err := Parse(input)
+		switch {
+		case expected == "" && err != nil:
+			t.Errorf("%.40q: unexpected error: %s", input, err)
+		case expected != "" && (err == nil || !strings.Contains(err.Error(), expected)):
+			t.Errorf("%.40q: expected error containing %q, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestParseDeprecations(t *testing.T) {
+	tests := map[string][]string{
+		"{% apply upper %}text{% endapply %}":                          nil,
+		"{% filter upper %}text{% endfilter %}":                        {`The "filter" tag is deprecated, use the "apply" tag instead.`},
+		"{% for i in items if i %}{{ i }}{% endfor %}":                 {`Using an "if" condition on a "for" tag is deprecated, use an "if" tag inside the loop instead.`},
+		"{% for i in items %}{% if i %}{{ i }}{% endif %}{% endfor %}": nil,
+	}
+	for input, expected := range tests {
+		tree, err := Parse(input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", input, err)
+			continue
+		}
+		if len(tree.Deprecations) != len(expected) {
+			t.Errorf("%s: expected %d deprecations, got %d", input, len(expected), len(tree.Deprecations))
+			continue
+		}
+		for i, d := range tree.Deprecations {
+			if d.Message != expected[i] {
+				t.Errorf("%s: expected %q, got %q", input, expected[i], d.Message)
+			}
+			if d.Line != 1 {
+				t.Errorf("%s: expected deprecation on line 1, got %d", input, d.Line)
+			}
+		}
+	}
+}
+
+func TestTreeMarshalBinary(t *testing.T) {
+	inputs := []string{
+		"{% extends 'base' %}{% block a %}{% block b %}{{ x|upper }}{% endblock %}{% endblock %}",
+		"{% macro m(a, b = 1) %}{{ a ~ b }}{% endmacro %}{% for k, v in items if v %}{{ m(v, k) }}{% else %}none{% endfor %}",
+		"{% embed 'card' with {'a': [1, 2]} only %}{% block body %}{{ a ? a.b(1) : not c }}{% endblock %}{% endembed %}",
+		"{% set x %}{% if a is defined %}{{ a }}{% elseif b %}{% filter upper %}b{% endfilter %}{% endif %}{% endset %}",
+	}
+	for _, input := range inputs {
+		tree, err := Parse(input)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", input, err)
+		}
+		data, err := tree.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", input, err)
+		}
+		decoded := &Tree{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: unexpected error: %s", input, err)
+		}
+		if !nodeEqual(decoded.Root(), tree.Root()) {
+			t.Errorf("%s: expected\n\t%s\ngot\n\t%s", input, tree.Root(), decoded.Root())
+		}
+		if len(decoded.Deprecations) != len(tree.Deprecations) {
+			t.Errorf("%s: expected %d deprecations, got %d", input, len(tree.Deprecations), len(decoded.Deprecations))
+		}
+		for name := range tree.Blocks() {
+			if decoded.Blocks()[name] == nil {
+				t.Errorf("%s: expected block %q", input, name)
+			}
+		}
+		for name := range tree.Macros() {
+			if decoded.Macros()[name] == nil {
+				t.Errorf("%s: expected macro %q", input, name)
+			}
+		}
+	}
+}
+
+func TestTreeMarshalBinaryInlined(t *testing.T) {
+	tree, err := Parse("{% include 'item' %}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	item, err := Parse("{% block b %}item{% endblock %}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tree.Root().Nodes[0].(*IncludeNode).Tree = item
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	decoded := &Tree{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	inlined := decoded.Root().Nodes[0].(*IncludeNode).Tree
+	if inlined == nil || !nodeEqual(inlined.Root(), item.Root()) || inlined.Blocks()["b"] == nil {
+		t.Errorf("expected inlined tree %s, got %v", item.Root(), inlined)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"{{name}}{{  a+b*c  }}{{ \"it\" }}", "{{ name }}{{ a + b * c }}{{ 'it' }}"},
+		{`{{ "it's" }}{{ 'say "hi"' }}`, `{{ "it's" }}{{ 'say "hi"' }}`},
+		{"{{ items|join(',')|upper }}", ""},
+		{"{{ (items|join(','))|upper }}", "{{ (items|join(','))|upper }}"},
+		{"{{ a.b.c(1,2)[d]['e'].0 }}{{ x[0] }}", "{{ a.b.c(1, 2)[d].e.0 }}{{ x[0] }}"},
+		{"{{ {a:1,'b':[1,2]} }}{{ 1..5 }}{{ x ? y : z }}{{ not a and b }}{{ -x }}", "{{ {a: 1, 'b': [1, 2]} }}{{ 1..5 }}{{ x ? y : z }}{{ not a and b }}{{ -x }}"},
+		{"{{ x is divisible by(3) }}{{ x is not defined }}{{ f(a, b=2) }}", "{{ x is divisible by(3) }}{{ x is not defined }}{{ f(a, b=2) }}"},
+		{"{{ \"a #{x + 1} b\" }}", "{{ 'a ' ~ (x + 1) ~ ' b' }}"},
+		{"{#comment#}{#  #}{# a\n  b #}", "{# comment #}{# #}{# a\n  b #}"},
+		{"{%if a%}1{%elseif b%}2{%else%}3{%endif%}", "{% if a %}1{% elseif b %}2{% else %}3{% endif %}"},
+		{"{% filter upper|lower %}x{% endfilter %}", "{% apply upper|lower %}x{% endapply %}"},
+		{"{% for k,v in items if v %}{{v}}{%else%}none{%endfor%}", "{% for k, v in items if v %}{{ v }}{% else %}none{% endfor %}"},
+		{"{% set a = 1 %}{% set b %}x{% endset %}{% do f() %}", "{% set a = 1 %}{% set b %}x{% endset %}{% do f() %}"},
+		{"{% macro m(a,b=1) %}{% endmacro %}{% import 'f' as f %}{% from 'f' import z as y, a %}", "{% macro m(a, b = 1) %}{% endmacro %}{% import 'f' as f %}{% from 'f' import a, z as y %}"},
+		{"{% use 'b' with x as y %}{% include 'a' with {x: 1} only %}", "{% use 'b' with x as y %}{% include 'a' with {x: 1} only %}"},
+		{"{% include ['a','b']  ignore  missing only %}", "{% include ['a', 'b'] ignore missing only %}"},
+		{"{% embed 'card' %}{% block b %}B{% endblock %}{% block a %}A{% endblock %}{% endembed %}", "{% embed 'card' %}\n    {% block b %}B{% endblock %}\n    {% block a %}A{% endblock %}\n{% endembed %}"},
+		{"{% verbatim %}{{ x }}{% endverbatim %}", "{% verbatim %}{{ x }}{% endverbatim %}"},
+		{
+			"<ul>\n{% for i in items %}\n  {% if i %}\n<li>{{ i }}</li>\n      {% endif %}\n{% endfor %}\n</ul>\n",
+			"<ul>\n{% for i in items %}\n    {% if i %}\n<li>{{ i }}</li>\n    {% endif %}\n{% endfor %}\n</ul>\n",
+		},
+		{"{% extends 'base' %}\n  {% block a %}\n{# c #}\n{% block b %}{% endblock %}\n{% endblock %}", "{% extends 'base' %}\n{% block a %}\n    {# c #}\n    {% block b %}{% endblock %}\n{% endblock %}"},
+	}
+	for _, test := range tests {
+		tree, err := Parse(test.input)
+		if err != nil {
+			if test.expected != "" {
+				t.Errorf("%s: unexpected error: %s", test.input, err)
+			}
+			continue
+		}
+		var buf bytes.Buffer
+		if err := Format(&buf, tree); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.input, err)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%s: expected\n\t%q\ngot\n\t%q", test.input, test.expected, buf.String())
+		}
+		reparsed, err := Parse(buf.String())
+		if err != nil {
+			t.Errorf("%s: unable to parse formatted source: %s", test.input, err)
+			continue
+		}
+		var again bytes.Buffer
+		if err := Format(&again, reparsed); err != nil || again.String() != buf.String() {
+			t.Errorf("%s: expected formatting to be stable, got %q", test.input, again.String())
+		}
+	}
+}
+
+func TestFormatQuotes(t *testing.T) {
+	tree, err := Parse("{{ x }}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tree.Root().Nodes[0].(*PrintNode).X = NewStringExpr(`it's "x"`, Pos{1, 3})
+	var buf bytes.Buffer
+	if err := Format(&buf, tree); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `{{ ('it' ~ "'" ~ 's "x"') }}`
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestFormatParseTests(t *testing.T) {
+	for _, test := range parseTests {
+		tree, err := Parse(test.input)
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := Format(&buf, tree); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		reparsed, err := Parse(buf.String())
+		if err != nil {
+			t.Errorf("%s: unable to parse formatted source %q: %s", test.name, buf.String(), err)
+			continue
+		}
+		if test.name == "string interpolation" {
+			// Interpolated strings are written as concatenations, which
+			// the parser groups differently.
+			continue
+		}
+		if !nodeEqual(reparsed.Root(), tree.Root()) {
+			t.Errorf("%s: formatted as %q\nexpected\n\t%s\ngot\n\t%s", test.name, buf.String(), tree.Root(), reparsed.Root())
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	tree, err := Parse("{% for k, v in items %}{{ v.name|upper ~ 'x' }}{% endfor %}{% use 'u' with a as b %}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := Dump(&buf, tree); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `ModuleNode 1:0 Origin=""
+  Nodes[0]: ForNode 1:3 Key="k" Val="v" NoLoop=false
+    X: NameExpr 1:15 Name="items"
+    Body: BodyNode 1:21
+      Nodes[0]: PrintNode 1:23
+        X: BinaryExpr 1:33 Op="~"
+          Left: FilterExpr 1:32 Name="upper"
+            Args[0]: GetAttrExpr 1:27
+              Cont: NameExpr 1:26 Name="v"
+              Attr: StringExpr 1:28 Text="name"
+          Right: StringExpr 1:42 Text="x"
+    Else: BodyNode 1:50
+  Nodes[1]: UseNode 1:62 Aliases={a: b}
+    Tpl: StringExpr 1:67 Text="u"
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(benchTemplate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
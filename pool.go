@@ -0,0 +1,103 @@
+package stick
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/tyler-sommer/stick/internal/bufpool"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+var statePool = sync.Pool{
+	New: func() interface{} {
+		return &state{
+			meta: &metadata{make(map[string]string)},
+
+			macros:      make(map[string]*parse.MacroNode),
+			localMacros: make(map[string]*parse.MacroNode),
+
+			scope: &scopeStack{},
+		}
+	},
+}
+
+// newState returns a template execution state, ready for use.
+//
+// The state should be released when execution completes.
+func newState(c context.Context, name string, out io.Writer, ctx map[string]Value, env *Env) *state {
+	s := statePool.Get().(*state)
+	s.out = out
+	s.name = name
+	s.env = env
+	s.scope.globals = env.Globals
+	s.scope.scopes = append(s.scope.scopes, ctx)
+	s.context = c
+	s.iterations = new(int)
+	s.depth = new(int)
+	return s
+}
+
+// release resets the state and returns it to the pool. The state must not
+// be used after it is released.
+func (s *state) release() {
+	for k := range s.meta.attr {
+		delete(s.meta.attr, k)
+	}
+	for k := range s.macros {
+		delete(s.macros, k)
+	}
+	for k := range s.localMacros {
+		delete(s.localMacros, k)
+	}
+	for i := range s.blocks {
+		s.blocks[i] = nil
+	}
+	for i := range s.scope.scopes {
+		s.scope.scopes[i] = nil
+	}
+	s.scope.globals = nil
+	s.scope.scopes = s.scope.scopes[:0]
+	*s = state{
+		meta:        s.meta,
+		blocks:      s.blocks[:0],
+		macros:      s.macros,
+		localMacros: s.localMacros,
+		scope:       s.scope,
+		frames:      s.frames[:0],
+		stack:       s.stack[:0],
+	}
+	statePool.Put(s)
+}
+
+// capture calls fn with the state's output redirected to a pooled buffer,
+// returning what was written. The previous output is restored afterwards.
+// Captured output counts toward the Env's MaxOutputBytes, since it is held
+// in memory.
+func (s *state) capture(fn func() error) (string, error) {
+	defer func(out io.Writer) {
+		s.out = out
+	}(s.out)
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	s.out = buf
+	if s.written != nil {
+		s.out = &limitWriter{w: buf, limit: s.env.MaxOutputBytes, n: s.written}
+	}
+	if err := fn(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// captureMarkup executes body, returning its output as markup that is not
+// escaped again when printed.
+func (s *state) captureMarkup(body parse.Node) (Value, error) {
+	res, err := s.capture(func() error {
+		return s.walk(body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMarkup(res), nil
+}
@@ -0,0 +1,161 @@
+// Package profiler provides a Stick extension that records how long
+// templates, blocks, macros, and includes take to execute.
+//
+// Register a Profiler with an Env, execute some templates, and then write
+// a report:
+//
+//	p := profiler.New()
+//	env.Register(p)
+//	env.Execute("index.html.twig", w, nil)
+//	p.WriteText(os.Stderr)
+package profiler // import "github.com/tyler-sommer/stick/profiler"
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// Kinds of profiles recorded by a Profiler, in the order they are reported.
+const (
+	KindTemplate = "template"
+	KindBlock    = "block"
+	KindMacro    = "macro"
+	KindInclude  = "include"
+)
+
+var kindOrder = map[string]int{
+	KindTemplate: 0,
+	KindBlock:    1,
+	KindMacro:    2,
+	KindInclude:  3,
+}
+
+// A Profile contains the timing information for a single template, block,
+// macro, or include.
+type Profile struct {
+	Kind     string        // One of KindTemplate, KindBlock, KindMacro, or KindInclude.
+	Name     string        // The name of the template, block, macro, or included template.
+	Count    int           // The number of times it was executed.
+	Duration time.Duration // The total time spent executing it, including anything it executed.
+}
+
+// A Profiler records timing information about template execution.
+//
+// A Profiler is safe for concurrent use.
+type Profiler struct {
+	mu       sync.Mutex
+	profiles map[[2]string]*Profile
+}
+
+// New returns a new, empty Profiler.
+func New() *Profiler {
+	return &Profiler{profiles: make(map[[2]string]*Profile)}
+}
+
+// Init registers the Profiler as the Env's Instrumentation, replacing any
+// existing Instrumentation.
+func (p *Profiler) Init(env *stick.Env) error {
+	env.Instrumentation = p
+	return nil
+}
+
+// BeforeNode satisfies the stick.Instrumentation interface.
+func (p *Profiler) BeforeNode(ctx stick.Context, node parse.Node) {}
+
+// AfterNode records the time taken to execute templates, blocks, macros,
+// and includes.
+func (p *Profiler) AfterNode(ctx stick.Context, node parse.Node, elapsed time.Duration, err error) {
+	var kind, name string
+	switch node := node.(type) {
+	case *parse.ModuleNode:
+		kind, name = KindTemplate, node.Origin
+		if name == "" {
+			name = ctx.Name()
+		}
+	case *parse.BlockNode:
+		kind, name = KindBlock, node.Name
+	case *parse.MacroNode:
+		kind, name = KindMacro, node.Name
+	case *parse.EmbedNode:
+		kind, name = KindInclude, templateName(node.Tpl)
+	case *parse.IncludeNode:
+		kind, name = KindInclude, templateName(node.Tpl)
+	default:
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k := [2]string{kind, name}
+	pr, ok := p.profiles[k]
+	if !ok {
+		pr = &Profile{Kind: kind, Name: name}
+		p.profiles[k] = pr
+	}
+	pr.Count++
+	pr.Duration += elapsed
+}
+
+// Profiles returns the recorded profiles, ordered by kind and then by name.
+func (p *Profiler) Profiles() []Profile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]Profile, 0, len(p.profiles))
+	for _, pr := range p.profiles {
+		res = append(res, *pr)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return kindOrder[res[i].Kind] < kindOrder[res[j].Kind]
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Reset discards all recorded profiles.
+func (p *Profiler) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles = make(map[[2]string]*Profile)
+}
+
+// WriteText writes a plain text report of the recorded profiles to w.
+func (p *Profiler) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tCOUNT\tDURATION")
+	for _, pr := range p.Profiles() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", pr.Kind, pr.Name, pr.Count, pr.Duration)
+	}
+	return tw.Flush()
+}
+
+// WriteHTML writes an HTML table containing the recorded profiles to w.
+func (p *Profiler) WriteHTML(w io.Writer) error {
+	if _, err := io.WriteString(w, "<table class=\"stick-profile\">\n<tr><th>Kind</th><th>Name</th><th>Count</th><th>Duration</th></tr>\n"); err != nil {
+		return err
+	}
+	for _, pr := range p.Profiles() {
+		_, err := fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%d</td><td>%s</td></tr>\n", pr.Kind, html.EscapeString(pr.Name), pr.Count, pr.Duration)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "</table>\n")
+	return err
+}
+
+// templateName returns the name of the template referenced by tpl.
+func templateName(tpl parse.Expr) string {
+	if s, ok := tpl.(*parse.StringExpr); ok {
+		return s.Text
+	}
+	return tpl.String()
+}
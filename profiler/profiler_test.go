@@ -0,0 +1,65 @@
+package profiler_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/profiler"
+)
+
+func TestProfiler(t *testing.T) {
+	env := stick.New(&stick.MemoryLoader{Templates: map[string]string{
+		"layout.twig": "{% block content %}{% endblock %}{% include 'footer.twig' %}",
+		"page.twig":   "{% extends 'layout.twig' %}{% block content %}{% import 'macros.twig' as m %}{% for i in 1..3 %}{{ m.item(i) }}{% endfor %}{% endblock %}",
+		"macros.twig": "{% macro item(i) %}{{ i }}{% endmacro %}",
+		"footer.twig": "<footer>",
+	}})
+	p := profiler.New()
+	if err := env.Register(p); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := env.Execute("page.twig", ioutil.Discard, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	var actual []string
+	for _, pr := range p.Profiles() {
+		actual = append(actual, fmt.Sprintf("%s %s %d", pr.Kind, pr.Name, pr.Count))
+	}
+	expected := []string{
+		"template footer.twig 2",
+		"template layout.twig 2",
+		"template page.twig 2",
+		"block content 2",
+		"macro item 6",
+		"include footer.twig 2",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := p.WriteText(buf); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 7 || !strings.HasPrefix(lines[5], "macro     item         6") {
+		t.Errorf("unexpected text report:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := p.WriteHTML(buf); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), "<tr><td>macro</td><td>item</td><td>6</td>") {
+		t.Errorf("unexpected HTML report:\n%s", buf.String())
+	}
+
+	p.Reset()
+	if len(p.Profiles()) != 0 {
+		t.Errorf("expected no profiles after reset")
+	}
+}
@@ -0,0 +1,95 @@
+package stick
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A SecurityPolicy restricts which fields and methods templates may access
+// on values in their context.
+//
+// The policy is consulted only for struct values, or pointers to structs.
+// Map keys, slice indexes, and the attributes an AttrProvider resolves
+// itself are always accessible.
+type SecurityPolicy interface {
+	// CheckPropertyAllowed returns an error if the named field of obj may
+	// not be read.
+	CheckPropertyAllowed(obj Value, name string) error
+
+	// CheckMethodAllowed returns an error if the named method of obj may
+	// not be called.
+	CheckMethodAllowed(obj Value, name string) error
+}
+
+// A SecurityError is returned when a template accesses a field or method
+// that is not allowed by the Env's SecurityPolicy. It matches
+// ErrSecurityViolation when using errors.Is.
+type SecurityError struct {
+	Kind string // Either "property" or "method".
+	Type string // The type of the value being accessed.
+	Name string // The name of the field or method.
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("%s \"%s\" of \"%s\" is not allowed", e.Kind, e.Name, e.Type)
+}
+
+// Is returns true if target is ErrSecurityViolation.
+func (e *SecurityError) Is(target error) bool {
+	return target == ErrSecurityViolation
+}
+
+// An AllowListPolicy is a SecurityPolicy that allows access only to the
+// listed fields and methods.
+//
+// Properties and Methods are keyed by type name, as formatted by "%T"
+// without any leading "*", such as "main.User".
+type AllowListPolicy struct {
+	Properties map[string][]string // Readable fields, by type name.
+	Methods    map[string][]string // Callable methods, by type name.
+}
+
+// CheckPropertyAllowed returns a SecurityError if the field is not listed
+// in Properties.
+func (p *AllowListPolicy) CheckPropertyAllowed(obj Value, name string) error {
+	return checkAllowed(p.Properties, "property", obj, name)
+}
+
+// CheckMethodAllowed returns a SecurityError if the method is not listed
+// in Methods.
+func (p *AllowListPolicy) CheckMethodAllowed(obj Value, name string) error {
+	return checkAllowed(p.Methods, "method", obj, name)
+}
+
+func checkAllowed(allowed map[string][]string, kind string, obj Value, name string) error {
+	typ := reflect.Indirect(reflect.ValueOf(obj)).Type().String()
+	for _, n := range allowed[typ] {
+		if n == name {
+			return nil
+		}
+	}
+	return &SecurityError{kind, typ, name}
+}
+
+// checkAttr consults the Env's SecurityPolicy before attr is accessed on v.
+func (env *Env) checkAttr(v Value, attr Value) error {
+	p := env.SecurityPolicy
+	if p == nil {
+		return nil
+	}
+	if _, ok := v.(*OrderedMap); ok {
+		return nil
+	}
+	r := reflect.Indirect(reflect.ValueOf(v))
+	if r.Kind() != reflect.Struct {
+		return nil
+	}
+	name := CoerceString(attr)
+	switch resolveAttr(reflect.TypeOf(v), name).kind {
+	case accessMethod, accessPtrMethod:
+		return p.CheckMethodAllowed(v, name)
+	}
+	// Fields, and attributes that only an AttrResolver provides, are
+	// checked as properties.
+	return p.CheckPropertyAllowed(v, name)
+}
@@ -0,0 +1,103 @@
+package stick
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/tyler-sommer/stick/internal/bufpool"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A SourceMap maps ranges of rendered output to the template source that
+// produced them.
+type SourceMap struct {
+	Mappings []Mapping // Mappings, ordered by output offset.
+}
+
+// A Mapping describes the template source of a range of rendered output.
+type Mapping struct {
+	Start    int64  // The offset of the first byte of output.
+	End      int64  // The offset just past the last byte of output.
+	Template string // The name of the template.
+	Line     int    // The line of the node that produced the output.
+	Column   int    // The column of the node that produced the output.
+}
+
+// Lookup returns the Mapping containing the given output offset.
+func (m *SourceMap) Lookup(offset int64) (Mapping, bool) {
+	i := sort.Search(len(m.Mappings), func(i int) bool {
+		return m.Mappings[i].End > offset
+	})
+	if i < len(m.Mappings) && m.Mappings[i].Start <= offset {
+		return m.Mappings[i], true
+	}
+	return Mapping{}, false
+}
+
+// ExecuteWithSourceMap executes the given template, returning a SourceMap
+// that describes which template and line produced each range of output.
+//
+// Output is attributed to the text, print, or apply/filter statement that
+// wrote it. Output of macros, captured set statements, and the block and
+// parent functions is attributed to the statement that printed it.
+//
+// The Env's OutputFilter is not applied, since the SourceMap describes
+// the output as the template wrote it. The Env's output middleware is
+// applied, and offsets are those of the output before it reaches the
+// middleware.
+func (env *Env) ExecuteWithSourceMap(tpl string, out io.Writer, ctx map[string]Value) (*SourceMap, error) {
+	w := &sourceMapWriter{m: &SourceMap{}}
+	err := env.render(out, func(out io.Writer) error {
+		if !env.AtomicOutput {
+			w.w = out
+			return executeSourceMapped(context.Background(), tpl, w, ctx, env)
+		}
+		buf := bufpool.Get()
+		defer bufpool.Put(buf)
+		w.w = buf
+		if err := executeSourceMapped(context.Background(), tpl, w, ctx, env); err != nil {
+			return err
+		}
+		_, err := buf.WriteTo(out)
+		return err
+	})
+	return w.m, err
+}
+
+// executeSourceMapped executes the named template, recording output
+// offsets using w.
+func executeSourceMapped(c context.Context, name string, w *sourceMapWriter, ctx map[string]Value, env *Env) error {
+	s := newRootState(c, name, w.w, ctx, env)
+	defer s.release()
+	w.w = s.out
+	s.out = w
+	return s.executeRoot()
+}
+
+// sourceMapWriter writes to w, recording the source of each write in m.
+type sourceMapWriter struct {
+	w io.Writer
+	m *SourceMap
+	n int64
+
+	template string    // The template currently writing.
+	pos      parse.Pos // The position of the node currently writing.
+}
+
+func (s *sourceMapWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if n > 0 {
+		start := s.n
+		s.n += int64(n)
+		if l := len(s.m.Mappings); l > 0 {
+			last := &s.m.Mappings[l-1]
+			if last.End == start && last.Template == s.template && last.Line == s.pos.Line && last.Column == s.pos.Offset {
+				last.End = s.n
+				return n, err
+			}
+		}
+		s.m.Mappings = append(s.m.Mappings, Mapping{start, s.n, s.template, s.pos.Line, s.pos.Offset})
+	}
+	return n, err
+}
@@ -1,9 +1,13 @@
 package stick // import "github.com/tyler-sommer/stick"
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"reflect"
+	"time"
 
+	"github.com/tyler-sommer/stick/internal/bufpool"
 	"github.com/tyler-sommer/stick/parse"
 )
 
@@ -19,11 +23,40 @@ type Template interface {
 // A Func represents a user-defined function.
 // Functions can be called anywhere expressions are allowed and
 // take any number of arguments.
+//
+// Arguments may be shared with the application or other templates;
+// functions must not modify them.
 type Func func(ctx Context, args ...Value) Value
 
+// A Callable is a value that can be called like a function. A template
+// calling a function that is not defined in the Env, such as helper in
+// {{ helper(arg) }}, calls the variable with that name instead, if it holds
+// a Callable. This allows helpers to be given in a template's context, as
+// closures over request-specific data.
+//
+// Callables are not known to Validate and Lint, which report calls to them
+// as undeclared functions.
+type Callable interface {
+	// Call calls the value with the given arguments.
+	Call(ctx Context, args ...Value) (Value, error)
+}
+
+// The CallableFunc type is an adapter to allow the use of ordinary
+// functions as Callables.
+type CallableFunc func(ctx Context, args ...Value) (Value, error)
+
+// Call calls f(ctx, args...).
+func (f CallableFunc) Call(ctx Context, args ...Value) (Value, error) {
+	return f(ctx, args...)
+}
+
 // A Filter is a user-defined filter.
 // Filters receive a value and modify it in some way. Filters
 // also accept parameters.
+//
+// The value and parameters may be shared with the application or other
+// templates; filters must return a new value rather than modifying them
+// in place.
 type Filter func(ctx Context, val Value, args ...Value) Value
 
 // A Test represents a user-defined test.
@@ -31,21 +64,318 @@ type Filter func(ctx Context, val Value, args ...Value) Value
 // also accept arguments and can consist of two words.
 type Test func(ctx Context, val Value, args ...Value) bool
 
+// An Operator is a user-defined binary operator.
+// Operators receive the values of their left and right operands.
+type Operator struct {
+	// Precedence determines how tightly the operator binds. For reference,
+	// "+" has a precedence of 30 and "*" a precedence of 60.
+	Precedence int
+
+	// RightAssoc is true if the operator is right-associative.
+	RightAssoc bool
+
+	// Func evaluates the operator.
+	Func func(ctx Context, left, right Value) Value
+}
+
+// NumberFormat describes how numbers are formatted by default.
+type NumberFormat struct {
+	Decimals           int    // The number of decimal places.
+	DecimalPoint       string // The separator between the integer and decimal parts.
+	ThousandsSeparator string // The separator between groups of thousands.
+}
+
+// A Collator compares strings in the order people expect in a language.
+// A *collate.Collator from golang.org/x/text/collate is a Collator:
+//
+//	env.Collator = collate.New(language.Swedish)
+type Collator interface {
+	// CompareString returns -1, 0, or 1 if a sorts before, the same as, or
+	// after b.
+	CompareString(a, b string) int
+}
+
 // Env represents a configured Stick environment.
+//
+// An Env may be used to execute templates from multiple goroutines
+// simultaneously. All state that changes during execution is confined to
+// each individual execution; the Env itself is only read. Configure the Env,
+// including registering extensions and escapers, before it is used
+// concurrently, and do not modify it afterward. The Loader, and any
+// functions, filters, tests, and handlers, must also be safe for concurrent
+// use.
 type Env struct {
 	Loader    Loader              // Template loader.
 	Functions map[string]Func     // User-defined functions.
 	Filters   map[string]Filter   // User-defined filters.
 	Tests     map[string]Test     // User-defined tests.
 	Visitors  []parse.NodeVisitor // User-defined node visitors.
+	Globals   map[string]Value    // Values available to every template and macro.
+	Escapers  map[string]Escaper  // Escapers used for auto-escaping, keyed by strategy.
+
+	Operators map[string]Operator        // User-defined binary operators.
+	Tags      map[string]parse.TagParser // User-defined tags.
+
+	// Charset is the charset of template output, such as "ISO-8859-1".
+	// It is used by escapers and string filters. If empty, DefaultCharset
+	// is used.
+	Charset string
+
+	// DateFormat is the default format, in PHP date() syntax, used by the
+	// date filter when no format is given. If empty, "F j, Y H:i" is used.
+	DateFormat string
+
+	// DateIntervalFormat is the default format, in PHP DateInterval syntax,
+	// used by the date filter to format a time.Duration when no format is
+	// given. If empty, "%d days" is used.
+	DateIntervalFormat string
+
+	// Timezone is the location dates are converted to by the date filter,
+	// the date function, and the date_modify filter when no timezone is
+	// given. If nil, dates are not converted.
+	Timezone *time.Location
+
+	// NumberFormat is the default format used by the number_format filter
+	// when arguments are omitted. If nil, numbers are formatted with no
+	// decimals, "." as the decimal point, and "," as the thousands separator.
+	NumberFormat *NumberFormat
+
+	// Collator, if set, compares strings sorted by the sort and sort_by
+	// filters. If nil, strings are sorted by byte order.
+	Collator Collator
+
+	// Engine determines how templates are executed. The default is
+	// EngineTree.
+	Engine Engine
+
+	// CacheMode controls whether cached templates are reloaded when they
+	// are modified. The default is CacheAutoReload.
+	CacheMode CacheMode
+
+	// MaxCachedTemplates, if greater than zero, limits the number of parsed
+	// templates kept in the Env's template cache. The least recently used
+	// templates are evicted first.
+	MaxCachedTemplates int
+
+	// MaxCachedBytes, if greater than zero, limits the total size, measured
+	// by the length of their source, of the parsed templates kept in the
+	// Env's template cache. The least recently used templates are evicted
+	// first.
+	MaxCachedBytes int64
+
+	// CacheDir, if set, is a directory where parsed templates are stored,
+	// keyed by a hash of their name and source, so that they need not be
+	// parsed again, even by other processes or after a restart. Templates
+	// loaded from CacheDir are not passed to Visitors, so the directory
+	// should only be shared by Envs with the same Visitors, Tags, and
+	// Operators. Problems reading or writing the directory are logged to
+	// Logger and otherwise ignored.
+	CacheDir string
+
+	// Optimizations is a combination of the Optimize constants, such as
+	// OptimizeAll, applied to templates when they are loaded.
+	Optimizations int
+
+	// DefaultEscapeStrategy is the escaping strategy, such as "html", used
+	// when printing values. If empty, printed values are not escaped.
+	DefaultEscapeStrategy string
+
+	// EscapeStrategy, if set, returns the escaping strategy used when printing
+	// values in the named template, and true; an empty strategy disables
+	// escaping for the template. If it returns false, DefaultEscapeStrategy
+	// is used.
+	EscapeStrategy func(name string) (string, bool)
+
+	// TemplateEscapeStrategies contains escaping strategies for specific
+	// templates, keyed by template name. These take precedence over
+	// EscapeStrategy and DefaultEscapeStrategy.
+	TemplateEscapeStrategies map[string]string
+
+	// ContextualEscaping enables contextual escaping for templates escaped
+	// as "html". When such a template is loaded, the HTML surrounding each
+	// printed value is analyzed to choose its escaping strategy, such as
+	// "html_attr" within an attribute value or "js" within a string in a
+	// script element, like html/template. Templates printing values where
+	// they cannot be escaped safely fail to load with an EscapeContextError.
+	// The Escapers provided by twig.AutoEscapeExtension are required.
+	ContextualEscaping bool
+
+	// UndefinedPolicy controls how references to undefined filters,
+	// functions, and tests are handled. The default is PolicyError.
+	UndefinedPolicy UndefinedPolicy
+
+	// StrictVariables causes references to undefined variables to fail
+	// with ErrUndefinedVariable instead of evaluating to nil.
+	StrictVariables bool
+
+	// UndefinedMode determines the value of references to undefined
+	// variables, unless StrictVariables is enabled, and of undefined
+	// attributes. The default is NilUndefined.
+	UndefinedMode UndefinedMode
+
+	// StrictTypes causes operators applied to values of incompatible types,
+	// such as adding a string to a number or comparing a bool to an array,
+	// to fail with a TypeError instead of converting the values.
+	StrictTypes bool
+
+	// Templates from untrusted sources should be executed with
+	// MaxOutputBytes and MaxLoopIterations set, and with a deadline on the
+	// context passed to ExecuteContext. Nesting of tags, expressions,
+	// included templates, and macro calls is always limited.
+
+	// MaxOutputBytes, if greater than zero, limits the number of bytes a
+	// single execution may write. Output captured to be used as a value,
+	// such as by set blocks, macro calls, parent(), and the apply tag, is
+	// counted as well, even if it is written again later. Execution fails
+	// with an OutputLimitError once the limit is exceeded.
+	MaxOutputBytes int64
+
+	// MaxLoopIterations, if greater than zero, limits the total number of
+	// for loop iterations in a single execution, including iterations in
+	// included templates. Execution fails with a LoopLimitError once the
+	// limit is exceeded.
+	MaxLoopIterations int
+
+	// MaxDepth, if greater than zero, limits the nesting of included and
+	// parent templates and macro calls, such as a recursive macro rendering
+	// a tree. Execution fails with a DepthLimitError once the limit is
+	// exceeded. The default is 100.
+	MaxDepth int
+
+	// SecurityPolicy, if set, is consulted before templates read fields or
+	// call methods on values. Execution fails if the policy returns an error.
+	SecurityPolicy SecurityPolicy
+
+	// AttrResolver, if set, is called to read attributes of values before
+	// they are read as usual, such as to lazily load relations of database
+	// records or to expose fields by another name. If it returns false, the
+	// attribute is read as usual. AttrResolver is not called for method
+	// calls with arguments. The SecurityPolicy is consulted before
+	// AttrResolver is called; attributes that are not fields or methods of
+	// a struct are checked as properties.
+	AttrResolver func(val Value, name string) (Value, bool, error)
+
+	// AtomicOutput causes Execute and ExecuteContext to buffer output and
+	// write it only if execution succeeds, as with ExecuteSafe. Use
+	// ExecuteStream to write output as it is produced.
+	AtomicOutput bool
+
+	// OutputFilter, if set, transforms the complete output of each template
+	// executed with Execute and its variants, other than ExecuteMacro and
+	// ExecuteWithSourceMap, before it is written, such as to minify HTML with minify.HTML. Since
+	// the output is buffered, nothing is written if execution fails, as
+	// with AtomicOutput.
+	OutputFilter func(name string, out []byte) ([]byte, error)
+
+	// Instrumentation, if set, is notified as nodes are executed.
+	Instrumentation Instrumentation
+
+	// Metrics, if set, is notified as templates are rendered, looked up in
+	// the template cache, and parsed.
+	Metrics Metrics
+
+	// Logger, if set, receives warnings and debug messages, such as
+	// references to undefined variables.
+	Logger Logger
+
+	// ContextDecorator, if set, is called at the start of each execution
+	// with the execution's context.Context and root scope. It can add values
+	// derived from the context, such as the current request or user, to
+	// every template. The root scope is a copy; changes do not affect the
+	// map passed to Execute.
+	ContextDecorator func(c context.Context, data map[string]Value)
+
+	// DeprecationHandler, if set, receives uses of deprecated syntax and
+	// features encountered while executing templates.
+	DeprecationHandler func(Deprecation)
+
+	// WarningHandler, if set, receives recoverable problems encountered while
+	// executing templates, such as a filter receiving an invalid argument.
+	// Warnings are discarded if WarningHandler is nil.
+	WarningHandler func(Warning)
+
+	cache      templateCache      // Parsed templates, keyed by name.
+	middleware []OutputMiddleware // Added by UseOutputMiddleware.
 }
 
 // An Extension is used to group related functions, filters, visitors, etc.
+//
+// In addition to Init, an Extension may implement any of FilterProvider,
+// FunctionProvider, TestProvider, GlobalProvider, OperatorProvider,
+// VisitorProvider, and TagProvider. Their contributions are added to the
+// Env when the Extension is registered, before Init is called.
 type Extension interface {
 	// Init is the entry-point for an extension to modify the Env.
 	Init(*Env) error
 }
 
+// A FilterProvider is an Extension that contributes filters.
+type FilterProvider interface {
+	Filters() map[string]Filter
+}
+
+// A FunctionProvider is an Extension that contributes functions.
+type FunctionProvider interface {
+	Functions() map[string]Func
+}
+
+// A TestProvider is an Extension that contributes tests.
+type TestProvider interface {
+	Tests() map[string]Test
+}
+
+// A GlobalProvider is an Extension that contributes global values.
+type GlobalProvider interface {
+	Globals() map[string]Value
+}
+
+// An OperatorProvider is an Extension that contributes binary operators.
+type OperatorProvider interface {
+	Operators() map[string]Operator
+}
+
+// A VisitorProvider is an Extension that contributes node visitors.
+type VisitorProvider interface {
+	Visitors() []parse.NodeVisitor
+}
+
+// A TagProvider is an Extension that contributes tags.
+type TagProvider interface {
+	Tags() map[string]parse.TagParser
+}
+
+// An Instrumentation is notified as a template is executed. It can be used
+// to build profilers, tracers, and coverage tools.
+//
+// Each node is reported when it is executed, with the exception of macro
+// definitions. Instead, BeforeNode and AfterNode are called with the
+// MacroNode each time the macro is called.
+type Instrumentation interface {
+	// BeforeNode is called before the node is executed.
+	BeforeNode(ctx Context, node parse.Node)
+
+	// AfterNode is called after the node is executed with the time taken
+	// and the resulting error, if any.
+	AfterNode(ctx Context, node parse.Node, elapsed time.Duration, err error)
+}
+
+// A Metrics receives measurements of the work done by an Env, so that they
+// can be exported to a monitoring system such as Prometheus. Its methods
+// are called concurrently, and should return quickly.
+type Metrics interface {
+	// Render is called when an execution of the named template completes,
+	// with the time taken and the resulting error, if any.
+	Render(name string, elapsed time.Duration, err error)
+
+	// CacheLookup is called each time the named template is loaded, with
+	// whether its parsed form was found in the template cache.
+	CacheLookup(name string, hit bool)
+
+	// Parse is called when the named template has been loaded and parsed,
+	// with the time taken and the resulting error, if any.
+	Parse(name string, elapsed time.Duration, err error)
+}
+
 // ContextMetadata contains additional, unstructured runtime attributes about
 // the template being executed.
 type ContextMetadata interface {
@@ -77,6 +407,17 @@ type Context interface {
 	Scope() ContextScope   // All defined root-level names.
 	Env() *Env
 
+	// Context returns the context.Context the template is being executed
+	// with. It is never nil.
+	Context() context.Context
+
+	// Warn reports a recoverable problem to the Env's WarningHandler.
+	Warn(err error)
+
+	// Deprecated reports the use of a deprecated feature, such as a
+	// deprecated filter, to the Env's DeprecationHandler.
+	Deprecated(msg string)
+
 	noexport() // Prevent other packages from satisfying this interface.
 }
 
@@ -92,30 +433,348 @@ func New(loader Loader) *Env {
 		Filters:   make(map[string]Filter),
 		Tests:     make(map[string]Test),
 		Visitors:  make([]parse.NodeVisitor, 0),
+		Globals:   make(map[string]Value),
+		Escapers:  make(map[string]Escaper),
+		Operators: make(map[string]Operator),
+		Tags:      make(map[string]parse.TagParser),
+
+		TemplateEscapeStrategies: make(map[string]string),
 	}
 }
 
-// Register adds the given Extension to the Env.
+// Register adds the given Extension to the Env, then calls its Init method.
+// Contributions from the Extension replace any existing definitions with
+// the same name.
 func (env *Env) Register(e Extension) error {
+	if p, ok := e.(FilterProvider); ok {
+		if env.Filters == nil {
+			env.Filters = make(map[string]Filter)
+		}
+		for k, v := range p.Filters() {
+			env.Filters[k] = v
+		}
+	}
+	if p, ok := e.(FunctionProvider); ok {
+		if env.Functions == nil {
+			env.Functions = make(map[string]Func)
+		}
+		for k, v := range p.Functions() {
+			env.Functions[k] = v
+		}
+	}
+	if p, ok := e.(TestProvider); ok {
+		if env.Tests == nil {
+			env.Tests = make(map[string]Test)
+		}
+		for k, v := range p.Tests() {
+			env.Tests[k] = v
+		}
+	}
+	if p, ok := e.(GlobalProvider); ok {
+		if env.Globals == nil {
+			env.Globals = make(map[string]Value)
+		}
+		for k, v := range p.Globals() {
+			env.Globals[k] = v
+		}
+	}
+	if p, ok := e.(OperatorProvider); ok {
+		if env.Operators == nil {
+			env.Operators = make(map[string]Operator)
+		}
+		for k, v := range p.Operators() {
+			env.Operators[k] = v
+		}
+	}
+	if p, ok := e.(VisitorProvider); ok {
+		env.Visitors = append(env.Visitors, p.Visitors()...)
+	}
+	if p, ok := e.(TagProvider); ok {
+		if env.Tags == nil {
+			env.Tags = make(map[string]parse.TagParser)
+		}
+		for k, v := range p.Tags() {
+			env.Tags[k] = v
+		}
+	}
 	return e.Init(env)
 }
 
+// An OutputMiddleware wraps the writer that a template's output is written
+// to, such as to compress the output or record it. If the returned writer
+// implements io.Closer, it is closed once the template has been executed,
+// even if execution fails.
+type OutputMiddleware func(next io.Writer) io.Writer
+
+// UseOutputMiddleware adds middleware wrapping the output of each template
+// executed with Execute and its variants, other than ExecuteMacro.
+// Middleware added later wraps middleware added earlier, and so receives
+// the output first; the Env's OutputFilter, if any, is applied before the
+// output reaches any middleware.
+//
+// UseOutputMiddleware is not safe to call while templates are executed.
+func (env *Env) UseOutputMiddleware(m ...OutputMiddleware) {
+	env.middleware = append(env.middleware, m...)
+}
+
+// render calls fn with out wrapped by the Env's output middleware, then
+// closes the middleware's writers.
+func (env *Env) render(out io.Writer, fn func(out io.Writer) error) error {
+	if len(env.middleware) == 0 {
+		return fn(out)
+	}
+	var closers []io.Closer
+	for _, m := range env.middleware {
+		next := out
+		out = m(next)
+		// Middleware returning the writer it was given must not close it
+		// twice.
+		if reflect.TypeOf(out).Comparable() && out == next {
+			continue
+		}
+		if c, ok := out.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+	err := fn(out)
+	for i := len(closers) - 1; i >= 0; i-- {
+		if cerr := closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RegisterEscaper adds an Escaper for the given strategy, replacing any
+// existing Escaper for that strategy.
+func (env *Env) RegisterEscaper(strategy string, fn Escaper) {
+	if env.Escapers == nil {
+		env.Escapers = make(map[string]Escaper)
+	}
+	env.Escapers[strategy] = fn
+}
+
+// escapeStrategy returns the escaping strategy for the named template.
+func (env *Env) escapeStrategy(name string) string {
+	if strategy, ok := env.TemplateEscapeStrategies[name]; ok {
+		return strategy
+	}
+	if env.EscapeStrategy != nil {
+		if strategy, ok := env.EscapeStrategy(name); ok {
+			return strategy
+		}
+	}
+	return env.DefaultEscapeStrategy
+}
+
 // Execute parses and executes the given template.
+//
+// Execute is safe to call from multiple goroutines.
 func (env *Env) Execute(tpl string, out io.Writer, ctx map[string]Value) error {
-	return execute(tpl, out, ctx, env)
+	return env.ExecuteContext(context.Background(), tpl, out, ctx)
+}
+
+// ExecuteContext parses and executes the given template. The given
+// context.Context is available to functions, filters, and tests through
+// Context.Context.
+//
+// Execution is aborted if c is cancelled or its deadline passes; the
+// returned error wraps c.Err().
+func (env *Env) ExecuteContext(c context.Context, tpl string, out io.Writer, ctx map[string]Value) error {
+	return env.render(out, func(out io.Writer) error {
+		if env.AtomicOutput || env.OutputFilter != nil {
+			return executeBuffered(c, tpl, out, ctx, env)
+		}
+		return execute(c, tpl, out, ctx, env)
+	})
+}
+
+// ExecuteBlock executes only the named block of the given template,
+// resolving the block through the template's inheritance chain.
+func (env *Env) ExecuteBlock(tpl, block string, out io.Writer, ctx map[string]Value) error {
+	return env.render(out, func(out io.Writer) error {
+		if env.OutputFilter != nil {
+			buf := bufpool.Get()
+			defer bufpool.Put(buf)
+			if err := executeBlock(context.Background(), tpl, block, buf, ctx, env); err != nil {
+				return err
+			}
+			return env.writeOutput(tpl, buf, out)
+		}
+		return executeBlock(context.Background(), tpl, block, out, ctx, env)
+	})
+}
+
+// ExecuteMacro calls the named macro defined in the given template with
+// the given arguments, returning its output.
+func (env *Env) ExecuteMacro(tpl, macro string, args ...Value) (string, error) {
+	return executeMacro(context.Background(), tpl, macro, args, env)
+}
+
+// ExecuteToString executes the template, returning the output as a string.
+// No output is returned if an error occurs.
+func (env *Env) ExecuteToString(tpl string, ctx map[string]Value) (string, error) {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := env.ExecuteContext(context.Background(), tpl, buf, ctx); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// MustExecute executes the template, returning the output as a string.
+// It panics if an error occurs.
+func (env *Env) MustExecute(tpl string, ctx map[string]Value) string {
+	res, err := env.ExecuteToString(tpl, ctx)
+	if err != nil {
+		panic(err)
+	}
+	return res
 }
 
 // ExecuteSafe executes the template but does not output anything if an error occurs.
 func (env *Env) ExecuteSafe(tpl string, out io.Writer, ctx map[string]Value) error {
-	buf := &bytes.Buffer{}
-	if err := env.Execute(tpl, buf, ctx); err != nil {
+	return env.render(out, func(out io.Writer) error {
+		return executeBuffered(context.Background(), tpl, out, ctx, env)
+	})
+}
+
+// ExecuteFunc writes the output of the named template, as written by fn,
+// to out as Execute would: through the Env's OutputFilter and output
+// middleware, and only if fn succeeds when output is buffered. It allows
+// templates executed by other means, such as those compiled by package
+// compile, to be written like any other.
+func (env *Env) ExecuteFunc(name string, out io.Writer, fn func(out io.Writer) error) error {
+	return env.render(out, func(out io.Writer) error {
+		if !env.AtomicOutput && env.OutputFilter == nil {
+			return fn(out)
+		}
+		buf := bufpool.Get()
+		defer bufpool.Put(buf)
+		if err := fn(buf); err != nil {
+			return err
+		}
+		return env.writeOutput(name, buf, out)
+	})
+}
+
+// ExecuteStream executes the template, writing output as it is produced,
+// even if the Env has AtomicOutput enabled. Output is buffered only if the
+// Env has an OutputFilter.
+func (env *Env) ExecuteStream(tpl string, out io.Writer, ctx map[string]Value) error {
+	return env.render(out, func(out io.Writer) error {
+		if env.OutputFilter != nil {
+			return executeBuffered(context.Background(), tpl, out, ctx, env)
+		}
+		return execute(context.Background(), tpl, out, ctx, env)
+	})
+}
+
+// A TypedContext provides the context for a particular template. The
+// types generated by compile.GenerateTypes implement it.
+type TypedContext interface {
+	TemplateName() string      // The name of the template to execute.
+	Context() map[string]Value // The context to execute it with.
+}
+
+// ExecuteTyped executes the template named by ctx, as with Execute. Using
+// a generated TypedContext ensures at compile time that the template is
+// given each variable it requires, with the expected type.
+func (env *Env) ExecuteTyped(out io.Writer, ctx TypedContext) error {
+	return env.Execute(ctx.TemplateName(), out, ctx.Context())
+}
+
+// ExecuteData executes the given template, as with Execute, with the
+// variables given by data, as returned by ContextOf.
+func (env *Env) ExecuteData(tpl string, out io.Writer, data interface{}) error {
+	ctx, err := ContextOf(data)
+	if err != nil {
 		return err
 	}
-	_, err := io.Copy(out, buf)
-	return err
+	return env.Execute(tpl, out, ctx)
+}
+
+// ContextOf returns the variables given by data, for executing a template.
+//
+// The data may be nil, a map with string keys, an *OrderedMap, a struct, a
+// TypedContext, or a pointer to any of these. The exported fields of a
+// struct, including those promoted from embedded structs, become variables
+// named exactly as the fields are. Only the top level of data is converted;
+// the values of entries and fields are used as they are, and read by
+// templates as they are accessed. Any other data results in an error.
+func ContextOf(data interface{}) (map[string]Value, error) {
+	switch d := data.(type) {
+	case nil:
+		return nil, nil
+	case map[string]Value:
+		return d, nil
+	case TypedContext:
+		return d.Context(), nil
+	case *OrderedMap:
+		return d.Map(), nil
+	}
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		ctx := make(map[string]Value, v.Len())
+		for _, k := range v.MapKeys() {
+			ctx[k.String()] = v.MapIndex(k).Interface()
+		}
+		return ctx, nil
+	case v.Kind() == reflect.Struct:
+		ctx := make(map[string]Value, v.NumField())
+		structContext(ctx, v)
+		return ctx, nil
+	}
+	return nil, fmt.Errorf("stick: cannot use data of type %T as a template context", data)
+}
+
+// structContext adds the exported fields of the struct v to ctx. Fields
+// already in ctx, which belong to an outer struct, take precedence over
+// those of embedded structs.
+func structContext(ctx map[string]Value, v reflect.Value) {
+	var embedded []reflect.Value
+	for i := 0; i < v.NumField(); i++ {
+		f, fv := v.Type().Field(i), v.Field(i)
+		if f.Anonymous {
+			for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				embedded = append(embedded, fv)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		ctx[f.Name] = fv.Interface()
+	}
+	for _, e := range embedded {
+		promoted := make(map[string]Value)
+		structContext(promoted, e)
+		for k, val := range promoted {
+			if _, ok := ctx[k]; !ok {
+				ctx[k] = val
+			}
+		}
+	}
 }
 
 // Parse loads and parses the given template.
+//
+// The returned Tree is not shared with the Env's template cache, so it is
+// safe to modify.
 func (env *Env) Parse(name string) (*parse.Tree, error) {
-	return env.load(name)
+	e, err := env.compile(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.tree, nil
 }
@@ -0,0 +1,253 @@
+// Package sticktest provides snapshot testing of Stick templates.
+//
+// A Suite renders each template in a directory that has a golden file,
+// containing its expected output, next to it, and reports any difference.
+// A template named "page.html.twig" has the golden file "page.html.golden",
+// and is executed with the context in "page.html.json", if it exists.
+//
+//	func TestTemplates(t *testing.T) {
+//		env := twig.New(stick.NewFilesystemLoader("testdata"))
+//		sticktest.Run(t, env, "testdata")
+//	}
+//
+// Templates without a golden file, such as layouts and partials, are not
+// rendered on their own. To create or refresh golden files, set Update, or
+// the STICKTEST_UPDATE environment variable, and run the tests again; only
+// golden files that already exist are written, so an empty golden file
+// marks a template to be tested.
+package sticktest // import "github.com/tyler-sommer/stick/sticktest"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// Extensions of the files used by a Suite.
+const (
+	TemplateExt = ".twig"
+	GoldenExt   = ".golden"
+	ContextExt  = ".json"
+)
+
+// A Suite is a set of templates and their expected output.
+type Suite struct {
+	// Env executes the templates. Its Loader must load templates by their
+	// path relative to Dir, using forward slashes, as does a
+	// FilesystemLoader rooted at Dir.
+	Env *stick.Env
+
+	// Dir is the directory containing the templates and their golden
+	// and context files. Subdirectories are included.
+	Dir string
+
+	// Context contains values given to every template. Values in a
+	// template's context file take precedence.
+	Context map[string]stick.Value
+
+	// Update causes golden files to be overwritten with the actual output
+	// instead of being compared with it.
+	Update bool
+}
+
+// Run runs the Suite for the templates in dir as subtests of t.
+func Run(t *testing.T, env *stick.Env, dir string) {
+	s := &Suite{Env: env, Dir: dir}
+	s.Run(t)
+}
+
+// Run checks each template with a golden file in a subtest of t, named
+// after the template.
+func (s *Suite) Run(t *testing.T) {
+	names, err := s.Templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatalf("sticktest: no templates with %s files found in %s", GoldenExt, s.Dir)
+	}
+	for _, name := range names {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			if err := s.Check(name); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Templates returns the names of the templates in Dir that have a golden
+// file, sorted.
+func (s *Suite) Templates() ([]string, error) {
+	var res []string
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, TemplateExt) {
+			return err
+		}
+		if _, err := os.Stat(s.file(path, GoldenExt)); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		res = append(res, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(res)
+	return res, err
+}
+
+// file returns the path of the file with the given extension that
+// accompanies the template at path.
+func (s *Suite) file(path, ext string) string {
+	return strings.TrimSuffix(path, TemplateExt) + ext
+}
+
+// Check renders the named template and compares the output with its golden
+// file, returning an error describing any difference. If Update is set,
+// the golden file is written instead.
+func (s *Suite) Check(name string) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	ctx, err := s.context(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := s.Env.Execute(name, &buf, ctx); err != nil {
+		return fmt.Errorf("sticktest: %s: %s", name, err)
+	}
+	golden := s.file(path, GoldenExt)
+	if s.Update || os.Getenv("STICKTEST_UPDATE") != "" {
+		return ioutil.WriteFile(golden, buf.Bytes(), 0644)
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		return fmt.Errorf("sticktest: %s: output differs from %s (-expected +actual):\n%s", name, golden, Diff(string(expected), buf.String()))
+	}
+	return nil
+}
+
+// context returns the context for the template at path.
+func (s *Suite) context(path string) (map[string]stick.Value, error) {
+	ctx := make(map[string]stick.Value, len(s.Context))
+	for k, v := range s.Context {
+		ctx[k] = v
+	}
+	data, err := ioutil.ReadFile(s.file(path, ContextExt))
+	if os.IsNotExist(err) {
+		return ctx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var vals map[string]stick.Value
+	if err := json.Unmarshal(data, &vals); err != nil {
+		return nil, fmt.Errorf("sticktest: %s: %s", s.file(path, ContextExt), err)
+	}
+	for k, v := range vals {
+		ctx[k] = v
+	}
+	return ctx, nil
+}
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 2
+
+// Diff returns the lines that differ between expected and actual. Removed
+// lines are prefixed by "-", added lines by "+", and unchanged lines
+// nearby by a space. Each line is preceded by its line number in expected,
+// or in actual for added lines, and lines are quoted if they contain trailing whitespace or control
+// characters, so that invisible differences are apparent.
+func Diff(expected, actual string) string {
+	a, b := splitLines(expected), splitLines(actual)
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		num  int
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', i + 1, a[i]})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', i + 1, a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', j + 1, b[j]})
+			j++
+		}
+	}
+	var buf strings.Builder
+	last := -1 // The index of the last line written.
+	for k, l := range lines {
+		near := false
+		for d := k - diffContext; d <= k+diffContext; d++ {
+			if d >= 0 && d < len(lines) && lines[d].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && last != k-1 {
+			buf.WriteString("...\n")
+		}
+		last = k
+		fmt.Fprintf(&buf, "%c%4d | %s\n", l.op, l.num, visible(l.text))
+	}
+	return buf.String()
+}
+
+// splitLines returns the lines in s, including their line breaks.
+func splitLines(s string) []string {
+	res := strings.SplitAfter(s, "\n")
+	if res[len(res)-1] == "" {
+		res = res[:len(res)-1]
+	}
+	return res
+}
+
+// visible returns s, without its line break, quoted if it contains
+// characters that would otherwise be hard to see.
+func visible(s string) string {
+	t := strings.TrimSuffix(s, "\n")
+	if t != strings.TrimRight(t, " \t") || strings.ContainsAny(t, "\r\x00") {
+		t = fmt.Sprintf("%q", t)
+	}
+	if !strings.HasSuffix(s, "\n") {
+		t += " (no newline at end)"
+	}
+	return t
+}
@@ -0,0 +1,87 @@
+package sticktest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/sticktest"
+)
+
+func newSuite(dir string) *sticktest.Suite {
+	return &sticktest.Suite{
+		Env:     stick.New(stick.NewFilesystemLoader(dir)),
+		Dir:     dir,
+		Context: map[string]stick.Value{"site": "Example"},
+	}
+}
+
+func TestSuite(t *testing.T) {
+	s := newSuite("testdata")
+	names, err := s.Templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "page.html.twig,partials/footer.html.twig" {
+		t.Errorf("unexpected templates %v", names)
+	}
+	s.Run(t)
+}
+
+func TestSuiteUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sticktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"page.twig":   "Hello, {{ name }}!\nBye.\n",
+		"page.json":   `{"name": "World"}`,
+		"page.golden": "",
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newSuite(dir)
+	err = s.Check("page.twig")
+	if err == nil || !strings.Contains(err.Error(), "+   1 | Hello, World!\n+   2 | Bye.\n") {
+		t.Errorf("expected a diff, got %v", err)
+	}
+	s.Update = true
+	if err := s.Check("page.twig"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "page.golden")); string(b) != "Hello, World!\nBye.\n" {
+		t.Errorf("expected golden file to be updated, got %q", b)
+	}
+	s.Update = false
+	if err := s.Check("page.twig"); err != nil {
+		t.Errorf("unexpected error after update: %s", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		actual   string
+		diff     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"changed", "a\nb\nc\n", "a\nx\nc\n", "    1 | a\n-   2 | b\n+   2 | x\n    3 | c\n"},
+		{"whitespace", "a\n", "a \n", "-   1 | a\n+   1 | \"a \"\n"},
+		{"no newline", "a\n", "a", "-   1 | a\n+   1 | a (no newline at end)\n"},
+		{"context", "1\n2\n3\n4\n5\n6\n7\n8\n", "1\n2\n3\n4\n5\n6\n7\nx\n", "    6 | 6\n    7 | 7\n-   8 | 8\n+   8 | x\n"},
+		{"separate", "1\n2\n3\n4\n5\n6\n7\n8\n", "x\n2\n3\n4\n5\n6\n7\ny\n", "-   1 | 1\n+   1 | x\n    2 | 2\n    3 | 3\n...\n    6 | 6\n    7 | 7\n-   8 | 8\n+   8 | y\n"},
+	}
+	for _, test := range tests {
+		if diff := sticktest.Diff(test.expected, test.actual); diff != test.diff {
+			t.Errorf("%s: expected diff\n%s\ngot\n%s", test.name, test.diff, diff)
+		}
+	}
+}
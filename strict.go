@@ -0,0 +1,104 @@
+package stick
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+
+	"github.com/shopspring/decimal"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// typeOf returns the type of v as checked by operators when the Env has
+// StrictTypes enabled: "null", "bool", "number", "string", "array", "map",
+// or "object" for any other value.
+func typeOf(v Value) string {
+	switch vc := v.(type) {
+	case nil:
+		return "null"
+	case SafeValue:
+		return typeOf(vc.Value())
+	case bool:
+		return "bool"
+	case string, []byte:
+		return "string"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64, json.Number, decimal.Decimal, *big.Int, *big.Rat, ExactNumber, Number:
+		return "number"
+	case Boolean:
+		return "bool"
+	}
+	if dv, ok := driverValue(v); ok {
+		return typeOf(dv)
+	}
+	switch {
+	case IsMap(v):
+		return "map"
+	case IsArray(v):
+		return "array"
+	}
+	if _, ok := v.(Stringer); ok {
+		return "string"
+	}
+	if u, ok := underlying(reflect.ValueOf(v)); ok {
+		return typeOf(u)
+	}
+	return "object"
+}
+
+// checkTypes returns a TypeError if the Env has StrictTypes enabled and
+// left and right cannot be operands of the binary operator op. Arithmetic
+// and bitwise operators require numbers. Values may be compared with
+// values of the same type, and with null for equality, unless they
+// implement Comparer or Equaler. Arrays and maps cannot be concatenated.
+func (s *state) checkTypes(op string, left, right Value) error {
+	if !s.env.StrictTypes {
+		return nil
+	}
+	var ok bool
+	lt, rt := typeOf(left), typeOf(right)
+	switch op {
+	case parse.OpBinaryAdd, parse.OpBinarySubtract, parse.OpBinaryMultiply,
+		parse.OpBinaryDivide, parse.OpBinaryFloorDiv, parse.OpBinaryModulo,
+		parse.OpBinaryPower, parse.OpBinaryRange, parse.OpBinaryBitwiseAnd,
+		parse.OpBinaryBitwiseOr, parse.OpBinaryBitwiseXor:
+		ok = lt == "number" && rt == "number"
+	case parse.OpBinaryConcat:
+		ok = lt != "array" && lt != "map" && rt != "array" && rt != "map"
+	case parse.OpBinaryEqual, parse.OpBinaryNotEqual:
+		ok = lt == rt || lt == "null" || rt == "null" || isCustomComparable(left, right)
+	case parse.OpBinaryGreaterThan, parse.OpBinaryGreaterEqual,
+		parse.OpBinaryLessThan, parse.OpBinaryLessEqual:
+		ok = lt == rt && (lt == "number" || lt == "string" || lt == "object") || isCustomComparable(left, right)
+	default:
+		return nil
+	}
+	if !ok {
+		return &TypeError{op, lt, rt}
+	}
+	return nil
+}
+
+// checkUnaryType returns a TypeError if the Env has StrictTypes enabled
+// and in cannot be the operand of the unary operator op.
+func (s *state) checkUnaryType(op string, in Value) error {
+	if !s.env.StrictTypes || op == parse.OpUnaryNot {
+		return nil
+	}
+	if t := typeOf(in); t != "number" {
+		return &TypeError{Op: op, Right: t}
+	}
+	return nil
+}
+
+// isCustomComparable returns true if either value decides for itself how
+// it compares to other values.
+func isCustomComparable(left, right Value) bool {
+	for _, v := range []Value{left, right} {
+		switch v.(type) {
+		case Comparer, Equaler:
+			return true
+		}
+	}
+	return false
+}
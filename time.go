@@ -0,0 +1,149 @@
+package stick
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A TimeValue is a value that represents a point in time, such as a custom
+// date type. It is accepted anywhere a date is expected.
+type TimeValue interface {
+	// AsTime returns the time represented by the value.
+	AsTime() time.Time
+}
+
+// A TimeConverter converts values of types it recognizes to a time.Time,
+// returning false for any other value.
+type TimeConverter func(v Value) (time.Time, bool)
+
+var (
+	timeConvertersMu sync.Mutex   // Serializes RegisterTimeConverter.
+	timeConverters   atomic.Value // The registered []TimeConverter.
+)
+
+// RegisterTimeConverter adds a TimeConverter consulted by CoerceTime, so
+// that date types which cannot implement TimeValue, such as those from
+// other packages, are accepted anywhere a date is expected. It is safe to
+// call concurrently, but is usually called during initialization.
+func RegisterTimeConverter(fn TimeConverter) {
+	timeConvertersMu.Lock()
+	defer timeConvertersMu.Unlock()
+	fns, _ := timeConverters.Load().([]TimeConverter)
+	timeConverters.Store(append(fns[:len(fns):len(fns)], fn))
+}
+
+// timeLayouts are the layouts of the strings accepted by CoerceTime, in the
+// order they are tried. Strings without a time zone are in UTC.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.ANSIC,
+}
+
+// CoerceTime coerces the given value into a time.Time. False is returned
+// if the value cannot be coerced.
+//
+// Accepted are a time.Time or *time.Time, a TimeValue, any value accepted
+// by a registered TimeConverter, and the value held by a driver.Valuer,
+// such as sql.NullTime. Numbers and strings of digits are Unix timestamps,
+// in seconds. Other strings may be "now", or a date in RFC 3339 or a
+// similar format, such as "2006-01-02 15:04:05", "2006-01-02", or RFC 1123.
+func CoerceTime(v Value) (time.Time, bool) {
+	switch vc := v.(type) {
+	case nil:
+		return time.Time{}, false
+	case time.Time:
+		return vc, true
+	case *time.Time:
+		if vc == nil {
+			return time.Time{}, false
+		}
+		return *vc, true
+	case TimeValue:
+		return vc.AsTime(), true
+	case SafeValue:
+		return CoerceTime(vc.Value())
+	}
+	if t, ok := convertTime(v); ok {
+		return t, true
+	}
+	if dv, ok := driverValue(v); ok {
+		return CoerceTime(dv)
+	}
+	switch vc := v.(type) {
+	case string:
+		return parseTime(vc)
+	case json.Number:
+		return parseTime(string(vc))
+	case bool:
+		return time.Time{}, false
+	}
+	if kindOf(v) != kindNumber {
+		return time.Time{}, false
+	}
+	return unixTime(CoerceNumber(v))
+}
+
+// convertTime converts v using the registered TimeConverters.
+func convertTime(v Value) (time.Time, bool) {
+	fns, _ := timeConverters.Load().([]TimeConverter)
+	for _, fn := range fns {
+		if t, ok := fn(v); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseTime parses s as a Unix timestamp or a date in one of timeLayouts.
+func parseTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "now" {
+		return time.Now(), true
+	}
+	if isNumericString(s) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return unixTime(f)
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// unixTime returns the time f seconds after the Unix epoch.
+func unixTime(f float64) (time.Time, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > 1<<62/1e9 {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// isTime returns true if v is a date, rather than a value that can merely
+// be coerced into one, such as a number or string.
+func isTime(v Value) bool {
+	switch v.(type) {
+	case time.Time, *time.Time, TimeValue:
+		return true
+	}
+	_, ok := convertTime(v)
+	return ok
+}
@@ -1,26 +1,40 @@
 package twig
 
 import (
+	"path"
 	"strings"
 
 	"github.com/tyler-sommer/stick"
-	"github.com/tyler-sommer/stick/parse"
 	"github.com/tyler-sommer/stick/twig/escape"
 )
 
 // An Escaper returns the escaped input.
 // Escapers should expect to receive unescaped input.
-type Escaper func(string) string
+type Escaper = stick.Escaper
 
 // AutoEscapeExtension provides Twig equivalent escaping for Stick templates.
 type AutoEscapeExtension struct {
 	Escapers map[string]Escaper
+
+	// Strategies maps template file extensions, such as "js", to escaping
+	// strategies. Templates with an extension not present in Strategies are
+	// escaped with the Env's DefaultEscapeStrategy, which Init sets to
+	// "html". An empty strategy disables escaping.
+	Strategies map[string]string
 }
 
 // Init registers the escape functionality with the given Env.
+//
+// Printed values are automatically escaped using the strategy guessed
+// from the template name, and the "escape" filter (aliased as "e") is
+// available to escape values explicitly.
 func (e *AutoEscapeExtension) Init(env *stick.Env) error {
-	env.Visitors = append(env.Visitors, &autoEscapeVisitor{})
-	env.Filters["escape"] = func(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	for k, v := range e.Escapers {
+		env.RegisterEscaper(k, v)
+	}
+	env.DefaultEscapeStrategy = "html"
+	env.EscapeStrategy = e.guessStrategy
+	escape := func(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 		ct := "html"
 		if len(args) > 0 {
 			ct = stick.CoerceString(args[0])
@@ -32,14 +46,14 @@ func (e *AutoEscapeExtension) Init(env *stick.Env) error {
 			}
 		}
 
-		escfn, ok := e.Escapers[ct]
-		if !ok {
+		if _, ok := ctx.Env().Escapers[ct]; !ok {
 			// TODO: Communicate error, no escaper for the specified content type.
 			return val
 		}
-
-		return stick.NewSafeValue(escfn(stick.CoerceString(val)), ct)
+		return stick.NewSafeValue(ctx.Env().EscapeWith(ct, val), ct)
 	}
+	env.Filters["escape"] = escape
+	env.Filters["e"] = escape
 	return nil
 }
 
@@ -53,67 +67,23 @@ func NewAutoEscapeExtension() *AutoEscapeExtension {
 			"js":        escape.JS,
 			"css":       escape.CSS,
 			"url":       escape.URLQueryParam,
+			"html_url":  escape.HTMLURL,
+		},
+		Strategies: map[string]string{
+			"html": "html",
+			"js":   "js",
+			"css":  "css",
+			"txt":  "",
 		},
 	}
 }
 
-// AutoEscapeVisitor can be used to automatically apply the "escape" filter
-// to any PrintNode.
-type autoEscapeVisitor struct {
-	stack []string
-}
-
-// push adds the given name on top of the stack.
-func (v *autoEscapeVisitor) push(name string) {
-	v.stack = append(v.stack, name)
-}
-
-// pop removes the top-most name on the stack.
-func (v *autoEscapeVisitor) pop() {
-	if len(v.stack) > 0 {
-		v.stack = v.stack[0 : len(v.stack)-1]
-	}
-}
-
-func (v *autoEscapeVisitor) current() string {
-	if len(v.stack) == 0 {
-		// TODO: This is an invalid state.
-		return ""
-	}
-	return v.stack[len(v.stack)-1]
-}
-
-func (v *autoEscapeVisitor) Enter(n parse.Node) {
-	switch node := n.(type) {
-	case *parse.ModuleNode:
-		v.push(v.guessTypeFromName(node.Origin))
-	case *parse.BlockNode:
-		v.push(v.guessTypeFromName(node.Origin))
-	case *parse.PrintNode:
-		ct := v.current()
-		v := node.X
-		r := parse.NewFilterExpr(
-			"escape",
-			[]parse.Expr{v, parse.NewStringExpr(ct, v.Start())},
-			v.Start(),
-		)
-		node.X = r
-	}
-}
-
-func (v *autoEscapeVisitor) Leave(n parse.Node) {
-	switch n.(type) {
-	case *parse.ModuleNode, *parse.BlockNode:
-		v.pop()
-	}
-}
-
-func (v *autoEscapeVisitor) guessTypeFromName(name string) string {
-	name = strings.TrimSuffix(name, ".twig")
-	p := strings.LastIndex(name, ".")
-	if p < 0 {
-		// Default to html
-		return "html"
-	}
-	return name[p+1:]
+// guessStrategy returns the escaping strategy for the named template,
+// based on its file extension. A trailing ".twig" is ignored, so
+// "foo.js.twig" is escaped as "js".
+func (e *AutoEscapeExtension) guessStrategy(name string) (string, bool) {
+	name = path.Base(strings.TrimSuffix(name, ".twig"))
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	strategy, ok := e.Strategies[ext]
+	return strategy, ok
 }
@@ -4,6 +4,7 @@ package escape // import "github.com/tyler-sommer/stick/twig/escape"
 import (
 	"bytes"
 	"fmt"
+	"strings"
 )
 
 // HTML provides a Twig-compatible HTML escape function.
@@ -109,3 +110,30 @@ func URLQueryParam(in string) string {
 	}
 	return out.String()
 }
+
+// HTMLURL escapes a URL for use as an HTML attribute value, such as href.
+// URLs with a scheme other than http, https, or mailto are replaced with
+// "about:invalid#unsafe", so that they cannot run scripts. Characters not
+// allowed in URLs are percent-encoded, and the result is escaped by HTML.
+func HTMLURL(in string) string {
+	if i := strings.IndexAny(in, ":/?#"); i > 0 && in[i] == ':' {
+		switch strings.ToLower(in[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "about:invalid#unsafe"
+		}
+	}
+	var out = &bytes.Buffer{}
+	var c byte
+	for i := 0; i < len(in); i++ {
+		c = in[i]
+		if (c >= 65 && c <= 90) || (c >= 97 && c <= 122) || (c >= 48 && c <= 57) || strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) >= 0 {
+			// a-zA-Z0-9 and reserved characters
+			out.WriteByte(c)
+		} else {
+			// UTF-8
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return HTML(out.String())
+}
@@ -40,3 +40,11 @@ func ExampleURLQueryParam() {
 	// Output:
 	// ?who=%D7%9E%D7%99%D7%99%D7%9F%20%D7%9E%D7%90%D7%9E%D7%A2%D7%9D
 }
+
+func ExampleHTMLURL() {
+	fmt.Printf("<a href=\"%s\">A link</a>\n", escape.HTMLURL("/search?q=a b&lang=\"en\""))
+	fmt.Printf("<a href=\"%s\">A link</a>", escape.HTMLURL("javascript:alert(1)"))
+	// Output:
+	// <a href="/search?q=a%20b&amp;lang=%22en%22">A link</a>
+	// <a href="about:invalid#unsafe">A link</a>
+}
@@ -2,17 +2,18 @@ package twig_test
 
 import (
 	"bytes"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/tyler-sommer/stick"
-	"github.com/tyler-sommer/stick/parse"
 	"github.com/tyler-sommer/stick/twig"
 )
 
-// This example shows how the AutoEscapeVisitor can be used to automatically
-// sanitize input. It does this by wrapping printed expressions with a filter
-// application, which resolves to stick.EscapeFilter.
+// This example shows how the AutoEscapeExtension can be used to automatically
+// sanitize input. Printed values are escaped using the strategy guessed from
+// the template name.
 func ExampleAutoEscapeExtension() {
 	env := twig.New(nil)
 	env.Execute("<html>{{ '<script>bad stuff</script>' }}", os.Stdout, map[string]stick.Value{})
@@ -34,45 +35,41 @@ func ExampleAutoEscapeExtension_alreadySafe() {
 	// <html>&lt;script&gt;bad script&lt;/script&gt; <script>good script</script>
 }
 
-func TestAutoEscapeVisitor(t *testing.T) {
-	env := twig.New(nil)
-	tree, err := env.Parse("Some {{ 'text' }}")
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	root := tree.Root()
-	a := root.All()
-	if l := len(a); l != 2 {
-		t.Errorf("expected two children, got %d", l)
-		return
-	}
-	ti, ok := a[0].(*parse.TextNode)
-	if !ok {
-		t.Errorf("expected TextNode, got %s", ti)
-		return
+func TestAutoEscapePrintPath(t *testing.T) {
+	loader := &stick.MemoryLoader{Templates: map[string]string{}}
+	env := twig.New(loader)
+	env.Filters["upper"] = func(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+		return strings.ToUpper(stick.CoerceString(val))
 	}
-	if tfi := ti.Data; tfi != "Some " {
-		t.Errorf("expected 'Some ', got %s", tfi)
-		return
+	tests := []struct {
+		tpl      string
+		expected string
+	}{
+		{`{{ v }}`, `&lt;b&gt;`},
+		{`{{ v|upper }}`, `&lt;B&gt;`},
+		{`{{ v|raw }}`, `<b>`},
+		{`{{ v|e }}`, `&lt;b&gt;`},
+		{`{{ v|escape('js') }}`, `\u003Cb\u003E`},
+		{`{{ safe }}`, `<i>`},
+		{`{{ safe_js }}`, `&lt;i&gt;`},
+		{`{{ lines|nl2br }}`, "a<br />\nb&lt;"},
+		{`{% macro m(v) %}<p>{{ v }}</p>{% endmacro %}{{ _self.m(v) }}`, `<p>&lt;b&gt;</p>`},
+		{`{% set c %}<p>{{ v }}</p>{% endset %}{{ c }}`, `<p>&lt;b&gt;</p>`},
 	}
-	fb, ok := a[1].(*parse.PrintNode)
-	if !ok {
-		t.Errorf("expected PrintNode, got %s", fb)
-		return
-	}
-	fi, ok := fb.X.(*parse.FilterExpr)
-	if !ok {
-		t.Errorf("expected FilterNode, got %s", fi)
-		return
-	}
-	fa, ok := fi.Args[0].(*parse.StringExpr)
-	if !ok {
-		t.Errorf("expected StringExpr, got %s", fa)
-		return
-	}
-	if fv := fa.Text; fv != "text" {
-		t.Errorf("expected 'text', got %s", fv)
+	for _, test := range tests {
+		loader.Templates["test.html.twig"] = test.tpl
+		buf := &bytes.Buffer{}
+		err := env.Execute("test.html.twig", buf, map[string]stick.Value{
+			"v":       "<b>",
+			"lines":   "a\nb<",
+			"safe":    stick.NewSafeValue("<i>", "html"),
+			"safe_js": stick.NewSafeValue("<i>", "js"),
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.tpl, err)
+		} else if actual := buf.String(); actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.tpl, test.expected, actual)
+		}
 	}
 }
 
@@ -95,3 +92,98 @@ func TestAutoEscapeExtension(t *testing.T) {
 		t.Errorf("expected output to be escaped, but got: %s", actual)
 	}
 }
+
+func TestAutoEscapeStrategies(t *testing.T) {
+	loader := &stick.MemoryLoader{Templates: map[string]string{}}
+	ext := twig.NewAutoEscapeExtension()
+	ext.Strategies["json"] = "js"
+	env := stick.New(loader)
+	if err := env.Register(ext); err != nil {
+		t.Fatalf("unexpected error registering extension: %s", err)
+	}
+	tests := map[string]string{
+		"page.html.twig":       `&lt;b&gt;`,
+		"page.twig":            `&lt;b&gt;`,
+		"page":                 `&lt;b&gt;`,
+		"page.xml.twig":        `&lt;b&gt;`,
+		"views/page.txt.twig":  `<b>`,
+		"page.txt":             `<b>`,
+		"script.js.twig":       `\u003Cb\u003E`,
+		"v1.2/data.json.twig":  `\u003Cb\u003E`,
+		"styles/main.css.twig": `\003Cb\003E`,
+	}
+	for name, expected := range tests {
+		loader.Templates[name] = "{{ v }}"
+		buf := &bytes.Buffer{}
+		if err := env.Execute(name, buf, map[string]stick.Value{"v": "<b>"}); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		} else if actual := buf.String(); actual != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestContextualEscaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		tpl      string
+		expected string
+		err      string
+	}{
+		{"text", `<p>{{ v }}</p>`, `<p>&lt;a href=&quot;x&quot;&gt; &amp; &#39;y&#39;</p>`, ""},
+		{"attribute", `<p title="{{ v }}" class={{ v }}>`, `<p title="&lt;a&#32;href&#61;&quot;x&quot;&gt;&#32;&amp;&#32;&#39;y&#39;" class=&lt;a&#32;href&#61;&quot;x&quot;&gt;&#32;&amp;&#32;&#39;y&#39;>`, ""},
+		{"url", `<a href="{{ url }}">`, `<a href="about:invalid#unsafe">`, ""},
+		{"url path", `<a href='/users/{{ v }}?q={{ v }}'>`, `<a href='/users/%3Ca%20href%3D%22x%22%3E%20%26%20%27y%27?q=%3Ca%20href%3D%22x%22%3E%20%26%20%27y%27'>`, ""},
+		{"event handler", `<a onclick="alert('{{ v }}')">`, `<a onclick="alert('\u003Ca\u0020href\u003D\u0022x\u0022\u003E\u0020\u0026\u0020\u0027y\u0027')">`, ""},
+		{"style", `<style>p { content: "{{ w }}" }</style><p style="color: {{ w }}">`, `<style>p { content: "a\0020b" }</style><p style="color: a\0020b">`, ""},
+		{"script", "<script>// {{ w }}\nvar s = \"'{{ w }}\";</script>{{ w }}", "<script>// a\\u0020b\nvar s = \"'a\\u0020b\";</script>a b", ""},
+		{"title", `<title>{{ v }}</title>`, `<title>&lt;a href=&quot;x&quot;&gt; &amp; &#39;y&#39;</title>`, ""},
+		{"raw", `<a href="{{ url|raw }}">`, `<a href="javascript:alert(1)">`, ""},
+		{"escape filter", `<a href="{{ w|e('url') }}">`, `<a href="a%20b">`, ""},
+		{"branches", `<a {% if w %}class="{{ w }}"{% else %}id="x"{% endif %}>{{ w }}</a>`, `<a class="a&#32;b">a b</a>`, ""},
+		{"loop", `<ul>{% for i in [w] %}<li title="{{ i }}">{{ i }}</li>{% endfor %}</ul>`, `<ul><li title="a&#32;b">a b</li></ul>`, ""},
+		{"url loop", `<a href="{% for i in [w, '?'] %}{{ i }}{% endfor %}">`, `<a href="a%20b?">`, ""},
+		{"include", `<div>{% include 'partial.html.twig' %}</div>`, `<div><i title="a&#32;b">a b</i></div>`, ""},
+		{"include url", `<div>{% include 'link.html.twig' %}</div>`, `<div><a href="about:invalid#unsafe" onclick="f('javascript\u003Aalert\u00281\u0029\u0027')"></a></div>`, ""},
+		{"extends", `{% extends 'layout.html.twig' %}{% block title %}{{ w }}{% endblock %}{% block link %}{{ url }}{% endblock %}`, `<title>a b</title><a href="about:invalid#unsafe">`, ""},
+		{"script value", `<script>var x = {{ w }};</script>`, "", "Contextual escaping: cannot print a value in JavaScript outside of a string literal on line 1, column 16 in test.html.twig"},
+		{"different branches", `{% if w %}<a href="{% endif %}{{ w }}`, "", "Contextual escaping: branches of if statement end in different contexts on line 1, column 3 in test.html.twig"},
+		{"loop context", `{% for i in [w] %}<p title="{{ i }}{% endfor %}`, "", "Contextual escaping: body of for loop ends in a different context than it starts on line 1, column 3 in test.html.twig"},
+		{"attribute name", `<p {{ w }}="{{ w }}">`, "", "Contextual escaping: cannot print the value of an attribute whose name is printed on line 1, column 12 in test.html.twig"},
+		{"block", `<p title="{% block b %}">{% endblock %}`, "", "Contextual escaping: block \"b\" ends in a different context than it starts on line 1, column 13 in test.html.twig"},
+	}
+	for _, test := range tests {
+		for _, engine := range []stick.Engine{stick.EngineTree, stick.EngineVM} {
+			for _, flags := range []int{0, stick.OptimizeAll} {
+				env := twig.New(stick.NewMemoryLoader(map[string]string{
+					"test.html.twig":    test.tpl,
+					"partial.html.twig": `<i title="{{ w }}">{{ w }}</i>`,
+					"link.html.twig":    `<a href="{{ js }}" onclick="f('{{ js }}')"></a>`,
+					"layout.html.twig":  `<title>{% block title %}{% endblock %}</title><a href="{% block link %}{% endblock %}">`,
+				}))
+				env.ContextualEscaping = true
+				env.Engine = engine
+				env.Optimizations = flags
+				actual, err := env.ExecuteToString("test.html.twig", map[string]stick.Value{
+					"v":   `<a href="x"> & 'y'`,
+					"w":   "a b",
+					"url": "javascript:alert(1)",
+					"js":  "javascript:alert(1)'",
+				})
+				if test.err != "" {
+					if err == nil || err.Error() != test.err {
+						t.Errorf("%s (optimizations %d): expected error %q, got %v", test.name, flags, test.err, err)
+					} else if !errors.Is(err, stick.ErrEscapeContext) {
+						t.Errorf("%s (optimizations %d): expected error to match ErrEscapeContext", test.name, flags)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s (optimizations %d): unexpected error: %s", test.name, flags, err)
+				} else if actual != test.expected {
+					t.Errorf("%s (optimizations %d): expected %q, got %q", test.name, flags, test.expected, actual)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package extra provides commonly used filters that are not part of Twig's
+// core, such as truncate and slug.
+//
+// The filters are registered as a bundle using the Extension:
+//
+//	env := twig.New(nil)
+//	env.Register(extra.New())
+package extra // import "github.com/tyler-sommer/stick/twig/extra"
+
+import (
+	"math/rand"
+	"strings"
+	"unicode"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig/internal/helper"
+)
+
+// Extension provides the extra filters.
+type Extension struct{}
+
+// New returns an Extension, ready to be registered with an Env.
+func New() *Extension {
+	return &Extension{}
+}
+
+// Init satisfies the stick.Extension interface. The filters themselves are
+// contributed by the Filters method.
+func (e *Extension) Init(env *stick.Env) error {
+	return nil
+}
+
+// Filters returns the extra filters.
+func (e *Extension) Filters() map[string]stick.Filter {
+	return map[string]stick.Filter{
+		"camelize":   filterCamelize,
+		"group_by":   filterGroupBy,
+		"shuffle":    filterShuffle,
+		"slug":       filterSlug,
+		"truncate":   filterTruncate,
+		"underscore": filterUnderscore,
+		"unique":     filterUnique,
+		"wordwrap":   filterWordwrap,
+	}
+}
+
+// filterTruncate takes 3 optional arguments, the maximum length (defaults to
+// 30), whether to preserve whole words (defaults to false), and the
+// separator appended to truncated values (defaults to "..."), and returns
+// val truncated to the given length.
+func filterTruncate(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	length := 30
+	preserve := false
+	separator := "..."
+	if len(args) >= 1 {
+		length = int(stick.CoerceNumber(args[0]))
+	}
+	if len(args) >= 2 {
+		preserve = stick.CoerceBool(args[1])
+	}
+	if len(args) >= 3 {
+		separator = stick.CoerceString(args[2])
+	}
+	runes := []rune(stick.CoerceString(val))
+	if len(runes) <= length || length < 0 {
+		return string(runes)
+	}
+	if preserve {
+		// Extend to the end of the current word.
+		for length < len(runes) && !unicode.IsSpace(runes[length]) {
+			length++
+		}
+		if length == len(runes) {
+			return string(runes)
+		}
+	}
+	return string(runes[:length]) + separator
+}
+
+// filterWordwrap takes 3 optional arguments, the line length (defaults to
+// 80), the line separator (defaults to "\n"), and whether to preserve whole
+// words (defaults to false), and returns val wrapped to the given length.
+func filterWordwrap(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	length := 80
+	separator := "\n"
+	preserve := false
+	if len(args) >= 1 {
+		length = int(stick.CoerceNumber(args[0]))
+	}
+	if len(args) >= 2 {
+		separator = stick.CoerceString(args[1])
+	}
+	if len(args) >= 3 {
+		preserve = stick.CoerceBool(args[2])
+	}
+	if length <= 0 {
+		helper.Warn(ctx, "wordwrap: length must be greater than 0, %d given", length)
+		return val
+	}
+	lines := strings.Split(stick.CoerceString(val), "\n")
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if preserve {
+			res = append(res, wrapWords(line, length)...)
+		} else {
+			res = append(res, wrapChars(line, length)...)
+		}
+	}
+	return strings.Join(res, separator)
+}
+
+// wrapChars splits line into chunks of length characters.
+func wrapChars(line string, length int) []string {
+	runes := []rune(line)
+	if len(runes) == 0 {
+		return []string{""}
+	}
+	var res []string
+	for len(runes) > length {
+		res = append(res, string(runes[:length]))
+		runes = runes[length:]
+	}
+	return append(res, string(runes))
+}
+
+// wrapWords splits line into lines of at most length characters, breaking
+// only between words. Words longer than length are not split.
+func wrapWords(line string, length int) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var res []string
+	curr := words[0]
+	for _, w := range words[1:] {
+		if len([]rune(curr))+1+len([]rune(w)) > length {
+			res = append(res, curr)
+			curr = w
+			continue
+		}
+		curr += " " + w
+	}
+	return append(res, curr)
+}
+
+// filterSlug takes 1 optional argument, the separator (defaults to "-"),
+// and returns val lower-cased with runs of non-alphanumeric characters
+// replaced by the separator.
+func filterSlug(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	separator := "-"
+	if len(args) >= 1 {
+		separator = stick.CoerceString(args[0])
+	}
+	return strings.Join(words(stick.CoerceString(val), false), separator)
+}
+
+// filterCamelize returns val in camel case, such as "fooBarBaz" for
+// "foo_bar baz".
+func filterCamelize(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	ws := words(stick.CoerceString(val), true)
+	for i, w := range ws {
+		if i > 0 {
+			r := []rune(w)
+			r[0] = unicode.ToUpper(r[0])
+			ws[i] = string(r)
+		}
+	}
+	return strings.Join(ws, "")
+}
+
+// filterUnderscore returns val in snake case, such as "foo_bar_baz" for
+// "fooBar baz".
+func filterUnderscore(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	return strings.Join(words(stick.CoerceString(val), true), "_")
+}
+
+// words splits s into lower-case words made up of letters and digits. If
+// camel is true, a change from lower to upper case also starts a new word.
+func words(s string, camel bool) []string {
+	var res []string
+	var curr []rune
+	var prev rune
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r) && camel && unicode.IsLower(prev) && len(curr) > 0:
+			res = append(res, string(curr))
+			curr = []rune{unicode.ToLower(r)}
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			curr = append(curr, unicode.ToLower(r))
+		case len(curr) > 0:
+			res = append(res, string(curr))
+			curr = nil
+		}
+		prev = r
+	}
+	if len(curr) > 0 {
+		res = append(res, string(curr))
+	}
+	return res
+}
+
+// filterShuffle returns the values of val in a random order.
+func filterShuffle(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	res := values(ctx, "shuffle", val)
+	for i := len(res) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// filterUnique returns the values of val with duplicates removed,
+// preserving the order in which they first appear.
+func filterUnique(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	res := make([]stick.Value, 0)
+	for _, v := range values(ctx, "unique", val) {
+		dup := false
+		for _, e := range res {
+			if stick.Equal(v, e) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// filterGroupBy takes 1 argument, the name of an attribute, and returns a
+// map of each distinct attribute value to the values of val having it.
+// Groups are ordered by their first value, and values are kept in their
+// original order within each group.
+func filterGroupBy(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if len(args) != 1 {
+		helper.Warn(ctx, "group_by: expected 1 argument, %d given", len(args))
+		return nil
+	}
+	res := stick.NewOrderedMap()
+	for _, v := range values(ctx, "group_by", val) {
+		key, err := stick.GetAttr(v, args[0])
+		if err != nil {
+			helper.Warn(ctx, "group_by: %s", err)
+			continue
+		}
+		k := stick.CoerceString(key)
+		group, _ := res.Get(k)
+		g, _ := group.([]stick.Value)
+		res.Set(k, append(g, v))
+	}
+	return res
+}
+
+// values returns the values of val as a slice.
+func values(ctx stick.Context, name string, val stick.Value) []stick.Value {
+	res := make([]stick.Value, 0)
+	if !stick.IsIterable(val) {
+		helper.Warn(ctx, "%s: value of type %T is not iterable", name, val)
+		return res
+	}
+	stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		res = append(res, v)
+		return false, nil
+	})
+	return res
+}
@@ -0,0 +1,68 @@
+package extra_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig"
+	"github.com/tyler-sommer/stick/twig/extra"
+)
+
+type post struct {
+	Title    string
+	Category string
+}
+
+func TestFilters(t *testing.T) {
+	env := twig.New(nil)
+	if err := env.Register(extra.New()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx := map[string]stick.Value{
+		"text":  "The quick brown fox jumps over the lazy dog",
+		"items": []stick.Value{3, 1, 3, "a", 1, "a"},
+		"posts": []post{{"One", "go"}, {"Two", "php"}, {"Three", "go"}},
+	}
+	tests := []struct {
+		tpl      string
+		expected string
+	}{
+		{"{{ text|truncate(9) }}", "The quick..."},
+		{"{{ text|truncate(6, true) }}", "The quick..."},
+		{"{{ text|truncate(12, false, '!') }}", "The quick br!"},
+		{"{{ 'short'|truncate }}", "short"},
+		{"{{ text|wordwrap(10, '|') }}", "The quick |brown fox |jumps over| the lazy |dog"},
+		{"{{ text|wordwrap(10, '|', true) }}", "The quick|brown fox|jumps over|the lazy|dog"},
+		{"{{ 'Hello, World! 2024'|slug }}", "hello-world-2024"},
+		{"{{ 'Hello World'|slug('_') }}", "hello_world"},
+		{"{{ 'foo_bar baz'|camelize }}", "fooBarBaz"},
+		{"{{ 'fooBar bazQux'|underscore }}", "foo_bar_baz_qux"},
+		{"{{ (items|unique)|join(',') }}", "3,1,a"},
+		{"{{ (items|shuffle)|length }}", "6"},
+		{"{% set groups = posts|group_by('Category') %}{% for p in groups.go %}{{ p.Title }}{% endfor %}", "OneThree"},
+	}
+	for _, test := range tests {
+		actual, err := env.ExecuteToString(test.tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.tpl, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.tpl, test.expected, actual)
+		}
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	shuffle := extra.New().Filters()["shuffle"]
+	vals := shuffle(nil, []int{1, 2, 3, 4}).([]stick.Value)
+	ints := make([]int, len(vals))
+	for i, v := range vals {
+		ints[i] = v.(int)
+	}
+	sort.Ints(ints)
+	for i, v := range ints {
+		if v != i+1 {
+			t.Errorf("expected shuffled values to contain %d, got %v", i+1, ints)
+		}
+	}
+}
@@ -2,18 +2,25 @@
 package filter // import "github.com/tyler-sommer/stick/twig/filter"
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
+	"math/big"
 	"net/url"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	"reflect"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig/escape"
+	"github.com/tyler-sommer/stick/twig/internal/helper"
 )
 
 // builtInFilters returns a map containing all built-in Twig filters,
@@ -44,6 +51,7 @@ func TwigFilters() map[string]stick.Filter {
 		"round":            filterRound,
 		"slice":            filterSlice,
 		"sort":             filterSort,
+		"sort_by":          filterSortBy,
 		"split":            filterSplit,
 		"striptags":        filterStripTags,
 		"title":            filterTitle,
@@ -54,8 +62,15 @@ func TwigFilters() map[string]stick.Filter {
 }
 
 // filterAbs takes no arguments and returns the absolute value of val.
-// Value val will be coerced into a number.
+// Value val will be coerced into a number, unless it is an exact number.
 func filterAbs(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if stick.IsExact(val) {
+		zero := stick.Sub(val, val)
+		if stick.Compare(val, zero) < 0 {
+			return stick.Sub(zero, val)
+		}
+		return val
+	}
 	n := stick.CoerceNumber(val)
 	if 0 == n {
 		return n
@@ -68,6 +83,9 @@ func filterAbs(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Va
 // of items per batch (defaults to 1), and the default fill value. If the
 // fill value is not specified, the last group of batched values may be smaller than
 // the number specified as items per batch.
+//
+// If val is a stream, such as a channel or a stick.Iterable, the result is
+// a stream of batches, read from val only as they are used.
 func filterBatch(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	perSlice := 1
 	var blankValue stick.Value
@@ -78,41 +96,37 @@ func filterBatch(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		}
 	}
 	if !stick.IsIterable(val) {
-		// TODO: This would trigger an E_WARNING in PHP.
+		helper.Warn(ctx, "batch: value of type %T is not iterable", val)
 		return nil
 	}
 	if perSlice <= 1 {
-		// TODO: This would trigger an E_WARNING in PHP.
+		helper.Warn(ctx, "batch: size must be greater than 1, %d given", perSlice)
 		return nil
 	}
-	l, _ := stick.Len(val)
-	numSlices := int(math.Ceil(float64(l) / float64(perSlice)))
-	out := make([][]stick.Value, numSlices)
-	curr := []stick.Value{}
-	i := 0
-	j := 0
-	_, err := stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
-		// Use a variable length slice and append(). This maintains
-		// correct compatibility with Twig when the fill value is nil.
-		curr = append(curr, v)
-		j++
-		if j == perSlice {
-			out[i] = curr
-			curr = []stick.Value{}
-			i++
-			j = 0
-		}
-		return false, nil
-	})
+	if isStream(val) {
+		return batchStream{val, perSlice, blankValue}
+	}
+	vals, err := stick.Values(val)
 	if err != nil {
-		// TODO: Report error
+		helper.Warn(ctx, "batch: %s", err)
 		return nil
 	}
-	if i != numSlices {
-		for ; blankValue != nil && j < perSlice; j++ {
-			curr = append(curr, blankValue)
+	// Each batch is a slice of vals, capped so that filling the last batch
+	// copies it instead of writing to vals.
+	out := make([][]stick.Value, 0, (len(vals)+perSlice-1)/perSlice)
+	for i := 0; i < len(vals); i += perSlice {
+		j := i + perSlice
+		if j > len(vals) {
+			j = len(vals)
 		}
-		out[i] = curr
+		out = append(out, vals[i:j:j])
+	}
+	if n := len(vals) % perSlice; n > 0 && blankValue != nil {
+		last := out[len(out)-1]
+		for ; n < perSlice; n++ {
+			last = append(last, blankValue)
+		}
+		out[len(out)-1] = last
 	}
 	return out
 }
@@ -124,21 +138,98 @@ func filterCapitalize(ctx stick.Context, val stick.Value, args ...stick.Value) s
 	return strings.ToUpper(s[:1]) + s[1:]
 }
 
+// filterConvertEncoding takes 2 arguments, the charset to convert to and
+// the charset to convert from, and returns val converted between them.
 func filterConvertEncoding(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	if len(args) != 2 {
+		helper.Warn(ctx, "convert_encoding: expected 2 arguments, %d given", len(args))
+		return val
+	}
+	res, err := stick.Decode(stick.CoerceString(val), stick.CoerceString(args[1]))
+	if err == nil {
+		res, err = stick.Encode(res, stick.CoerceString(args[0]))
+	}
+	if err != nil {
+		helper.Warn(ctx, "convert_encoding: %s", err)
+		return val
+	}
+	return res
+}
+
+// charsetOf returns the charset of the Env of ctx.
+func charsetOf(ctx stick.Context) string {
+	if env := helper.Env(ctx); env != nil {
+		return env.Charset
+	}
+	return stick.DefaultCharset
+}
+
+// decode converts s from the Env's charset to UTF-8.
+func decode(ctx stick.Context, s string) string {
+	charset := charsetOf(ctx)
+	if stick.IsUTF8(charset) {
+		return s
+	}
+	res, err := stick.Decode(s, charset)
+	if err != nil {
+		helper.Warn(ctx, "%s", err)
+		return s
+	}
+	return res
 }
 
+// encode converts the UTF-8 string s to the Env's charset.
+func encode(ctx stick.Context, s string) string {
+	charset := charsetOf(ctx)
+	if stick.IsUTF8(charset) {
+		return s
+	}
+	res, err := stick.Encode(s, charset)
+	if err != nil {
+		helper.Warn(ctx, "%s", err)
+		return s
+	}
+	return res
+}
+
+// Default formats used by the date filter when neither an argument nor an
+// Env setting is given.
+const (
+	defaultDateFormat         = "F j, Y H:i"
+	defaultDateIntervalFormat = "%d days"
+)
+
+// filterDate takes 2 optional arguments, a format in PHP date() syntax and
+// a timezone, and returns the formatted date. The date may be any value
+// accepted by stick.CoerceTime. If val is a time.Duration, the format is in
+// PHP DateInterval syntax instead.
+//
+// The Env's DateFormat, DateIntervalFormat, and Timezone are used when the
+// arguments are omitted or null. A timezone of false disables conversion.
 func filterDate(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	var requestedLayout string
-	dt, ok := val.(time.Time)
+	if d, ok := val.(time.Duration); ok {
+		format := defaultDateIntervalFormat
+		if len(args) >= 1 && args[0] != nil {
+			format = stick.CoerceString(args[0])
+		} else if env := helper.Env(ctx); env != nil && env.DateIntervalFormat != "" {
+			format = env.DateIntervalFormat
+		}
+		return formatInterval(d, format)
+	}
+	dt, ok := stick.CoerceTime(val)
 	if !ok {
-		// TODO: trigger runtime error
+		helper.Warn(ctx, "date: value of type %T is not a date", val)
 		return nil
 	}
 
-	if l := len(args); l >= 1 {
+	requestedLayout := defaultDateFormat
+	if len(args) >= 1 && args[0] != nil {
 		requestedLayout = stick.CoerceString(args[0])
+	} else if env := helper.Env(ctx); env != nil && env.DateFormat != "" {
+		requestedLayout = env.DateFormat
+	}
+	if loc, _ := helper.Location(ctx, "date", args, 1); loc != nil {
+		dt = dt.In(loc)
 	}
 
 	// build a golang date string
@@ -214,9 +305,109 @@ func filterDate(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 	return toReturn
 }
 
+// formatInterval formats d using a PHP DateInterval format string. Since a
+// time.Duration has no notion of months or years, "%y" and "%m" are always
+// zero and "%d" is the total number of days.
+func formatInterval(d time.Duration, format string) string {
+	sign := "+"
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	days := int64(d / (24 * time.Hour))
+	hours := int64(d/time.Hour) % 24
+	minutes := int64(d/time.Minute) % 60
+	seconds := int64(d/time.Second) % 60
+	var res bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			res.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'y', 'm':
+			res.WriteString("0")
+		case 'Y', 'M':
+			res.WriteString("00")
+		case 'd', 'a':
+			fmt.Fprintf(&res, "%d", days)
+		case 'D':
+			fmt.Fprintf(&res, "%02d", days)
+		case 'h':
+			fmt.Fprintf(&res, "%d", hours)
+		case 'H':
+			fmt.Fprintf(&res, "%02d", hours)
+		case 'i':
+			fmt.Fprintf(&res, "%d", minutes)
+		case 'I':
+			fmt.Fprintf(&res, "%02d", minutes)
+		case 's':
+			fmt.Fprintf(&res, "%d", seconds)
+		case 'S':
+			fmt.Fprintf(&res, "%02d", seconds)
+		case 'R':
+			res.WriteString(sign)
+		case 'r':
+			if sign == "-" {
+				res.WriteString(sign)
+			}
+		case '%':
+			res.WriteByte('%')
+		default:
+			res.WriteByte('%')
+			res.WriteByte(format[i])
+		}
+	}
+	return res.String()
+}
+
+// dateModifier matches a single relative date modification, such as
+// "+1 day" or "-2 hours".
+var dateModifier = regexp.MustCompile(`^\s*([+-]?\d+)\s*(year|month|week|day|hour|minute|min|second|sec)s?\b`)
+
+// filterDateModify takes 1 argument, a modifier such as "+1 day -2 hours",
+// and returns the modified date. The result is converted to the Env's
+// Timezone, if set.
 func filterDateModify(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	dt, ok := stick.CoerceTime(val)
+	if !ok {
+		helper.Warn(ctx, "date_modify: value of type %T is not a date", val)
+		return nil
+	}
+	var modifier string
+	if len(args) >= 1 {
+		modifier = stick.CoerceString(args[0])
+	}
+	for rest := modifier; strings.TrimSpace(rest) != ""; {
+		m := dateModifier.FindStringSubmatch(rest)
+		if m == nil {
+			helper.Warn(ctx, "date_modify: failed to parse modifier %q", modifier)
+			return val
+		}
+		rest = rest[len(m[0]):]
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "year":
+			dt = dt.AddDate(n, 0, 0)
+		case "month":
+			dt = dt.AddDate(0, n, 0)
+		case "week":
+			dt = dt.AddDate(0, 0, 7*n)
+		case "day":
+			dt = dt.AddDate(0, 0, n)
+		case "hour":
+			dt = dt.Add(time.Duration(n) * time.Hour)
+		case "minute", "min":
+			dt = dt.Add(time.Duration(n) * time.Minute)
+		case "second", "sec":
+			dt = dt.Add(time.Duration(n) * time.Second)
+		}
+	}
+	if loc, _ := helper.Location(ctx, "date_modify", nil, 0); loc != nil {
+		dt = dt.In(loc)
+	}
+	return dt
 }
 
 // filterDefault takes one argument, the default value. If val is empty,
@@ -238,14 +429,18 @@ func filterFirst(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		return arr.Index(0).Interface()
 	}
 
-	if stick.IsMap(val) {
-		// TODO: Trigger runtime error, Golang randomises map keys so getting the "First" does not make sense
-		return nil
+	if stick.IsIterable(val) {
+		var res stick.Value
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			res = v
+			return true, nil
+		})
+		return res
 	}
 
 	if s := stick.CoerceString(val); s != "" {
-		runes := []rune(s)
-		return string(runes[0])
+		runes := []rune(decode(ctx, s))
+		return encode(ctx, string(runes[0]))
 	}
 
 	return nil
@@ -266,27 +461,45 @@ func filterJoin(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 		separator = stick.CoerceString(args[0])
 	}
 
-	var slice []string
-	stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
-		slice = append(slice, stick.CoerceString(v))
-		return false, nil
-	})
-
-	return strings.Join(slice, separator)
+	if slice, ok := val.([]string); ok {
+		return strings.Join(slice, separator)
+	}
+	vals, _ := stick.Values(val)
+	var b strings.Builder
+	for i, v := range vals {
+		if i > 0 {
+			b.WriteString(separator)
+		}
+		b.WriteString(stick.CoerceString(v))
+	}
+	return b.String()
 }
 
 func filterJSONEncode(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	// TODO: implement flags
+	if isStream(val) {
+		// Streams are encoded as a list of their values.
+		vals, err := stick.Values(val)
+		if err != nil {
+			helper.Warn(ctx, "json_encode: %s", err)
+			return nil
+		}
+		val = vals
+	}
 	jsonData, err := json.Marshal(val)
 	if err != nil {
-		// TODO: Report error
+		helper.Warn(ctx, "json_encode: %s", err)
 		return nil
 	}
 
 	return string(jsonData)
 }
 
+// filterKeys returns the keys of val, in the order they are iterated.
 func filterKeys(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if m, ok := val.(*stick.OrderedMap); ok {
+		return m.Keys()
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array:
@@ -297,16 +510,22 @@ func filterKeys(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 		}
 		return res
 	case reflect.Map:
-		keys := r.MapKeys()
-		res := make([]string, 0)
-		for _, k := range keys {
+		res := make([]string, 0, r.Len())
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
 			res = append(res, fmt.Sprintf("%v", k))
-		}
-		sort.Strings(res)
+			return false, nil
+		})
 		return res
-	default:
-		return []string{}
 	}
+	if val != nil && stick.IsIterable(val) {
+		res := make([]stick.Value, 0)
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			res = append(res, k)
+			return false, nil
+		})
+		return res
+	}
+	return []string{}
 }
 
 func filterLast(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
@@ -315,34 +534,53 @@ func filterLast(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 		return arr.Index(arr.Len() - 1).Interface()
 	}
 
-	if stick.IsMap(val) {
-		// TODO: Trigger runtime error, Golang randomises map keys so getting the "Last" does not make sense
-		return nil
+	if stick.IsIterable(val) {
+		var res stick.Value
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			res = v
+			return false, nil
+		})
+		return res
 	}
 
 	if s := stick.CoerceString(val); s != "" {
-		runes := []rune(s)
-		return string(runes[len(runes)-1])
+		runes := []rune(decode(ctx, s))
+		return encode(ctx, string(runes[len(runes)-1]))
 	}
 
 	return nil
 }
 
-// filterLength returns the length of val.
+// filterLength returns the length of val. Streams are counted by reading
+// them, as with PHP's iterator_count, so a channel is consumed.
 func filterLength(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	if v, ok := val.(string); ok {
-		return utf8.RuneCountInString(v)
+		return utf8.RuneCountInString(decode(ctx, v))
+	}
+	if isStream(val) {
+		n, err := stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			return false, nil
+		})
+		if err != nil {
+			helper.Warn(ctx, "length: %s", err)
+		}
+		return n
+	}
+	l, err := stick.Len(val)
+	if err != nil {
+		helper.Warn(ctx, "length: %s", err)
 	}
-	l, _ := stick.Len(val)
-	// TODO: Report error
 	return l
 }
 
 // filterLower returns val transformed to lower-case.
 func filterLower(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	return strings.ToLower(stick.CoerceString(val))
+	return encode(ctx, strings.ToLower(decode(ctx, stick.CoerceString(val))))
 }
 
+// filterMerge returns val merged with the array or map in its argument. If
+// either of them is a stream, the result is a stream that yields the values
+// of val followed by those of the argument.
 func filterMerge(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	if !stick.IsIterable(val) {
 		return nil
@@ -352,47 +590,108 @@ func filterMerge(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		return nil
 	}
 
-	outMap, isObject := val.(map[string]stick.Value)
-
-	if isObject {
-		argMap, ok := args[0].(map[string]stick.Value)
-
-		if ok {
-			for k, v := range argMap {
-				outMap[k] = v
-			}
+	if stick.IsMap(val) {
+		// Entries of args[0] replace those with the same key, and new keys
+		// are added at the end.
+		outMap := stick.NewOrderedMap()
+		set := func(k, v stick.Value, l stick.Loop) (bool, error) {
+			outMap.Set(stick.CoerceString(k), v)
+			return false, nil
+		}
+		stick.Iterate(val, set)
+		if stick.IsMap(args[0]) {
+			stick.Iterate(args[0], set)
 		}
 
 		return outMap
+	} else if isStream(val) || isStream(args[0]) {
+		if !stick.IsIterable(args[0]) {
+			return concatStream{[]stick.Value{val}}
+		}
+		return concatStream{[]stick.Value{val, args[0]}}
 	} else {
-		var out []stick.Value
-
-		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
-			out = append(out, v)
-			return false, nil
-		})
-
-		stick.Iterate(args[0], func(k, v stick.Value, l stick.Loop) (bool, error) {
-			out = append(out, v)
-			return false, nil
-		})
-
-		return out
+		vals, _ := stick.Values(val)
+		more, _ := stick.Values(args[0])
+		out := make([]stick.Value, 0, len(vals)+len(more))
+		out = append(out, vals...)
+		return append(out, more...)
 	}
 }
 
+// filterNL2BR inserts HTML line breaks before each newline in val.
+// The input is HTML escaped, unless already safe, and the result is
+// marked safe for HTML.
 func filterNL2BR(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	s := stick.CoerceString(val)
+	if sval, ok := val.(stick.SafeValue); !ok || !sval.IsSafe("html") {
+		s = escape.HTML(s)
+	}
+	s = strings.Replace(s, "\n", "<br />\n", -1)
+	return stick.NewSafeValue(s, "html")
 }
 
+// filterNumberFormat takes 3 optional arguments, the number of decimal
+// places, the decimal point, and the thousands separator, and returns val
+// formatted as a number.
+//
+// The Env's NumberFormat is used when the arguments are omitted or null.
+// Exact numbers, such as decimals, are formatted without loss of precision.
 func filterNumberFormat(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	format := stick.NumberFormat{Decimals: 0, DecimalPoint: ".", ThousandsSeparator: ","}
+	if env := helper.Env(ctx); env != nil && env.NumberFormat != nil {
+		format = *env.NumberFormat
+	}
+	if len(args) >= 1 && args[0] != nil {
+		format.Decimals = int(stick.CoerceNumber(args[0]))
+	}
+	if len(args) >= 2 && args[1] != nil {
+		format.DecimalPoint = stick.CoerceString(args[1])
+	}
+	if len(args) >= 3 && args[2] != nil {
+		format.ThousandsSeparator = stick.CoerceString(args[2])
+	}
+	if format.Decimals < 0 {
+		format.Decimals = 0
+	}
+
+	var num string
+	var neg bool
+	if r, ok := exactRat(val); ok {
+		r = roundRat(r, format.Decimals, "")
+		num = new(big.Rat).Abs(r).FloatString(format.Decimals)
+		neg = r.Sign() < 0
+	} else {
+		n := stick.CoerceNumber(val)
+		mult := math.Pow10(format.Decimals)
+		n = mathRound(n*mult) / mult
+		num = strconv.FormatFloat(math.Abs(n), 'f', format.Decimals, 64)
+		neg = n < 0
+	}
+	intPart, fracPart := num, ""
+	if i := strings.IndexByte(num, '.'); i >= 0 {
+		intPart, fracPart = num[:i], num[i+1:]
+	}
+
+	var res bytes.Buffer
+	if neg {
+		res.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			res.WriteString(format.ThousandsSeparator)
+		}
+		res.WriteRune(c)
+	}
+	if fracPart != "" {
+		res.WriteString(format.DecimalPoint)
+		res.WriteString(fracPart)
+	}
+	return res.String()
 }
 
+// filterRaw returns val unchanged. When it is the last filter applied in a
+// print statement, the printed value is not auto-escaped.
 func filterRaw(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
 	return val
 }
 
@@ -429,7 +728,30 @@ func filterReverse(ctx stick.Context, val stick.Value, args ...stick.Value) stic
 	}
 
 	if stick.IsMap(val) {
-		return val
+		res := stick.NewOrderedMap()
+		var keys []string
+		var vals []stick.Value
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			keys = append(keys, stick.CoerceString(k))
+			vals = append(vals, v)
+			return false, nil
+		})
+		for i := len(keys) - 1; i >= 0; i-- {
+			res.Set(keys[i], vals[i])
+		}
+		return res
+	}
+
+	if val != nil && stick.IsIterable(val) {
+		var res []stick.Value
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			res = append(res, v)
+			return false, nil
+		})
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+		return res
 	}
 
 	if s := stick.CoerceString(val); s != "" {
@@ -443,6 +765,10 @@ func filterReverse(ctx stick.Context, val stick.Value, args ...stick.Value) stic
 	return nil
 }
 
+// filterRound takes 2 optional arguments, the precision and the rounding
+// method, "common", "ceil", or "floor", and returns val rounded. Exact
+// numbers, such as decimals, are rounded exactly, and the result is a
+// decimal.Decimal.
 func filterRound(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	input := stick.CoerceNumber(val)
 	precision := 0
@@ -457,6 +783,11 @@ func filterRound(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		algo = stick.CoerceString(args[1])
 	}
 
+	if r, ok := exactRat(val); ok {
+		d, _ := decimal.NewFromString(roundRat(r, precision, algo).FloatString(precision))
+		return d
+	}
+
 	mult := math.Pow10(precision)
 	switch algo {
 	case "ceil":
@@ -468,14 +799,240 @@ func filterRound(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 	}
 }
 
+// exactRat returns val as a rational number, if it is an exact number.
+func exactRat(val stick.Value) (*big.Rat, bool) {
+	if !stick.IsExact(val) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(stick.CoerceString(val))
+}
+
+// roundRat rounds r to the given number of decimal places, using the
+// rounding method algo, as in filterRound.
+func roundRat(r *big.Rat, precision int, algo string) *big.Rat {
+	mult := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil)
+	x := new(big.Rat).Mul(r, new(big.Rat).SetInt(mult))
+	n := new(big.Int)
+	switch algo {
+	case "ceil":
+		n.Neg(x.Num())
+		n.Div(n, x.Denom())
+		n.Neg(n)
+	case "floor":
+		n.Div(x.Num(), x.Denom())
+	default:
+		// Halves are rounded away from zero.
+		h := new(big.Rat).Abs(x)
+		h.Add(h, big.NewRat(1, 2))
+		n.Div(h.Num(), h.Denom())
+		if x.Sign() < 0 {
+			n.Neg(n)
+		}
+	}
+	return new(big.Rat).SetFrac(n, mult)
+}
+
+// filterSlice returns the part of val that starts at the offset given as
+// the first argument, with the length given as the optional second
+// argument. Value val may be a string, which is sliced by character, or an
+// array or map. A negative offset counts from the end, and a negative length
+// leaves off that many elements from the end. The keys of a map are kept,
+// while numeric keys are renumbered unless the third argument is true.
+//
+// If val is a stream, such as a channel or a stick.Iterable, and the offset
+// and length are not negative, the result is a stream that reads only as
+// much of val as it needs.
 func filterSlice(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	if len(args) == 0 {
+		helper.Warn(ctx, "slice: expected a start offset")
+		return val
+	}
+	start := int(stick.CoerceNumber(args[0]))
+	length := -1
+	hasLength := len(args) > 1 && args[1] != nil
+	if hasLength {
+		length = int(stick.CoerceNumber(args[1]))
+	}
+	preserveKeys := len(args) > 2 && stick.CoerceBool(args[2])
+	if !stick.IsIterable(val) {
+		s := []rune(decode(ctx, stick.CoerceString(val)))
+		i, j := sliceBounds(len(s), start, length, hasLength)
+		return encode(ctx, string(s[i:j]))
+	}
+	if isStream(val) && start >= 0 && (length >= 0 || !hasLength) {
+		return sliceStream{val, start, length, preserveKeys}
+	}
+	if stick.IsMap(val) {
+		n, _ := stick.Len(val)
+		i, j := sliceBounds(n, start, length, hasLength)
+		res := stick.NewOrderedMap()
+		c := 0
+		stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			if l.Index0 < i {
+				return false, nil
+			}
+			if l.Index0 >= j {
+				return true, nil
+			}
+			if _, ok := k.(string); !ok && !preserveKeys {
+				k = c
+				c++
+			}
+			res.Set(stick.CoerceString(k), v)
+			return false, nil
+		})
+		return res
+	}
+	vals, err := stick.Values(val)
+	if err != nil {
+		helper.Warn(ctx, "slice: %s", err)
+		return nil
+	}
+	i, j := sliceBounds(len(vals), start, length, hasLength)
+	return vals[i:j:j]
+}
+
+// sliceBounds returns the bounds of the slice of n elements that starts at
+// start and has the given length, as for PHP's array_slice.
+func sliceBounds(n, start, length int, hasLength bool) (int, int) {
+	if start < 0 {
+		start += n
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > n {
+		start = n
+	}
+	end := n
+	if hasLength {
+		if length < 0 {
+			end = n + length
+		} else if start+length < n {
+			end = start + length
+		}
+	}
+	if end < start {
+		end = start
+	}
+	return start, end
 }
 
+// filterSort returns the values of val sorted in ascending order, as
+// compared by stick.Compare. The keys of a map are kept with their values,
+// and the result is an *stick.OrderedMap. Strings are compared by the Env's
+// Collator, if it has one.
+//
+// Twig's optional comparison arrow function is not supported.
 func filterSort(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	// TODO: Implement Me
-	return val
+	if !stick.IsIterable(val) {
+		helper.Warn(ctx, "sort: value of type %T is not iterable", val)
+		return val
+	}
+	return sortValues(ctx, val, func(v stick.Value) []stick.Value {
+		return []stick.Value{v}
+	})
+}
+
+// filterSortBy returns the values of val sorted in ascending order by their
+// attributes named by args, such as sort_by('lastName', 'firstName').
+// Values are compared by the first attribute, then by the next one if they
+// are equal, and so on. Values that are still equal keep their order. The
+// keys of a map are kept with their values, and strings are compared, as
+// with filterSort.
+func filterSortBy(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if !stick.IsIterable(val) {
+		helper.Warn(ctx, "sort_by: value of type %T is not iterable", val)
+		return val
+	}
+	if len(args) == 0 {
+		helper.Warn(ctx, "sort_by: no attributes given")
+		return val
+	}
+	env := helper.Env(ctx)
+	return sortValues(ctx, val, func(v stick.Value) []stick.Value {
+		keys := make([]stick.Value, len(args))
+		for i, attr := range args {
+			// Values without the attribute sort as if it were null.
+			if env == nil {
+				keys[i], _ = stick.GetAttr(v, attr)
+			} else if a, err := env.GetAttr(v, attr); err != nil {
+				helper.Warn(ctx, "sort_by: %w", err)
+			} else {
+				keys[i] = a
+			}
+		}
+		return keys
+	})
+}
+
+// sortValues returns the values of val sorted in ascending order by the
+// keys returned by key for each value, keeping the order of values with
+// equal keys. The keys of a map are kept with their values, and the result
+// is an *stick.OrderedMap.
+func sortValues(ctx stick.Context, val stick.Value, key func(v stick.Value) []stick.Value) stick.Value {
+	var coll stick.Collator
+	if env := helper.Env(ctx); env != nil {
+		coll = env.Collator
+	}
+	var keys []stick.Value
+	var vals []stick.Value
+	var skeys [][]stick.Value
+	stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		keys = append(keys, k)
+		vals = append(vals, v)
+		skeys = append(skeys, key(v))
+		return false, nil
+	})
+	idx := make([]int, len(vals))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return compareSortKeys(coll, skeys[idx[i]], skeys[idx[j]]) < 0
+	})
+	if !stick.IsMap(val) {
+		res := make([]stick.Value, len(idx))
+		for i, n := range idx {
+			res[i] = vals[n]
+		}
+		return res
+	}
+	res := stick.NewOrderedMap()
+	for _, n := range idx {
+		res.Set(stick.CoerceString(keys[n]), vals[n])
+	}
+	return res
+}
+
+// compareSortKeys returns -1, 0, or 1 if the keys in a sort before, the
+// same as, or after the keys in b, comparing each pair of keys in turn.
+// Pairs of strings are compared by coll, if it is not nil.
+func compareSortKeys(coll stick.Collator, a, b []stick.Value) int {
+	for i := range a {
+		var r int
+		as, aok := sortString(a[i])
+		bs, bok := sortString(b[i])
+		if coll != nil && aok && bok {
+			r = coll.CompareString(as, bs)
+		} else {
+			r = stick.Compare(a[i], b[i])
+		}
+		if r != 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+// sortString returns v as a string, if it is one, to be compared by a
+// Collator.
+func sortString(v stick.Value) (string, bool) {
+	if sv, ok := v.(stick.SafeValue); ok {
+		v = sv.Value()
+	}
+	s, ok := v.(string)
+	return s, ok
 }
 
 func filterSplit(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
@@ -489,7 +1046,11 @@ func filterStripTags(ctx stick.Context, val stick.Value, args ...stick.Value) st
 }
 
 // filterTitle returns val with the first character of each word capitalized.
+//
+// The filter is deprecated, as it is implemented with strings.Title, which
+// does not handle Unicode punctuation properly.
 func filterTitle(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	helper.Deprecated(ctx, `The "title" filter is deprecated, as it uses strings.Title, which does not handle Unicode punctuation properly.`)
 	return strings.Title(stick.CoerceString(val))
 }
 
@@ -500,7 +1061,7 @@ func filterTrim(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 
 // filterUpper returns val in upper-case.
 func filterUpper(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
-	return strings.ToUpper(stick.CoerceString(val))
+	return encode(ctx, strings.ToUpper(decode(ctx, stick.CoerceString(val))))
 }
 
 func filterURLEncode(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
@@ -2,10 +2,12 @@ package filter
 
 import (
 	"fmt"
+	"math/big"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/tyler-sommer/stick"
 )
 
@@ -44,6 +46,8 @@ func TestFilters(t *testing.T) {
 		{"abs positive", func() stick.Value { return filterAbs(nil, 5.1) }, 5.1},
 		{"abs negative", func() stick.Value { return filterAbs(nil, -42) }, 42.0 /* note: coerced to float */},
 		{"abs invalid", func() stick.Value { return filterAbs(nil, "invalid") }, 0.0},
+		{"abs decimal", func() stick.Value { return filterAbs(nil, decimal.RequireFromString("-0.10000000000000000001")) }, "0.10000000000000000001"},
+		{"abs big int", func() stick.Value { return filterAbs(nil, big.NewInt(-42)) }, big.NewInt(42).String()},
 		{"len string", func() stick.Value { return filterLength(nil, "hello") }, 5},
 		{"len nil", func() stick.Value { return filterLength(nil, nil) }, 0},
 		{"len slice", func() stick.Value { return filterLength(nil, []string{"h", "e"}) }, 2},
@@ -67,7 +71,25 @@ func TestFilters(t *testing.T) {
 		{"date r", func() stick.Value { return filterDate(nil, testDate, "r") }, "Sat, 31 May 1980 22:01:00 +0800"},
 		{"date test", func() stick.Value { return filterDate(nil, testDate2, "d D j l F m M n Y y a A g G h H i s O P T") }, "03 Sat 3 Saturday February 02 Feb 2 2018 18 am AM 2 02 02 02 01 44 +0800 +08:00 AWST"},
 		{"date u", func() stick.Value { return filterDate(nil, testDate2, "s.u") }, "44.123456"},
+		{"number_format", func() stick.Value { return filterNumberFormat(nil, 1234567.891) }, "1,234,568"},
+		{"number_format decimals", func() stick.Value { return filterNumberFormat(nil, 1234.5678, 2) }, "1,234.57"},
+		{"number_format separators", func() stick.Value { return filterNumberFormat(nil, -1234567.5, 1, ",", ".") }, "-1.234.567,5"},
+		{"number_format small", func() stick.Value { return filterNumberFormat(nil, 999) }, "999"},
+		{"number_format decimal", func() stick.Value {
+			return filterNumberFormat(nil, decimal.RequireFromString("12345678901234567.895"), 2)
+		}, "12,345,678,901,234,567.90"},
+		{"number_format negative decimal", func() stick.Value { return filterNumberFormat(nil, decimal.RequireFromString("-0.005"), 2) }, "-0.01"},
+		{"number_format rat", func() stick.Value { return filterNumberFormat(nil, big.NewRat(2, 3), 3) }, "0.667"},
 		{"date S", func() stick.Value { return filterDate(nil, testDate, "S") }, "st"},
+		{"date default format", func() stick.Value { return filterDate(nil, testDate) }, "May 31, 1980 22:01"},
+		{"date timezone", func() stick.Value { return filterDate(nil, testDate, "H:i T", "UTC") }, "14:01 UTC"},
+		{"date timezone false", func() stick.Value { return filterDate(nil, testDate, nil, false) }, "May 31, 1980 22:01"},
+		{"date interval", func() stick.Value { return filterDate(nil, 50*time.Hour) }, "2 days"},
+		{"date interval format", func() stick.Value { return filterDate(nil, -(26*time.Hour + 5*time.Minute), "%R%a %H:%I %%") }, "-1 02:05 %"},
+		{"date_modify", func() stick.Value {
+			return filterDate(nil, filterDateModify(nil, testDate, "+1 day -2 hours +1 month"), "Y-m-d H:i")
+		}, "1980-07-01 20:01"},
+		{"date_modify invalid", func() stick.Value { return filterDateModify(nil, testDate, "sometime") }, testDate},
 		{"date S 2", func() stick.Value { return filterDate(nil, testDate2, "S") }, "rd"},
 		{"join", func() stick.Value { return filterJoin(nil, []string{"a", "b", "c"}, "-") }, "a-b-c"},
 		{"round common down", func() stick.Value { return filterRound(nil, 3.4) }, 3.0},
@@ -80,6 +102,10 @@ func TestFilters(t *testing.T) {
 		{"round ceil 2 digits", func() stick.Value { return filterRound(nil, 3.123, 2, "ceil") }, 3.13},
 		{"round floor", func() stick.Value { return filterRound(nil, 3.123, 0, "floor") }, 3.0},
 		{"round floor 2 digits", func() stick.Value { return filterRound(nil, 3.123, 2, "floor") }, 3.12},
+		{"round decimal", func() stick.Value { return filterRound(nil, decimal.RequireFromString("1.005"), 2) }, "1.01"},
+		{"round decimal ceil", func() stick.Value { return filterRound(nil, decimal.RequireFromString("-1.119"), 2, "ceil") }, "-1.11"},
+		{"round decimal floor", func() stick.Value { return filterRound(nil, decimal.RequireFromString("-1.111"), 2, "floor") }, "-1.12"},
+		{"round rat", func() stick.Value { return filterRound(nil, big.NewRat(5, 2)) }, "3"},
 		{"reverse array", func() stick.Value { return stickSliceToString(filterReverse(nil, []string{"1", "2", "3", "4"})) }, "4.3.2.1"},
 		{"reverse string", func() stick.Value { return filterReverse(nil, "1234") }, "4321"},
 		{"reverse string utf8", func() stick.Value { return filterReverse(nil, "東京") }, "京東"},
@@ -114,21 +140,102 @@ func TestFilters(t *testing.T) {
 		{
 			"merge object",
 			func() stick.Value {
-				return filterMerge(nil, map[string]stick.Value{"test": "wot"}, map[string]stick.Value{"foo": "bar"})
+				return stickMapToString(filterMerge(nil, map[string]stick.Value{"test": "wot"}, map[string]stick.Value{"foo": "bar"}))
 			},
-			func(actual stick.Value) (ex string, ok bool) {
-				ex = "map[foo:bar test:wot]"
-				ok = false
-				if v, ok := actual.(map[string]stick.Value); ok {
-					// elaborate check is needed here because map order is not guaranteed; a simple string
-					// comparison will not reliably pass.
-					if len(v) == 2 && v["test"] == "wot" && v["foo"] == "bar" {
-						return ex, true
-					}
-				}
-				return
+			"test=wot.foo=bar",
+		},
+		{
+			"merge ordered map",
+			func() stick.Value {
+				return stickMapToString(filterMerge(nil, orderedMap("b", 1, "a", 2), orderedMap("c", 3, "b", 4)))
+			},
+			"b=4.a=2.c=3",
+		},
+		{"first ordered map", func() stick.Value { return filterFirst(nil, orderedMap("b", 1, "a", 2)) }, 1},
+		{"first map", func() stick.Value { return filterFirst(nil, map[string]int{"b": 1, "a": 2}) }, 2},
+		{"last ordered map", func() stick.Value { return filterLast(nil, orderedMap("b", 1, "a", 2)) }, 2},
+		{"keys ordered map", func() stick.Value { return stickSliceToString(filterKeys(nil, orderedMap("b", 1, "a", 2))) }, "b.a"},
+		{"reverse ordered map", func() stick.Value { return stickMapToString(filterReverse(nil, orderedMap("b", 1, "a", 2))) }, "a=2.b=1"},
+		{"first channel", func() stick.Value { return filterFirst(nil, testChan(1, 2, 3)) }, 1},
+		{"last channel", func() stick.Value { return filterLast(nil, testChan(1, 2, 3)) }, 3},
+		{"keys channel", func() stick.Value { return stickSliceToString(filterKeys(nil, testChan("a", "b"))) }, "0.1"},
+		{"join channel", func() stick.Value { return filterJoin(nil, testChan("a", "b"), ",") }, "a,b"},
+		{"reverse channel", func() stick.Value { return stickSliceToString(filterReverse(nil, testChan(1, 2, 3))) }, "3.2.1"},
+		{"batch channel", func() stick.Value { return newBatchFunc(testChan(1, 2, 3), 2, 0)() }, "1.2..3.0.."},
+		{"sort array", func() stick.Value { return stickSliceToString(filterSort(nil, []int{3, 1, 2})) }, "1.2.3"},
+		{"sort ordered map", func() stick.Value { return stickMapToString(filterSort(nil, orderedMap("a", "z", "b", "x", "c", "y"))) }, "b=x.c=y.a=z"},
+		{"sort bytes", func() stick.Value { return stickSliceToString(filterSort(nil, []string{"b", "Z", "é", "a"})) }, "Z.a.b.é"},
+		{"sort_by", func() stick.Value { return sortedIDs(filterSortBy(nil, testPeople(), "last", "first")) }, "5.2.4.3.1"},
+		{"sort_by one key", func() stick.Value { return sortedIDs(filterSortBy(nil, testPeople(), "last")) }, "5.2.4.1.3"},
+		{"sort_by struct", func() stick.Value {
+			return stickSliceToString(filterSortBy(nil, []testPerson{{"Bo", 40}, {"Al", 30}, {"Cy", 30}}, "Age", "Name"))
+		}, "Al.Cy.Bo"},
+		{"sort_by map", func() stick.Value {
+			return stickMapToString(filterSortBy(nil, orderedMap("a", testPerson{"A", 3}, "b", testPerson{"B", 1}), "Age"))
+		}, "b=B.a=A"},
+		{"sort_by no attributes", func() stick.Value { return sortedIDs(filterSortBy(nil, testPeople())) }, "1.2.3.4.5"},
+		{
+			"merge object does not modify input",
+			func() stick.Value {
+				in := map[string]stick.Value{"test": "wot"}
+				filterMerge(nil, in, map[string]stick.Value{"foo": "bar"})
+				return len(in)
+			},
+			1,
+		},
+		{"join values", func() stick.Value { return filterJoin(nil, []stick.Value{"a", 1, true}, ",") }, "a,1,1"},
+		{"batch values", func() stick.Value { return newBatchFunc([]stick.Value{1, 2, 3}, 2, 0)() }, "1.2..3.0.."},
+		{
+			"batch values does not modify input",
+			func() stick.Value {
+				in := []stick.Value{1, 2, 3, 4}
+				filterBatch(nil, in[:3], 2, 0)
+				return in[3]
 			},
+			4,
 		},
+		{
+			"merge values does not modify input",
+			func() stick.Value {
+				in := make([]stick.Value, 1, 2)
+				in[0] = "a"
+				filterMerge(nil, in, []stick.Value{"b"})
+				return in[:2][1] == nil
+			},
+			true,
+		},
+		{"merge channel", func() stick.Value { return stickMapToString(filterMerge(nil, []int{1, 2}, testChan(3, 4))) }, "0=1.1=2.2=3.3=4"},
+		{"batch stream reads lazily", func() stick.Value {
+			src := countingStream(100)
+			stick.Iterate(filterBatch(nil, src.iterate, 2), func(k, v stick.Value, l stick.Loop) (bool, error) {
+				return true, nil
+			})
+			return src.reads < 10
+		}, true},
+		{"length channel", func() stick.Value { return filterLength(nil, testChan(1, 2, 3)) }, 3},
+		{"length stream", func() stick.Value { return filterLength(nil, countingStream(4).iterate) }, 4},
+		{"length batched channel", func() stick.Value { return filterLength(nil, filterBatch(nil, testChan(1, 2, 3, 4), 3)) }, 2},
+		{"length merged stream", func() stick.Value { return filterLength(nil, filterMerge(nil, testChan(1, 2, 3), []int{8, 9})) }, 5},
+		{"slice string", func() stick.Value { return filterSlice(nil, "héllo", 1, 3) }, "éll"},
+		{"slice string negative", func() stick.Value { return filterSlice(nil, "hello", -3) }, "llo"},
+		{"slice string negative length", func() stick.Value { return filterSlice(nil, "hello", 1, -1) }, "ell"},
+		{"slice string out of range", func() stick.Value { return filterSlice(nil, "hello", 10, 2) }, ""},
+		{"slice array", func() stick.Value { return stickSliceToString(filterSlice(nil, []int{1, 2, 3, 4}, 1, 2)) }, "2.3"},
+		{"slice array negative", func() stick.Value { return stickSliceToString(filterSlice(nil, []int{1, 2, 3, 4}, -2)) }, "3.4"},
+		{"slice ordered map", func() stick.Value {
+			return stickMapToString(filterSlice(nil, orderedMap("a", 1, "b", 2, "c", 3), 1, 1))
+		}, "b=2"},
+		{"slice int keys", func() stick.Value { return stickMapToString(filterSlice(nil, map[int]int{5: 1, 6: 2, 7: 3}, 1)) }, "0=2.1=3"},
+		{"slice int keys preserved", func() stick.Value {
+			return stickMapToString(filterSlice(nil, map[int]int{5: 1, 6: 2, 7: 3}, 1, nil, true))
+		}, "6=2.7=3"},
+		{"slice channel", func() stick.Value { return stickMapToString(filterSlice(nil, testChan(1, 2, 3, 4), 1, 2)) }, "0=2.1=3"},
+		{"slice channel preserving keys", func() stick.Value { return stickMapToString(filterSlice(nil, testChan(1, 2, 3, 4), 2, nil, true)) }, "2=3.3=4"},
+		{"slice channel negative", func() stick.Value { return stickSliceToString(filterSlice(nil, testChan(1, 2, 3, 4), -2)) }, "3.4"},
+		{"slice stream reads lazily", func() stick.Value {
+			src := countingStream(100)
+			return stickSliceToString(filterSlice(nil, src.iterate, 1, 2)) + fmt.Sprint(src.reads < 10)
+		}, "1.2true"},
 		{"urlencode", func() stick.Value { return filterURLEncode(nil, "http://test.com/dude?sweet=33&1=2") }, "http%3A%2F%2Ftest.com%2Fdude%3Fsweet%3D33%261%3D2"},
 	}
 	for _, test := range tests {
@@ -165,3 +272,81 @@ func stickSliceToString(value stick.Value) (output string) {
 
 	return strings.Join(slice, ".")
 }
+
+type testPerson struct {
+	Name string
+	Age  int
+}
+
+func (p testPerson) String() string {
+	return p.Name
+}
+
+func testPeople() []stick.Value {
+	return []stick.Value{
+		map[string]stick.Value{"id": 1, "last": "Smith", "first": "John"},
+		map[string]stick.Value{"id": 2, "last": "Doe", "first": "Jane"},
+		map[string]stick.Value{"id": 3, "last": "Smith", "first": "Anna"},
+		map[string]stick.Value{"id": 4, "last": "Doe", "first": "Jane"},
+		map[string]stick.Value{"id": 5, "first": "Zed"},
+	}
+}
+
+// sortedIDs returns the ids of the sorted people, as given by testPeople.
+func sortedIDs(value stick.Value) string {
+	var ids []string
+	stick.Iterate(value, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		id, _ := stick.GetAttr(v, "id")
+		ids = append(ids, stick.CoerceString(id))
+		return false, nil
+	})
+	return strings.Join(ids, ".")
+}
+
+func stickMapToString(value stick.Value) string {
+	var entries []string
+	stick.Iterate(value, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		entries = append(entries, stick.CoerceString(k)+"="+stick.CoerceString(v))
+		return false, nil
+	})
+	return strings.Join(entries, ".")
+}
+
+// orderedMap returns an OrderedMap of the given keys and values.
+func orderedMap(kvs ...stick.Value) *stick.OrderedMap {
+	res := stick.NewOrderedMap()
+	for i := 0; i < len(kvs); i += 2 {
+		res.Set(stick.CoerceString(kvs[i]), kvs[i+1])
+	}
+	return res
+}
+
+// A testStream is an iterator function over the numbers 0 to n-1 that
+// counts how many of them have been read.
+type testStream struct {
+	n     int
+	reads int
+}
+
+func countingStream(n int) *testStream {
+	return &testStream{n: n}
+}
+
+func (s *testStream) iterate(yield func(stick.Value) bool) {
+	for i := 0; i < s.n; i++ {
+		s.reads++
+		if !yield(i) {
+			return
+		}
+	}
+}
+
+// testChan returns a closed channel containing vals.
+func testChan(vals ...stick.Value) <-chan stick.Value {
+	ch := make(chan stick.Value, len(vals))
+	for _, v := range vals {
+		ch <- v
+	}
+	close(ch)
+	return ch
+}
@@ -0,0 +1,97 @@
+package filter
+
+import "github.com/tyler-sommer/stick"
+
+// isStream returns true if val is an iterable value that produces its
+// elements one at a time, such as a channel, an iterator function, or a
+// stick.Iterable like a database cursor. Filters applied to a stream return
+// a stream themselves, so that a large collection is never read into memory
+// at once.
+func isStream(val stick.Value) bool {
+	return stick.IsIterable(val) && !stick.IsArray(val) && !stick.IsMap(val)
+}
+
+// A batchStream is the result of the batch filter applied to a stream. It
+// reads one batch at a time from src.
+type batchStream struct {
+	src  stick.Value
+	size int
+	fill stick.Value
+}
+
+// Iterate implements stick.Iterable.
+func (s batchStream) Iterate(yield func(k, v stick.Value) bool) error {
+	var curr []stick.Value
+	n := 0
+	stop := false
+	_, err := stick.Iterate(s.src, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		curr = append(curr, v)
+		if len(curr) < s.size {
+			return false, nil
+		}
+		stop = !yield(n, curr)
+		curr = nil
+		n++
+		return stop, nil
+	})
+	if err != nil || stop || len(curr) == 0 {
+		return err
+	}
+	for s.fill != nil && len(curr) < s.size {
+		curr = append(curr, s.fill)
+	}
+	yield(n, curr)
+	return nil
+}
+
+// A concatStream is the result of the merge filter applied to a stream. It
+// yields the values of each of its sources in turn, numbered from 0.
+type concatStream struct {
+	srcs []stick.Value
+}
+
+// Iterate implements stick.Iterable.
+func (s concatStream) Iterate(yield func(k, v stick.Value) bool) error {
+	n := 0
+	for _, src := range s.srcs {
+		stop := false
+		_, err := stick.Iterate(src, func(k, v stick.Value, l stick.Loop) (bool, error) {
+			stop = !yield(n, v)
+			n++
+			return stop, nil
+		})
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// A sliceStream is the result of the slice filter applied to a stream. It
+// yields length elements of src, or all remaining elements if length is
+// negative, after skipping the first start elements.
+type sliceStream struct {
+	src          stick.Value
+	start        int
+	length       int
+	preserveKeys bool
+}
+
+// Iterate implements stick.Iterable.
+func (s sliceStream) Iterate(yield func(k, v stick.Value) bool) error {
+	if s.length == 0 {
+		return nil
+	}
+	n := 0
+	_, err := stick.Iterate(s.src, func(k, v stick.Value, l stick.Loop) (bool, error) {
+		if l.Index0 < s.start {
+			return false, nil
+		}
+		if !s.preserveKeys {
+			k = n
+		}
+		n++
+		return !yield(k, v) || n == s.length, nil
+	})
+	return err
+}
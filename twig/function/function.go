@@ -0,0 +1,54 @@
+// Package function provides built-in functions for Twig-compatibility.
+package function // import "github.com/tyler-sommer/stick/twig/function"
+
+import (
+	"time"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig/internal/helper"
+)
+
+// TwigFunctions returns a map containing all built-in Twig functions.
+func TwigFunctions() map[string]stick.Func {
+	return map[string]stick.Func{
+		"date":            functionDate,
+		"template_exists": functionTemplateExists,
+	}
+}
+
+// functionDate takes 2 optional arguments, a date and a timezone, and
+// returns the date as a time.Time. The date may be any value accepted by
+// stick.CoerceTime; if it is omitted or null, the current time is used.
+//
+// The result is converted to the given timezone, or the Env's Timezone if
+// the argument is omitted or null. A timezone of false disables conversion.
+func functionDate(ctx stick.Context, args ...stick.Value) stick.Value {
+	dt := time.Now()
+	if len(args) >= 1 && args[0] != nil {
+		t, ok := stick.CoerceTime(args[0])
+		if !ok {
+			helper.Warn(ctx, "date: cannot convert %q to a date", stick.CoerceString(args[0]))
+			return nil
+		}
+		dt = t
+	}
+	loc, ok := helper.Location(ctx, "date", args, 1)
+	if !ok {
+		return nil
+	}
+	if loc != nil {
+		dt = dt.In(loc)
+	}
+	return dt
+}
+
+// functionTemplateExists takes 1 argument, the name of a template, and
+// returns true if the template exists, so that optional partials can be
+// included only when they are present.
+func functionTemplateExists(ctx stick.Context, args ...stick.Value) stick.Value {
+	if len(args) != 1 || ctx == nil {
+		helper.Warn(ctx, "template_exists: expected 1 argument, got %d", len(args))
+		return false
+	}
+	return ctx.Env().Exists(stick.CoerceString(args[0]))
+}
@@ -0,0 +1,68 @@
+package function
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+)
+
+func TestFunctions(t *testing.T) {
+	perth, err := time.LoadLocation("Australia/Perth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates := map[string]string{"partial.twig": "partial"}
+	env := stick.New(&stick.MemoryLoader{Templates: templates})
+	for name, fn := range TwigFunctions() {
+		env.Functions[name] = fn
+	}
+	env.Filters["format"] = func(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+		if t, ok := val.(time.Time); ok {
+			return t.Format(stick.CoerceString(args[0]))
+		}
+		return "not a date"
+	}
+	env.Timezone = perth
+	var warnings []string
+	env.WarningHandler = func(w stick.Warning) {
+		warnings = append(warnings, w.Err.Error())
+	}
+	ctx := map[string]stick.Value{"d": time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	tests := []struct {
+		tpl      string
+		expected string
+		warning  string
+	}{
+		{"{{ date(d)|format('2006-01-02 15:04 MST') }}", "2020-01-02 11:04 AWST", ""},
+		{"{{ date(d, 'UTC')|format('15:04 MST') }}", "03:04 UTC", ""},
+		{"{{ date(d, false)|format('15:04 MST') }}", "03:04 UTC", ""},
+		{"{{ date(0, 'UTC')|format('2006') }}", "1970", ""},
+		{"{{ date('2020-01-02', 'UTC')|format('Jan 2') }}", "Jan 2", ""},
+		{"{{ date()|format('MST') }}", "AWST", ""},
+		{"{{ date('nope')|format('2006') }}", "not a date", `date: cannot convert "nope" to a date`},
+		{"{{ date(d, 'Nowhere/Nope')|format('2006') }}", "not a date", "date: unknown time zone Nowhere/Nope"},
+		{"{{ template_exists('partial.twig') ? 'yes' : 'no' }}", "yes", ""},
+		{"{{ template_exists('missing.twig') ? 'yes' : 'no' }}", "no", ""},
+		{"{{ template_exists() ? 'yes' : 'no' }}", "no", "template_exists: expected 1 argument, got 0"},
+	}
+	for _, test := range tests {
+		templates[test.tpl] = test.tpl
+	}
+	for _, test := range tests {
+		warnings = nil
+		actual, err := env.ExecuteToString(test.tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.tpl, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.tpl, test.expected, actual)
+		}
+		if test.warning == "" && len(warnings) > 0 {
+			t.Errorf("%s: unexpected warnings %q", test.tpl, warnings)
+		} else if test.warning != "" && (len(warnings) != 1 || warnings[0] != test.warning) {
+			t.Errorf("%s: expected warning %q, got %q", test.tpl, test.warning, warnings)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package helper provides functions shared by the packages implementing
+// Twig's filters and functions.
+package helper // import "github.com/tyler-sommer/stick/twig/internal/helper"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+)
+
+// Warn reports a recoverable problem to the Env's WarningHandler, in the
+// same situations where PHP would trigger an E_WARNING. Nothing is
+// reported if ctx is nil, such as when a filter is called directly.
+func Warn(ctx stick.Context, format string, args ...interface{}) {
+	if ctx == nil {
+		return
+	}
+	ctx.Warn(fmt.Errorf(format, args...))
+}
+
+// Deprecated reports the use of a deprecated feature to the Env's
+// DeprecationHandler. Nothing is reported if ctx is nil.
+func Deprecated(ctx stick.Context, msg string) {
+	if ctx == nil {
+		return
+	}
+	ctx.Deprecated(msg)
+}
+
+// Env returns the Env of ctx, or nil if ctx is nil.
+func Env(ctx stick.Context) *stick.Env {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Env()
+}
+
+// Location returns the timezone given by args[i], or the Env's Timezone if
+// the argument is omitted or null. The timezone is nil if dates should not
+// be converted, such as when the argument is false. If the argument is not
+// a valid timezone, a warning is reported for the named filter or function
+// and false is returned.
+func Location(ctx stick.Context, name string, args []stick.Value, i int) (*time.Location, bool) {
+	if len(args) <= i || args[i] == nil {
+		if env := Env(ctx); env != nil {
+			return env.Timezone, true
+		}
+		return nil, true
+	}
+	switch tz := args[i].(type) {
+	case *time.Location:
+		return tz, true
+	case bool:
+		if !tz {
+			return nil, true
+		}
+	}
+	loc, err := time.LoadLocation(stick.CoerceString(args[i]))
+	if err != nil {
+		Warn(ctx, "%s: %s", name, err)
+		return nil, false
+	}
+	return loc, true
+}
@@ -0,0 +1,34 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+)
+
+func TestLocation(t *testing.T) {
+	perth, err := time.LoadLocation("Australia/Perth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		args     []stick.Value
+		expected *time.Location
+		ok       bool
+	}{
+		{"omitted", nil, nil, true},
+		{"null", []stick.Value{nil}, nil, true},
+		{"false", []stick.Value{false}, nil, true},
+		{"location", []stick.Value{perth}, perth, true},
+		{"name", []stick.Value{"Australia/Perth"}, perth, true},
+		{"invalid", []stick.Value{"Nowhere/Nope"}, nil, false},
+	}
+	for _, test := range tests {
+		loc, ok := Location(nil, "test", test.args, 0)
+		if ok != test.ok || loc.String() != test.expected.String() {
+			t.Errorf("%s: expected %v, %v, got %v, %v", test.name, test.expected, test.ok, loc, ok)
+		}
+	}
+}
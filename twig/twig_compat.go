@@ -29,6 +29,7 @@ import (
 	"github.com/tyler-sommer/stick"
 	"github.com/tyler-sommer/stick/parse"
 	"github.com/tyler-sommer/stick/twig/filter"
+	"github.com/tyler-sommer/stick/twig/function"
 )
 
 // New creates a new, default Env that aims to be compatible with Twig.
@@ -39,10 +40,16 @@ func New(loader stick.Loader) *stick.Env {
 	}
 	env := &stick.Env{
 		Loader:    loader,
-		Functions: make(map[string]stick.Func),
+		Functions: function.TwigFunctions(),
 		Filters:   filter.TwigFilters(),
 		Tests:     make(map[string]stick.Test),
 		Visitors:  make([]parse.NodeVisitor, 0),
+		Globals:   make(map[string]stick.Value),
+		Escapers:  make(map[string]stick.Escaper),
+		Operators: make(map[string]stick.Operator),
+		Tags:      make(map[string]parse.TagParser),
+
+		TemplateEscapeStrategies: make(map[string]string),
 	}
 	env.Register(NewAutoEscapeExtension())
 	return env
@@ -0,0 +1,254 @@
+package twig_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig"
+)
+
+func TestDateDefaults(t *testing.T) {
+	env := twig.New(nil)
+	env.DateFormat = "Y-m-d H:i"
+	env.DateIntervalFormat = "%h hours"
+	env.Timezone = time.UTC
+	tz := time.FixedZone("UTC+2", 2*60*60)
+	ref := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	ctx := map[string]stick.Value{
+		"d":   time.Date(2020, 1, 2, 3, 4, 0, 0, tz),
+		"dur": 5 * time.Hour,
+		"dp":  &ref,
+	}
+	tests := map[string]string{
+		"{{ d|date }}":              "2020-01-02 01:04",
+		"{{ d|date('H:i') }}":       "01:04",
+		"{{ d|date(null, false) }}": "2020-01-02 03:04",
+		"{{ dur|date }}":            "5 hours",
+		"{{ (d|date_modify('+1 day'))|date('Y-m-d H:i T') }}": "2020-01-03 01:04 UTC",
+		"{{ date(d)|date('T') }}":                             "UTC",
+		"{{ date(0)|date('Y') }}":                             "1970",
+		"{{ '2020-01-02 03:04:05'|date }}":                    "2020-01-02 03:04",
+		"{{ 1577934245|date('Y-m-d') }}":                      "2020-01-02",
+		"{{ dp|date('Y-m-d') }}":                              "2020-01-02",
+		"{{ ('2020-01-02'|date_modify('+1 day'))|date }}":     "2020-01-03 00:00",
+		"{{ date('2020-01-02T00:00:00Z')|date('Y') }}":        "2020",
+		"{{ (d > '2020-01-01') ? 'after' : 'before' }}":       "after",
+		"{% if not date('soon') %}invalid{% endif %}":         "invalid",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestNumberFormatDefaults(t *testing.T) {
+	env := twig.New(nil)
+	env.NumberFormat = &stick.NumberFormat{Decimals: 2, DecimalPoint: ",", ThousandsSeparator: " "}
+	tests := map[string]string{
+		"{{ 1234.5|number_format }}":                 "1 234,50",
+		"{{ 1234.5|number_format(0) }}":              "1 235",
+		"{{ 1234.5|number_format(1, '.') }}":         "1 234.5",
+		"{{ 1234.5|number_format(null, null, '') }}": "1234,50",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+// foldCollator compares strings ignoring case.
+type foldCollator struct{}
+
+func (foldCollator) CompareString(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+func TestSortCollator(t *testing.T) {
+	env := twig.New(nil)
+	ctx := map[string]stick.Value{
+		"names": []string{"bo", "Anna", "Cid", "anders"},
+		"mixed": []stick.Value{"b", 2, "A", 1},
+	}
+	tests := map[string]string{
+		"{{ (names|sort)|join(', ') }}": "Anna, Cid, anders, bo",
+		"{{ (mixed|sort)|join(', ') }}": "1, 2, A, b",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+	env.Collator = foldCollator{}
+	tests = map[string]string{
+		"{{ (names|sort)|join(', ') }}": "anders, Anna, bo, Cid",
+		"{{ (mixed|sort)|join(', ') }}": "1, 2, A, b",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	env := twig.New(nil)
+	env.Collator = foldCollator{}
+	ctx := map[string]stick.Value{"people": []map[string]string{
+		{"first": "Bo", "last": "van Dijk"},
+		{"first": "bea", "last": "Berg"},
+		{"first": "Anna", "last": "Berg"},
+		{"first": "Cid", "last": "Zorn"},
+	}}
+	tpl := "{% for p in people|sort_by('last', 'first') %}{{ p.first }} {{ p.last }}, {% endfor %}"
+	actual, err := env.ExecuteToString(tpl, ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "Anna Berg, bea Berg, Bo van Dijk, Cid Zorn, "; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	var warnings []stick.Warning
+	env.WarningHandler = func(w stick.Warning) {
+		warnings = append(warnings, w)
+	}
+	ctx = map[string]stick.Value{"items": []sortItem{{"b", 1}, {"a", 2}}}
+	tpl = "{% for i in items|sort_by('Name', 'missing') %}{{ i.Name }}{% endfor %}"
+	if actual, err = env.ExecuteToString(tpl, ctx); err != nil || actual != "ab" {
+		t.Errorf("expected %q, got %q, %v", "ab", actual, err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings for a missing attribute, got %v", warnings)
+	}
+	env.SecurityPolicy = &stick.AllowListPolicy{Properties: map[string][]string{"twig_test.sortItem": {"Name"}}}
+	tpl = "{% for i in items|sort_by('Secret') %}{% endfor %}"
+	if _, err = env.ExecuteToString(tpl, ctx); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(warnings) == 0 || !errors.Is(warnings[0].Err, stick.ErrSecurityViolation) {
+		t.Errorf("expected a security violation warning, got %v", warnings)
+	}
+}
+
+type sortItem struct {
+	Name   string
+	Secret int
+}
+
+func TestHashOrder(t *testing.T) {
+	env := twig.New(nil)
+	tests := map[string]string{
+		`{% set h = {b: 1, a: 2} %}{{ (h|keys)|join(",") }}`:                      "b,a",
+		`{{ {b: 1, a: 2}|first }}{{ {b: 1, a: 2}|last }}`:                         "12",
+		`{% set h = {b: 1, a: 2}|merge({c: 3, b: 4}) %}{{ (h|json_encode)|raw }}`: `{"b":4,"a":2,"c":3}`,
+		`{% set h = {b: 2, a: 3, c: 1}|sort %}{{ (h|keys)|join(",") }}`:           "c,b,a",
+		`{% set h = {b: 1, a: 2}|reverse %}{{ (h|json_encode)|raw }}`:             `{"a":2,"b":1}`,
+		`{% for k, v in {z: 1, y: 2} %}{{ k }}={{ v }};{% endfor %}`:              "z=1;y=2;",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	env := twig.New(nil)
+	ctx := map[string]stick.Value{
+		"items": func(yield func(stick.Value) bool) {
+			for i := 0; i < 5 && yield(i); i++ {
+			}
+		},
+	}
+	tests := map[string]string{
+		`{% for b in items|batch(2) %}{{ b|join(",") }};{% endfor %}`: "0,1;2,3;4;",
+		`{% for v in items|slice(1, 2) %}{{ v }}{% endfor %}`:         "12",
+		`{% for v in items|merge([9]) %}{{ v }}{% endfor %}`:          "012349",
+		`{{ (items|slice(3))|join(",") }}`:                            "3,4",
+		`{{ 'stream'|slice(1, 3) }}`:                                  "tre",
+		`{{ (items|merge([8, 9]))|first }}`:                           "0",
+		`{{ (items|merge([8, 9]))|last }}`:                            "9",
+		`{{ ((items|merge([8, 9]))|reverse)|join(",") }}`:             "9,8,4,3,2,1,0",
+		`{{ ((items|merge([8, 9]))|keys)|join(",") }}`:                "0,1,2,3,4,5,6",
+		`{{ (items|merge([8, 9]))|length }}`:                          "7",
+		`{{ (items|merge([8, 9]))|json_encode }}`:                     "[0,1,2,3,4,8,9]",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestTemplateExists(t *testing.T) {
+	env := twig.New(stick.NewMemoryLoader(map[string]string{
+		"page.twig": `{{ template_exists("page.twig") ? "yes" : "no" }} {{ template_exists("missing.twig") ? "yes" : "no" }}`,
+	}))
+	actual, err := env.ExecuteToString("page.twig", nil)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if expected := "yes no"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	env := twig.New(nil)
+	env.Charset = "ISO-8859-1"
+	ctx := map[string]stick.Value{"s": "\xe9t\xe9 <b>"}
+	tests := map[string]string{
+		"{{ s }}":                "\xe9t\xe9 &lt;b&gt;",
+		"{{ s|length }}":         "7",
+		"{{ s|upper }}":          "\xc9T\xc9 &lt;B&gt;",
+		"{{ s|first }}":          "\xe9",
+		"{{ s|e('html_attr') }}": "&#233;t&#233;&#32;&lt;b&gt;",
+		"{{ s|convert_encoding('UTF-8', 'ISO-8859-1') }}": "été &lt;b&gt;",
+	}
+	for tpl, expected := range tests {
+		actual, err := env.ExecuteToString(tpl, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tpl, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %q, got %q", tpl, expected, actual)
+		}
+	}
+}
+
+func TestFilterDeprecations(t *testing.T) {
+	env := twig.New(nil)
+	collector := &stick.DeprecationCollector{}
+	env.DeprecationHandler = collector.Handle
+	actual, err := env.ExecuteToString("{{ 'a' }}\n{{ 'hello world'|title }}", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if expected := "a\nHello World"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	ds := collector.Deprecations()
+	if len(ds) != 1 || ds[0].Pos.Line != 2 || !strings.Contains(ds[0].Message, `"title" filter`) {
+		t.Errorf("expected a deprecation of the title filter on line 2, got %v", ds)
+	}
+}
@@ -0,0 +1,223 @@
+//go:build go1.18
+// +build go1.18
+
+package stick
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Filter1 returns a Filter that takes no arguments and calls fn with the
+// filtered value, coerced to T.
+//
+// Values are coerced as described for Func1. A Filter called with the wrong
+// number of arguments, or with a value that cannot be coerced, reports a
+// warning and returns nil.
+//
+//	env.Filters["shout"] = stick.Filter1(func(s string) string {
+//		return strings.ToUpper(s) + "!"
+//	})
+func Filter1[T, R any](fn func(T) R) Filter {
+	return func(ctx Context, val Value, args ...Value) Value {
+		var v T
+		if !checkArgs(ctx, args, 0) || !coerceArg(ctx, val, &v) {
+			return nil
+		}
+		return fn(v)
+	}
+}
+
+// Filter2 returns a Filter that takes one argument and calls fn with the
+// filtered value and the argument, coerced to T and A.
+func Filter2[T, A, R any](fn func(T, A) R) Filter {
+	return func(ctx Context, val Value, args ...Value) Value {
+		var v T
+		var a A
+		if !checkArgs(ctx, args, 1) || !coerceArg(ctx, val, &v) || !coerceArg(ctx, args[0], &a) {
+			return nil
+		}
+		return fn(v, a)
+	}
+}
+
+// Filter3 returns a Filter that takes two arguments and calls fn with the
+// filtered value and the arguments, coerced to T, A, and B.
+func Filter3[T, A, B, R any](fn func(T, A, B) R) Filter {
+	return func(ctx Context, val Value, args ...Value) Value {
+		var v T
+		var a A
+		var b B
+		if !checkArgs(ctx, args, 2) || !coerceArg(ctx, val, &v) || !coerceArg(ctx, args[0], &a) || !coerceArg(ctx, args[1], &b) {
+			return nil
+		}
+		return fn(v, a, b)
+	}
+}
+
+// Func0 returns a Func that takes no arguments and calls fn.
+func Func0[R any](fn func() R) Func {
+	return func(ctx Context, args ...Value) Value {
+		if !checkArgs(ctx, args, 0) {
+			return nil
+		}
+		return fn()
+	}
+}
+
+// Func1 returns a Func that takes one argument and calls fn with it,
+// coerced to A.
+//
+// Arguments of type A are passed as is. Otherwise, strings, numbers, and
+// booleans, including named types such as time.Duration, are coerced with
+// CoerceString, CoerceNumber, and CoerceBool, and a time.Time with
+// CoerceTime. Slices are built from the elements of any iterable value,
+// and nil becomes the zero value of A. A Func called with the wrong number
+// of arguments, or with an argument that cannot be coerced, reports a
+// warning and returns nil.
+func Func1[A, R any](fn func(A) R) Func {
+	return func(ctx Context, args ...Value) Value {
+		var a A
+		if !checkArgs(ctx, args, 1) || !coerceArg(ctx, args[0], &a) {
+			return nil
+		}
+		return fn(a)
+	}
+}
+
+// Func2 returns a Func that takes two arguments and calls fn with them,
+// coerced to A and B.
+func Func2[A, B, R any](fn func(A, B) R) Func {
+	return func(ctx Context, args ...Value) Value {
+		var a A
+		var b B
+		if !checkArgs(ctx, args, 2) || !coerceArg(ctx, args[0], &a) || !coerceArg(ctx, args[1], &b) {
+			return nil
+		}
+		return fn(a, b)
+	}
+}
+
+// Func3 returns a Func that takes three arguments and calls fn with them,
+// coerced to A, B, and C.
+func Func3[A, B, C, R any](fn func(A, B, C) R) Func {
+	return func(ctx Context, args ...Value) Value {
+		var a A
+		var b B
+		var c C
+		if !checkArgs(ctx, args, 3) || !coerceArg(ctx, args[0], &a) || !coerceArg(ctx, args[1], &b) || !coerceArg(ctx, args[2], &c) {
+			return nil
+		}
+		return fn(a, b, c)
+	}
+}
+
+// Test1 returns a Test that takes no arguments and calls fn with the tested
+// value, coerced to T. A Test that is given the wrong number of arguments,
+// or a value that cannot be coerced, reports a warning and fails.
+func Test1[T any](fn func(T) bool) Test {
+	return func(ctx Context, val Value, args ...Value) bool {
+		var v T
+		return checkArgs(ctx, args, 0) && coerceArg(ctx, val, &v) && fn(v)
+	}
+}
+
+// Test2 returns a Test that takes one argument and calls fn with the tested
+// value and the argument, coerced to T and A.
+func Test2[T, A any](fn func(T, A) bool) Test {
+	return func(ctx Context, val Value, args ...Value) bool {
+		var v T
+		var a A
+		return checkArgs(ctx, args, 1) && coerceArg(ctx, val, &v) && coerceArg(ctx, args[0], &a) && fn(v, a)
+	}
+}
+
+// checkArgs reports a warning and returns false if args does not contain
+// exactly n arguments.
+func checkArgs(ctx Context, args []Value, n int) bool {
+	if len(args) == n {
+		return true
+	}
+	if ctx != nil {
+		ctx.Warn(fmt.Errorf("expected %d argument(s), got %d", n, len(args)))
+	}
+	return false
+}
+
+// coerceArg coerces v into the value pointed to by dst, reporting a warning
+// and returning false if it cannot be coerced.
+func coerceArg(ctx Context, v Value, dst interface{}) bool {
+	d := reflect.ValueOf(dst).Elem()
+	if err := coerceTo(v, d); err != nil {
+		if ctx != nil {
+			ctx.Warn(err)
+		}
+		return false
+	}
+	return true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// coerceTo coerces v into d, which must be settable.
+func coerceTo(v Value, d reflect.Value) error {
+	if v == nil {
+		return nil
+	}
+	t := d.Type()
+	r := reflect.ValueOf(v)
+	if r.Type().AssignableTo(t) {
+		d.Set(r)
+		return nil
+	}
+	if sv, ok := v.(SafeValue); ok {
+		return coerceTo(sv.Value(), d)
+	}
+	switch t.Kind() {
+	case reflect.String:
+		d.SetString(CoerceString(v))
+		return nil
+	case reflect.Bool:
+		d.SetBool(CoerceBool(v))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		d.SetInt(int64(CoerceNumber(v)))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f := CoerceNumber(v); f >= 0 {
+			d.SetUint(uint64(f))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		d.SetFloat(CoerceNumber(v))
+		return nil
+	case reflect.Slice:
+		if !IsIterable(v) {
+			break
+		}
+		res := reflect.MakeSlice(t, 0, 0)
+		_, err := Iterate(v, func(k, v Value, l Loop) (bool, error) {
+			e := reflect.New(t.Elem()).Elem()
+			if err := coerceTo(v, e); err != nil {
+				return true, err
+			}
+			res = reflect.Append(res, e)
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+		d.Set(res)
+		return nil
+	case reflect.Struct:
+		if t != timeType {
+			break
+		}
+		if tm, ok := CoerceTime(v); ok {
+			d.Set(reflect.ValueOf(tm))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot use %T as %s", v, t)
+}
@@ -0,0 +1,93 @@
+//go:build go1.18
+// +build go1.18
+
+package stick
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTyped(t *testing.T) {
+	env := New(nil)
+	env.Filters["shout"] = Filter1(func(s string) string {
+		return strings.ToUpper(s) + "!"
+	})
+	env.Filters["repeat"] = Filter2(func(s string, n int) string {
+		return strings.Repeat(s, n)
+	})
+	env.Filters["clamp"] = Filter3(func(f, lo, hi float64) float64 {
+		if f < lo {
+			return lo
+		}
+		if f > hi {
+			return hi
+		}
+		return f
+	})
+	env.Filters["total"] = Filter1(func(vals []int) int {
+		res := 0
+		for _, v := range vals {
+			res += v
+		}
+		return res
+	})
+	env.Filters["year"] = Filter1(func(t time.Time) int {
+		return t.Year()
+	})
+	env.Functions["answer"] = Func0(func() int { return 42 })
+	env.Functions["neg"] = Func1(func(b bool) bool { return !b })
+	env.Functions["join"] = Func2(func(vals []string, sep string) string {
+		return strings.Join(vals, sep)
+	})
+	env.Functions["wait"] = Func1(func(d time.Duration) string {
+		return d.String()
+	})
+	env.Functions["between"] = Func3(func(v, lo, hi float64) bool {
+		return lo <= v && v <= hi
+	})
+	env.Tests["long"] = Test1(func(s string) bool { return len(s) > 3 })
+	env.Tests["longer than"] = Test2(func(s string, n int) bool { return len(s) > n })
+
+	tests := []struct {
+		name     string
+		tpl      string
+		expected string
+		warning  string
+	}{
+		{"Filter1", `{{ 'hi'|shout }} {{ 12|shout }}`, "HI! 12!", ""},
+		{"Filter2", `{{ 'ab'|repeat('3') }}`, "ababab", ""},
+		{"Filter3", `{{ 15|clamp(0, 10) }} {{ '-1'|clamp(0, 10) }}`, "10 0", ""},
+		{"slice", `{{ [1, '2', 3.0]|total }} {{ {a: 1, b: 2}|total }}`, "6 3", ""},
+		{"time", `{{ '2006-01-02'|year }}`, "2006", ""},
+		{"Func0", `{{ answer() }}`, "42", ""},
+		{"Func1", `{{ neg(0) ? 'yes' : 'no' }}`, "yes", ""},
+		{"Func2", `{{ join([1, 2], '-') }}`, "1-2", ""},
+		{"named type", `{{ wait(1000000000) }}`, "1s", ""},
+		{"Func3", `{{ between(5, 1, 10) ? 'in' : 'out' }}`, "in", ""},
+		{"Test1", `{{ ('abcd' is long) ? 'y' : 'n' }}{{ ('ab' is long) ? 'y' : 'n' }}`, "yn", ""},
+		{"Test2", `{{ ('abc' is longer than(2)) ? 'y' : 'n' }}`, "y", ""},
+		{"nil", `{{ null|shout }}`, "!", ""},
+		{"too many arguments", `{{ 'a'|shout(1) }}`, "", "expected 0 argument(s), got 1"},
+		{"too few arguments", `{{ join([1]) }}`, "", "expected 2 argument(s), got 1"},
+		{"cannot coerce", `{{ 'soon'|year }}`, "", "cannot use string as time.Time"},
+	}
+	for _, test := range tests {
+		var warnings []string
+		env.WarningHandler = func(w Warning) {
+			warnings = append(warnings, w.Err.Error())
+		}
+		res, err := env.ExecuteToString(test.tpl, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if res != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, res)
+		}
+		if actual := strings.Join(warnings, "; "); actual != test.warning {
+			t.Errorf("%s: expected warning %q, got %q", test.name, test.warning, actual)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package stick
+
+import (
+	"fmt"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An UndefinedMode determines the value of references to undefined
+// variables and attributes during template execution.
+type UndefinedMode int
+
+const (
+	// NilUndefined causes undefined variables and attributes to evaluate
+	// to nil.
+	NilUndefined UndefinedMode = iota
+	// LenientUndefined causes undefined variables and attributes to
+	// evaluate to an Undefined, which prints as an empty string, is false,
+	// has no elements, and whose attributes are also Undefined.
+	LenientUndefined
+	// StrictUndefined causes undefined variables and attributes to evaluate
+	// to an Undefined that can only be assigned, passed to a macro, checked
+	// with the defined test, or replaced by the default filter. Any other
+	// use, such as printing it or reading its attributes, fails with
+	// ErrUndefinedVariable.
+	StrictUndefined
+)
+
+// An Undefined is the value of an undefined variable or attribute when
+// the Env's UndefinedMode is LenientUndefined or StrictUndefined.
+// Comparisons and tests treat it as nil.
+type Undefined struct {
+	Name string // The name of the variable or attribute, such as "user.email".
+
+	strict bool
+}
+
+// String returns an empty string.
+func (u Undefined) String() string {
+	return ""
+}
+
+// Boolean returns false.
+func (u Undefined) Boolean() bool {
+	return false
+}
+
+// Number returns 0.
+func (u Undefined) Number() float64 {
+	return 0
+}
+
+// GetAttr returns an Undefined for the named attribute.
+func (u Undefined) GetAttr(name string) (Value, bool) {
+	return Undefined{u.Name + "." + name, u.strict}, true
+}
+
+// Iterate implements Iterable; an Undefined has no elements.
+func (u Undefined) Iterate(yield func(k, v Value) bool) error {
+	return nil
+}
+
+// MarshalJSON encodes an Undefined as null.
+func (u Undefined) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// err returns the error caused by using u.
+func (u Undefined) err() error {
+	return fmt.Errorf("%w \"%s\"", ErrUndefinedVariable, u.Name)
+}
+
+// use returns an error if v is an Undefined that cannot be used, and
+// otherwise returns v, replacing an Undefined with nil.
+func use(v Value) (Value, error) {
+	if u, ok := v.(Undefined); ok {
+		if u.strict {
+			return nil, u.err()
+		}
+		return nil, nil
+	}
+	return v, nil
+}
+
+// checkUse returns an error if v is an Undefined that cannot be used.
+func checkUse(v Value) error {
+	if u, ok := v.(Undefined); ok && u.strict {
+		return u.err()
+	}
+	return nil
+}
+
+// undefined returns the value of the undefined variable or attribute
+// referenced by exp, according to the Env's UndefinedMode.
+func (s *state) undefined(exp parse.Expr) Value {
+	switch s.env.UndefinedMode {
+	case LenientUndefined:
+		return Undefined{Name: undefinedName(exp)}
+	case StrictUndefined:
+		return Undefined{Name: undefinedName(exp), strict: true}
+	}
+	return nil
+}
+
+// undefinedName returns the name of the variable or attribute referenced
+// by exp, such as "user.email", or "email" if the attribute is read from
+// any other expression.
+func undefinedName(exp parse.Expr) string {
+	switch exp := exp.(type) {
+	case *parse.NameExpr:
+		return exp.Name
+	case *parse.GetAttrExpr:
+		attr := ""
+		if a, ok := exp.Attr.(*parse.StringExpr); ok {
+			attr = a.Text
+		} else if a, ok := exp.Attr.(*parse.NumberExpr); ok {
+			attr = a.Value
+		}
+		if c := undefinedName(exp.Cont); c != "" && attr != "" {
+			return c + "." + attr
+		}
+		return attr
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package stick
+
+import (
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// Validate parses the named template and every template it statically
+// references, without executing them, and returns any problems found.
+//
+// Templates that fail to parse or cannot be found are reported, as are
+// references to filters, functions, and tests that are not defined in the
+// Env. Undefined references are reported as *UndeclaredError, regardless
+// of the Env's UndefinedPolicy. Validate returns nil if no problems are found.
+//
+// Only template references using a string literal, such as
+// {% include 'footer.twig' %}, are followed.
+func (env *Env) Validate(name string) []error {
+	var errs []error
+	env.validate([]string{name}, func(_ string, _ *parse.Tree, e []error) {
+		errs = append(errs, e...)
+	})
+	return errs
+}
+
+// validate checks the named templates and every template they statically
+// reference, calling fn with the problems found in each. If a template
+// cannot be loaded, fn is called with a nil tree.
+func (env *Env) validate(names []string, fn func(name string, tree *parse.Tree, errs []error)) {
+	seen := make(map[string]bool)
+	var queue []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			queue = append(queue, name)
+		}
+	}
+	var name string
+	for len(queue) > 0 {
+		name, queue = queue[0], queue[1:]
+		tree, err := env.load(name)
+		if err != nil {
+			fn(name, nil, []error{err})
+			continue
+		}
+		v := &validator{env: env, name: name, macros: make(map[string]bool)}
+		for k := range tree.Macros() {
+			v.macros[k] = true
+		}
+		visitAll(tree.Root(), v.collect)
+		visitAll(tree.Root(), v.check)
+		fn(name, tree, v.errs)
+		for _, ref := range v.refs {
+			if !seen[ref] {
+				seen[ref] = true
+				queue = append(queue, ref)
+			}
+		}
+	}
+}
+
+// validator checks a single template for undeclared references.
+type validator struct {
+	env    *Env
+	name   string
+	macros map[string]bool // Macros callable as functions.
+	refs   []string        // Templates referenced.
+	errs   []error
+}
+
+// collect records the names of imported macros and referenced templates.
+func (v *validator) collect(node parse.Node) {
+	var tpl parse.Expr
+	switch node := node.(type) {
+	case *parse.ModuleNode:
+		if node.Parent != nil {
+			tpl = node.Parent.Tpl
+		}
+	case *parse.IncludeNode:
+		tpl = node.Tpl
+	case *parse.EmbedNode:
+		tpl = node.Tpl
+	case *parse.UseNode:
+		tpl = node.Tpl
+	case *parse.ImportNode:
+		tpl = node.Tpl
+	case *parse.FromNode:
+		tpl = node.Tpl
+		for _, alias := range node.Imports {
+			v.macros[alias] = true
+		}
+	}
+	if n := staticName(tpl); n != "" {
+		v.refs = append(v.refs, n)
+	}
+}
+
+// check records an error for each undeclared filter, function, or test.
+func (v *validator) check(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.FilterExpr:
+		if _, ok := v.env.Filters[node.Name]; !ok {
+			v.undeclared("filter", node.Name, node, filterNames(v.env))
+		}
+	case *parse.TestExpr:
+		if _, ok := v.env.Tests[node.Name]; !ok && node.Name != "defined" {
+			v.undeclared("test", node.Name, node, testNames(v.env))
+		}
+	case *parse.FuncExpr:
+		if node.Name == "parent" || node.Name == "block" || v.macros[node.Name] {
+			return
+		}
+		if _, ok := v.env.Functions[node.Name]; !ok {
+			names := functionNames(v.env)
+			for k := range v.macros {
+				names = append(names, k)
+			}
+			v.undeclared("function", node.Name, node, names)
+		}
+	case *parse.FilterNode:
+		for _, f := range node.Filters {
+			if _, ok := v.env.Filters[f]; !ok {
+				v.undeclared("filter", f, node, filterNames(v.env))
+			}
+		}
+	}
+}
+
+func (v *validator) undeclared(kind, name string, node parse.Node, candidates []string) {
+	v.errs = append(v.errs, &UndeclaredError{kind, name, v.name, node.Start(), suggest(name, candidates)})
+}
+
+func filterNames(env *Env) []string {
+	res := make([]string, 0, len(env.Filters))
+	for k := range env.Filters {
+		res = append(res, k)
+	}
+	return res
+}
+
+func functionNames(env *Env) []string {
+	res := make([]string, 0, len(env.Functions))
+	for k := range env.Functions {
+		res = append(res, k)
+	}
+	return res
+}
+
+func testNames(env *Env) []string {
+	res := make([]string, 0, len(env.Tests))
+	for k := range env.Tests {
+		res = append(res, k)
+	}
+	return res
+}
@@ -1,9 +1,17 @@
 package stick
 
 import (
+	"bytes"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/shopspring/decimal"
 )
@@ -81,7 +89,8 @@ type Boolean interface {
 }
 
 // CoerceBool coerces the given value into a boolean. Boolean false is returned
-// if the value cannot be coerced.
+// if the value cannot be coerced. The value held by a driver.Valuer, such as
+// sql.NullBool, is coerced in its place.
 func CoerceBool(v Value) bool {
 	switch vc := v.(type) {
 	case SafeValue:
@@ -118,6 +127,12 @@ func CoerceBool(v Value) bool {
 		return len(vc) > 0
 	case decimal.Decimal:
 		return vc.GreaterThan(decimal.Zero)
+	case json.Number, *big.Int, *big.Rat, ExactNumber:
+		return CoerceNumber(vc) > 0
+	case driver.Valuer:
+		if dv, ok := driverValue(vc); ok {
+			return CoerceBool(dv)
+		}
 	case Stringer:
 		return len(vc.String()) > 0
 	case Number:
@@ -126,16 +141,16 @@ func CoerceBool(v Value) bool {
 	return false
 }
 
+// stringToFloat returns the number that s starts with, as with PHP's
+// conversion of strings to numbers, or 0 if it does not start with one.
 func stringToFloat(s string) float64 {
-	fv, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return 0
-	}
-	return fv
+	f, _ := parseNumeric(s)
+	return f
 }
 
 // CoerceNumber coerces the given value into a number. Zero (0) is returned
-// if the value cannot be coerced.
+// if the value cannot be coerced. The value held by a driver.Valuer, such as
+// sql.NullInt64, is coerced in its place.
 func CoerceNumber(v Value) float64 {
 	switch vc := v.(type) {
 	case SafeValue:
@@ -169,6 +184,23 @@ func CoerceNumber(v Value) float64 {
 	case decimal.Decimal:
 		f, _ := vc.Float64()
 		return f
+	case json.Number:
+		f, _ := vc.Float64()
+		return f
+	case *big.Int:
+		if vc != nil {
+			f, _ := new(big.Float).SetInt(vc).Float64()
+			return f
+		}
+	case *big.Rat:
+		if vc != nil {
+			f, _ := vc.Float64()
+			return f
+		}
+	case driver.Valuer:
+		if dv, ok := driverValue(vc); ok {
+			return CoerceNumber(dv)
+		}
 	case Stringer:
 		return stringToFloat(vc.String())
 	case string:
@@ -185,8 +217,106 @@ func CoerceNumber(v Value) float64 {
 	return 0
 }
 
+// roundFloat32 returns f as the float64 with the shortest float32
+// representation, so that values like float32(3.14) are not printed as
+// 3.1400001049042.
+func roundFloat32(f float32) float64 {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return r
+}
+
+// formatFloat returns the string representation of f, matching PHP's
+// (and therefore Twig's) default float to string conversion.
+//
+// Integral values are printed without decimals, other values use up to
+// 14 significant digits, and very large or small values use exponent
+// notation such as "1.0E+21".
+func formatFloat(f float64) string {
+	var buf [32]byte
+	return string(appendFloat(buf[:0], f))
+}
+
+// appendFloat appends f to dst, formatted as by formatFloat.
+func appendFloat(dst []byte, f float64) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, "NAN"...)
+	case math.IsInf(f, 1):
+		return append(dst, "INF"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-INF"...)
+	}
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, 'g', 14, 64)
+	p := bytes.IndexByte(dst[start:], 'e')
+	if p < 0 {
+		return dst
+	}
+	p += start
+	var exp [8]byte
+	n := copy(exp[:], dst[p+1:])
+	dst = dst[:p]
+	if bytes.IndexByte(dst[start:], '.') < 0 {
+		dst = append(dst, ".0"...)
+	}
+	dst = append(dst, 'E', exp[0])
+	return append(dst, bytes.TrimLeft(exp[1:n], "0")...)
+}
+
+// appendString appends the string representation of v, as returned by
+// CoerceString, to dst. Strings, numbers, and booleans are appended without
+// allocating.
+func appendString(dst []byte, v Value) []byte {
+	switch vc := v.(type) {
+	case SafeValue:
+		return appendString(dst, vc.Value())
+	case string:
+		return append(dst, vc...)
+	case int:
+		return strconv.AppendInt(dst, int64(vc), 10)
+	case int8:
+		return strconv.AppendInt(dst, int64(vc), 10)
+	case int16:
+		return strconv.AppendInt(dst, int64(vc), 10)
+	case int32:
+		return strconv.AppendInt(dst, int64(vc), 10)
+	case int64:
+		return strconv.AppendInt(dst, vc, 10)
+	case uint:
+		return strconv.AppendUint(dst, uint64(vc), 10)
+	case uint8:
+		return strconv.AppendUint(dst, uint64(vc), 10)
+	case uint16:
+		return strconv.AppendUint(dst, uint64(vc), 10)
+	case uint32:
+		return strconv.AppendUint(dst, uint64(vc), 10)
+	case uint64:
+		return strconv.AppendUint(dst, vc, 10)
+	case float64:
+		return appendFloat(dst, vc)
+	case bool:
+		if vc {
+			return append(dst, '1')
+		}
+		return dst
+	case nil:
+		return dst
+	}
+	return append(dst, CoerceString(v)...)
+}
+
 // CoerceString coerces the given value into a string. An empty string is returned
 // if the value cannot be coerced.
+//
+// Numbers are formatted the same way Twig would print them: integers without
+// decimals and floats in their shortest representation.
+//
+// Other values are converted by the first of these that applies: a String
+// method (fmt.Stringer), the value held by a driver.Valuer, such as
+// sql.NullString, an Error method (error), or a MarshalText method
+// (encoding.TextMarshaler). Failing that, values of named types whose
+// underlying type is a string, number, or bool, such as enums and ID
+// types, are converted as their underlying type.
 func CoerceString(v Value) string {
 	switch vc := v.(type) {
 	case SafeValue:
@@ -195,10 +325,46 @@ func CoerceString(v Value) string {
 		return vc
 	case Stringer:
 		return vc.String()
-	case float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-		return fmt.Sprintf("%v", vc)
+	case driver.Valuer:
+		if dv, ok := driverValue(vc); ok {
+			return CoerceString(dv)
+		}
+	case []byte:
+		return string(vc)
+	case error:
+		return vc.Error()
+	case encoding.TextMarshaler:
+		b, err := vc.MarshalText()
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	case int:
+		return strconv.FormatInt(int64(vc), 10)
+	case int8:
+		return strconv.FormatInt(int64(vc), 10)
+	case int16:
+		return strconv.FormatInt(int64(vc), 10)
+	case int32:
+		return strconv.FormatInt(int64(vc), 10)
+	case int64:
+		return strconv.FormatInt(vc, 10)
+	case uint:
+		return strconv.FormatUint(uint64(vc), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(vc), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(vc), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(vc), 10)
+	case uint64:
+		return strconv.FormatUint(vc, 10)
+	case float32:
+		return formatFloat(roundFloat32(vc))
+	case float64:
+		return formatFloat(vc)
 	case Number:
-		return fmt.Sprintf("%v", vc.Number())
+		return formatFloat(vc.Number())
 	case Boolean:
 		if vc.Boolean() == true {
 			return "1" // Twig compatibility (aka PHP compatibility)
@@ -207,13 +373,64 @@ func CoerceString(v Value) string {
 		if vc == true {
 			return "1" // Twig compatibility (aka PHP compatibility)
 		}
-
+	case nil:
+	default:
+		if u, ok := underlying(reflect.ValueOf(v)); ok {
+			return CoerceString(u)
+		}
 	}
 	return ""
 }
 
+// underlying returns the value of v converted to its underlying type, if
+// it is a named string, number, or bool type.
+func underlying(v reflect.Value) (Value, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), true
+	case reflect.Float32:
+		return float32(v.Float()), true
+	case reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		return v.Bool(), true
+	}
+	return nil, false
+}
+
+// An AttrProvider is a value that provides its own attributes, such as a
+// wrapper around a protobuf message or a lazily loaded record. Attributes
+// accessed with the "." operator or the attribute function are looked up
+// using GetAttr before Stick looks for a field or method with reflection.
+type AttrProvider interface {
+	// GetAttr returns the value of the named attribute, and whether the
+	// value has such an attribute.
+	GetAttr(name string) (Value, bool)
+}
+
 // GetAttr attempts to access the given value and return the specified attribute.
+//
+// Attributes holding a driver.Valuer, such as sql.NullString, evaluate to
+// the value it holds, or nil if it is NULL.
 func GetAttr(v Value, attr Value, args ...Value) (Value, error) {
+	if m, ok := v.(*OrderedMap); ok {
+		if res, ok := m.Get(CoerceString(attr)); ok {
+			return res, nil
+		}
+		return nil, fmt.Errorf("getattr: unable to locate attribute \"%s\" on \"%v\"", attr, v)
+	}
+	if p, ok := v.(AttrProvider); ok && len(args) == 0 {
+		if res, ok := p.GetAttr(CoerceString(attr)); ok {
+			if dv, ok := driverValue(res); ok {
+				return dv, nil
+			}
+			return res, nil
+		}
+	}
 	r := reflect.Indirect(reflect.ValueOf(v))
 	if !r.IsValid() {
 		return nil, fmt.Errorf("getattr: value does not support attribute lookup: %v", v)
@@ -221,14 +438,10 @@ func GetAttr(v Value, attr Value, args ...Value) (Value, error) {
 	var retval reflect.Value
 	switch r.Kind() {
 	case reflect.Struct:
-		strval := CoerceString(attr)
-		retval = r.FieldByName(strval)
-		if !retval.IsValid() {
-			var err error
-			retval, err = getMethod(v, strval)
-			if err != nil {
-				return nil, err
-			}
+		var err error
+		retval, err = structAttr(v, r, CoerceString(attr))
+		if err != nil {
+			return nil, err
 		}
 	case reflect.Map:
 		retval = r.MapIndex(reflect.ValueOf(attr))
@@ -259,31 +472,32 @@ func GetAttr(v Value, attr Value, args ...Value) (Value, error) {
 		}
 		retval = res[0]
 	}
+	if dv, ok := driverValue(retval.Interface()); ok {
+		return dv, nil
+	}
 	return retval.Interface(), nil
 }
 
-func getMethod(v Value, name string) (reflect.Value, error) {
-	var retVal reflect.Value
-	value := reflect.ValueOf(v)
-	retVal = value.MethodByName(name) // Match either "value, value receiver" or "ptr, ptr receiver"
-	if retVal.IsValid() {
-		return retVal, nil
+// driverValue returns the value held by v, if it is a driver.Valuer such
+// as sql.NullString, so that database values can be used like the values
+// they hold. Invalid values, such as a NULL sql.NullString, hold nil.
+// Decimals are not converted.
+func driverValue(v Value) (Value, bool) {
+	dv, ok := v.(driver.Valuer)
+	if !ok {
+		return nil, false
 	}
-
-	var ptr reflect.Value
-	if value.Kind() == reflect.Ptr {
-		ptr = value
-		value = ptr.Elem()
-	} else {
-		ptr = reflect.New(reflect.TypeOf(v))
-		temp := ptr.Elem()
-		temp.Set(value)
+	if _, ok := v.(decimal.Decimal); ok {
+		return nil, false
 	}
-	retVal = ptr.MethodByName(name) // Match "value, ptr receiver" or "ptr, value receiver"
-	if retVal.IsValid() {
-		return retVal, nil
+	if r := reflect.ValueOf(v); r.Kind() == reflect.Ptr && r.IsNil() {
+		return nil, true
 	}
-	return retVal, fmt.Errorf("stick: unable to locate method \"%s\" on \"%v\"", name, v)
+	res, err := dv.Value()
+	if err != nil {
+		return nil, false
+	}
+	return res, true
 }
 
 // An Iteratee is called for each step in a loop.
@@ -310,88 +524,201 @@ func IsArray(val Value) bool {
 	return false
 }
 
-// IsMap returns true if the given Value is a map.
+// IsMap returns true if the given Value is a map or an *OrderedMap.
 func IsMap(val Value) bool {
+	if _, ok := val.(*OrderedMap); ok {
+		return true
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	return r.Kind() == reflect.Map
 }
 
-// IsIterable returns true if the given Value is a slice, array, or map.
+// IsIterable returns true if the given Value is a slice, array, map, channel,
+// iterator function, or Iterable.
 func IsIterable(val Value) bool {
 	if val == nil {
 		return true
 	}
+	switch val.(type) {
+	case *OrderedMap, Iterable:
+		return true
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array, reflect.Map:
 		return true
+	case reflect.Chan, reflect.Func:
+		return isStream(r.Type())
 	}
 	return false
 }
 
+// newLoop returns the Loop for the first step in a loop over ln items.
+func newLoop(ln int) Loop {
+	return Loop{
+		ln == 1,
+		1,
+		0,
+		ln,
+		ln - 1,
+		true,
+		ln,
+	}
+}
+
+// next advances l to the next step in the loop.
+func (l *Loop) next() {
+	l.Index++
+	l.Index0++
+	l.Last = l.Length == l.Index
+	l.Revindex--
+	l.Revindex0--
+	l.First = false
+}
+
 // Iterate calls the Iteratee func for every item in the Value.
+//
+// An *OrderedMap is iterated in the order of its keys. The keys of other
+// maps are iterated in sorted order, since Go maps are unordered.
+//
+// Channels are received from until they are closed, with the number of each
+// element as its key. Iterator functions, such as an iter.Seq or iter.Seq2,
+// are called with a yield function; the keys of an iter.Seq are numbered
+// too. Their length is unknown, so the Loop's Length, Revindex, and
+// Revindex0 are -1. One element is read ahead, so that Last can be set.
+//
+// An Iterable is iterated using its Iterate method, in the same way.
 func Iterate(val Value, it Iteratee) (int, error) {
 	if val == nil {
 		return 0, nil
 	}
+	if c, ok := val.(Iterable); ok {
+		return iterateIterable(c, it)
+	}
+	// The most common collections are iterated without reflection.
+	switch vc := val.(type) {
+	case *OrderedMap:
+		keys := vc.Keys()
+		return iterateN(len(keys), func(i int) (Value, Value) {
+			return keys[i], vc.vals[keys[i]]
+		}, it)
+	case []Value:
+		return iterateN(len(vc), func(i int) (Value, Value) { return i, vc[i] }, it)
+	case []string:
+		return iterateN(len(vc), func(i int) (Value, Value) { return i, vc[i] }, it)
+	case []int:
+		return iterateN(len(vc), func(i int) (Value, Value) { return i, vc[i] }, it)
+	case map[string]Value:
+		keys := make([]string, 0, len(vc))
+		for k := range vc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return iterateN(len(keys), func(i int) (Value, Value) { return keys[i], vc[keys[i]] }, it)
+	case map[string]string:
+		keys := make([]string, 0, len(vc))
+		for k := range vc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return iterateN(len(keys), func(i int) (Value, Value) { return keys[i], vc[keys[i]] }, it)
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array:
-		ln := r.Len()
-		l := Loop{
-			ln == 1,
-			1,
-			0,
-			ln,
-			ln - 1,
-			true,
-			ln,
-		}
-		for i := 0; i < ln; i++ {
-			v := r.Index(i)
-			brk, err := it(i, v.Interface(), l)
-			if brk || err != nil {
-				return i + 1, err
-			}
+		return iterateN(r.Len(), func(i int) (Value, Value) {
+			return i, r.Index(i).Interface()
+		}, it)
+	case reflect.Map:
+		keys := sortedMapKeys(r)
+		return iterateN(len(keys), func(i int) (Value, Value) {
+			return keys[i].Interface(), r.MapIndex(keys[i]).Interface()
+		}, it)
+	case reflect.Chan, reflect.Func:
+		if isStream(r.Type()) {
+			return iterateStream(r, it)
+		}
+	}
+	return 0, fmt.Errorf(`stick: unable to iterate over %s "%v"`, r.Kind(), val)
+}
 
-			l.Index++
-			l.Index0++
-			l.Last = ln == l.Index
-			l.Revindex--
-			l.Revindex0--
-			l.First = false
+// iterateN calls it for n elements, taking the key and value of each
+// element from at.
+func iterateN(n int, at func(i int) (Value, Value), it Iteratee) (int, error) {
+	l := newLoop(n)
+	for i := 0; i < n; i++ {
+		k, v := at(i)
+		brk, err := it(k, v, l)
+		if brk || err != nil {
+			return i + 1, err
 		}
-		return ln, nil
-	case reflect.Map:
-		keys := r.MapKeys()
-		ln := r.Len()
-		l := Loop{
-			ln == 1,
-			1,
-			0,
-			ln,
-			ln - 1,
-			true,
-			ln,
-		}
-		for i, k := range keys {
-			v := r.MapIndex(k)
-			brk, err := it(k.Interface(), v.Interface(), l)
-			if brk || err != nil {
-				return i + 1, err
-			}
+		l.next()
+	}
+	return n, nil
+}
 
-			l.Index++
-			l.Index0++
-			l.Last = ln == l.Index
-			l.Revindex--
-			l.Revindex0--
-			l.First = false
+// Values returns the values of the elements of val, in the order that
+// Iterate visits them. A []Value is returned as is, without copying, so
+// the result must not be modified; other collections are copied into a new
+// slice, without calling an Iteratee for each element.
+func Values(val Value) ([]Value, error) {
+	switch vc := val.(type) {
+	case nil:
+		return nil, nil
+	case []Value:
+		return vc, nil
+	case []string:
+		res := make([]Value, len(vc))
+		for i, v := range vc {
+			res[i] = v
 		}
-		return ln, nil
-	default:
-		return 0, fmt.Errorf(`stick: unable to iterate over %s "%v"`, r.Kind(), val)
+		return res, nil
 	}
+	var res []Value
+	if n, err := Len(val); err == nil && n > 0 {
+		res = make([]Value, 0, n)
+	}
+	_, err := Iterate(val, func(k, v Value, l Loop) (bool, error) {
+		res = append(res, v)
+		return false, nil
+	})
+	return res, err
+}
+
+// sortedMapKeys returns the keys of the map m in a consistent order:
+// strings and numbers are sorted by value, and other keys by their
+// string representation.
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
+	return keys
+}
+
+// keyLess returns true if the map key a sorts before b.
+func keyLess(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Interface {
+		a, b = a.Elem(), b.Elem()
+	}
+	if a.Kind() != b.Kind() {
+		return a.Kind() < b.Kind()
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	case reflect.Invalid:
+		return false
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
 }
 
 // Len returns the Length of Value.
@@ -399,6 +726,14 @@ func Len(val Value) (int, error) {
 	if val == nil {
 		return 0, nil
 	}
+	if m, ok := val.(*OrderedMap); ok {
+		return m.Len(), nil
+	}
+	if c, ok := val.(Iterable); ok {
+		if l, ok := c.(lener); ok {
+			return l.Len(), nil
+		}
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array, reflect.Map:
@@ -407,10 +742,374 @@ func Len(val Value) (int, error) {
 	return 0, fmt.Errorf(`stick: could not get Length of %s "%v"`, r.Kind(), val)
 }
 
+// A valueKind categorizes a Value for the purposes of loose comparison.
+type valueKind int
+
+const (
+	kindNull valueKind = iota
+	kindBool
+	kindNumber
+	kindString
+	kindArray
+	kindTime
+	kindOther
+)
+
+// kindOf returns the valueKind of the given Value.
+func kindOf(v Value) valueKind {
+	if isTime(v) {
+		return kindTime
+	}
+	switch vc := v.(type) {
+	case nil:
+		return kindNull
+	case bool:
+		return kindBool
+	case string:
+		return kindString
+	case float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, decimal.Decimal, *big.Int, *big.Rat:
+		return kindNumber
+	case SafeValue:
+		return kindOf(vc.Value())
+	case driver.Valuer:
+		if dv, ok := driverValue(vc); ok {
+			return kindOf(dv)
+		}
+	case Number, ExactNumber:
+		return kindNumber
+	case Boolean:
+		return kindBool
+	case Stringer:
+		return kindString
+	}
+	if IsIterable(v) && !isStream(reflect.TypeOf(v)) {
+		return kindArray
+	}
+	return kindOther
+}
+
+// A numericKind describes how PHP reads a string as a number.
+type numericKind int
+
+const (
+	nonNumeric     numericKind = iota // No number at all, such as "abc" or "".
+	leadingNumeric                    // A number followed by other text, such as "10abc".
+	numeric                           // Only a number, such as "10", " 1e3", or ".5 ".
+)
+
+// parseNumeric reads s as a number the way PHP does: leading and trailing
+// whitespace is ignored, and exponents are allowed, but hexadecimal
+// numbers, underscores, and words such as "INF" are not. The number that s
+// starts with is returned, or 0 if it does not start with one.
+func parseNumeric(s string) (float64, numericKind) {
+	i := 0
+	for i < len(s) && isNumericSpace(s[i]) {
+		i++
+	}
+	start := i
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		j := i + 1
+		for ; j < len(s) && isDigit(s[j]); j++ {
+			digits++
+		}
+		if digits > 0 {
+			i = j
+		}
+	}
+	if digits == 0 {
+		return 0, nonNumeric
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	// Numbers too large for a float64 are read as infinity, as in PHP, so
+	// the error can be ignored.
+	f, _ := strconv.ParseFloat(s[start:i], 64)
+	for i < len(s) && isNumericSpace(s[i]) {
+		i++
+	}
+	if i < len(s) {
+		return f, leadingNumeric
+	}
+	return f, numeric
+}
+
+func isNumericSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isNumericString returns true if s would be considered numeric by PHP.
+// Leading and trailing whitespace is allowed.
+func isNumericString(s string) bool {
+	_, kind := parseNumeric(s)
+	return kind == numeric
+}
+
+// looseBool converts the given value to a boolean for loose comparison.
+// Unlike CoerceBool, PHP semantics are followed exactly: non-empty arrays
+// and non-zero numbers are true, while the string "0" is false.
+func looseBool(v Value) bool {
+	switch kindOf(v) {
+	case kindArray:
+		l, _ := Len(v)
+		return l > 0
+	case kindNumber:
+		return CoerceNumber(v) != 0
+	case kindString:
+		s := CoerceString(v)
+		return s != "" && s != "0"
+	}
+	return CoerceBool(v)
+}
+
+func compareNumbers(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareBools(l, r bool) int {
+	switch {
+	case l == r:
+		return 0
+	case l:
+		return 1
+	}
+	return -1
+}
+
+// uncomparable is returned by compare when two values cannot be compared.
+// It is treated as "greater than" for ordering, and never equal.
+const uncomparable = 2
+
+// An Equaler is a value that determines whether it is equal to another
+// value, such as a UUID or money type. It is consulted by "==", "!=", and
+// other operations comparing values for equality, such as "in", in place
+// of the usual loose comparison.
+type Equaler interface {
+	// Equal returns true if the value is equal to other.
+	Equal(other Value) bool
+}
+
+// A Comparer is a value that determines its order relative to other values,
+// such as a version or money type. It is consulted by "<", ">", "==", and
+// other comparisons, and by sorting, in place of the usual loose
+// comparison.
+type Comparer interface {
+	// Compare returns a negative number, zero, or a positive number if the
+	// value is less than, equal to, or greater than other. False is
+	// returned if the value cannot be compared with other, in which case
+	// the values are compared as usual.
+	Compare(other Value) (int, bool)
+}
+
+// compare implements loose comparison of two values. It returns -1, 0, or 1
+// when left is less than, equal to, or greater than right, or uncomparable.
+func compare(left, right Value) int {
+	if c, ok := compareCustom(left, right); ok {
+		return c
+	}
+	return compareLoose(left, right)
+}
+
+// compareCustom compares two values using their Compare or Equal methods,
+// if either has one. Values that an Equaler reports to be unequal are
+// ordered as usual, but are uncomparable if they would otherwise be equal.
+func compareCustom(left, right Value) (int, bool) {
+	if c, ok := left.(Comparer); ok {
+		if res, ok := c.Compare(right); ok {
+			return sign(res), true
+		}
+	}
+	if c, ok := right.(Comparer); ok {
+		if res, ok := c.Compare(left); ok {
+			return -sign(res), true
+		}
+	}
+	var eq bool
+	if e, ok := left.(Equaler); ok {
+		eq = e.Equal(right)
+	} else if e, ok := right.(Equaler); ok {
+		eq = e.Equal(left)
+	} else {
+		return 0, false
+	}
+	if eq {
+		return 0, true
+	}
+	if c := compareLoose(left, right); c != 0 {
+		return c, true
+	}
+	return uncomparable, true
+}
+
+// sign returns -1, 0, or 1 if n is negative, zero, or positive.
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// compareLoose compares two values following the rules of Twig's
+// comparison operators.
+func compareLoose(left, right Value) int {
+	lk, rk := kindOf(left), kindOf(right)
+	switch {
+	case lk == kindNull && rk == kindNull:
+		return 0
+	case lk == kindNull && rk == kindString:
+		return strings.Compare("", CoerceString(right))
+	case lk == kindString && rk == kindNull:
+		return strings.Compare(CoerceString(left), "")
+	case lk == kindBool || rk == kindBool || lk == kindNull || rk == kindNull:
+		return compareBools(looseBool(left), looseBool(right))
+	case lk == kindTime || rk == kindTime:
+		lt, lok := CoerceTime(left)
+		rt, rok := CoerceTime(right)
+		if !lok || !rok {
+			break
+		}
+		switch {
+		case lt.Before(rt):
+			return -1
+		case lt.After(rt):
+			return 1
+		}
+		return 0
+	case lk == kindNumber && rk == kindNumber:
+		if c, ok := compareExact(left, right); ok {
+			return c
+		}
+		return compareNumbers(CoerceNumber(left), CoerceNumber(right))
+	case lk == kindString && rk == kindString:
+		ls, rs := CoerceString(left), CoerceString(right)
+		if isNumericString(ls) && isNumericString(rs) {
+			return compareNumbers(CoerceNumber(strings.TrimSpace(ls)), CoerceNumber(strings.TrimSpace(rs)))
+		}
+		return strings.Compare(ls, rs)
+	case lk == kindNumber && rk == kindString:
+		if rs := CoerceString(right); isNumericString(rs) {
+			return compareNumbers(CoerceNumber(left), CoerceNumber(strings.TrimSpace(rs)))
+		}
+		return strings.Compare(CoerceString(left), CoerceString(right))
+	case lk == kindString && rk == kindNumber:
+		if ls := CoerceString(left); isNumericString(ls) {
+			return compareNumbers(CoerceNumber(strings.TrimSpace(ls)), CoerceNumber(right))
+		}
+		return strings.Compare(CoerceString(left), CoerceString(right))
+	case lk == kindArray && rk == kindArray:
+		return compareArrays(left, right)
+	case lk == kindArray:
+		return 1
+	case rk == kindArray:
+		return -1
+	}
+	if identical(left, right) {
+		return 0
+	}
+	return uncomparable
+}
+
+// identical returns true if left == right. Values of types that cannot be
+// compared, such as structs with a slice field, are never identical.
+func identical(left, right Value) (eq bool) {
+	lt, rt := reflect.TypeOf(left), reflect.TypeOf(right)
+	if lt != rt || lt != nil && !lt.Comparable() {
+		return false
+	}
+	// A comparable type may still hold an uncomparable value in an
+	// interface field, which panics when compared.
+	defer func() {
+		if recover() != nil {
+			eq = false
+		}
+	}()
+	return left == right
+}
+
+// arrayEntries returns the entries of a slice, array, or map keyed by their
+// string representation.
+func arrayEntries(v Value) (keys []string, vals map[string]Value) {
+	vals = make(map[string]Value)
+	Iterate(v, func(k, v Value, l Loop) (bool, error) {
+		ks := CoerceString(k)
+		keys = append(keys, ks)
+		vals[ks] = v
+		return false, nil
+	})
+	return keys, vals
+}
+
+// compareArrays compares two arrays or maps. Arrays with fewer elements are
+// considered smaller; otherwise elements are compared one by one.
+func compareArrays(left, right Value) int {
+	lkeys, lvals := arrayEntries(left)
+	_, rvals := arrayEntries(right)
+	if c := compareNumbers(float64(len(lvals)), float64(len(rvals))); c != 0 {
+		return c
+	}
+	if IsMap(left) {
+		sort.Strings(lkeys)
+	}
+	for _, k := range lkeys {
+		rv, ok := rvals[k]
+		if !ok {
+			return uncomparable
+		}
+		if c := compare(lvals[k], rv); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
 // Equal returns true if the two Values are considered equal.
+//
+// Values are compared loosely, following the rules of Twig's "==" operator:
+// numeric strings are compared numerically, null is equal to false, zero,
+// and the empty string, and arrays and maps are equal if they contain equal
+// elements. Values implementing Equaler or Comparer decide for themselves.
 func Equal(left Value, right Value) bool {
-	// TODO: Stop-gap for now, this will need to be much more sophisticated.
-	return CoerceString(left) == CoerceString(right)
+	return compare(left, right) == 0
+}
+
+// Compare returns an integer comparing the two Values loosely, using the same
+// rules as Equal. The result will be 0 if left == right, -1 if left < right,
+// and +1 if left > right. Values that cannot be compared, such as two distinct
+// structs, are reported as +1.
+func Compare(left Value, right Value) int {
+	if c := compare(left, right); c != uncomparable {
+		return c
+	}
+	return 1
 }
 
 // Contains returns true if the haystack Value contains needle.
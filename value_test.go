@@ -1,10 +1,16 @@
 package stick
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/big"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -23,6 +29,24 @@ func (t testType) Number() float64 {
 	return 42
 }
 
+type testID string
+
+type testEnum int
+
+type testRatio float32
+
+type testText struct{ s string }
+
+func (t testText) MarshalText() ([]byte, error) {
+	return []byte("text:" + t.s), nil
+}
+
+type testError struct{}
+
+func (t testError) Error() string {
+	return "an error"
+}
+
 func TestValue(t *testing.T) {
 	var stringTests = map[Value]string{
 		testType{}: "some string",
@@ -44,8 +68,30 @@ func TestValue(t *testing.T) {
 
 		float64(3.14): "3.14",
 		float32(3.14): "3.14",
+		float64(7):    "7",
+		float64(-0.5): "-0.5",
+		0.1 + 0.2:     "0.3",
+		float64(1e14): "1.0E+14",
+		1.5e21:        "1.5E+21",
+		1.5e-7:        "1.5E-7",
+		math.Inf(1):   "INF",
 
 		decimal.NewFromFloat(3.1415): "3.1415",
+
+		testError{}:      "an error",
+		testText{"a"}:    "text:a",
+		testID("user-1"): "user-1",
+		testEnum(2):      "2",
+
+		json.Number("1.50"):                        "1.50",
+		sql.NullString{String: "a", Valid: true}:   "a",
+		sql.NullString{String: "a"}:                "",
+		sql.NullInt64{Int64: 5, Valid: true}:       "5",
+		sql.NullFloat64{Float64: 2.5, Valid: true}: "2.5",
+		sql.NullBool{Bool: true, Valid: true}:      "1",
+		(*sql.NullString)(nil):                     "",
+		testRatio(0.1):                             "0.1",
+		struct{}{}:                                 "",
 	}
 	for val, expected := range stringTests {
 		actual := CoerceString(val)
@@ -88,6 +134,13 @@ func TestValue(t *testing.T) {
 
 		"true": true,
 		"":     false,
+
+		json.Number("0"):                         false,
+		json.Number("0.5"):                       true,
+		sql.NullBool{Bool: true, Valid: true}:    true,
+		sql.NullBool{Bool: true}:                 false,
+		sql.NullString{String: "0", Valid: true}: true,
+		sql.NullInt64{Int64: 0, Valid: true}:     false,
 	}
 	for val, expected := range boolTests {
 		actual := CoerceBool(val)
@@ -100,6 +153,17 @@ func TestValue(t *testing.T) {
 		testType{}: 42,
 		"3":        3.0,
 
+		" 1e3 ":    1000,
+		"+.5":      0.5,
+		"-2.5e-1x": -0.25,
+		"10abc":    10,
+		"1e":       1,
+		"1_000":    1,
+		"0x1A":     0,
+		"INF":      0,
+		"abc":      0,
+		"":         0,
+
 		int(3):   3.0,
 		int8(3):  3.0,
 		int16(3): 3.0,
@@ -117,6 +181,11 @@ func TestValue(t *testing.T) {
 
 		true:  1,
 		false: 0,
+
+		json.Number("1e3"):                         1000,
+		sql.NullInt64{Int64: 7, Valid: true}:       7,
+		sql.NullInt64{Int64: 7}:                    0,
+		sql.NullFloat64{Float64: 1.5, Valid: true}: 1.5,
 	}
 	for val, expected := range numberTests {
 		actual := CoerceNumber(val)
@@ -162,6 +231,21 @@ type propStruct struct {
 	Name string
 }
 
+// testRecord provides its attributes from a map, with its methods as a
+// fallback.
+type testRecord struct {
+	attrs map[string]Value
+}
+
+func (r testRecord) GetAttr(name string) (Value, bool) {
+	v, ok := r.attrs[name]
+	return v, ok
+}
+
+func (r testRecord) Kind() string {
+	return "record"
+}
+
 func TestGetAttr(t *testing.T) {
 	var getAttrTests = []getAttrTest{
 		newGetAttrTest("map with non-string keys", map[int]string{1: "test"}, 1, "test"),
@@ -174,19 +258,34 @@ func TestGetAttr(t *testing.T) {
 		newGetAttrMethodTest("method with parameters", testStruct{"Ray"}, []Value{"Meow"}, "Modify", "modified:Meow"),
 		newGetAttrTest("map (string key)", map[string]Value{"name": "Amy"}, "name", "Amy"),
 		newGetAttrTest("array", []Value{"World", "Hello"}, "1", "Hello"),
+		newGetAttrTest("sql.NullString", struct{ Name sql.NullString }{sql.NullString{String: "Ann", Valid: true}}, "Name", "Ann"),
+		newGetAttrTest("embedded struct property", struct{ propStruct }{propStruct{"Eve"}}, "Name", "Eve"),
+		newGetAttrTest("AttrProvider", testRecord{map[string]Value{"name": "Bo"}}, "name", "Bo"),
+		newGetAttrTest("AttrProvider method", testRecord{}, "Kind", "record"),
 	}
 
-	for _, test := range getAttrTests {
-		res, err := GetAttr(test.cont, test.attr, test.args...)
-		if err != nil {
-			t.Errorf("getattr: %s: unexpected error:\n\t%v", test.name, err)
-			return
-		}
-		actual := CoerceString(res)
-		if actual != test.expected {
-			t.Errorf("getattr: %s: got \"%s\" expected \"%s\"", test.name, actual, test.expected)
+	// The tests are run twice, the second time with resolved attributes cached.
+	for i := 0; i < 2; i++ {
+		for _, test := range getAttrTests {
+			res, err := GetAttr(test.cont, test.attr, test.args...)
+			if err != nil {
+				t.Errorf("getattr: %s: unexpected error:\n\t%v", test.name, err)
+				return
+			}
+			actual := CoerceString(res)
+			if actual != test.expected {
+				t.Errorf("getattr: %s: got \"%s\" expected \"%s\"", test.name, actual, test.expected)
+			}
 		}
 	}
+	if _, err := GetAttr(testStruct{}, "Missing"); err == nil {
+		t.Errorf("getattr: expected an error for a missing attribute")
+	}
+
+	res, err := GetAttr(struct{ Name sql.NullString }{}, "Name")
+	if err != nil || res != nil {
+		t.Errorf("getattr: expected NULL sql.NullString to be nil, got %v, %v", res, err)
+	}
 }
 
 func TestIsIterable(t *testing.T) {
@@ -199,6 +298,14 @@ func TestIsIterable(t *testing.T) {
 		{"is iterable array", [4]int{}, true},
 		{"is iterable slice", []int{}, true},
 		{"is iterable map", map[string]string{}, true},
+		{"is iterable ordered map", NewOrderedMap(), true},
+		{"is iterable channel", make(chan int), true},
+		{"is iterable receive-only channel", make(<-chan int), true},
+		{"is iterable send-only channel", make(chan<- int), false},
+		{"is iterable iterator", func(yield func(int) bool) {}, true},
+		{"is iterable key-value iterator", func(yield func(string, int) bool) {}, true},
+		{"is iterable func", func(int) bool { return true }, false},
+		{"is iterable Iterable", &testCursor{}, true},
 		{"is iterable string", "a string", false},
 		{"is iterable struct", struct{ name string }{"world"}, false},
 	}
@@ -220,6 +327,7 @@ func TestIsMap(t *testing.T) {
 		{"is map array", [4]int{}, false},
 		{"is map slice", []int{}, false},
 		{"is map map", map[string]string{}, true},
+		{"is map ordered map", NewOrderedMap(), true},
 		{"is map string", "a string", false},
 		{"is map struct", struct{ name string }{"world"}, false},
 	}
@@ -241,6 +349,7 @@ func TestIsArray(t *testing.T) {
 		{"is array array", [4]int{}, true},
 		{"is array slice", []int{}, true},
 		{"is array map", map[string]string{}, false},
+		{"is array ordered map", NewOrderedMap(), false},
 		{"is array string", "a string", false},
 		{"is array struct", struct{ name string }{"world"}, false},
 	}
@@ -264,6 +373,9 @@ func TestLen(t *testing.T) {
 		{"len empty slice", []int{}, 0, false},
 		{"len empty map", map[string]string{}, 0, false},
 		{"len map", map[string]string{"a": "A", "b": "B"}, 2, false},
+		{"len ordered map", testOrderedMap("a", "A", "b", "B"), 2, false},
+		{"len sized Iterable", &testSizedCursor{testCursor{vals: []Value{1, 2}}}, 2, false},
+		{"len Iterable", &testCursor{vals: []Value{1, 2}}, 0, true},
 		{"len empty string", "", 0, true},
 		{"len string", "a string", 0, true},
 		{"len struct", struct{ name string }{"world"}, 0, true},
@@ -290,8 +402,12 @@ func TestIterate(t *testing.T) {
 	}{
 		{"iterate string", "a string", "unable to iterate over string"},
 		{"iterate map", map[string]string{"a": "A", "b": "B"}, noError},
+		{"iterate ordered map", testOrderedMap("b", "B", "a", "A"), noError},
 		{"iterate slice", []string{"a", "b", "c"}, noError},
 		{"iterate array", [3]string{"a", "b", "c"}, noError},
+		{"iterate value slice", []Value{"a", 1, true}, noError},
+		{"iterate int slice", []int{1, 2, 3}, noError},
+		{"iterate value map", map[string]Value{"a": 1, "b": "B"}, noError},
 		{"iterate struct", struct{ name string }{"world"}, "unable to iterate over struct"},
 	}
 	for _, test := range ts {
@@ -358,9 +474,226 @@ func TestIterate_breakMap(t *testing.T) {
 	if n != 1 {
 		t.Errorf("expected to iterate over 1 item, got %d", n)
 	}
-	exp := []string{"hello world", "exclaim !"}
-	if v := strings.Join(res, " "); v != exp[0] && v != exp[1] {
-		t.Errorf("expected one of '%s' or '%s', got '%s'", exp[0], exp[1], v)
+	if v := strings.Join(res, " "); v != "exclaim !" {
+		t.Errorf("expected 'exclaim !' got '%s'", v)
+	}
+}
+
+func TestIterate_order(t *testing.T) {
+	ts := []struct {
+		name     string
+		input    Value
+		expected string
+	}{
+		{"ordered map", testOrderedMap("b", 1, "a", 2, "c", 3), "b a c"},
+		{"string keys", map[string]int{"b": 1, "a": 2, "c": 3}, "a b c"},
+		{"string values", map[string]string{"b": "1", "a": "2", "c": "3"}, "a b c"},
+		{"value map", map[string]Value{"b": 1, "a": 2, "c": 3}, "a b c"},
+		{"int keys", map[int]int{10: 1, 9: 2, -1: 3}, "-1 9 10"},
+		{"mixed keys", map[interface{}]int{"a": 1, 2: 2, 1: 3}, "1 2 a"},
+	}
+	for _, test := range ts {
+		var keys []string
+		Iterate(test.input, func(k, v Value, l Loop) (bool, error) {
+			keys = append(keys, CoerceString(k))
+			return false, nil
+		})
+		if actual := strings.Join(keys, " "); actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	ts := []struct {
+		name     string
+		input    Value
+		expected []Value
+	}{
+		{"nil", nil, nil},
+		{"value slice", []Value{"a", 1}, []Value{"a", 1}},
+		{"string slice", []string{"a", "b"}, []Value{"a", "b"}},
+		{"int slice", []int{1, 2}, []Value{1, 2}},
+		{"map", map[string]int{"b": 1, "a": 2}, []Value{2, 1}},
+		{"ordered map", testOrderedMap("b", 1, "a", 2), []Value{1, 2}},
+	}
+	for _, test := range ts {
+		actual, err := Values(test.input)
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected error: %s", test.name, err)
+		} else if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+	}
+	if _, err := Values("a string"); err == nil {
+		t.Errorf("expected an error for a string")
+	}
+}
+
+func BenchmarkIterate(b *testing.B) {
+	vals := make([]string, 100)
+	for i := range vals {
+		vals[i] = strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Iterate(vals, func(k, v Value, l Loop) (bool, error) {
+			return false, nil
+		})
+	}
+}
+
+func TestIterate_stream(t *testing.T) {
+	ch := make(chan string, 3)
+	ch <- "a"
+	ch <- "b"
+	ch <- "c"
+	close(ch)
+	ts := []struct {
+		name     string
+		input    Value
+		brk      int
+		expected string
+	}{
+		{"channel", ch, 0, "0=a 1=b 2=c last"},
+		{"nil channel", (chan int)(nil), 0, ""},
+		{"iterator", func(yield func(string) bool) {
+			for _, v := range []string{"a", "b"} {
+				if !yield(v) {
+					return
+				}
+			}
+		}, 0, "0=a 1=b last"},
+		{"key-value iterator", func(yield func(string, int) bool) {
+			yield("x", 1) // The result is ignored.
+			yield("y", 2)
+			yield("z", 3)
+		}, 2, "x=1 y=2"},
+	}
+	for _, test := range ts {
+		var res []string
+		n, err := Iterate(test.input, func(k, v Value, l Loop) (bool, error) {
+			if l.Length != -1 || l.Revindex != -1 || l.First != (l.Index0 == 0) {
+				t.Errorf("%s: unexpected loop %+v", test.name, l)
+			}
+			res = append(res, CoerceString(k)+"="+CoerceString(v))
+			if l.Last {
+				res = append(res, "last")
+			}
+			return l.Index == test.brk, nil
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if actual := strings.Join(res, " "); actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+		if test.brk > 0 && n != test.brk {
+			t.Errorf("%s: expected to iterate over %d items, got %d", test.name, test.brk, n)
+		}
+	}
+}
+
+// testCursor is an Iterable over a list of values, which fails with err
+// after its values.
+type testCursor struct {
+	vals []Value
+	err  error
+}
+
+func (c *testCursor) Iterate(yield func(k, v Value) bool) error {
+	for i, v := range c.vals {
+		if !yield(i, v) {
+			return nil
+		}
+	}
+	return c.err
+}
+
+// testSizedCursor is a testCursor with a known length.
+type testSizedCursor struct {
+	testCursor
+}
+
+func (c *testSizedCursor) Len() int {
+	return len(c.vals)
+}
+
+func TestIterate_iterable(t *testing.T) {
+	ts := []struct {
+		name     string
+		input    Iterable
+		brk      int
+		expected string
+		err      string
+	}{
+		{"iterable", &testCursor{vals: []Value{"a", "b"}}, 0, "0=a(-1) 1=b(-1) last", ""},
+		{"sized iterable", &testSizedCursor{testCursor{vals: []Value{"a", "b", "c"}}}, 0, "0=a(3) 1=b(2) 2=c(1) last", ""},
+		{"break", &testCursor{vals: []Value{"a", "b", "c"}}, 2, "0=a(-1) 1=b(-1)", ""},
+		{"error", &testCursor{vals: []Value{"a"}, err: testError{}}, 0, "0=a(-1) last", "an error"},
+	}
+	for _, test := range ts {
+		var res []string
+		n, err := Iterate(test.input, func(k, v Value, l Loop) (bool, error) {
+			res = append(res, fmt.Sprintf("%v=%v(%d)", k, v, l.Revindex))
+			if l.Last {
+				res = append(res, "last")
+			}
+			return l.Index == test.brk, nil
+		})
+		if err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if actual := strings.Join(res, " "); actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+		if test.brk > 0 && n != test.brk {
+			t.Errorf("%s: expected to iterate over %d items, got %d", test.name, test.brk, n)
+		}
+	}
+}
+
+// testOrderedMap returns an OrderedMap of the given keys and values.
+func testOrderedMap(kvs ...Value) *OrderedMap {
+	res := NewOrderedMap()
+	for i := 0; i < len(kvs); i += 2 {
+		res.Set(CoerceString(kvs[i]), kvs[i+1])
+	}
+	return res
+}
+
+func TestOrderedMap(t *testing.T) {
+	var m OrderedMap
+	m.Set("b", 1)
+	m.Set("a", 2)
+	m.Set("c", 3)
+	m.Set("b", 4)
+	m.Delete("a")
+	m.Delete("missing")
+	if keys := strings.Join(m.Keys(), " "); keys != "b c" {
+		t.Errorf("expected keys 'b c', got '%s'", keys)
+	}
+	if v, ok := m.Get("b"); !ok || v != 4 {
+		t.Errorf("expected b to be 4, got %v", v)
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Errorf("expected a to be deleted")
+	}
+	if m.Len() != 2 || len(m.Map()) != 2 {
+		t.Errorf("expected 2 entries, got %d", m.Len())
+	}
+	b, err := json.Marshal(testOrderedMap("z", 1, "a", testOrderedMap("y", "x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"z":1,"a":{"y":"x"}}` {
+		t.Errorf("unexpected JSON: %s", b)
+	}
+	if v, err := GetAttr(&m, "c"); err != nil || v != 3 {
+		t.Errorf("expected attribute c to be 3, got %v (%v)", v, err)
+	}
+	if _, err := GetAttr(&m, "Keys"); err == nil {
+		t.Errorf("expected an error for a missing key")
 	}
 }
 
@@ -386,3 +719,325 @@ func TestIterate_error(t *testing.T) {
 		t.Errorf("expected 'hello world' got '%s'", v)
 	}
 }
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		left, right Value
+		expected    bool
+	}{
+		{nil, nil, true},
+		{nil, false, true},
+		{nil, 0, true},
+		{nil, "", true},
+		{nil, "0", false},
+		{nil, "a", false},
+		{nil, []Value{}, true},
+		{nil, []Value{1}, false},
+		{true, "a", true},
+		{true, 1, true},
+		{false, "0", true},
+		{false, []int{}, true},
+		{1, 1.0, true},
+		{1, "1", true},
+		{1, "1.0", true},
+		{100, "1e2", true},
+		{1, " 1", true},
+		{0, "a", false},
+		{"abc", 0, false},
+		{"1", "01", true},
+		{"10", "1e1", true},
+		{"abc", "abc", true},
+		{"abc", "ABC", false},
+		{[]int{1, 2}, []Value{1, "2"}, true},
+		{[]int{1, 2}, []int{2, 1}, false},
+		{[]int{1, 2}, []int{1}, false},
+		{map[string]Value{"a": 1}, map[string]int{"a": 1}, true},
+		{map[string]Value{"a": 1}, map[string]int{"b": 1}, false},
+		{[]Value{"a"}, map[string]Value{"0": "a"}, true},
+		{decimal.NewFromFloat(1.5), 1.5, true},
+		{NewSafeValue("a"), "a", true},
+		{json.Number("1.0"), 1, true},
+		{sql.NullInt64{Int64: 3, Valid: true}, 3, true},
+		{sql.NullString{String: "a", Valid: true}, "a", true},
+		{sql.NullString{}, nil, true},
+		{testUUID("6BA7B810-9DAD-11D1-80B4-00C04FD430C8"), "6ba7b810-9dad-11d1-80b4-00c04fd430c8", true},
+		{testUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8"), testUUID("6ba7b811-9dad-11d1-80b4-00c04fd430c8"), false},
+		{testUUID("a"), 0, false},
+		{testVersion("1.10.0"), "1.10", true},
+		{testVersion("1.10"), testVersion("1.9"), false},
+		{[]Value{testVersion("2.0")}, []Value{"2"}, true},
+		{testSliceStruct{A: []int{1}}, testSliceStruct{A: []int{1}}, false},
+		{testAnyStruct{A: []int{1}}, testAnyStruct{A: []int{1}}, false},
+		{testAnyStruct{A: 1}, testAnyStruct{A: 1}, true},
+	}
+	for _, test := range tests {
+		if actual := Equal(test.left, test.right); actual != test.expected {
+			t.Errorf("Equal(%#v, %#v): expected %v, got %v", test.left, test.right, test.expected, actual)
+		}
+		if actual := Equal(test.right, test.left); actual != test.expected {
+			t.Errorf("Equal(%#v, %#v): expected %v, got %v", test.right, test.left, test.expected, actual)
+		}
+	}
+}
+
+// testSliceStruct cannot be compared with ==.
+type testSliceStruct struct {
+	A []int
+}
+
+// testAnyStruct can be compared with ==, unless A holds a value that
+// cannot.
+type testAnyStruct struct {
+	A interface{}
+}
+
+func TestAppendString(t *testing.T) {
+	values := []Value{
+		nil, true, false, "abc", NewSafeValue(12), -7, int8(8), int16(-16), int32(32), int64(1) << 62,
+		uint(1), uint8(8), uint16(16), uint32(32), uint64(1) << 63, 0.1 + 0.2, 1e21, 1.5e-7, 100.0,
+		math.NaN(), math.Inf(-1), float32(3.14), testType{}, testID("id"), []byte("bytes"),
+	}
+	for _, v := range values {
+		expected := CoerceString(v)
+		if actual := string(appendString([]byte("x"), v)); actual != "x"+expected {
+			t.Errorf("appendString(%#v): expected %q, got %q", v, "x"+expected, actual)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		left, right Value
+		expected    int
+	}{
+		{1, 2, -1},
+		{2, 1, 1},
+		{"10", "9", 1},
+		{"10", "9a", -1},
+		{"abc", "abd", -1},
+		{10, "9", 1},
+		{null(), -1, -1},
+		{null(), 1, -1},
+		{true, false, 1},
+		{[]int{1, 2}, []int{1, 3}, -1},
+		{[]int{1, 2, 3}, []int{4, 5}, 1},
+		{[]int{1}, 100, 1},
+		{"a", []int{1}, -1},
+		{struct{}{}, struct{ a int }{1}, 1},
+		{decimal.RequireFromString("0.30000000000000001"), decimal.RequireFromString("0.3"), 1},
+		{decimal.RequireFromString("0.3"), 0.3, 0},
+		{bigInt("100000000000000000001"), 1e20, 1},
+		{big.NewRat(1, 3), decimal.RequireFromString("0.3333"), 1},
+		{testCents(150), testCents(120), 1},
+		{testVersion("1.10.0"), testVersion("1.9.3"), 1},
+		{"1.9", testVersion("1.10"), -1},
+		{testVersion("2"), "2.0.0", 0},
+		{testVersion("2"), 1.5, 1},
+		{testUUID("a"), testUUID("A"), 0},
+	}
+	for _, test := range tests {
+		if actual := Compare(test.left, test.right); actual != test.expected {
+			t.Errorf("Compare(%#v, %#v): expected %v, got %v", test.left, test.right, test.expected, actual)
+		}
+	}
+}
+
+// testUUID is a UUID, which is equal to the same UUID in any case.
+type testUUID string
+
+func (u testUUID) Equal(other Value) bool {
+	return strings.EqualFold(string(u), CoerceString(other))
+}
+
+// testVersion is a version number, such as "1.10.0", which is ordered by
+// its numeric components.
+type testVersion string
+
+func (v testVersion) Compare(other Value) (int, bool) {
+	var o string
+	switch oc := other.(type) {
+	case testVersion:
+		o = string(oc)
+	case string:
+		o = oc
+	default:
+		return 0, false
+	}
+	a, b := strings.Split(string(v), "."), strings.Split(o, ".")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if i < len(b) {
+			y, _ = strconv.Atoi(b[i])
+		}
+		if x != y {
+			return x - y, true
+		}
+	}
+	return 0, true
+}
+
+// testCents is an amount of money in cents, with exact arithmetic.
+type testCents int64
+
+func (c testCents) Add(y ExactNumber) ExactNumber { return c + y.(testCents) }
+func (c testCents) Sub(y ExactNumber) ExactNumber { return c - y.(testCents) }
+func (c testCents) Mul(y ExactNumber) ExactNumber { return c * y.(testCents) / 100 }
+func (c testCents) Div(y ExactNumber) ExactNumber { return c * 100 / y.(testCents) }
+
+func (c testCents) Cmp(y ExactNumber) int {
+	return compareNumbers(float64(c), float64(y.(testCents)))
+}
+
+func (c testCents) String() string {
+	return fmt.Sprintf("%d.%02d", c/100, c%100)
+}
+
+func bigInt(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
+
+func TestExactArithmetic(t *testing.T) {
+	tests := []struct {
+		name        string
+		fn          func(left, right Value) Value
+		left, right Value
+		expected    string
+	}{
+		{"decimals", Add, decimal.RequireFromString("0.1"), decimal.RequireFromString("0.2"), "0.3"},
+		{"decimal and float", Add, decimal.RequireFromString("0.1"), 0.2, "0.3"},
+		{"float and decimal", Sub, 1, decimal.RequireFromString("0.9"), "0.1"},
+		{"decimal and string", Mul, decimal.RequireFromString("19.99"), "3", "59.97"},
+		{"decimal division", Div, decimal.RequireFromString("10"), 4, "2.5"},
+		{"decimal division by zero", Div, decimal.RequireFromString("10"), 0, "INF"},
+		{"big ints", Mul, bigInt("123456789012345678901234567890"), bigInt("10"), "1234567890123456789012345678900"},
+		{"big int and float", Add, bigInt("9007199254740993"), 1, "9007199254740994"},
+		{"big int division", Div, bigInt("10"), 4, "5/2"},
+		{"rats", Add, big.NewRat(1, 3), big.NewRat(1, 6), "1/2"},
+		{"rat and decimal", Add, big.NewRat(1, 4), decimal.RequireFromString("0.5"), "3/4"},
+		{"safe value", Add, NewSafeValue(decimal.RequireFromString("0.1")), 0.2, "0.3"},
+		{"custom type", Add, testCents(10), testCents(20), "0.30"},
+		{"custom type division", Div, testCents(300), testCents(200), "1.50"},
+		{"custom type and float", Add, testCents(10), 0.2, "0.3"},
+		{"floats", Add, 0.1, 0.2, "0.3"},
+		{"non-numeric", Add, decimal.RequireFromString("1"), "a", "1"},
+	}
+	for _, test := range tests {
+		if actual := CoerceString(test.fn(test.left, test.right)); actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+	if _, ok := Add(decimal.RequireFromString("0.1"), 0.2).(decimal.Decimal); !ok {
+		t.Errorf("expected the sum of a decimal and a float to be a decimal")
+	}
+	if _, ok := Mul(bigInt("2"), 3).(*big.Int); !ok {
+		t.Errorf("expected the product of a big.Int and an integer to be a big.Int")
+	}
+}
+
+type testDate struct{ t time.Time }
+
+func (d testDate) AsTime() time.Time {
+	return d.t
+}
+
+// testUnixDay is a custom date type handled by a TimeConverter.
+type testUnixDay int
+
+func TestCoerceTime(t *testing.T) {
+	RegisterTimeConverter(func(v Value) (time.Time, bool) {
+		if d, ok := v.(testUnixDay); ok {
+			return time.Unix(int64(d)*86400, 0).UTC(), true
+		}
+		return time.Time{}, false
+	})
+	ref := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		val      Value
+		expected string
+	}{
+		{ref, "2020-01-02T03:04:05Z"},
+		{&ref, "2020-01-02T03:04:05Z"},
+		{testDate{ref}, "2020-01-02T03:04:05Z"},
+		{testUnixDay(1), "1970-01-02T00:00:00Z"},
+		{sql.NullTime{Time: ref, Valid: true}, "2020-01-02T03:04:05Z"},
+		{NewSafeValue("2020-01-02T03:04:05+02:00"), "2020-01-02T01:04:05Z"},
+		{"2020-01-02 03:04:05", "2020-01-02T03:04:05Z"},
+		{"2020-01-02", "2020-01-02T00:00:00Z"},
+		{"Thu, 02 Jan 2020 03:04:05 GMT", "2020-01-02T03:04:05Z"},
+		{"1577934245", "2020-01-02T03:04:05Z"},
+		{json.Number("1577934245"), "2020-01-02T03:04:05Z"},
+		{int64(1577934245), "2020-01-02T03:04:05Z"},
+		{1577934245.5, "2020-01-02T03:04:05.5Z"},
+		{"tomorrow", ""},
+		{true, ""},
+		{nil, ""},
+		{(*time.Time)(nil), ""},
+		{sql.NullTime{}, ""},
+		{math.Inf(1), ""},
+		{[]int{1}, ""},
+	}
+	for _, test := range tests {
+		actual, ok := CoerceTime(test.val)
+		if test.expected == "" {
+			if ok {
+				t.Errorf("CoerceTime(%#v): expected failure, got %v", test.val, actual)
+			}
+		} else if !ok {
+			t.Errorf("CoerceTime(%#v): unexpected failure", test.val)
+		} else if s := actual.UTC().Format(time.RFC3339Nano); s != test.expected {
+			t.Errorf("CoerceTime(%#v): expected %s, got %s", test.val, test.expected, s)
+		}
+	}
+	if _, ok := CoerceTime("now"); !ok {
+		t.Errorf("CoerceTime(\"now\"): unexpected failure")
+	}
+
+	early, late := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC-1", -3600))
+	compareTests := []struct {
+		left, right Value
+		expected    int
+	}{
+		{early, late, -1},
+		{late, early, 1},
+		{early, early.In(time.FixedZone("UTC+5", 5*3600)), 0},
+		{early, "2020-01-01", 0},
+		{late, 1577836800, 1},
+		{testUnixDay(18262), early, 0},
+		{early, "never", 1},
+	}
+	for _, test := range compareTests {
+		if actual := Compare(test.left, test.right); actual != test.expected {
+			t.Errorf("Compare(%v, %v): expected %d, got %d", test.left, test.right, test.expected, actual)
+		}
+	}
+}
+
+func null() Value {
+	return nil
+}
+
+func TestCharset(t *testing.T) {
+	latin1 := "caf\xe9"
+	dec, err := Decode(latin1, "ISO-8859-1")
+	if err != nil || dec != "café" {
+		t.Errorf("Decode: expected %q, got %q (%v)", "café", dec, err)
+	}
+	enc, err := Encode("café €", "latin1")
+	if err != nil || enc != "caf\xe9 ?" {
+		t.Errorf("Encode: expected %q, got %q (%v)", "caf\xe9 ?", enc, err)
+	}
+	enc, err = Encode("café", "US-ASCII")
+	if err != nil || enc != "caf?" {
+		t.Errorf("Encode: expected %q, got %q (%v)", "caf?", enc, err)
+	}
+	if _, err := Decode("x", "EBCDIC"); err == nil {
+		t.Errorf("expected error for unsupported charset")
+	}
+	if !IsUTF8("") || !IsUTF8("utf8") || IsUTF8("ISO-8859-1") {
+		t.Errorf("IsUTF8 returned unexpected results")
+	}
+}
@@ -0,0 +1,278 @@
+package stick
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// A Variable describes a variable read by a template.
+type Variable struct {
+	Name  string   // The name of the variable.
+	Attrs []string // Attribute paths read from the variable, such as "address.city", sorted.
+	Local bool     // True if the variable is set by the template wherever it is read.
+}
+
+// Variables returns the variables read when executing the named template,
+// sorted by name. Variables that are not Local must be provided in the
+// context passed to Execute. Checking them when an application starts
+// ensures that each handler provides what its templates require:
+//
+//	vars, err := env.Variables("page.twig")
+//	if err != nil {
+//		return err
+//	}
+//	for _, v := range vars {
+//		if _, ok := ctx[v.Name]; !ok && !v.Local {
+//			return fmt.Errorf("page.twig requires %q", v.Name)
+//		}
+//	}
+//
+// Templates that are extended, included, or embedded using a string
+// literal are analyzed along with the named template, as they share its
+// context. Macros are not, as they have their own scope. Globals and the
+// special variables "loop", "varargs", "_self", "_context", and "_charset"
+// are omitted.
+//
+// Attribute paths include attributes given by a name or string literal, as
+// in user.address.city or user['name']. A path ends at an attribute given
+// by any other expression, such as user[key].
+func (env *Env) Variables(name string) ([]Variable, error) {
+	c := &variableCollector{
+		inspector: inspector{scopes: []map[string]bool{{"_self": true}}},
+		env:       env,
+		required:  make(map[string]bool),
+		local:     make(map[string]bool),
+		attrs:     make(map[string]map[string]bool),
+		active:    make(map[string]bool),
+	}
+	if err := c.template(name); err != nil {
+		return nil, err
+	}
+	var res []Variable
+	for n := range c.required {
+		res = append(res, Variable{Name: n, Attrs: sortedKeys(c.attrs[n])})
+	}
+	for n := range c.local {
+		if !c.required[n] {
+			res = append(res, Variable{Name: n, Attrs: sortedKeys(c.attrs[n]), Local: true})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// variableCollector walks a template and the templates sharing its
+// context, recording the variables they read.
+type variableCollector struct {
+	inspector
+	env        *Env
+	required   map[string]bool            // Names read while not set.
+	local      map[string]bool            // Names read while set.
+	attrs      map[string]map[string]bool // Attribute paths read, by name.
+	active     map[string]bool            // Templates being walked, to prevent cycles.
+	overridden map[string]bool            // Blocks replaced by a child or embedding template.
+	err        error
+}
+
+// template walks the named template, followed by its parent, if any.
+func (c *variableCollector) template(name string) error {
+	if c.active[name] {
+		return nil
+	}
+	tree, err := c.env.load(name)
+	if err != nil {
+		return err
+	}
+	c.active[name] = true
+	defer delete(c.active, name)
+	root := tree.Root()
+	c.visit(root.BodyNode)
+	if root.Parent == nil || c.err != nil {
+		return c.err
+	}
+	parent := staticName(root.Parent.Tpl)
+	if parent == "" {
+		return nil
+	}
+	prev := c.overridden
+	c.overridden = c.override(tree.Blocks())
+	defer func() { c.overridden = prev }()
+	return c.template(parent)
+}
+
+// override returns the blocks overridden so far, plus those in blocks
+// that do not call parent().
+func (c *variableCollector) override(blocks map[string]*parse.BlockNode) map[string]bool {
+	res := make(map[string]bool)
+	for k := range c.overridden {
+		res[k] = true
+	}
+	for k, blk := range blocks {
+		callsParent := false
+		visitAll(blk.Body, func(n parse.Node) {
+			if fn, ok := n.(*parse.FuncExpr); ok && fn.Name == "parent" {
+				callsParent = true
+			}
+		})
+		if !callsParent {
+			res[k] = true
+		}
+	}
+	return res
+}
+
+// include walks the template included by n, which has the blocks given.
+func (c *variableCollector) include(n *parse.IncludeNode, blocks map[string]*parse.BlockNode) {
+	name := staticName(n.Tpl)
+	if name == "" || c.err != nil {
+		return
+	}
+	var with []string
+	switch x := n.With.(type) {
+	case nil:
+	case *parse.HashExpr:
+		for _, kv := range x.Elements {
+			switch k := kv.Key.(type) {
+			case *parse.NameExpr:
+				with = append(with, k.Name)
+			case *parse.StringExpr:
+				with = append(with, k.Text)
+			}
+		}
+	default:
+		if n.Only {
+			// The variables passed are unknown.
+			return
+		}
+	}
+	scopes, overridden := c.scopes, c.overridden
+	if n.Only {
+		c.scopes = []map[string]bool{{"_self": true}}
+	}
+	c.push(with...)
+	c.overridden = c.override(blocks)
+	if err := c.template(name); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.scopes, c.overridden = scopes, overridden
+}
+
+func (c *variableCollector) read(name, path string) {
+	switch {
+	case name == "_self" || name == "_context" || name == "_charset":
+		return
+	case name == "loop" && c.defined(name):
+		return
+	case c.defined(name):
+		c.local[name] = true
+	default:
+		if _, ok := c.env.Globals[name]; ok {
+			return
+		}
+		c.required[name] = true
+	}
+	if path != "" {
+		if c.attrs[name] == nil {
+			c.attrs[name] = make(map[string]bool)
+		}
+		c.attrs[name][path] = true
+	}
+}
+
+func (c *variableCollector) visit(node parse.Node) {
+	switch node := node.(type) {
+	case nil:
+		return
+	case *parse.NameExpr:
+		c.read(node.Name, "")
+		return
+	case *parse.GetAttrExpr:
+		c.attr(node)
+		return
+	case *parse.ImportNode:
+		c.define(node.Alias)
+	case *parse.FromNode:
+		for _, alias := range node.Imports {
+			c.define(alias)
+		}
+	case *parse.SetNode:
+		c.visit(node.X)
+		c.define(node.Name)
+		return
+	case *parse.ForNode:
+		c.visit(node.X)
+		c.push(node.Key, node.Val, "loop")
+		c.visit(node.Body)
+		c.pop()
+		c.visit(node.Else)
+		return
+	case *parse.HashExpr:
+		for _, kv := range node.Elements {
+			// Keys given by name are literal.
+			if _, ok := kv.Key.(*parse.NameExpr); !ok {
+				c.visit(kv.Key)
+			}
+			c.visit(kv.Value)
+		}
+		return
+	case *parse.MacroNode:
+		return
+	case *parse.BlockNode:
+		if c.overridden[node.Name] {
+			return
+		}
+	case *parse.EmbedNode:
+		c.visit(node.Tpl)
+		c.visit(node.With)
+		for _, blk := range node.Blocks {
+			c.visit(blk)
+		}
+		c.include(node.IncludeNode, node.Blocks)
+		return
+	case *parse.IncludeNode:
+		c.visit(node.Tpl)
+		c.visit(node.With)
+		c.include(node, nil)
+		return
+	}
+	for _, n := range node.All() {
+		c.visit(n)
+	}
+}
+
+// attr records the attribute path read by n.
+func (c *variableCollector) attr(n *parse.GetAttrExpr) {
+	var chain []*parse.GetAttrExpr
+	var base parse.Expr = n
+	for {
+		a, ok := base.(*parse.GetAttrExpr)
+		if !ok {
+			break
+		}
+		chain = append(chain, a)
+		base = a.Cont
+	}
+	var path []string
+	static := true
+	for i := len(chain) - 1; i >= 0; i-- {
+		a := chain[i]
+		if s, ok := a.Attr.(*parse.StringExpr); ok && static {
+			path = append(path, s.Text)
+		} else {
+			static = false
+			c.visit(a.Attr)
+		}
+		for _, arg := range a.Args {
+			c.visit(arg)
+		}
+	}
+	if name, ok := base.(*parse.NameExpr); ok {
+		c.read(name.Name, strings.Join(path, "."))
+		return
+	}
+	c.visit(base)
+}
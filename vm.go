@@ -0,0 +1,337 @@
+package stick
+
+import (
+	"strconv"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An Engine determines how templates are executed.
+type Engine int
+
+const (
+	// EngineTree executes templates by walking their syntax trees.
+	EngineTree Engine = iota
+	// EngineVM compiles templates into a compact instruction stream, which
+	// is executed by a small virtual machine. Compilation happens once, when
+	// a template is added to the Env's template cache; templates that are
+	// not cached are executed by walking their syntax trees.
+	//
+	// Nodes and expressions that the virtual machine does not support, such
+	// as blocks, includes, and filter calls, are executed as with EngineTree.
+	// EngineVM is not used when the Env has Instrumentation.
+	EngineVM
+)
+
+// An opcode identifies an instruction.
+type opcode uint8
+
+const (
+	opText      opcode = iota // Write text[arg].
+	opPrint                   // Pop a value and print it.
+	opWalk                    // Execute the instruction's node using the tree-walker.
+	opEval                    // Push the value of the instruction's expression, evaluated by the tree-walker.
+	opConst                   // Push consts[arg].
+	opName                    // Push the value of the instruction's variable.
+	opUnary                   // Pop a value, then push the result of the instruction's unary expression.
+	opBinary                  // Pop two values, then push the result of the instruction's binary expression.
+	opAttr                    // Pop arg arguments, an attribute, and a container, then push the attribute's value.
+	opJumpFalse               // Pop a value, then jump to arg if it is false.
+	opJump                    // Jump to arg.
+	opSet                     // Pop a value, then set the variable named text[arg].
+	opPop                     // Pop and discard a value.
+	opFor                     // Pop a value, then execute loops[arg] over it.
+)
+
+// An instr is a single instruction.
+type instr struct {
+	op   opcode
+	arg  int
+	node parse.Node // The node the instruction was compiled from.
+}
+
+// A program is a compiled template body.
+type program struct {
+	code   []instr
+	consts []Value
+	text   []string
+	loops  []forLoop
+}
+
+// forLoop is a compiled for loop.
+type forLoop struct {
+	node *parse.ForNode
+	body *program
+	els  *program
+}
+
+// vmCompiler compiles the bodies of a template into programs.
+type vmCompiler struct {
+	programs map[*parse.BodyNode]*program
+}
+
+// compileTree compiles each body of tree that may be executed directly,
+// such as the bodies of the template itself, its blocks, and its macros.
+func compileTree(tree *parse.Tree) map[*parse.BodyNode]*program {
+	c := &vmCompiler{make(map[*parse.BodyNode]*program)}
+	c.body(tree.Root().BodyNode)
+	return c.programs
+}
+
+// body compiles body into a new program.
+func (c *vmCompiler) body(body *parse.BodyNode) *program {
+	if p, ok := c.programs[body]; ok {
+		return p
+	}
+	p := &program{}
+	c.programs[body] = p
+	c.node(p, body)
+	return p
+}
+
+// walked compiles the bodies within node, which is executed by the
+// tree-walker, so that they are executed by the VM.
+func (c *vmCompiler) walked(node parse.Node) {
+	if n, ok := node.(*parse.IncludeNode); ok && n.Tree != nil {
+		c.body(n.Tree.Root().BodyNode)
+	}
+	for _, child := range node.All() {
+		if b, ok := child.(*parse.BodyNode); ok {
+			c.body(b)
+		} else if child != nil {
+			c.walked(child)
+		}
+	}
+}
+
+func (p *program) emit(op opcode, arg int, node parse.Node) int {
+	p.code = append(p.code, instr{op, arg, node})
+	return len(p.code) - 1
+}
+
+func (p *program) addConst(v Value) int {
+	p.consts = append(p.consts, v)
+	return len(p.consts) - 1
+}
+
+func (p *program) addText(s string) int {
+	p.text = append(p.text, s)
+	return len(p.text) - 1
+}
+
+// node compiles a statement into p.
+func (c *vmCompiler) node(p *program, node parse.Node) {
+	switch node := node.(type) {
+	case *parse.BodyNode:
+		for _, n := range node.All() {
+			c.node(p, n)
+		}
+	case *parse.CommentNode:
+	case *parse.TextNode:
+		p.emit(opText, p.addText(node.Data), node)
+	case *parse.PrintNode:
+		c.expr(p, node.X)
+		p.emit(opPrint, 0, node)
+	case *parse.IfNode:
+		c.expr(p, node.Cond)
+		jf := p.emit(opJumpFalse, 0, node)
+		c.node(p, node.Body)
+		j := p.emit(opJump, 0, node)
+		p.code[jf].arg = len(p.code)
+		c.node(p, node.Else)
+		p.code[j].arg = len(p.code)
+	case *parse.ForNode:
+		c.expr(p, node.X)
+		loop := forLoop{node: node, body: &program{}, els: &program{}}
+		c.node(loop.body, node.Body)
+		c.node(loop.els, node.Else)
+		p.loops = append(p.loops, loop)
+		p.emit(opFor, len(p.loops)-1, node)
+	case *parse.SetNode:
+		switch x := node.X.(type) {
+		case *parse.BodyNode:
+			c.walk(p, node)
+		case parse.Expr:
+			c.expr(p, x)
+			p.emit(opSet, p.addText(node.Name), node)
+		default:
+			c.walk(p, node)
+		}
+	case *parse.DoNode:
+		c.expr(p, node.X)
+		p.emit(opPop, 0, node)
+	case nil:
+	default:
+		c.walk(p, node)
+	}
+}
+
+// walk compiles node to be executed by the tree-walker.
+func (c *vmCompiler) walk(p *program, node parse.Node) {
+	p.emit(opWalk, 0, node)
+	c.walked(node)
+}
+
+// expr compiles an expression into p, leaving its value on the stack.
+func (c *vmCompiler) expr(p *program, exp parse.Expr) {
+	switch exp := exp.(type) {
+	case *parse.NullExpr:
+		p.emit(opConst, p.addConst(nil), exp)
+	case *parse.BoolExpr:
+		p.emit(opConst, p.addConst(exp.Value), exp)
+	case *parse.StringExpr:
+		p.emit(opConst, p.addConst(exp.Text), exp)
+	case *parse.NumberExpr:
+		num, err := strconv.ParseFloat(exp.Value, 64)
+		if err != nil {
+			p.emit(opEval, 0, exp)
+			return
+		}
+		p.emit(opConst, p.addConst(num), exp)
+	case *parse.NameExpr:
+		if exp.Name == "_self" {
+			p.emit(opEval, 0, exp)
+			return
+		}
+		p.emit(opName, 0, exp)
+	case *parse.GroupExpr:
+		c.expr(p, exp.X)
+	case *parse.UnaryExpr:
+		c.expr(p, exp.X)
+		p.emit(opUnary, 0, exp)
+	case *parse.BinaryExpr:
+		if t, ok := exp.Right.(*parse.TestExpr); ok && t.Name == "defined" {
+			// The operand of a defined test must not be evaluated.
+			p.emit(opEval, 0, exp)
+			return
+		}
+		c.expr(p, exp.Left)
+		c.expr(p, exp.Right)
+		p.emit(opBinary, 0, exp)
+	case *parse.GetAttrExpr:
+		for _, a := range exp.Args {
+			if _, ok := a.(*parse.NamedArgExpr); ok {
+				p.emit(opEval, 0, exp)
+				return
+			}
+		}
+		c.expr(p, exp.Cont)
+		c.expr(p, exp.Attr)
+		for _, a := range exp.Args {
+			c.expr(p, a)
+		}
+		p.emit(opAttr, len(exp.Args), exp)
+	case *parse.TernaryIfExpr:
+		c.expr(p, exp.Cond)
+		jf := p.emit(opJumpFalse, 0, exp)
+		c.expr(p, exp.TrueX)
+		j := p.emit(opJump, 0, exp)
+		p.code[jf].arg = len(p.code)
+		c.expr(p, exp.FalseX)
+		p.code[j].arg = len(p.code)
+	default:
+		p.emit(opEval, 0, exp)
+	}
+}
+
+// program returns the compiled program for body, or nil if body should be
+// executed by the tree-walker.
+func (s *state) program(body *parse.BodyNode) *program {
+	if s.env.Engine != EngineVM || s.env.Instrumentation != nil {
+		return nil
+	}
+	if p, ok := s.env.cache.programs.Load(body); ok {
+		return p.(*program)
+	}
+	return nil
+}
+
+// run executes p.
+func (s *state) run(p *program) error {
+	if err := s.context.Err(); err != nil {
+		return err
+	}
+	// The operand stack is shared with nested programs, such as loop
+	// bodies; each program uses the part of it above base.
+	base := len(s.stack)
+	defer s.truncate(base)
+	for pc := 0; pc < len(p.code); pc++ {
+		in := p.code[pc]
+		var err error
+		switch in.op {
+		case opText:
+			err = s.write(in.node, p.text[in.arg])
+		case opPrint:
+			node := in.node.(*parse.PrintNode)
+			err = s.print(node, s.pop())
+		case opWalk:
+			err = s.walk(in.node)
+		case opEval:
+			var v Value
+			v, err = s.evalExpr(in.node.(parse.Expr))
+			s.stack = append(s.stack, v)
+		case opConst:
+			s.stack = append(s.stack, p.consts[in.arg])
+		case opName:
+			var v Value
+			v, err = s.variable(in.node.(*parse.NameExpr))
+			s.stack = append(s.stack, v)
+		case opUnary:
+			top := len(s.stack) - 1
+			s.stack[top], err = s.evalUnary(in.node.(*parse.UnaryExpr), s.stack[top])
+		case opBinary:
+			right := s.pop()
+			top := len(s.stack) - 1
+			s.stack[top], err = s.evalBinary(in.node.(*parse.BinaryExpr), s.stack[top], right)
+		case opAttr:
+			var args []Value
+			if in.arg > 0 {
+				args = make([]Value, in.arg)
+				copy(args, s.stack[len(s.stack)-in.arg:])
+				s.truncate(len(s.stack) - in.arg)
+			}
+			k := s.pop()
+			top := len(s.stack) - 1
+			s.stack[top], err = s.getAttr(in.node.(*parse.GetAttrExpr), s.stack[top], k, args, nil)
+		case opJumpFalse:
+			v := s.pop()
+			if err = checkUse(v); err == nil && !CoerceBool(v) {
+				pc = in.arg - 1
+			}
+		case opJump:
+			pc = in.arg - 1
+		case opSet:
+			s.scope.Set(p.text[in.arg], s.pop())
+		case opPop:
+			s.pop()
+		case opFor:
+			loop := p.loops[in.arg]
+			err = s.iterate(loop.node, s.pop(), func() error {
+				return s.run(loop.body)
+			}, func() error {
+				return s.run(loop.els)
+			})
+		}
+		if err != nil {
+			return s.wrapError(in.node, err)
+		}
+	}
+	return nil
+}
+
+// pop removes the top value from the operand stack and returns it.
+func (s *state) pop() Value {
+	top := len(s.stack) - 1
+	v := s.stack[top]
+	s.stack[top] = nil
+	s.stack = s.stack[:top]
+	return v
+}
+
+// truncate shrinks the operand stack to n values.
+func (s *state) truncate(n int) {
+	for i := n; i < len(s.stack); i++ {
+		s.stack[i] = nil
+	}
+	s.stack = s.stack[:n]
+}
@@ -0,0 +1,59 @@
+package stick
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Warmup loads and parses the named templates ahead of time, adding them to
+// the Env's template cache so that executing them does not incur parsing
+// costs. Templates are parsed concurrently, using one goroutine per CPU.
+//
+// Any errors encountered are returned, in the order the templates are
+// given. Warmup returns nil if every template was parsed successfully.
+//
+// Templates are only kept if they can be cached; see CacheMode.
+func (env *Env) Warmup(names ...string) []error {
+	errs := make([]error, len(names))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(names) {
+		workers = len(names)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				_, errs[i] = env.load(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	var res []error
+	for _, err := range errs {
+		if err != nil {
+			res = append(res, err)
+		}
+	}
+	return res
+}
+
+// WarmupAll calls Warmup with every template the Env's Loader can load.
+// The Loader must be a Lister; otherwise ErrNotLister is returned.
+func (env *Env) WarmupAll() []error {
+	l, ok := env.Loader.(Lister)
+	if !ok {
+		return []error{ErrNotLister}
+	}
+	names, err := l.List()
+	if err != nil {
+		return []error{err}
+	}
+	return env.Warmup(names...)
+}
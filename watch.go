@@ -0,0 +1,109 @@
+package stick
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Watch polls the Env's Loader for templates that are added, removed, or
+// modified, clearing the Env's template cache when any are found so that
+// they are reloaded when next used. It is intended for development, where
+// a server can use changed, if non-nil, to live-reload pages; changed is
+// called with the names of the affected templates, sorted.
+//
+// The Loader must be a Lister; otherwise ErrNotLister is returned. The
+// interval must be positive.
+//
+// Templates are considered modified when their modification time changes,
+// so templates without one are only noticed when added or removed. Watch
+// polls rather than subscribing to file system events so that it works
+// with any Lister and needs no dependencies. Loaders with a ModTime method,
+// such as FilesystemLoader, are asked for each template's modification
+// time; other Loaders load every listed template on each poll, which may
+// be expensive for Loaders that fetch templates over the network. Errors
+// listing templates are ignored, and the Loader is polled again after the
+// interval.
+//
+// Watch blocks until ctx is done, then returns ctx.Err().
+func (env *Env) Watch(ctx context.Context, interval time.Duration, changed func(names []string)) error {
+	if interval <= 0 {
+		return fmt.Errorf("watch: interval must be positive, got %s", interval)
+	}
+	l, ok := env.Loader.(Lister)
+	if !ok {
+		return ErrNotLister
+	}
+	prev, err := env.snapshot(l)
+	if err != nil {
+		prev = nil
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		cur, err := env.snapshot(l)
+		if err != nil {
+			continue
+		}
+		diff := make(map[string]bool)
+		for name, mt := range cur {
+			if pmt, ok := prev[name]; !ok || !pmt.Equal(mt) {
+				diff[name] = true
+			}
+		}
+		for name := range prev {
+			if _, ok := cur[name]; !ok {
+				diff[name] = true
+			}
+		}
+		prev = cur
+		if len(diff) == 0 {
+			continue
+		}
+		env.ClearTemplateCache()
+		if changed != nil {
+			changed(sortedKeys(diff))
+		}
+	}
+}
+
+// snapshot returns the modification time of each template listed by l.
+func (env *Env) snapshot(l Lister) (map[string]time.Time, error) {
+	names, err := l.List()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		res[name] = env.modTime(name)
+	}
+	return res, nil
+}
+
+// A modTimeLoader is a Loader that can tell when a template was last
+// modified without loading it.
+type modTimeLoader interface {
+	ModTime(name string) (time.Time, error)
+}
+
+// modTime returns when the named template was last modified, or the zero
+// time if it is not known.
+func (env *Env) modTime(name string) time.Time {
+	if l, ok := env.Loader.(modTimeLoader); ok {
+		t, _ := l.ModTime(name)
+		return t
+	}
+	tpl, err := env.Loader.Load(name)
+	if err != nil {
+		return time.Time{}
+	}
+	if mt, ok := tpl.(modTimer); ok {
+		return mt.ModTime()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,47 @@
+package stick
+
+import "io"
+
+// limitWriter writes to w until limit bytes have been written, counted by
+// n, which may be shared by several limitWriters. Writes past the limit
+// fail with an OutputLimitError.
+type limitWriter struct {
+	w     io.Writer
+	limit int64
+	n     *int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if remain := l.limit - *l.n; int64(len(p)) > remain {
+		if remain < 0 {
+			remain = 0
+		}
+		n, err := l.w.Write(p[:remain])
+		*l.n += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, &OutputLimitError{l.limit}
+	}
+	n, err := l.w.Write(p)
+	*l.n += int64(n)
+	return n, err
+}
+
+// errWriter writes to w until an error occurs. Once a write fails, all
+// subsequent writes fail with the same error without writing anything.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}